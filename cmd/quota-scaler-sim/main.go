@@ -0,0 +1,120 @@
+package main
+
+// quota-scaler-sim replays a recorded timeline of QuotaAutoscalers, ResourceQuota statuses and Pod Events offline, see
+// internal.Simulation, and prints the resulting resizes and statistics per namespace. It is meant to tune the behavior
+// of QuotaAutoscalers without trial and error on a cluster.
+//
+// Example usage:
+//  quota-scaler-sim --timeline timeline.yaml --config config.yaml --resize-latency 30s
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	_ "time/tzdata" // The time zones of schedules
+
+	"github.com/ing-bank/quota-scaler/internal"
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	v1 "k8s.io/api/core/v1"
+)
+
+func main() {
+	timelinePath := flag.String("timeline", "", "YAML or JSON file with the recorded timeline")
+	clusterConfig := flag.String("config", "", "Versioned YAML file with the defaults, ceilings and timings of the cluster, its dryRun is ignored")
+	resizeLatency := flag.Duration("resize-latency", 10*time.Second, "Time the resize API takes to resize a ResourceQuota")
+	output := flag.String("output", "text", "Output format, one of: text, json")
+	flag.Int64Var(&internal.DefaultCpuLimitRatio, "cpu-limit-ratio", internal.DefaultCpuLimitRatio, "Ratio between the CPU limits and CPU requests of ResourceQuotas, for QuotaAutoscalers without a cpuLimitRatio. Zero leaves the CPU limits alone")
+	flag.Parse()
+
+	if os.Getenv("LOG_LEVEL") == "" {
+		logging.SetLevel(logging.WARNING) // The calculations log every step
+	}
+	if *timelinePath == "" || (*output != "text" && *output != "json") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *clusterConfig != "" {
+		config, err := internal.LoadClusterConfig(*clusterConfig)
+		if err != nil {
+			fail(err)
+		}
+		config.DryRun = false
+		internal.UseClusterConfig(config)
+	}
+
+	timeline, err := internal.LoadTimeline(*timelinePath)
+	if err != nil {
+		fail(err)
+	}
+	result, err := internal.NewSimulation(timeline, *resizeLatency).Run()
+	if err != nil {
+		fail(err)
+	}
+
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			fail(err)
+		}
+		return
+	}
+	printResult(result)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// printResult prints the resize timeline and a summary per namespace as tables.
+func printResult(result *internal.SimulationResult) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer writer.Flush()
+
+	fmt.Fprintf(writer, "Simulated %s to %s\n\n", result.Start.Format(time.RFC3339), result.End.Format(time.RFC3339))
+	fmt.Fprintln(writer, "REQUESTED\tNAMESPACE\tOLD\tNEW\tAPPLIED")
+	for _, resize := range result.Resizes {
+		applied := "in progress"
+		if resize.Applied != nil {
+			applied = resize.Applied.Format(time.RFC3339)
+		} else if resize.Superseded {
+			applied = "superseded"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", resize.Requested.Format(time.RFC3339), resize.Namespace, resize.Old, resize.New, applied)
+	}
+
+	namespaces := make([]string, 0, len(result.Namespaces))
+	for namespace := range result.Namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	fmt.Fprintln(writer, "\nNAMESPACE\tCALCULATIONS\tRESIZES\tAPPLIED\tEVENTS\tSTALLS\tAVERAGE HEADROOM")
+	for _, namespace := range namespaces {
+		summary := result.Namespaces[namespace]
+		fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", namespace, summary.Calculations, summary.ResizesRequested,
+			summary.ResizesApplied, summary.Events, summary.Stalls, formatHeadroom(summary.AverageHeadroom))
+	}
+}
+
+// formatHeadroom formats the percentages sorted by resource, e.g. `cpu=35%, memory=12%`.
+func formatHeadroom(headroom map[v1.ResourceName]float64) string {
+	names := make([]string, 0, len(headroom))
+	for name := range headroom {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, fmt.Sprintf("%s=%.0f%%", name, headroom[v1.ResourceName(name)]))
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -2,17 +2,55 @@ package main
 
 import (
 	"context"
+	"flag"
 	ichp "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned"
+	ichpinformers "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/informers/externalversions"
+	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	_ "time/tzdata" // The image has no time zone database, needed for the time zones of schedules
 
 	"github.com/ing-bank/quota-scaler/internal"
 	"github.com/ing-bank/quota-scaler/pkg/kubeconfig"
 	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resize"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 )
 
+// workers is the number of namespaces that are calculated in parallel
+const workers = 4
+
 func main() {
+	leaderElect := flag.Bool("leader-elect", true, "Elect a leader using a Lease, only the leader resizes namespaces")
+	leaseNamespace := flag.String("leader-election-namespace", "", "Namespace of the Lease, defaults to the namespace of the Pod")
+	backendName := flag.String("resize-backend", "", "Resize backend, one of: "+strings.Join(resize.Names(), ", ")+" (default from the config file or "+resize.DefaultBackend+")")
+	backendConfig := flag.String("resize-backend-config", "", "YAML file which selects and configures the resize backend")
+	flag.Int64Var(&internal.DefaultCpuLimitRatio, "cpu-limit-ratio", internal.DefaultCpuLimitRatio, "Ratio between the CPU limits and CPU requests of ResourceQuotas, for QuotaAutoscalers without a cpuLimitRatio. Zero leaves the CPU limits alone")
+	clusterConfig := flag.String("config", "", "Versioned YAML file with the defaults, ceilings and timings of the cluster, reloaded when it changes")
+	webhookAddr := flag.String("webhook-addr", "", "Address of the QuotaAutoscaler and Pod admission webhooks, e.g. :9443. Empty disables the webhooks")
+	webhookCertDir := flag.String("webhook-cert-dir", "/etc/quota-scaler/webhook", "Directory with the tls.crt and tls.key of the admission webhook")
+	ownerKinds := flag.String("owner-kinds", "", "Comma separated Pod owners in the Kind.version.group format that are resolved using their spec.template and scale subresource, e.g. Rollout.v1alpha1.argoproj.io")
+	flag.Parse()
+
+	if *clusterConfig != "" {
+		config, err := internal.LoadClusterConfig(*clusterConfig)
+		if err != nil {
+			panic(err)
+		}
+		internal.UseClusterConfig(config)
+	}
+	// Changes to the ResyncPeriod, MetricsAddr and EventReasons require a restart
+	startConfig := internal.CurrentClusterConfig()
+
 	config, err := kubeconfig.GetKubeConfig()
 	if err != nil {
 		panic(err)
@@ -28,51 +66,154 @@ func main() {
 		panic(err)
 	}
 
+	kinds, err := internal.ParseOwnerKinds(*ownerKinds)
+	if err != nil {
+		panic(err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err)
+	}
+
+	resizeConfig := resize.Config{Backend: resize.DefaultBackend}
+	if *backendConfig != "" {
+		if resizeConfig, err = resize.LoadConfig(*backendConfig); err != nil {
+			panic(err)
+		}
+	}
+	if *backendName != "" {
+		resizeConfig.Backend = *backendName
+	}
+	backend, err := resize.New(resizeConfig.Backend, client, resizeConfig.Options)
+	if err != nil {
+		panic(err)
+	}
+	logging.LogInfo("Using resize backend %s", backend.Name())
+	internal.UseResizeBackend(backend)
+
 	go func() {
-		// Profiling
-		panic(http.ListenAndServe(":8080", nil))
+		// Profiling and Prometheus metrics
+		http.Handle("/metrics", promhttp.Handler())
+		panic(http.ListenAndServe(startConfig.MetricsAddr, nil))
 	}()
 
-	// Runs forever, handles Resize events async by calling the Resize API
-	go internal.RunEventHandler()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopCh := ctx.Done()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		logging.LogInfo("Shutting down")
+		cancel()
+	}()
+	if *clusterConfig != "" {
+		go internal.WatchClusterConfig(*clusterConfig, internal.ClusterConfigReloadInterval, stopCh)
+	}
 
-	for {
-		logging.LogInfo("(re-)starting stream")
-		var watchTimeoutSec int64 = 3600 // Hourly
+	factory := informers.NewSharedInformerFactory(client, 0)
+	ichpFactory := ichpinformers.NewSharedInformerFactory(ichpClient, startConfig.ResyncPeriod.Duration)
 
-		startScalerState, err := ichpClient.IchpV1().QuotaAutoscalers("").List(context.TODO(), v1.ListOptions{})
-		if err != nil {
-			panic(err)
-		}
+	// We catch "FailedCreate" Pod events (and calculate extra resources based on that). cert-manager has a specific
+	// type of event, when trying to create solver pods it will fail under the reason=PresentError. StatefulSets report
+	// claims that exceed the storage quota in their FailedCreate events. The reasons are set in the cluster config.
+	// FieldSelector should be unique, that's why we create an informer factory per reason.
+	var eventFactories []informers.SharedInformerFactory
+	var eventInformers []coreinformers.EventInformer
+	for _, reason := range startConfig.EventReasons {
+		selector := "reason=" + reason
+		eventFactory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+			informers.WithTweakListOptions(func(options *v1.ListOptions) { options.FieldSelector = selector }))
+		eventFactories = append(eventFactories, eventFactory)
+		eventInformers = append(eventInformers, eventFactory.Core().V1().Events())
+	}
 
-		scalerWatch, err := ichpClient.IchpV1().QuotaAutoscalers("").Watch(context.TODO(), v1.ListOptions{TimeoutSeconds: &watchTimeoutSec})
-		if err != nil {
-			panic(err)
-		}
+	watcher := internal.NewQuotaWatcher(client, ichpClient,
+		ichpFactory.Ichp().V1().QuotaAutoscalers(),
+		factory.Core().V1().ResourceQuotas(),
+		eventInformers...,
+	)
+	watcher.Owners = internal.NewOwnerResolver(dynamicClient, client.Discovery(), kinds)
+	watcher.RuntimeClasses = internal.NewRuntimeClasses(client, dynamicClient)
+	watcher.WatchClaims(factory.Core().V1().PersistentVolumeClaims())
+	watcher.Usage = internal.NewUsageHistory(client, podNamespace())
+	watcher.Consumption = internal.NewConsumptionSource(dynamicClient)
+	watcher.Autoscalers = &internal.HorizontalAutoscalers{Client: client, Dynamic: dynamicClient, Owners: watcher.Owners, RuntimeClasses: watcher.RuntimeClasses}
 
-		quotaWatch, err := client.CoreV1().ResourceQuotas("").Watch(context.TODO(), v1.ListOptions{TimeoutSeconds: &watchTimeoutSec})
-		if err != nil {
-			panic(err)
-		}
+	if *webhookAddr != "" {
+		// Every replica serves the admission webhook, not only the leader
+		webhook := &internal.AdmissionWebhook{Client: client}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/mutate", webhook.ServeMutate)
+		mux.HandleFunc("/validate", webhook.ServeValidate)
+		// Only called for Pods when the pod admission webhook is registered, only the leader grows quotas
+		mux.HandleFunc("/pods", internal.NewPodAdmissionWebhook(watcher).ServePods)
+		go func() {
+			logging.LogInfo("Serving the admission webhook on %s", *webhookAddr)
+			panic(http.ListenAndServeTLS(*webhookAddr, filepath.Join(*webhookCertDir, "tls.crt"), filepath.Join(*webhookCertDir, "tls.key"), mux))
+		}()
+	}
 
-		// We catch "FailedCreate" Pod events (and calculate extra resources based on that)
-		eventWatch, err := client.CoreV1().Events("").Watch(context.TODO(), v1.ListOptions{TimeoutSeconds: &watchTimeoutSec, FieldSelector: "reason=FailedCreate"})
-		if err != nil {
-			panic(err)
+	// The Service of the Pod admission webhook only selects the Pod of the leader
+	podName := os.Getenv("POD_NAME")
+	labelLeader := func(leader bool) {
+		if podName == "" {
+			return
 		}
-
-		// cert-manager has an specific type of event, when trying to create solver pods it will fail under the reason=PresentError
-		// FieldSelector should be unique, that's why we triger 2 different watch calls
-		cmEventWatch, err := client.CoreV1().Events("").Watch(context.TODO(), v1.ListOptions{TimeoutSeconds: &watchTimeoutSec, FieldSelector: "reason=PresentError"})
-		if err != nil {
-			panic(err)
+		if err := internal.LabelLeader(client, podNamespace(), podName, leader); err != nil {
+			logging.LogWarning("Cannot set the leader label of Pod %s to %t: %v", podName, leader, err)
 		}
+	}
+	labelLeader(false)
+
+	factory.Start(stopCh)
+	ichpFactory.Start(stopCh)
+	for _, eventFactory := range eventFactories {
+		eventFactory.Start(stopCh)
+	}
+
+	lead := func(stopCh <-chan struct{}) {
+		labelLeader(true)
+		// Runs forever, handles Resize events async by calling the Resize API
+		go internal.RunEventHandler()
+		// Saves the usage history for predictions, also when leadership is lost
+		go watcher.Usage.Run(internal.UsageHistorySaveInterval, stopCh)
+
+		// Blocking call until shutdown or loss of leadership
+		watcher.Run(workers, stopCh)
+	}
+
+	if !*leaderElect {
+		lead(stopCh)
+		return
+	}
+
+	// Followers keep the informer caches warm and only start the workers when they are elected
+	identity := podName
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	if *leaseNamespace == "" {
+		*leaseNamespace = podNamespace()
+	}
+	election := internal.NewLeaderElection(*leaseNamespace, identity)
+	if err := internal.RunAsLeader(ctx, client, election, lead); err != nil {
+		panic(err)
+	}
 
-		// Blocking call until stream watch timeout
-		internal.WatchQuotas(client, startScalerState.Items, quotaWatch.ResultChan(), scalerWatch.ResultChan(), eventWatch.ResultChan(), cmEventWatch.ResultChan())
+	// The event handler cannot be stopped and may still call the resize API, restart as a follower instead
+	if ctx.Err() == nil {
+		logging.LogCritical("Lost leadership, exiting")
+		os.Exit(1)
+	}
+}
 
-		scalerWatch.Stop()
-		quotaWatch.Stop()
-		eventWatch.Stop()
+// podNamespace returns the namespace the scaler runs in, from the downward API or the ServiceAccount.
+func podNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	if namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		return strings.TrimSpace(string(namespace))
 	}
+	return "default"
 }
@@ -0,0 +1,455 @@
+package internal
+
+// This file contains the admission webhook of QuotaAutoscalers. Without it the scaler silently corrects a spec: bad
+// quantities fall back to defaults, unknown policy methods are ignored and maximums are clamped to the ceilings of
+// the cluster. The validating webhook rejects such specs instead, the mutating webhook fills in the defaults that do
+// not depend on the cluster config. The bounds that a spec leaves empty are not filled in, they follow the defaults
+// of the cluster config when it is reloaded.
+//
+// Example usage:
+//  webhook := &AdmissionWebhook{Client: client}
+//  mux.HandleFunc("/mutate", webhook.ServeMutate)
+//  mux.HandleFunc("/validate", webhook.ServeValidate)
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes"
+)
+
+// admissionTimeout is how long the webhook looks for the ResourceQuota of a QuotaAutoscaler
+const admissionTimeout = 5 * time.Second
+
+var quotaAutoscalerKind = schema.GroupKind{Group: "ichp.ing.net", Kind: "QuotaAutoscaler"}
+
+// AdmissionWebhook serves the mutating and validating admission webhooks of QuotaAutoscalers.
+type AdmissionWebhook struct {
+	Client kubernetes.Interface // Checks that the ResourceQuota exists, may be nil
+}
+
+// ServeMutate fills in the defaults of a QuotaAutoscaler, see DefaultQuotaScaler.
+func (webhook *AdmissionWebhook) ServeMutate(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, func(request *admissionv1.AdmissionRequest, scaler *v14.QuotaAutoscaler) *admissionv1.AdmissionResponse {
+		DefaultQuotaScaler(scaler)
+		patch, err := json.Marshal([]map[string]interface{}{{"op": "add", "path": "/spec", "value": scaler.Spec}})
+		if err != nil {
+			return deniedResponse(apierrors.NewInternalError(err))
+		}
+
+		patchType := admissionv1.PatchTypeJSONPatch
+		return &admissionv1.AdmissionResponse{Allowed: true, Patch: patch, PatchType: &patchType}
+	})
+}
+
+// ServeValidate rejects invalid QuotaAutoscalers, see ValidateQuotaAutoscalerSpec, maximums above the ceilings of the
+// cluster, see ValidateQuotaAutoscalerCeilings, and QuotaAutoscalers of which the ResourceQuota does not exist.
+func (webhook *AdmissionWebhook) ServeValidate(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, func(request *admissionv1.AdmissionRequest, scaler *v14.QuotaAutoscaler) *admissionv1.AdmissionResponse {
+		var old *v14.QuotaAutoscalerSpec
+		if request.Operation == admissionv1.Update && len(request.OldObject.Raw) > 0 {
+			oldScaler := &v14.QuotaAutoscaler{}
+			if err := json.Unmarshal(request.OldObject.Raw, oldScaler); err != nil {
+				return deniedResponse(apierrors.NewBadRequest(err.Error()))
+			}
+			old = &oldScaler.Spec
+		}
+
+		errs := ValidateQuotaAutoscalerSpec(scaler.Spec)
+		if len(errs) == 0 {
+			errs = ValidateQuotaAutoscalerCeilings(scaler.Spec, old)
+		}
+		if scaler.Spec.ResourceQuota != "" && webhook.Client != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), admissionTimeout)
+			defer cancel()
+			_, err := webhook.Client.CoreV1().ResourceQuotas(request.Namespace).Get(ctx, scaler.Spec.ResourceQuota, v13.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				errs = append(errs, field.NotFound(field.NewPath("spec", "resourceQuota"), scaler.Spec.ResourceQuota))
+			} else if err != nil {
+				return deniedResponse(apierrors.NewInternalError(err))
+			}
+		}
+
+		if len(errs) > 0 {
+			logging.LogInfo("[%s] Rejected QuotaAutoscaler %s: %s", request.Namespace, request.Name, errs.ToAggregate())
+			return deniedResponse(apierrors.NewInvalid(quotaAutoscalerKind, request.Name, errs))
+		}
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	})
+}
+
+// serveAdmission decodes the AdmissionReview of a QuotaAutoscaler and replies with the response of admit.
+func serveAdmission(w http.ResponseWriter, r *http.Request, admit func(*admissionv1.AdmissionRequest, *v14.QuotaAutoscaler) *admissionv1.AdmissionResponse) {
+	review := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "expected an AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	scaler := &v14.QuotaAutoscaler{}
+	var response *admissionv1.AdmissionResponse
+	if err := json.Unmarshal(review.Request.Object.Raw, scaler); err != nil {
+		response = deniedResponse(apierrors.NewBadRequest(err.Error()))
+	} else {
+		response = admit(review.Request, scaler)
+	}
+	writeAdmissionReview(w, review, response)
+}
+
+// writeAdmissionReview replies to the AdmissionReview with the response.
+func writeAdmissionReview(w http.ResponseWriter, review admissionv1.AdmissionReview, response *admissionv1.AdmissionResponse) {
+	response.UID = review.Request.UID
+	review.Response = response
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		logging.LogError("Unable to reply to AdmissionReview: %v", err)
+	}
+}
+
+func deniedResponse(err *apierrors.StatusError) *admissionv1.AdmissionResponse {
+	status := err.Status()
+	return &admissionv1.AdmissionResponse{Allowed: false, Result: &status}
+}
+
+// DefaultQuotaScaler fills in the defaults of the spec that ValidateQuotaScaler would use and that do not depend on
+// the cluster config: mode, usageSource, replicaHeadroom, the min and minStep of resources, the selectPolicy and scaleUp
+// stabilization window of the behaviors, the time zone of schedules and the parameters of the prediction. The CPU and
+// memory bounds and steps, the maxStep of resources, the cpuLimitRatio and the scaleDown stabilization window are left
+// empty, they follow the cluster config and the --cpu-limit-ratio of the scaler.
+func DefaultQuotaScaler(scaler *v14.QuotaAutoscaler) {
+	spec := &scaler.Spec
+	if spec.Mode == "" {
+		spec.Mode = v14.RatioQuotaMode
+	}
+	if spec.UsageSource == "" {
+		spec.UsageSource = v14.QuotaUsageSource
+	}
+	if spec.ReplicaHeadroom == "" {
+		spec.ReplicaHeadroom = v14.NoReplicaHeadroom
+	}
+	for i := range spec.Resources {
+		bounds := &spec.Resources[i]
+		scale := resources.ScaleOf(v12.ResourceName(strings.ToLower(string(bounds.Name))))
+		defaultQuantity(&bounds.Min, 0, scale)
+		defaultQuantity(&bounds.MinStep, 1, scale)
+	}
+
+	defaultBehavior(&spec.Behavior.ScaleUp)
+	defaultBehavior(&spec.Behavior.ScaleDown)
+	if spec.Behavior.ScaleUp.StabilizationWindowSeconds == nil {
+		windowSeconds := int32(0) // Scaling up is not stabilized by default
+		spec.Behavior.ScaleUp.StabilizationWindowSeconds = &windowSeconds
+	}
+
+	for i := range spec.Schedules {
+		if spec.Schedules[i].TimeZone == "" {
+			spec.Schedules[i].TimeZone = time.UTC.String()
+		}
+	}
+
+	if prediction := spec.Prediction; prediction != nil {
+		if prediction.Horizon.Duration == 0 {
+			prediction.Horizon.Duration = DefaultPredictionHorizon
+		}
+		if len(prediction.Seasons) == 0 {
+			prediction.Seasons = append([]v14.PredictionSeason(nil), DefaultPredictionSeasons...)
+		}
+		defaultPercentage(&prediction.LevelSmoothing, DefaultPredictionLevelSmoothing)
+		defaultPercentage(&prediction.TrendSmoothing, DefaultPredictionTrendSmoothing)
+		defaultPercentage(&prediction.SeasonalSmoothing, DefaultPredictionSeasonalSmoothing)
+	}
+}
+
+func defaultPercentage(value **int32, def int32) {
+	if *value == nil {
+		*value = &def
+	}
+}
+
+func defaultQuantity(value *string, def int64, scale resource.Scale) {
+	if *value == "" {
+		*value = formatQuantity(def, scale)
+	}
+}
+
+func defaultBehavior(behavior *v14.QuotaScaleBehavior) {
+	if behavior.SelectPolicy == "" {
+		behavior.SelectPolicy = v14.MaxPolicySelect
+	}
+	if behavior.Policies == nil {
+		behavior.Policies = []v14.QuotaScalePolicy{} // The CRD does not allow null
+	}
+}
+
+// ValidateQuotaAutoscalerSpec returns the errors of a spec which ValidateQuotaScaler would silently correct or
+// ignore: quantities that do not parse or are negative, minimums above their maximum, limit bounds outside the
+// Independent mode, resource bounds without max, policies of resources without bounds or consumption, schedules that
+// do not parse, predictions outside their ranges and an unknown usageSource or replicaHeadroom. The bounds are checked
+// with the overrides of every schedule too. The ceilings of the cluster are checked by ValidateQuotaAutoscalerCeilings.
+func ValidateQuotaAutoscalerSpec(spec v14.QuotaAutoscalerSpec) field.ErrorList {
+	path := field.NewPath("spec")
+	var errs field.ErrorList
+	if spec.ResourceQuota == "" {
+		errs = append(errs, field.Required(path.Child("resourceQuota"), "the name of the ResourceQuota to scale"))
+	}
+
+	errs = append(errs, validateQuantity(path.Child("minCpu"), spec.MinCpu)...)
+	errs = append(errs, validateQuantity(path.Child("maxCpu"), spec.MaxCpu)...)
+	errs = append(errs, validateQuantity(path.Child("minCpuStep"), spec.MinCpuStep)...)
+	errs = append(errs, validateQuantity(path.Child("maxCpuStep"), spec.MaxCpuStep)...)
+	errs = append(errs, validateQuantity(path.Child("minMemory"), spec.MinMemory)...)
+	errs = append(errs, validateQuantity(path.Child("maxMemory"), spec.MaxMemory)...)
+	errs = append(errs, validateQuantity(path.Child("minMemoryStep"), spec.MinMemoryStep)...)
+	errs = append(errs, validateQuantity(path.Child("maxMemoryStep"), spec.MaxMemoryStep)...)
+
+	limits := map[string]string{"minCpuLimit": spec.MinCpuLimit, "maxCpuLimit": spec.MaxCpuLimit,
+		"minMemoryLimit": spec.MinMemoryLimit, "maxMemoryLimit": spec.MaxMemoryLimit}
+	for _, name := range []string{"minCpuLimit", "maxCpuLimit", "minMemoryLimit", "maxMemoryLimit"} {
+		if spec.Mode != v14.IndependentQuotaMode && limits[name] != "" {
+			errs = append(errs, field.Forbidden(path.Child(name), "only used in the Independent mode"))
+		}
+		errs = append(errs, validateQuantity(path.Child(name), limits[name])...)
+	}
+
+	bounded := map[v12.ResourceName]bool{v12.ResourceCPU: true, v12.ResourceMemory: true}
+	for i, bounds := range spec.Resources {
+		boundsPath := path.Child("resources").Index(i)
+		name := v12.ResourceName(strings.ToLower(string(bounds.Name)))
+		switch {
+		case name == "":
+			errs = append(errs, field.Required(boundsPath.Child("name"), "a ResourceQuota resource name"))
+		case isComputeResource(name):
+			errs = append(errs, field.Forbidden(boundsPath.Child("name"), "CPU and memory are bounded by their own fields, e.g. maxCpu"))
+		case bounded[name]:
+			errs = append(errs, field.Duplicate(boundsPath.Child("name"), bounds.Name))
+		}
+		bounded[name] = true
+
+		if bounds.Max == "" {
+			errs = append(errs, field.Required(boundsPath.Child("max"), "resources are only scaled up to their max"))
+		}
+		errs = append(errs, validateQuantity(boundsPath.Child("min"), bounds.Min)...)
+		errs = append(errs, validateQuantity(boundsPath.Child("max"), bounds.Max)...)
+		errs = append(errs, validateQuantity(boundsPath.Child("minStep"), bounds.MinStep)...)
+		errs = append(errs, validateQuantity(boundsPath.Child("maxStep"), bounds.MaxStep)...)
+	}
+
+	behaviorPath := path.Child("behavior")
+	consumption := spec.UsageSource == v14.MetricsUsageSource
+	if spec.UsageSource != "" && spec.UsageSource != v14.QuotaUsageSource && !consumption {
+		errs = append(errs, field.NotSupported(path.Child("usageSource"), spec.UsageSource, []string{string(v14.QuotaUsageSource), string(v14.MetricsUsageSource)}))
+	}
+	switch spec.ReplicaHeadroom {
+	case "", v14.NoReplicaHeadroom, v14.DesiredReplicaHeadroom, v14.MaxReplicaHeadroom:
+	default:
+		errs = append(errs, field.NotSupported(path.Child("replicaHeadroom"), spec.ReplicaHeadroom,
+			[]string{string(v14.NoReplicaHeadroom), string(v14.DesiredReplicaHeadroom), string(v14.MaxReplicaHeadroom)}))
+	}
+	errs = append(errs, validatePolicies(behaviorPath.Child("scaleUp", "policies"), spec.Behavior.ScaleUp.Policies, bounded, false)...)
+	errs = append(errs, validatePolicies(behaviorPath.Child("scaleDown", "policies"), spec.Behavior.ScaleDown.Policies, bounded, consumption)...)
+	errs = append(errs, validateSchedules(path.Child("schedules"), spec.Schedules, bounded, consumption)...)
+	if spec.Prediction != nil {
+		errs = append(errs, validatePrediction(path.Child("prediction"), spec.Prediction)...)
+	}
+
+	if len(errs) > 0 {
+		// The bounds below would be compared with defaults instead of the invalid quantities
+		return errs
+	}
+	if errs = validateBounds(path, spec); len(errs) > 0 {
+		return errs
+	}
+	for i := range spec.Schedules {
+		errs = append(errs, validateBounds(path.Child("schedules").Index(i), ApplySchedule(spec, &spec.Schedules[i]))...)
+	}
+	return errs
+}
+
+// validateSchedules returns the errors of the schedules, their names must be unique.
+func validateSchedules(path *field.Path, schedules []v14.QuotaScalerSchedule, bounded map[v12.ResourceName]bool, consumption bool) field.ErrorList {
+	var errs field.ErrorList
+	names := map[string]bool{}
+	for i, schedule := range schedules {
+		schedulePath := path.Index(i)
+		if schedule.Name == "" {
+			errs = append(errs, field.Required(schedulePath.Child("name"), "the name that the status reports"))
+		} else if names[schedule.Name] {
+			errs = append(errs, field.Duplicate(schedulePath.Child("name"), schedule.Name))
+		}
+		names[schedule.Name] = true
+
+		if _, err := parseCron(schedule.Cron); err != nil {
+			errs = append(errs, field.Invalid(schedulePath.Child("cron"), schedule.Cron, err.Error()))
+		}
+		if _, err := scheduleLocation(schedule.TimeZone); err != nil {
+			errs = append(errs, field.Invalid(schedulePath.Child("timeZone"), schedule.TimeZone, err.Error()))
+		}
+		if schedule.Duration.Duration <= 0 {
+			errs = append(errs, field.Invalid(schedulePath.Child("duration"), schedule.Duration.Duration.String(), "must be positive"))
+		}
+
+		errs = append(errs, validateQuantity(schedulePath.Child("minCpu"), schedule.MinCpu)...)
+		errs = append(errs, validateQuantity(schedulePath.Child("maxCpu"), schedule.MaxCpu)...)
+		errs = append(errs, validateQuantity(schedulePath.Child("minMemory"), schedule.MinMemory)...)
+		errs = append(errs, validateQuantity(schedulePath.Child("maxMemory"), schedule.MaxMemory)...)
+		if schedule.Behavior != nil {
+			behaviorPath := schedulePath.Child("behavior")
+			errs = append(errs, validatePolicies(behaviorPath.Child("scaleUp", "policies"), schedule.Behavior.ScaleUp.Policies, bounded, false)...)
+			errs = append(errs, validatePolicies(behaviorPath.Child("scaleDown", "policies"), schedule.Behavior.ScaleDown.Policies, bounded, consumption)...)
+		}
+	}
+	return errs
+}
+
+// validatePrediction returns the errors of a prediction, its horizon may not exceed a day.
+func validatePrediction(path *field.Path, prediction *v14.QuotaScalerPrediction) field.ErrorList {
+	var errs field.ErrorList
+	if horizon := prediction.Horizon.Duration; horizon < 0 || horizon > 24*time.Hour {
+		errs = append(errs, field.Invalid(path.Child("horizon"), horizon.String(), "must be positive and at most 24h"))
+	}
+
+	seasons := map[v14.PredictionSeason]bool{}
+	for i, season := range prediction.Seasons {
+		if _, ok := seasonLengths[season]; !ok {
+			errs = append(errs, field.NotSupported(path.Child("seasons").Index(i), season, []string{string(v14.DailySeason), string(v14.WeeklySeason)}))
+		} else if seasons[season] {
+			errs = append(errs, field.Duplicate(path.Child("seasons").Index(i), season))
+		}
+		seasons[season] = true
+	}
+
+	smoothing := map[string]*int32{"levelSmoothing": prediction.LevelSmoothing, "trendSmoothing": prediction.TrendSmoothing,
+		"seasonalSmoothing": prediction.SeasonalSmoothing}
+	for _, name := range []string{"levelSmoothing", "trendSmoothing", "seasonalSmoothing"} {
+		if value := smoothing[name]; value != nil && (*value < 0 || *value > 100) {
+			errs = append(errs, field.Invalid(path.Child(name), *value, "must be a percentage between 0 and 100"))
+		}
+	}
+	return errs
+}
+
+// validateQuantity returns an error when a quantity does not parse or is negative, empty quantities are defaulted.
+func validateQuantity(path *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return field.ErrorList{field.Invalid(path, value, err.Error())}
+	}
+	if quantity.Sign() < 0 {
+		return field.ErrorList{field.Invalid(path, value, "must not be negative")}
+	}
+	return nil
+}
+
+// validatePolicies returns the errors of the policies of a behavior, their method must name a bounded resource. The
+// consumption policies are only allowed when consumption is.
+func validatePolicies(path *field.Path, policies []v14.QuotaScalePolicy, bounded map[v12.ResourceName]bool, consumption bool) field.ErrorList {
+	var methods []string
+	for name := range bounded {
+		methods = append(methods, string(name))
+	}
+	sort.Strings(methods)
+
+	var errs field.ErrorList
+	for i, policy := range policies {
+		policyPath := path.Index(i)
+		if isConsumptionPolicy(policy) {
+			if !consumption {
+				errs = append(errs, field.Forbidden(policyPath.Child("method"), "consumption policies only scale down with the Metrics usageSource"))
+			}
+		} else if !bounded[v12.ResourceName(strings.ToLower(policy.Method))] {
+			errs = append(errs, field.NotSupported(policyPath.Child("method"), policy.Method, methods))
+		}
+		if policy.Value < 1 || policy.Value > 100 {
+			errs = append(errs, field.Invalid(policyPath.Child("value"), policy.Value, "must be a percentage between 1 and 100"))
+		}
+		if policy.MaxChange != "" && policy.PeriodMinutes <= 0 {
+			errs = append(errs, field.Forbidden(policyPath.Child("maxChange"), "only used with periodMinutes"))
+		}
+		errs = append(errs, validateQuantity(policyPath.Child("maxChange"), policy.MaxChange)...)
+	}
+	return errs
+}
+
+// validateBounds returns an error for each minimum above its maximum. Only bounds that the spec sets are compared, a
+// change of the defaults or ceilings of the cluster must not reject an update of an unrelated field.
+func validateBounds(path *field.Path, spec v14.QuotaAutoscalerSpec) field.ErrorList {
+	var errs field.ErrorList
+	notGreater := func(valuePath *field.Path, value, maxName, max string, scale resource.Scale) {
+		if value != "" && max != "" && ParseQuantityWithDefault(value, scale, 0) > ParseQuantityWithDefault(max, scale, 0) {
+			errs = append(errs, field.Invalid(valuePath, value, fmt.Sprintf("must not be greater than %s (%s)", maxName, max)))
+		}
+	}
+
+	notGreater(path.Child("minCpu"), spec.MinCpu, "maxCpu", spec.MaxCpu, resource.Milli)
+	notGreater(path.Child("minCpuStep"), spec.MinCpuStep, "maxCpuStep", spec.MaxCpuStep, resource.Milli)
+	notGreater(path.Child("minMemory"), spec.MinMemory, "maxMemory", spec.MaxMemory, resource.Mega)
+	notGreater(path.Child("minMemoryStep"), spec.MinMemoryStep, "maxMemoryStep", spec.MaxMemoryStep, resource.Mega)
+	notGreater(path.Child("minCpuLimit"), spec.MinCpuLimit, "maxCpuLimit", spec.MaxCpuLimit, resource.Milli)
+	notGreater(path.Child("minMemoryLimit"), spec.MinMemoryLimit, "maxMemoryLimit", spec.MaxMemoryLimit, resource.Mega)
+
+	for _, bounds := range spec.Resources {
+		name := v12.ResourceName(strings.ToLower(string(bounds.Name)))
+		boundsPath, scale := path.Child("resources").Key(string(name)), resources.ScaleOf(name)
+		notGreater(boundsPath.Child("min"), bounds.Min, "max", bounds.Max, scale)
+		notGreater(boundsPath.Child("minStep"), bounds.MinStep, "maxStep", bounds.MaxStep, scale)
+	}
+	return errs
+}
+
+// ValidateQuotaAutoscalerCeilings returns an error for each maxCpu, maxMemory, maxCpuLimit and maxMemoryLimit, of the
+// spec or of a schedule, above the ceilings of the cluster. On an update old is the previous spec and only maximums
+// that changed are checked, lowering the ceilings must not reject an update of an unrelated field. Maximums that are
+// left empty follow the defaults of the cluster config, which never exceed the ceilings.
+func ValidateQuotaAutoscalerCeilings(spec v14.QuotaAutoscalerSpec, old *v14.QuotaAutoscalerSpec) field.ErrorList {
+	var errs field.ErrorList
+	ceilings := CurrentClusterConfig().Ceilings
+	notAboveCeiling := func(valuePath *field.Path, value, oldValue string, ceiling resource.Quantity) {
+		if value == "" || (old != nil && value == oldValue) {
+			return
+		}
+		if quantity, err := resource.ParseQuantity(value); err == nil && quantity.Cmp(ceiling) > 0 {
+			errs = append(errs, field.Invalid(valuePath, value, fmt.Sprintf("must not be greater than the maximum of the cluster (%s)", ceiling.String())))
+		}
+	}
+
+	path := field.NewPath("spec")
+	previous := v14.QuotaAutoscalerSpec{}
+	if old != nil {
+		previous = *old
+	}
+	notAboveCeiling(path.Child("maxCpu"), spec.MaxCpu, previous.MaxCpu, ceilings.MaxCpu)
+	notAboveCeiling(path.Child("maxMemory"), spec.MaxMemory, previous.MaxMemory, ceilings.MaxMemory)
+	notAboveCeiling(path.Child("maxCpuLimit"), spec.MaxCpuLimit, previous.MaxCpuLimit, ceilings.MaxCpuLimit)
+	notAboveCeiling(path.Child("maxMemoryLimit"), spec.MaxMemoryLimit, previous.MaxMemoryLimit, ceilings.MaxMemoryLimit)
+
+	previousSchedules := map[string]v14.QuotaScalerSchedule{}
+	for _, schedule := range previous.Schedules {
+		previousSchedules[schedule.Name] = schedule
+	}
+	for i, schedule := range spec.Schedules {
+		schedulePath := path.Child("schedules").Index(i)
+		notAboveCeiling(schedulePath.Child("maxCpu"), schedule.MaxCpu, previousSchedules[schedule.Name].MaxCpu, ceilings.MaxCpu)
+		notAboveCeiling(schedulePath.Child("maxMemory"), schedule.MaxMemory, previousSchedules[schedule.Name].MaxMemory, ceilings.MaxMemory)
+	}
+	return errs
+}
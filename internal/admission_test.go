@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestValidateQuotaAutoscalerSpec(t *testing.T) {
+	policies := func(methods ...string) v14.QuotaAutoscalerSpecBehavior {
+		behavior := v14.QuotaAutoscalerSpecBehavior{}
+		for _, method := range methods {
+			behavior.ScaleUp.Policies = append(behavior.ScaleUp.Policies, v14.QuotaScalePolicy{Method: method, Value: 80})
+		}
+		return behavior
+	}
+
+	schedule := func(modify func(*v14.QuotaScalerSchedule)) []v14.QuotaScalerSchedule {
+		valid := v14.QuotaScalerSchedule{Name: "office-hours", Cron: "0 7 * * 1-5", TimeZone: "Europe/Amsterdam", Duration: v13.Duration{Duration: 12 * time.Hour}}
+		modify(&valid)
+		return []v14.QuotaScalerSchedule{valid}
+	}
+
+	tests := []struct {
+		name     string
+		spec     v14.QuotaAutoscalerSpec
+		expected string
+	}{
+		{"Valid", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", MaxCpu: "10", Behavior: policies("cpu", "Memory")}, ""},
+		{"Missing quota", v14.QuotaAutoscalerSpec{}, "spec.resourceQuota: Required value"},
+		{"Bad quantity", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", MinCpu: "1 core"}, `spec.minCpu: Invalid value: "1 core"`},
+		{"Negative quantity", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", MinMemory: "-1G"}, "spec.minMemory: Invalid value: \"-1G\": must not be negative"},
+		{"Min above max", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", MinCpu: "4", MaxCpu: "2"}, "spec.minCpu: Invalid value: \"4\": must not be greater than maxCpu (2)"},
+		{"Min above default max", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", MinCpu: "40"}, ""},
+		{"Limits in Ratio mode", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", MaxCpuLimit: "80"}, "spec.maxCpuLimit: Forbidden: only used in the Independent mode"},
+		{"Unknown method", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Behavior: policies("gpu")}, `spec.behavior.scaleUp.policies[0].method: Unsupported value: "gpu": supported values: "cpu", "memory"`},
+		{"Resource without max", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Resources: []v14.QuotaResourceBounds{{Name: "count/pods"}}}, "spec.resources[0].max: Required value"},
+		{"Resource min above max", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Resources: []v14.QuotaResourceBounds{{Name: "count/pods", Min: "20", Max: "10"}}, Behavior: policies("count/pods")},
+			"spec.resources[count/pods].min: Invalid value: \"20\": must not be greater than max (10)"},
+		{"Valid schedule", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Schedules: schedule(func(s *v14.QuotaScalerSchedule) { s.MinCpu = "4" })}, ""},
+		{"Schedule without name", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Schedules: schedule(func(s *v14.QuotaScalerSchedule) { s.Name = "" })}, "spec.schedules[0].name: Required value"},
+		{"Bad cron", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Schedules: schedule(func(s *v14.QuotaScalerSchedule) { s.Cron = "0 7 * *" })}, `spec.schedules[0].cron: Invalid value: "0 7 * *"`},
+		{"Cron with time zone", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Schedules: schedule(func(s *v14.QuotaScalerSchedule) { s.Cron = "CRON_TZ=UTC 0 7 * * *" })}, "the time zone must be set in timeZone"},
+		{"Bad time zone", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Schedules: schedule(func(s *v14.QuotaScalerSchedule) { s.TimeZone = "Europe/Nowhere" })}, `spec.schedules[0].timeZone: Invalid value: "Europe/Nowhere"`},
+		{"Zero duration", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Schedules: schedule(func(s *v14.QuotaScalerSchedule) { s.Duration.Duration = 0 })}, "spec.schedules[0].duration: Invalid value: \"0s\": must be positive"},
+		{"Schedule min above max", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", MaxCpu: "10", Schedules: schedule(func(s *v14.QuotaScalerSchedule) { s.MinCpu = "20" })}, "spec.schedules[0].minCpu: Invalid value: \"20\": must not be greater than maxCpu (10)"},
+		{"Valid prediction", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Prediction: &v14.QuotaScalerPrediction{Seasons: []v14.PredictionSeason{v14.DailySeason}}}, ""},
+		{"Long horizon", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Prediction: &v14.QuotaScalerPrediction{Horizon: v13.Duration{Duration: 48 * time.Hour}}}, `spec.prediction.horizon: Invalid value: "48h0m0s"`},
+		{"Unknown season", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Prediction: &v14.QuotaScalerPrediction{Seasons: []v14.PredictionSeason{"Monthly"}}}, `spec.prediction.seasons[0]: Unsupported value: "Monthly"`},
+		{"Duplicate season", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Prediction: &v14.QuotaScalerPrediction{Seasons: []v14.PredictionSeason{v14.DailySeason, v14.DailySeason}}}, `spec.prediction.seasons[1]: Duplicate value: "Daily"`},
+		{"Unknown replica headroom", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", ReplicaHeadroom: "Replicas"}, `spec.replicaHeadroom: Unsupported value: "Replicas"`},
+		{"Unknown usage source", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", UsageSource: "Kubelet"}, `spec.usageSource: Unsupported value: "Kubelet"`},
+		{"Consumption scale down", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", UsageSource: v14.MetricsUsageSource, Behavior: v14.QuotaAutoscalerSpecBehavior{
+			ScaleDown: v14.QuotaScaleBehavior{Policies: []v14.QuotaScalePolicy{{Method: "cpuConsumption", Value: 50}}}}}, ""},
+		{"Consumption without metrics", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Behavior: v14.QuotaAutoscalerSpecBehavior{
+			ScaleDown: v14.QuotaScaleBehavior{Policies: []v14.QuotaScalePolicy{{Method: "memoryConsumption", Value: 50}}}}}, "spec.behavior.scaleDown.policies[0].method: Forbidden"},
+		{"Consumption scale up", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", UsageSource: v14.MetricsUsageSource, Behavior: v14.QuotaAutoscalerSpecBehavior{
+			ScaleUp: v14.QuotaScaleBehavior{Policies: []v14.QuotaScalePolicy{{Method: "cpuConsumption", Value: 50}}}}}, "spec.behavior.scaleUp.policies[0].method: Forbidden"},
+		{"Smoothing above 100", v14.QuotaAutoscalerSpec{ResourceQuota: "quota", Prediction: &v14.QuotaScalerPrediction{TrendSmoothing: &[]int32{120}[0]}}, "spec.prediction.trendSmoothing: Invalid value: 120"},
+	}
+
+	for _, test := range tests {
+		errs := ValidateQuotaAutoscalerSpec(test.spec)
+		if test.expected == "" && len(errs) > 0 {
+			t.Errorf("%s: expected no errors but got: %v\n", test.name, errs)
+		}
+		if test.expected != "" && !strings.Contains(errs.ToAggregate().Error(), test.expected) {
+			t.Errorf("%s: expected error %s but got: %v\n", test.name, test.expected, errs)
+		}
+	}
+}
+
+func TestValidateQuotaAutoscalerCeilings(t *testing.T) {
+	schedule := []v14.QuotaScalerSchedule{{Name: "office-hours", MaxMemory: "200G"}}
+	old := &v14.QuotaAutoscalerSpec{MaxCpu: "40", Schedules: schedule}
+
+	tests := []struct {
+		name     string
+		spec     v14.QuotaAutoscalerSpec
+		old      *v14.QuotaAutoscalerSpec
+		expected string
+	}{
+		{"Below ceiling", v14.QuotaAutoscalerSpec{MaxCpu: "35", MaxMemory: "150G"}, nil, ""},
+		{"Above ceiling", v14.QuotaAutoscalerSpec{MaxMemory: "1T"}, nil, "spec.maxMemory: Invalid value: \"1T\": must not be greater than the maximum of the cluster (150G)"},
+		{"Limit above ceiling", v14.QuotaAutoscalerSpec{Mode: v14.IndependentQuotaMode, MaxCpuLimit: "1k"}, nil, "spec.maxCpuLimit: Invalid value: \"1k\""},
+		{"Schedule above ceiling", v14.QuotaAutoscalerSpec{Schedules: schedule}, nil, "spec.schedules[0].maxMemory: Invalid value: \"200G\""},
+		{"Unchanged above ceiling", v14.QuotaAutoscalerSpec{MaxCpu: "40", MinCpu: "1", Schedules: schedule}, old, ""},
+		{"Raised above ceiling", v14.QuotaAutoscalerSpec{MaxCpu: "50", Schedules: schedule}, old, "spec.maxCpu: Invalid value: \"50\""},
+	}
+
+	for _, test := range tests {
+		errs := ValidateQuotaAutoscalerCeilings(test.spec, test.old)
+		if test.expected == "" && len(errs) > 0 {
+			t.Errorf("%s: expected no errors but got: %v\n", test.name, errs)
+		}
+		if test.expected != "" && !strings.Contains(errs.ToAggregate().Error(), test.expected) {
+			t.Errorf("%s: expected error %s but got: %v\n", test.name, test.expected, errs)
+		}
+	}
+}
+
+// newTestAdmissionReview sends the scaler to the webhook, as update of old when it is set and as create otherwise
+func newTestAdmissionReview(t *testing.T, url string, scaler, old *v14.QuotaAutoscaler) *admissionv1.AdmissionResponse {
+	raw, _ := json.Marshal(scaler)
+	request := &admissionv1.AdmissionRequest{
+		UID:       "1234",
+		Name:      scaler.Name,
+		Namespace: scaler.Namespace,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	if old != nil {
+		request.Operation = admissionv1.Update
+		request.OldObject.Raw, _ = json.Marshal(old)
+	}
+	body, _ := json.Marshal(admissionv1.AdmissionReview{Request: request})
+
+	reply, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	defer reply.Body.Close()
+
+	review := admissionv1.AdmissionReview{}
+	_ = json.NewDecoder(reply.Body).Decode(&review)
+	if review.Response == nil || review.Response.UID != "1234" {
+		t.Fatalf("expected a response for the request but got: %+v\n", review)
+	}
+	return review.Response
+}
+
+func TestAdmissionWebhook(t *testing.T) {
+	webhook := &AdmissionWebhook{Client: fake.NewSimpleClientset(&v12.ResourceQuota{
+		ObjectMeta: v13.ObjectMeta{Name: "example-quota", Namespace: "example-dev"},
+	})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", webhook.ServeMutate)
+	mux.HandleFunc("/validate", webhook.ServeValidate)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scaler := &v14.QuotaAutoscaler{ObjectMeta: v13.ObjectMeta{Name: "example-scaler", Namespace: "example-dev"}}
+	scaler.Spec.ResourceQuota = "example-quota"
+	if response := newTestAdmissionReview(t, server.URL+"/validate", scaler, nil); !response.Allowed {
+		t.Errorf("expected the scaler to be allowed but got: %+v\n", response.Result)
+	}
+
+	// Maximums above the ceilings are rejected when they are set, not when the ceilings were lowered afterwards
+	above := scaler.DeepCopy()
+	above.Spec.MaxCpu = "40"
+	if response := newTestAdmissionReview(t, server.URL+"/validate", above, nil); response.Allowed || !strings.Contains(response.Result.Message, "spec.maxCpu") {
+		t.Errorf("expected the maxCpu above the ceiling to be rejected but got: %+v\n", response.Result)
+	}
+	updated := above.DeepCopy()
+	updated.Spec.MinCpu = "1"
+	if response := newTestAdmissionReview(t, server.URL+"/validate", updated, above); !response.Allowed {
+		t.Errorf("expected the update of minCpu to be allowed but got: %+v\n", response.Result)
+	}
+
+	// The ResourceQuota must exist
+	scaler.Spec.ResourceQuota = "other-quota"
+	response := newTestAdmissionReview(t, server.URL+"/validate", scaler, nil)
+	if response.Allowed || !strings.Contains(response.Result.Message, `spec.resourceQuota: Not found: "other-quota"`) {
+		t.Errorf("expected the missing quota to be rejected but got: %+v\n", response.Result)
+	}
+
+	// The defaults are patched into the spec
+	scaler.Spec.Schedules = []v14.QuotaScalerSchedule{{Name: "office-hours", Cron: "0 7 * * 1-5", Duration: v13.Duration{Duration: 12 * time.Hour}}}
+	scaler.Spec.Prediction = &v14.QuotaScalerPrediction{}
+	scaler.Spec.Resources = []v14.QuotaResourceBounds{{Name: "count/pods", Max: "50"}}
+	response = newTestAdmissionReview(t, server.URL+"/mutate", scaler, nil)
+	var patch []struct {
+		Op    string                  `json:"op"`
+		Path  string                  `json:"path"`
+		Value v14.QuotaAutoscalerSpec `json:"value"`
+	}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil || len(patch) != 1 {
+		t.Fatalf("expected a single patch but got: %s %v\n", response.Patch, err)
+	}
+	spec := patch[0].Value
+	if spec.ResourceQuota != "other-quota" || spec.Mode != v14.RatioQuotaMode || spec.UsageSource != v14.QuotaUsageSource || spec.ReplicaHeadroom != v14.NoReplicaHeadroom ||
+		spec.Behavior.ScaleUp.SelectPolicy != v14.MaxPolicySelect || spec.Behavior.ScaleDown.SelectPolicy != v14.MaxPolicySelect {
+		t.Errorf("expected the enum fields to be filled in but got: %+v\n", spec)
+	}
+
+	if window := spec.Behavior.ScaleUp.StabilizationWindowSeconds; window == nil || *window != 0 {
+		t.Errorf("expected the scaleUp stabilization window to be filled in but got: %+v\n", spec.Behavior.ScaleUp)
+	}
+	if len(spec.Resources) != 1 || spec.Resources[0].Min != "0" || spec.Resources[0].MinStep != "1" || spec.Resources[0].MaxStep != "" {
+		t.Errorf("expected the min and minStep of the resource to be filled in but got: %+v\n", spec.Resources)
+	}
+	if len(spec.Schedules) != 1 || spec.Schedules[0].TimeZone != "UTC" {
+		t.Errorf("expected the schedule in UTC but got: %+v\n", spec.Schedules)
+	}
+	if prediction := spec.Prediction; prediction == nil || prediction.Horizon.Duration != DefaultPredictionHorizon || len(prediction.Seasons) != 2 ||
+		prediction.LevelSmoothing == nil || *prediction.LevelSmoothing != DefaultPredictionLevelSmoothing {
+		t.Errorf("expected the prediction defaults to be filled in but got: %+v\n", prediction)
+	}
+
+	// The defaults of the cluster config are resolved when the quota is calculated, they are not persisted
+	if spec.MaxCpu != "" || spec.MinMemory != "" || spec.CpuLimitRatio != nil || spec.Behavior.ScaleDown.StabilizationWindowSeconds != nil {
+		t.Errorf("expected the bounds and scaleDown stabilization window to be left empty but got: %+v\n", spec)
+	}
+}
@@ -0,0 +1,277 @@
+package internal
+
+// This file contains the configuration of the quota-scaler for the whole cluster: the defaults and ceilings of
+// QuotaAutoscalers, timings, the watched Event reasons and the dry run. It is read from a versioned YAML file, usually a mounted
+// ConfigMap, and reloaded when the file changes. Settings that are missing from the file keep their defaults.
+//
+// Example usage:
+//  config, err := internal.LoadClusterConfig("/etc/quota-scaler/config/config.yaml")
+//  if err != nil { panic(err) }
+//  internal.UseClusterConfig(config)
+//  go internal.WatchClusterConfig("/etc/quota-scaler/config/config.yaml", ClusterConfigReloadInterval, stopCh)
+//
+//  maxCpu := internal.CurrentClusterConfig().Ceilings.MaxCpu
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	ClusterConfigAPIVersion = "quotascaler.ichp.ing.net/v1"
+	ClusterConfigKind       = "ClusterConfig"
+
+	// ClusterConfigReloadInterval is how often the configuration file is checked for changes. Kubelet updates mounted
+	// ConfigMaps within a minute.
+	ClusterConfigReloadInterval = 10 * time.Second
+
+	maxPodAdmissionBudget = 30 * time.Second
+)
+
+// ClusterConfig is the configuration of the quota-scaler for the whole cluster.
+type ClusterConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	Defaults ScalerDefaults `json:"defaults"`
+	Ceilings ScalerCeilings `json:"ceilings"`
+
+	// Debounce is how long ResourceQuota and Pod Event changes of a namespace are aggregated before the namespace is
+	// calculated. Quota changes are very frequent, every Pod "modifies" the Quota status twice.
+	Debounce v13.Duration `json:"debounce"`
+	// StaleEventAge is the age after which a Pod Event is no longer considered. This skips old Events that are listed
+	// when the informer (re-)starts.
+	StaleEventAge v13.Duration `json:"staleEventAge"`
+
+	// ResyncPeriod re-evaluates every namespace periodically, e.g. for scale downs that were held back by a
+	// stabilization window while no new ResourceQuota changes arrived. Requires a restart.
+	ResyncPeriod v13.Duration `json:"resyncPeriod"`
+	// MetricsAddr serves the Prometheus metrics and pprof endpoints. Requires a restart.
+	MetricsAddr string `json:"metricsAddr"`
+	// EventReasons are the reasons of the Events that raise the quota. Requires a restart.
+	EventReasons []string `json:"eventReasons"`
+
+	// DryRun puts all QuotaAutoscalers in dry run, see QuotaAutoscalerSpec.DryRun.
+	DryRun bool `json:"dryRun"`
+
+	// UsageSampleInterval is the interval of the usage history that predictions are made from, the highest usage within
+	// an interval is kept. Changes discard the recorded history.
+	UsageSampleInterval v13.Duration `json:"usageSampleInterval"`
+	// PrometheusURL is the Prometheus compatible query endpoint that the Metrics usageSource reads the consumption of
+	// Pods from, e.g. http://prometheus.monitoring:9090. Empty uses the metrics.k8s.io API.
+	PrometheusURL string `json:"prometheusURL"`
+	// PodAdmissionBudget is how long the pod admission webhook may take to grow the quota for a Pod, after which the
+	// Pod is admitted without. It must be lower than the timeoutSeconds of the webhook.
+	PodAdmissionBudget v13.Duration `json:"podAdmissionBudget"`
+}
+
+// ScalerDefaults are used for the fields that a QuotaAutoscaler does not set.
+type ScalerDefaults struct {
+	MinCpu        resource.Quantity `json:"minCpu"`
+	MaxCpu        resource.Quantity `json:"maxCpu"`
+	MinCpuStep    resource.Quantity `json:"minCpuStep"`
+	MaxCpuStep    resource.Quantity `json:"maxCpuStep"`
+	MinMemory     resource.Quantity `json:"minMemory"`
+	MaxMemory     resource.Quantity `json:"maxMemory"`
+	MinMemoryStep resource.Quantity `json:"minMemoryStep"`
+	MaxMemoryStep resource.Quantity `json:"maxMemoryStep"`
+
+	ScaleDownStabilizationWindow v13.Duration `json:"scaleDownStabilizationWindow"`
+}
+
+// ScalerCeilings are the highest maximums of a QuotaAutoscaler, the admission webhook rejects QuotaAutoscalers above
+// them. The limit ceilings apply to the maxCpuLimit and maxMemoryLimit of the Independent mode.
+type ScalerCeilings struct {
+	MaxCpu         resource.Quantity `json:"maxCpu"`
+	MaxMemory      resource.Quantity `json:"maxMemory"`
+	MaxCpuLimit    resource.Quantity `json:"maxCpuLimit"`
+	MaxMemoryLimit resource.Quantity `json:"maxMemoryLimit"`
+}
+
+// DefaultClusterConfig returns the configuration that is used without configuration file.
+func DefaultClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		APIVersion: ClusterConfigAPIVersion,
+		Kind:       ClusterConfigKind,
+		Defaults: ScalerDefaults{
+			MinCpu:                       resource.MustParse("400m"),
+			MaxCpu:                       resource.MustParse("35"),
+			MinCpuStep:                   resource.MustParse("10m"),
+			MaxCpuStep:                   resource.MustParse("35"),
+			MinMemory:                    resource.MustParse("1G"),
+			MaxMemory:                    resource.MustParse("150G"),
+			MinMemoryStep:                resource.MustParse("10M"),
+			MaxMemoryStep:                resource.MustParse("150G"),
+			ScaleDownStabilizationWindow: v13.Duration{Duration: time.Minute},
+		},
+		Ceilings: ScalerCeilings{
+			MaxCpu:         resource.MustParse("35"),
+			MaxMemory:      resource.MustParse("150G"),
+			MaxCpuLimit:    resource.MustParse("350"),
+			MaxMemoryLimit: resource.MustParse("150G"),
+		},
+		Debounce:            v13.Duration{Duration: 5 * time.Second},
+		StaleEventAge:       v13.Duration{Duration: time.Minute},
+		ResyncPeriod:        v13.Duration{Duration: 10 * time.Minute},
+		MetricsAddr:         ":8080",
+		EventReasons:        []string{"FailedCreate", "PresentError"},
+		UsageSampleInterval: v13.Duration{Duration: 10 * time.Minute},
+		PodAdmissionBudget:  v13.Duration{Duration: 3 * time.Second},
+	}
+}
+
+var clusterConfig atomic.Value
+
+func init() {
+	UseClusterConfig(DefaultClusterConfig())
+}
+
+// CurrentClusterConfig returns the configuration in use. It must not be modified.
+func CurrentClusterConfig() *ClusterConfig {
+	return clusterConfig.Load().(*ClusterConfig)
+}
+
+// UseClusterConfig replaces the configuration in use, calculations that are running keep the previous configuration.
+func UseClusterConfig(config *ClusterConfig) {
+	clusterConfig.Store(config)
+}
+
+// LoadClusterConfig reads and validates a YAML or JSON configuration file. Unknown fields are rejected, missing fields
+// keep their defaults.
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseClusterConfig(content)
+}
+
+// ParseClusterConfig parses and validates a YAML or JSON configuration, see LoadClusterConfig.
+func ParseClusterConfig(content []byte) (*ClusterConfig, error) {
+	config := DefaultClusterConfig()
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %v", err)
+	}
+	return config, nil
+}
+
+// Validate returns an error for an unknown version, minimums above their maximum, default maximums above their
+// ceiling, ceilings above their limit ceiling, durations that are not positive, a podAdmissionBudget above 30s and a prometheusURL that is not an http(s)
+// URL.
+func (config *ClusterConfig) Validate() error {
+	if config.APIVersion != ClusterConfigAPIVersion || config.Kind != ClusterConfigKind {
+		return fmt.Errorf("expected apiVersion %s and kind %s but got: %s %s", ClusterConfigAPIVersion, ClusterConfigKind, config.APIVersion, config.Kind)
+	}
+
+	defaults, ceilings := config.Defaults, config.Ceilings
+	for _, bounds := range []struct {
+		name     string
+		min, max resource.Quantity
+	}{
+		{"defaults.minCpu", defaults.MinCpu, defaults.MaxCpu},
+		{"defaults.minCpuStep", defaults.MinCpuStep, defaults.MaxCpuStep},
+		{"defaults.minMemory", defaults.MinMemory, defaults.MaxMemory},
+		{"defaults.minMemoryStep", defaults.MinMemoryStep, defaults.MaxMemoryStep},
+		{"defaults.maxCpu", defaults.MaxCpu, ceilings.MaxCpu},
+		{"defaults.maxMemory", defaults.MaxMemory, ceilings.MaxMemory},
+		{"ceilings.maxCpu", ceilings.MaxCpu, ceilings.MaxCpuLimit},
+		{"ceilings.maxMemory", ceilings.MaxMemory, ceilings.MaxMemoryLimit},
+	} {
+		if bounds.min.Sign() < 0 {
+			return fmt.Errorf("%s must not be negative", bounds.name)
+		}
+		if bounds.min.Cmp(bounds.max) > 0 {
+			return fmt.Errorf("%s %s must not be greater than %s", bounds.name, bounds.min.String(), bounds.max.String())
+		}
+	}
+
+	for _, duration := range []struct {
+		name  string
+		value v13.Duration
+	}{
+		{"debounce", config.Debounce}, {"staleEventAge", config.StaleEventAge}, {"resyncPeriod", config.ResyncPeriod},
+		{"usageSampleInterval", config.UsageSampleInterval}, {"podAdmissionBudget", config.PodAdmissionBudget},
+	} {
+		if duration.value.Duration <= 0 {
+			return fmt.Errorf("%s must be positive", duration.name)
+		}
+	}
+	if defaults.ScaleDownStabilizationWindow.Duration < 0 {
+		return fmt.Errorf("defaults.scaleDownStabilizationWindow must not be negative")
+	}
+	if config.PodAdmissionBudget.Duration > maxPodAdmissionBudget {
+		return fmt.Errorf("podAdmissionBudget must not be above %s, the highest timeout of an admission webhook", maxPodAdmissionBudget)
+	}
+	if config.MetricsAddr == "" {
+		return fmt.Errorf("metricsAddr must be set")
+	}
+	if len(config.EventReasons) == 0 {
+		return fmt.Errorf("eventReasons must not be empty")
+	}
+	if config.PrometheusURL != "" {
+		if u, err := url.Parse(config.PrometheusURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("prometheusURL %s must be an http or https URL", config.PrometheusURL)
+		}
+	}
+	return nil
+}
+
+// requiresRestart returns the changed settings that only take effect after a restart.
+func (config *ClusterConfig) requiresRestart(previous *ClusterConfig) []string {
+	var changed []string
+	if config.ResyncPeriod != previous.ResyncPeriod {
+		changed = append(changed, "resyncPeriod")
+	}
+	if config.MetricsAddr != previous.MetricsAddr {
+		changed = append(changed, "metricsAddr")
+	}
+	if fmt.Sprint(config.EventReasons) != fmt.Sprint(previous.EventReasons) {
+		changed = append(changed, "eventReasons")
+	}
+	return changed
+}
+
+// WatchClusterConfig reloads the configuration file when it changes, until stopCh is closed. An invalid file is
+// logged and the configuration in use is kept.
+func WatchClusterConfig(path string, interval time.Duration, stopCh <-chan struct{}) {
+	previous, _ := ioutil.ReadFile(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil || bytes.Equal(content, previous) {
+			continue
+		}
+		previous = content
+
+		config, err := ParseClusterConfig(content)
+		if err != nil {
+			logging.LogError("Keeping the cluster config, %v", err)
+			continue
+		}
+		if changed := config.requiresRestart(CurrentClusterConfig()); len(changed) > 0 {
+			logging.LogWarning("Cluster config changes of %v take effect after a restart", changed)
+		}
+		UseClusterConfig(config)
+		logging.LogInfo("Reloaded the cluster config %s", path)
+	}
+}
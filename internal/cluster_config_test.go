@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+)
+
+func TestParseClusterConfig(t *testing.T) {
+	config, err := ParseClusterConfig([]byte(`
+apiVersion: quotascaler.ichp.ing.net/v1
+kind: ClusterConfig
+defaults:
+  minCpu: 1
+  scaleDownStabilizationWindow: 5m
+ceilings:
+  maxCpu: 100
+debounce: 10s
+eventReasons: [FailedCreate]
+`))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if minCpu := config.Defaults.MinCpu.MilliValue(); minCpu != 1000 {
+		t.Errorf("expected minCpu 1000m but got: %dm\n", minCpu)
+	}
+	if config.Defaults.MaxCpu.String() != "35" || config.MetricsAddr != ":8080" {
+		t.Errorf("expected missing fields to keep their defaults but got: %s %s\n", config.Defaults.MaxCpu.String(), config.MetricsAddr)
+	}
+	if config.Debounce.Duration != 10*time.Second || len(config.EventReasons) != 1 {
+		t.Errorf("expected debounce 10s and 1 event reason but got: %s %v\n", config.Debounce.Duration, config.EventReasons)
+	}
+
+	for content, expected := range map[string]string{
+		"apiVersion: quotascaler.ichp.ing.net/v2\nkind: ClusterConfig":                              "expected apiVersion",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\nmaxCpu: 10":                  "unknown field",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\ndefaults: {minCpu: 1 core}":  "quantities must match",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\ndefaults: {minMemory: 200G}": "defaults.minMemory 200G must not be greater than 150G",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\ndefaults: {maxCpu: 50}":      "defaults.maxCpu 50 must not be greater than 35",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\nceilings: {maxCpuLimit: 20}": "ceilings.maxCpu 35 must not be greater than 20",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\ndebounce: 0s":                "debounce must be positive",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\nusageSampleInterval: 0s":     "usageSampleInterval must be positive",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\neventReasons: []":            "eventReasons must not be empty",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\nprometheusURL: prometheus":   "prometheusURL prometheus must be an http or https URL",
+		"apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\npodAdmissionBudget: 1m":      "podAdmissionBudget must not be above 30s",
+	} {
+		if _, err := ParseClusterConfig([]byte(content)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %s but got: %v\n", expected, err)
+		}
+	}
+}
+
+func TestWatchClusterConfig(t *testing.T) {
+	defer UseClusterConfig(DefaultClusterConfig())
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	_ = ioutil.WriteFile(path, []byte("apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\n"), 0644)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go WatchClusterConfig(path, 10*time.Millisecond, stopCh)
+
+	// An invalid file keeps the configuration in use
+	_ = ioutil.WriteFile(path, []byte("apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\ndefaults: {minCpu: 100}\n"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	if minCpu := ValidateQuotaScaler(&v1.QuotaAutoscaler{}).MinCpu; minCpu != 400 {
+		t.Errorf("expected the default minCpu 400m but got: %dm\n", minCpu)
+	}
+
+	_ = ioutil.WriteFile(path, []byte("apiVersion: quotascaler.ichp.ing.net/v1\nkind: ClusterConfig\ndefaults: {minCpu: 2}\n"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	if minCpu := ValidateQuotaScaler(&v1.QuotaAutoscaler{}).MinCpu; minCpu != 2000 {
+		t.Errorf("expected the reloaded minCpu 2000m but got: %dm\n", minCpu)
+	}
+}
@@ -0,0 +1,185 @@
+package internal
+
+// This file reads the actual CPU and memory consumption of the Pods of a namespace for the Metrics usageSource. The
+// ResourceQuota only knows what the Pods request, the consumption comes from the metrics.k8s.io API (metrics-server)
+// or, when the cluster config sets a prometheusURL, from a Prometheus compatible query endpoint using the cAdvisor
+// metrics.
+//
+// Example usage:
+//  source := internal.NewConsumptionSource(dynamicClient)
+//  pods, err := source.PodConsumption("example-dev") // e.g. web-6f7d-x2x4c: app=cpu=120m, memory=310M
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// PodMetricsResource is the resource of the PodMetrics of the metrics.k8s.io API.
+var PodMetricsResource = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+
+// PodConsumption is the consumption of the containers of a Pod, by container name.
+type PodConsumption map[string]resources.Resources
+
+// ConsumptionSource reads the consumption of the Pods of a namespace, by Pod name.
+type ConsumptionSource interface {
+	PodConsumption(namespace string) (map[string]PodConsumption, error)
+}
+
+// NewConsumptionSource returns a ConsumptionSource that reads from Prometheus when the cluster config sets a
+// prometheusURL, and from the metrics.k8s.io API otherwise.
+func NewConsumptionSource(client dynamic.Interface) ConsumptionSource {
+	return &configuredConsumptionSource{metricsAPI: &MetricsAPISource{Client: client}, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type configuredConsumptionSource struct {
+	metricsAPI *MetricsAPISource
+	http       *http.Client
+}
+
+func (source *configuredConsumptionSource) PodConsumption(namespace string) (map[string]PodConsumption, error) {
+	if prometheusURL := CurrentClusterConfig().PrometheusURL; prometheusURL != "" {
+		return (&PrometheusSource{URL: prometheusURL, Client: source.http}).PodConsumption(namespace)
+	}
+	return source.metricsAPI.PodConsumption(namespace)
+}
+
+// MetricsAPISource reads the PodMetrics of the metrics.k8s.io API with the dynamic client.
+type MetricsAPISource struct {
+	Client dynamic.Interface
+}
+
+// podMetrics is the part of a PodMetrics that is used
+type podMetrics struct {
+	Metadata   v13.ObjectMeta `json:"metadata"`
+	Containers []struct {
+		Name  string           `json:"name"`
+		Usage v12.ResourceList `json:"usage"`
+	} `json:"containers"`
+}
+
+func (source *MetricsAPISource) PodConsumption(namespace string) (map[string]PodConsumption, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	list, err := source.Client.Resource(PodMetricsResource).Namespace(namespace).List(ctx, v13.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	pods := map[string]PodConsumption{}
+	for _, item := range list.Items {
+		raw, err := json.Marshal(item.Object)
+		if err != nil {
+			return nil, err
+		}
+		metrics := podMetrics{}
+		if err := json.Unmarshal(raw, &metrics); err != nil {
+			return nil, fmt.Errorf("invalid PodMetrics %s: %v", item.GetName(), err)
+		}
+
+		pod := PodConsumption{}
+		for _, container := range metrics.Containers {
+			pod[container.Name] = resources.Resources(container.Usage).Only(v12.ResourceCPU, v12.ResourceMemory)
+		}
+		pods[metrics.Metadata.Name] = pod
+	}
+	return pods, nil
+}
+
+// PrometheusSource queries the cAdvisor metrics of a Prometheus compatible query endpoint, e.g. Prometheus, Thanos
+// or VictoriaMetrics. CPU is the rate over 5 minutes, memory the working set.
+type PrometheusSource struct {
+	URL    string
+	Client *http.Client
+}
+
+const (
+	prometheusCpuQuery    = `sum by (pod, container) (rate(container_cpu_usage_seconds_total{namespace=%q, container!="", container!="POD"}[5m]))`
+	prometheusMemoryQuery = `sum by (pod, container) (container_memory_working_set_bytes{namespace=%q, container!="", container!="POD"})`
+)
+
+// prometheusResponse is the response of an instant query that returns a vector
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		Result []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"` // Timestamp and value
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func (source *PrometheusSource) PodConsumption(namespace string) (map[string]PodConsumption, error) {
+	pods := map[string]PodConsumption{}
+	for _, query := range []struct {
+		name   v12.ResourceName
+		query  string
+		format func(float64) *resource.Quantity
+	}{
+		{v12.ResourceCPU, prometheusCpuQuery, func(cores float64) *resource.Quantity {
+			return resource.NewMilliQuantity(int64(cores*1000+0.5), resource.DecimalSI)
+		}},
+		{v12.ResourceMemory, prometheusMemoryQuery, func(bytes float64) *resource.Quantity {
+			return resource.NewQuantity(int64(bytes), resource.BinarySI)
+		}},
+	} {
+		response, err := source.query(fmt.Sprintf(query.query, namespace))
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range response.Data.Result {
+			pod, container := sample.Metric["pod"], sample.Metric["container"]
+			if pod == "" || container == "" || len(sample.Value) != 2 {
+				continue
+			}
+			text, _ := sample.Value[1].(string)
+			value, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sample %q of %s/%s: %v", text, pod, container, err)
+			}
+
+			if pods[pod] == nil {
+				pods[pod] = PodConsumption{}
+			}
+			if pods[pod][container] == nil {
+				pods[pod][container] = resources.Resources{}
+			}
+			pods[pod][container][query.name] = *query.format(value)
+		}
+	}
+	return pods, nil
+}
+
+func (source *PrometheusSource) query(query string) (*prometheusResponse, error) {
+	client := source.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	reply, err := client.Get(strings.TrimSuffix(source.URL, "/") + "/api/v1/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		return nil, err
+	}
+	defer reply.Body.Close()
+
+	response := &prometheusResponse{}
+	if err := json.NewDecoder(reply.Body).Decode(response); err != nil {
+		return nil, fmt.Errorf("invalid Prometheus response (%s): %v", reply.Status, err)
+	}
+	if response.Status != "success" {
+		return nil, fmt.Errorf("Prometheus query failed (%s): %s", reply.Status, response.Error)
+	}
+	return response, nil
+}
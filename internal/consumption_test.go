@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newTestPodMetrics(namespace, name string, containers ...map[string]interface{}) *unstructured.Unstructured {
+	items := make([]interface{}, len(containers))
+	for i, container := range containers {
+		items[i] = container
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "metrics.k8s.io/v1beta1",
+		"kind":       "PodMetrics",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+		"containers": items,
+	}}
+}
+
+func TestMetricsAPISource(t *testing.T) {
+	// Created through the client, the fake would guess podmetricses as resource of the kind
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	for _, metrics := range []*unstructured.Unstructured{
+		newTestPodMetrics("example-dev", "web-6f7d-x2x4c",
+			map[string]interface{}{"name": "app", "usage": map[string]interface{}{"cpu": "120m", "memory": "300Mi"}},
+			map[string]interface{}{"name": "proxy", "usage": map[string]interface{}{"cpu": "15334n", "memory": "20Mi"}}),
+		newTestPodMetrics("other-dev", "batch-1", map[string]interface{}{"name": "job", "usage": map[string]interface{}{"cpu": "1", "memory": "1Gi"}}),
+	} {
+		if _, err := client.Resource(PodMetricsResource).Namespace(metrics.GetNamespace()).Create(context.TODO(), metrics, v13.CreateOptions{}); err != nil {
+			t.Fatalf("expected no error but got: %v\n", err)
+		}
+	}
+
+	pods, err := (&MetricsAPISource{Client: client}).PodConsumption("example-dev")
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(pods) != 1 || len(pods["web-6f7d-x2x4c"]) != 2 {
+		t.Fatalf("expected the 2 containers of a single Pod but got: %v\n", pods)
+	}
+	if app := pods["web-6f7d-x2x4c"]["app"]; app.Cpu() != 120 || app.Memory() != 315 {
+		t.Errorf("expected app to consume cpu=120m, memory=315M but got: %v\n", app)
+	}
+}
+
+func TestPrometheusSource(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		value := "0.1204"
+		if len(queries) == 2 {
+			value = "314572800"
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"pod":"web-6f7d-x2x4c","container":"app"},"value":[1709546400,%q]}]}}`, value)
+	}))
+	defer server.Close()
+
+	pods, err := (&PrometheusSource{URL: server.URL + "/"}).PodConsumption("example-dev")
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if app := pods["web-6f7d-x2x4c"]["app"]; app.Cpu() != 120 || app.Memory() != 315 {
+		t.Errorf("expected app to consume cpu=120m, memory=315M but got: %v\n", app)
+	}
+	if len(queries) != 2 || queries[0] != `sum by (pod, container) (rate(container_cpu_usage_seconds_total{namespace="example-dev", container!="", container!="POD"}[5m]))` {
+		t.Errorf("expected a CPU and a memory query but got: %v\n", queries)
+	}
+
+	// Errors of the query API are returned
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+	}))
+	defer failing.Close()
+	if _, err := (&PrometheusSource{URL: failing.URL}).PodConsumption("example-dev"); err == nil {
+		t.Errorf("expected an error for a failed query\n")
+	}
+}
@@ -0,0 +1,112 @@
+package internal
+
+// Only one quota-scaler replica may calculate namespaces and call the resize API, otherwise two replicas (e.g. during
+// a rolling update) resize the same namespace concurrently. Replicas elect a leader using a coordination.k8s.io Lease.
+// Followers keep their informer caches warm, so they can take over within LeaseDuration when the leader goes away,
+// or immediately when the leader shuts down gracefully and releases the Lease. The Pod of the leader is labelled with
+// LeaderLabel, the Service of the Pod admission webhook only selects the leader.
+//
+// Example usage:
+//  election := internal.NewLeaderElection(namespace, hostname)
+//  internal.RunAsLeader(ctx, client, election, func(stopCh <-chan struct{}) {
+//    watcher.Run(4, stopCh)
+//  })
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// LeaseName is the name of the Lease that is held by the leader
+	LeaseName = "quota-scaler-leader"
+
+	// Defaults of the Kubernetes controllers
+	LeaseDuration = 15 * time.Second
+	RenewDeadline = 10 * time.Second
+	RetryPeriod   = 2 * time.Second
+
+	// LeaderLabel is "true" on the Pod of the leader and "false" on the Pods of the followers
+	LeaderLabel = "quota-scaler.ing.net/leader"
+)
+
+// LeaderElection configures the Lease based leader election.
+type LeaderElection struct {
+	Namespace string // Namespace of the Lease
+	Name      string // Name of the Lease
+	Identity  string // Unique identity of this replica, e.g. the Pod name
+
+	LeaseDuration time.Duration // How long followers wait before taking over a Lease that is not renewed
+	RenewDeadline time.Duration // How long the leader retries renewing the Lease before it gives up leadership
+	RetryPeriod   time.Duration // Interval between attempts to acquire or renew the Lease
+}
+
+func NewLeaderElection(namespace, identity string) LeaderElection {
+	return LeaderElection{
+		Namespace:     namespace,
+		Name:          LeaseName,
+		Identity:      identity,
+		LeaseDuration: LeaseDuration,
+		RenewDeadline: RenewDeadline,
+		RetryPeriod:   RetryPeriod,
+	}
+}
+
+// RunAsLeader blocks until this replica is elected and then calls lead. The stopCh passed to lead is closed when
+// leadership is lost. RunAsLeader returns when ctx is done or leadership is lost. The Lease is released when ctx is
+// done, so another replica can take over immediately.
+func RunAsLeader(ctx context.Context, client kubernetes.Interface, election LeaderElection, lead func(stopCh <-chan struct{})) error {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  v13.ObjectMeta{Namespace: election.Namespace, Name: election.Name},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: election.Identity},
+		},
+		LeaseDuration:   election.LeaseDuration,
+		RenewDeadline:   election.RenewDeadline,
+		RetryPeriod:     election.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            election.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logging.LogInfo("[%s] Started leading", election.Identity)
+				leaderGauge.Set(1)
+				lead(ctx.Done())
+			},
+			OnStoppedLeading: func() {
+				logging.LogInfo("[%s] Stopped leading", election.Identity)
+				leaderGauge.Set(0)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != election.Identity {
+					logging.LogInfo("[%s] Following leader %s", election.Identity, identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	elector.Run(ctx)
+	return nil
+}
+
+// LabelLeader sets the LeaderLabel of the Pod of this replica. A replica that lost leadership restarts in the same
+// Pod, so every replica sets it to false when it starts.
+func LabelLeader(client kubernetes.Interface, namespace, pod string, leader bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, LeaderLabel, strconv.FormatBool(leader))
+	_, err := client.CoreV1().Pods(namespace).Patch(ctx, pod, types.MergePatchType, []byte(patch), v13.PatchOptions{})
+	return err
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestLeaderElection(identity string) LeaderElection {
+	election := NewLeaderElection("ichp-quota-scaler", identity)
+	election.LeaseDuration = time.Second
+	election.RenewDeadline = 500 * time.Millisecond
+	election.RetryPeriod = 100 * time.Millisecond
+	return election
+}
+
+// eventually waits until the condition is true, or returns false after the timeout.
+func eventually(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestRunAsLeaderFailover(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	var leading, followerLed int32
+
+	leaderCtx, stopLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		_ = RunAsLeader(leaderCtx, client, newTestLeaderElection("scaler-a"), func(stopCh <-chan struct{}) {
+			atomic.AddInt32(&leading, 1)
+			<-stopCh
+			atomic.AddInt32(&leading, -1)
+		})
+	}()
+
+	if !eventually(func() bool { return atomic.LoadInt32(&leading) == 1 }, 2*time.Second) {
+		t.Fatalf("expected 1 leader but got: %d\n", atomic.LoadInt32(&leading))
+	}
+
+	followerCtx, stopFollower := context.WithCancel(context.Background())
+	defer stopFollower()
+	go func() {
+		_ = RunAsLeader(followerCtx, client, newTestLeaderElection("scaler-b"), func(stopCh <-chan struct{}) {
+			atomic.StoreInt32(&followerLed, 1)
+			<-stopCh
+		})
+	}()
+
+	// The follower does not lead while the Lease is renewed
+	time.Sleep(1500 * time.Millisecond)
+	if led := atomic.LoadInt32(&followerLed); led != 0 {
+		t.Errorf("expected the follower not to lead but got: %d\n", led)
+	}
+
+	// The leader releases the Lease on shutdown and the follower takes over before the Lease would expire
+	stopLeader()
+	<-leaderDone
+	if !eventually(func() bool { return atomic.LoadInt32(&leading) == 0 }, 100*time.Millisecond) {
+		t.Errorf("expected the leader to stop leading but got: %d\n", atomic.LoadInt32(&leading))
+	}
+	if !eventually(func() bool { return atomic.LoadInt32(&followerLed) == 1 }, 500*time.Millisecond) {
+		t.Errorf("expected the follower to take over but got: %d\n", atomic.LoadInt32(&followerLed))
+	}
+}
+
+func TestLabelLeader(t *testing.T) {
+	client := fake.NewSimpleClientset(&v12.Pod{ObjectMeta: v13.ObjectMeta{Name: "scaler-a", Namespace: "ichp-quota-scaler", Labels: map[string]string{"app": "quota-scaler"}}})
+	for _, leader := range []bool{true, false} {
+		if err := LabelLeader(client, "ichp-quota-scaler", "scaler-a", leader); err != nil {
+			t.Fatalf("expected no error but got: %v\n", err)
+		}
+		pod, _ := client.CoreV1().Pods("ichp-quota-scaler").Get(context.TODO(), "scaler-a", v13.GetOptions{})
+		if pod.Labels[LeaderLabel] != strconv.FormatBool(leader) || pod.Labels["app"] != "quota-scaler" {
+			t.Errorf("expected the leader label %t next to the other labels but got: %v\n", leader, pod.Labels)
+		}
+	}
+}
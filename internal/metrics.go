@@ -0,0 +1,223 @@
+package internal
+
+// This file contains the Prometheus metrics of the quota-scaler, which are served on /metrics. Per namespace gauges
+// describe the ResourceQuota and the scaling decision of the last calculation, they are removed when the
+// QuotaAutoscaler of the namespace is deleted. CPU is exported in cores, memory in bytes and other resources in their
+// unit, e.g. bytes for requests.storage.
+//
+// Example alerts:
+//  rate(quota_scaler_resize_failures_total[5m]) > 0
+//  histogram_quantile(0.99, rate(quota_scaler_resize_duration_seconds_bucket[5m])) > 10
+//  quota_scaler_resize_results_dropped_total > 0
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const metricsNamespace = "quota_scaler"
+
+var (
+	quotaHardGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_hard",
+		Help:      "Hard limit of the ResourceQuota targeted by a QuotaAutoscaler, CPU in cores and memory in bytes.",
+	}, []string{"namespace", "resource"})
+	quotaUsedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_used",
+		Help:      "Used resources of the ResourceQuota targeted by a QuotaAutoscaler, CPU in cores and memory in bytes.",
+	}, []string{"namespace", "resource"})
+	quotaDesiredGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "quota_desired",
+		Help:      "Desired ResourceQuota of the last calculation, CPU in cores and memory in bytes.",
+	}, []string{"namespace", "resource"})
+	usagePercentageGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "usage_percentage",
+		Help:      "Usage percentage of the ResourceQuota as seen by the scaling policies.",
+	}, []string{"namespace", "resource"})
+	predictedUsageGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "predicted_usage",
+		Help:      "Highest usage forecast within the prediction horizon, CPU in cores and memory in bytes.",
+	}, []string{"namespace", "resource"})
+	consumedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "consumed",
+		Help:      "CPU and memory consumed by the Pods of a namespace with the Metrics usageSource, CPU in cores and memory in bytes.",
+	}, []string{"namespace", "resource"})
+	replicaHeadroomGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "replica_headroom",
+		Help:      "Room kept in the quota for the autoscaled workloads to reach their desired or max replicas, CPU in cores and memory in bytes.",
+	}, []string{"namespace", "resource"})
+
+	resizeCallsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_calls_total",
+		Help:      "Number of calls to the resize API.",
+	})
+	resizeFailuresCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_failures_total",
+		Help:      "Number of failed calls to the resize API.",
+	})
+	resizeDurationHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_duration_seconds",
+		Help:      "Duration of calls to the resize API.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"result"})
+	resizesPendingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "resizes_pending",
+		Help:      "Number of namespaces with a resize that waits for a previous resize of the namespace to finish.",
+	})
+	resizesInProgressGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "resizes_in_progress",
+		Help:      "Number of namespaces that the resize API is currently resizing.",
+	})
+	resizeResultsDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "resize_results_dropped_total",
+		Help:      "Number of resize results that were dropped because ResizeResultChan was full.",
+	})
+
+	wouldResizeGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "would_resize",
+		Help:      "1 when the last calculation of a QuotaAutoscaler in dry run would have resized the ResourceQuota, 0 otherwise.",
+	}, []string{"namespace"})
+	wouldResizesCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "would_resizes_total",
+		Help:      "Number of resizes that were not requested because of the dry run.",
+	})
+
+	podEventsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pod_events_processed_total",
+		Help:      "Number of Pod creation failure Events processed per reason and kind of the involved object, also when an earlier Event of the same object was processed.",
+	}, []string{"reason", "kind"})
+
+	podAdmissionCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pod_admission_total",
+		Help:      "Number of Pods created by result of the pod admission webhook: fits, resized, skipped or failed.",
+	}, []string{"result"})
+
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "1 when this replica is the elected leader, 0 otherwise.",
+	})
+)
+
+// scaledResourcesLock guards scaledResources, the resources of which gauges are exported per namespace
+var scaledResourcesLock sync.Mutex
+var scaledResources = map[string]map[v12.ResourceName]bool{}
+
+// recordQuotaMetrics exports the hard and used resources of the ResourceQuota that are scaled.
+func recordQuotaMetrics(quota *v12.ResourceQuota, names []v12.ResourceName) {
+	scaledResourcesLock.Lock()
+	defer scaledResourcesLock.Unlock()
+	if scaledResources[quota.Namespace] == nil {
+		scaledResources[quota.Namespace] = map[v12.ResourceName]bool{}
+	}
+
+	for _, name := range names {
+		hard, used := quota.Spec.Hard[name], quota.Status.Used[name]
+		if name == v12.ResourceMemory {
+			used = *ResourceQuotaUsedMemoryLimit(quota)
+		}
+		quotaHardGauge.WithLabelValues(quota.Namespace, string(name)).Set(units(&hard))
+		quotaUsedGauge.WithLabelValues(quota.Namespace, string(name)).Set(units(&used))
+		scaledResources[quota.Namespace][name] = true
+	}
+}
+
+// units returns the quantity in cores for CPU and in its unit for other resources.
+func units(quantity *resource.Quantity) float64 {
+	return float64(quantity.MilliValue()) / 1e3
+}
+
+// recordDesiredMetrics exports the outcome of a calculation.
+func recordDesiredMetrics(namespace string, desired resources.Resources, cpuUsage, memoryUsage int64) {
+	for name, quantity := range desired {
+		quotaDesiredGauge.WithLabelValues(namespace, string(name)).Set(units(&quantity))
+	}
+	usagePercentageGauge.WithLabelValues(namespace, "cpu").Set(float64(cpuUsage))
+	usagePercentageGauge.WithLabelValues(namespace, "memory").Set(float64(memoryUsage))
+}
+
+// recordPredictionMetrics exports the predicted usage, resources without a prediction are removed.
+func recordPredictionMetrics(namespace string, predicted resources.Resources) {
+	recordComputeMetrics(predictedUsageGauge, namespace, predicted)
+}
+
+// recordConsumptionMetrics exports the consumption of the Pods, nil removes it.
+func recordConsumptionMetrics(namespace string, consumed resources.Resources) {
+	recordComputeMetrics(consumedGauge, namespace, consumed)
+}
+
+// recordComputeMetrics sets the CPU and memory gauges of the namespace, missing resources are removed.
+func recordComputeMetrics(gauge *prometheus.GaugeVec, namespace string, values resources.Resources) {
+	for _, name := range []v12.ResourceName{v12.ResourceCPU, v12.ResourceMemory} {
+		if quantity, ok := values[name]; ok {
+			gauge.WithLabelValues(namespace, string(name)).Set(units(&quantity))
+		} else {
+			gauge.DeleteLabelValues(namespace, string(name))
+		}
+	}
+}
+
+// recordDryRunMetrics exports whether a calculation in dry run would have resized the ResourceQuota.
+func recordDryRunMetrics(namespace string, dryRun, wouldResize bool) {
+	if !dryRun {
+		wouldResizeGauge.DeleteLabelValues(namespace)
+	} else if wouldResize {
+		wouldResizesCounter.Inc()
+		wouldResizeGauge.WithLabelValues(namespace).Set(1)
+	} else {
+		wouldResizeGauge.WithLabelValues(namespace).Set(0)
+	}
+}
+
+// forgetNamespaceMetrics removes the per namespace gauges, e.g. when the QuotaAutoscaler was deleted.
+func forgetNamespaceMetrics(namespace string) {
+	scaledResourcesLock.Lock()
+	defer scaledResourcesLock.Unlock()
+
+	names := []string{"cpu", "memory"}
+	for name := range scaledResources[namespace] {
+		names = append(names, string(name))
+	}
+	delete(scaledResources, namespace)
+	wouldResizeGauge.DeleteLabelValues(namespace)
+
+	for _, gauge := range []*prometheus.GaugeVec{quotaHardGauge, quotaUsedGauge, quotaDesiredGauge, usagePercentageGauge, predictedUsageGauge, consumedGauge, replicaHeadroomGauge} {
+		for _, name := range names {
+			gauge.DeleteLabelValues(namespace, name)
+		}
+	}
+}
+
+// observeResize records a call to the resize API that started at start.
+func observeResize(start time.Time, err error) {
+	result := "success"
+	resizeCallsCounter.Inc()
+	if err != nil {
+		result = "failure"
+		resizeFailuresCounter.Inc()
+	}
+	resizeDurationHistogram.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNamespaceMetrics(t *testing.T) {
+	startEventHandler()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	watcher, _, ichpClient := newTestWatcher(t, stopCh,
+		[]*v14.QuotaAutoscaler{newTestScaler("metrics-dev")},
+		[]*v12.ResourceQuota{newTestNamespaceQuota("metrics-dev", "100m")},
+	)
+	if err := watcher.UpdateNs("metrics-dev"); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	if hard := testutil.ToFloat64(quotaHardGauge.WithLabelValues("metrics-dev", "cpu")); hard != 1 {
+		t.Errorf("expected hard CPU of 1 core but got: %f\n", hard)
+	}
+	if used := testutil.ToFloat64(quotaUsedGauge.WithLabelValues("metrics-dev", "memory")); used != 500e6 {
+		t.Errorf("expected used memory of 500e6 bytes but got: %f\n", used)
+	}
+	if desired := testutil.ToFloat64(quotaDesiredGauge.WithLabelValues("metrics-dev", "cpu")); desired <= 0 {
+		t.Errorf("expected a desired CPU but got: %f\n", desired)
+	}
+	if usage := testutil.ToFloat64(usagePercentageGauge.WithLabelValues("metrics-dev", "memory")); usage != 50 {
+		t.Errorf("expected memory usage of 50%% but got: %f\n", usage)
+	}
+
+	// The gauges of a namespace are removed with its QuotaAutoscaler
+	_ = ichpClient.IchpV1().QuotaAutoscalers("metrics-dev").Delete(context.TODO(), "metrics-dev-scaler", v13.DeleteOptions{})
+	deadline := time.Now().Add(time.Second)
+	for scaler, _ := watcher.GetScaler("metrics-dev"); scaler != nil && time.Now().Before(deadline); scaler, _ = watcher.GetScaler("metrics-dev") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := watcher.UpdateNs("metrics-dev"); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if quotaHardGauge.DeleteLabelValues("metrics-dev", "cpu") {
+		t.Errorf("expected the namespace gauges to be removed\n")
+	}
+}
+
+func TestObserveResize(t *testing.T) {
+	calls, failures := testutil.ToFloat64(resizeCallsCounter), testutil.ToFloat64(resizeFailuresCounter)
+
+	observeResize(time.Now(), nil)
+	observeResize(time.Now(), errors.New("resize API status NOK"))
+
+	if increase := testutil.ToFloat64(resizeCallsCounter) - calls; increase != 2 {
+		t.Errorf("expected 2 resize calls but got: %f\n", increase)
+	}
+	if increase := testutil.ToFloat64(resizeFailuresCounter) - failures; increase != 1 {
+		t.Errorf("expected 1 resize failure but got: %f\n", increase)
+	}
+}
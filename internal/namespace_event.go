@@ -9,15 +9,25 @@ import (
 	"time"
 )
 
-func PublishNamespaceEvent(client *kubernetes.Clientset, ref v1.ObjectReference, ev ResizeResult) error {
-	msg := fmt.Sprintf("Namespace ResourceQuota resized from CPU: %dm Memory: %dM to CPU: %dm Memory: %dM", ev.Old.Cpu, ev.Old.Memory, ev.New.Cpu, ev.New.Memory)
+func PublishNamespaceEvent(client kubernetes.Interface, ref v1.ObjectReference, ev ResizeResult) error {
+	msg := fmt.Sprintf("Namespace ResourceQuota resized from %s to %s", ev.Old, ev.New)
 	evType := "Normal"
 
 	if ev.Err != nil {
-		msg = fmt.Sprintf("Failed to resize ResourceQuota from CPU: %dm Memory: %dM to CPU: %dm Memory: %dM: %s", ev.Old.Cpu, ev.Old.Memory, ev.New.Cpu, ev.New.Memory, ev.Err.Error())
+		msg = fmt.Sprintf("Failed to resize ResourceQuota from %s to %s: %s", ev.Old, ev.New, ev.Err.Error())
 		evType = "Warning"
 	}
 
+	return publishEvent(client, ref, "QuotaResize", evType, msg)
+}
+
+// PublishWouldResizeEvent reports the resize that a QuotaAutoscaler in dry run would have requested.
+func PublishWouldResizeEvent(client kubernetes.Interface, ref v1.ObjectReference, ev NamespaceResizeEvent) error {
+	msg := fmt.Sprintf("Dry run, would resize ResourceQuota from %s to %s", ev.Old, ev.New)
+	return publishEvent(client, ref, WouldResizeReason, "Normal", msg)
+}
+
+func publishEvent(client kubernetes.Interface, ref v1.ObjectReference, reason, evType, msg string) error {
 	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
 	defer cancel()
 	_, err := client.CoreV1().Events(ref.Namespace).Create(ctx, &v1.Event{
@@ -25,7 +35,7 @@ func PublishNamespaceEvent(client *kubernetes.Clientset, ref v1.ObjectReference,
 		FirstTimestamp:      v13.Now(),
 		LastTimestamp:       v13.Now(),
 		InvolvedObject:      ref,
-		Reason:              "QuotaResize",
+		Reason:              reason,
 		Message:             msg,
 		Type:                evType,
 		ReportingController: "ichp-quota-scaler/scaler",
@@ -0,0 +1,150 @@
+package internal
+
+// This file resolves the Pod template and missing replicas of Pod owners that are not built in, e.g. Argo Rollouts,
+// OpenKruise CloneSets or in-house CRDs. Any allowed kind with a `spec.template` works, the missing replicas are read
+// from its `/scale` subresource. Kinds without a scale subresource are assumed to miss a single Pod.
+//
+// Example usage:
+//  kinds, _ := internal.ParseOwnerKinds("CloneSet.v1alpha1.apps.kruise.io,Rollout.v1alpha1.argoproj.io")
+//  owners := internal.NewOwnerResolver(dynamicClient, client.Discovery(), kinds)
+//  spec, missingReplicas, err := owners.Resolve(ev.InvolvedObject)
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+)
+
+// OwnerResolver resolves Pod owners of the allowed GroupVersionKinds with the dynamic client.
+type OwnerResolver struct {
+	Client  dynamic.Interface
+	Mapper  meta.RESTMapper
+	Allowed map[schema.GroupVersionKind]bool
+}
+
+// NewOwnerResolver creates an OwnerResolver that maps kinds to resources using the (cached) discovery API.
+func NewOwnerResolver(client dynamic.Interface, discoveryClient discovery.DiscoveryInterface, allowed []schema.GroupVersionKind) *OwnerResolver {
+	resolver := &OwnerResolver{
+		Client:  client,
+		Mapper:  restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		Allowed: map[schema.GroupVersionKind]bool{},
+	}
+	for _, gvk := range allowed {
+		resolver.Allowed[gvk] = true
+	}
+	return resolver
+}
+
+// ParseOwnerKinds parses a comma separated list of kinds in the `Kind.version.group` format.
+func ParseOwnerKinds(kinds string) ([]schema.GroupVersionKind, error) {
+	var result []schema.GroupVersionKind
+	for _, kind := range strings.Split(kinds, ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+		gvk, _ := schema.ParseKindArg(kind)
+		if gvk == nil {
+			return nil, fmt.Errorf("owner kind %q is not in the Kind.version.group format", kind)
+		}
+		result = append(result, *gvk)
+	}
+	return result, nil
+}
+
+// Allows returns whether the owner is of an allowed kind.
+func (resolver *OwnerResolver) Allows(owner v12.ObjectReference) bool {
+	return resolver != nil && resolver.Allowed[schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind)]
+}
+
+// Resolve returns the Pod template of the owner and the number of replicas that it misses.
+func (resolver *OwnerResolver) Resolve(owner v12.ObjectReference) (v12.PodTemplateSpec, int32, error) {
+	pod, desired, current, err := resolver.ResolveReplicas(owner)
+	return pod, desired - current, err
+}
+
+// ResolveReplicas returns the Pod template of the owner and its desired and current replicas. Kinds without a scale
+// subresource desire a single replica and have none.
+func (resolver *OwnerResolver) ResolveReplicas(owner v12.ObjectReference) (v12.PodTemplateSpec, int32, int32, error) {
+	var pod v12.PodTemplateSpec
+	gvk := schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind)
+	if !resolver.Allows(owner) {
+		return pod, 0, 0, fmt.Errorf("owner kind %s is not allowed", gvk)
+	}
+
+	mapping, err := resolver.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		if deferred, ok := resolver.Mapper.(*restmapper.DeferredDiscoveryRESTMapper); ok && meta.IsNoMatchError(err) {
+			deferred.Reset() // The CRD may have been installed after the discovery was cached
+		}
+		return pod, 0, 0, err
+	}
+	client := resolver.Client.Resource(mapping.Resource).Namespace(owner.Namespace)
+
+	target, err := client.Get(context.TODO(), owner.Name, v13.GetOptions{})
+	if err != nil {
+		return pod, 0, 0, err
+	}
+	template, found, err := unstructured.NestedMap(target.Object, "spec", "template")
+	if err != nil || !found {
+		return pod, 0, 0, fmt.Errorf("%s %s has no spec.template", owner.Kind, owner.Name)
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(template, &pod); err != nil {
+		return pod, 0, 0, err
+	}
+	pod.Namespace = owner.Namespace
+
+	scale, err := client.Get(context.TODO(), owner.Name, v13.GetOptions{}, "scale")
+	if apierrors.IsNotFound(err) {
+		return pod, 1, 0, nil
+	} else if err != nil {
+		return pod, 0, 0, err
+	}
+	desired, _, _ := unstructured.NestedInt64(scale.Object, "spec", "replicas")
+	current, _, _ := unstructured.NestedInt64(scale.Object, "status", "replicas")
+	return pod, int32(desired), int32(current), nil
+}
+
+// RestartableInitContainers returns the names of the init containers in the Pod template of the owner that run as
+// sidecars (`restartPolicy: Always`). The typed API of this client predates the field, so the owner is read with the
+// dynamic client. Any kind with a `spec.template` works, the allowlist does not apply.
+func (resolver *OwnerResolver) RestartableInitContainers(owner v12.ObjectReference) map[string]bool {
+	if resolver == nil {
+		return nil
+	}
+	gvk := schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind)
+	mapping, err := resolver.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		logging.LogWarning("[%s] Cannot find sidecars of %s %s: %v", owner.Namespace, owner.Kind, owner.Name, err)
+		return nil
+	}
+	target, err := resolver.Client.Resource(mapping.Resource).Namespace(owner.Namespace).Get(context.TODO(), owner.Name, v13.GetOptions{})
+	if err != nil {
+		logging.LogWarning("[%s] Cannot find sidecars of %s %s: %v", owner.Namespace, owner.Kind, owner.Name, err)
+		return nil
+	}
+
+	initContainers, _, _ := unstructured.NestedSlice(target.Object, "spec", "template", "spec", "initContainers")
+	sidecars := map[string]bool{}
+	for _, container := range initContainers {
+		container, _ := container.(map[string]interface{})
+		if restartPolicy, _, _ := unstructured.NestedString(container, "restartPolicy"); restartPolicy == "Always" {
+			name, _, _ := unstructured.NestedString(container, "name")
+			sidecars[name] = true
+		}
+	}
+	return sidecars
+}
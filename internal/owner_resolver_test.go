@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"testing"
+
+	v15 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestOwner(apiVersion, kind, name string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"name": name, "namespace": "example-dev"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{
+						"name":      "app",
+						"resources": map[string]interface{}{"requests": map[string]interface{}{"cpu": "100m", "memory": "100M"}},
+					}},
+				},
+			},
+		},
+	}}
+}
+
+func newTestOwnerResolver(t *testing.T) *OwnerResolver {
+	kinds, err := ParseOwnerKinds("CloneSet.v1alpha1.apps.kruise.io, Widget.v1.example.com")
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newTestOwner("apps.kruise.io/v1alpha1", "CloneSet", "app"),
+		newTestOwner("example.com/v1", "Widget", "widget"),
+		newTestOwner("example.com/v1", "Gadget", "gadget"),
+	)
+	// The fake client does not implement subresources
+	client.PrependReactor("get", "clonesets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "autoscaling/v1",
+			"kind":       "Scale",
+			"spec":       map[string]interface{}{"replicas": int64(5)},
+			"status":     map[string]interface{}{"replicas": int64(2)},
+		}}, nil
+	})
+	client.PrependReactor("get", "widgets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewNotFound(schema.GroupResource{Group: "example.com", Resource: "widgets"}, "widget")
+	})
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range append(kinds, schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Gadget"}) {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+
+	resolver := NewOwnerResolver(client, nil, kinds)
+	resolver.Mapper = mapper
+	return resolver
+}
+
+func TestOwnerResolver(t *testing.T) {
+	owners := newTestOwnerResolver(t)
+	client := fake.NewSimpleClientset()
+	event := func(apiVersion, kind, name string) []v12.Event {
+		return []v12.Event{{InvolvedObject: v12.ObjectReference{APIVersion: apiVersion, Kind: kind, Name: name, Namespace: "example-dev"}}}
+	}
+
+	// The missing replicas are read from the scale subresource
+	sum, _ := GetResourcesFromPodEvents(client, owners, nil, event("apps.kruise.io/v1alpha1", "CloneSet", "app"))
+	if sum.Cpu() != 300 || sum.Memory() != 300 {
+		t.Errorf("expected 300m 300M for 3 missing replicas but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+
+	// Kinds without scale subresource miss a single Pod
+	sum, _ = GetResourcesFromPodEvents(client, owners, nil, event("example.com/v1", "Widget", "widget"))
+	if sum.Cpu() != 100 || sum.Memory() != 100 {
+		t.Errorf("expected 100m 100M for a single Pod but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+
+	// Kinds that are not allowed are ignored
+	sum, _ = GetResourcesFromPodEvents(client, owners, nil, event("example.com/v1", "Gadget", "gadget"))
+	if !sum.IsEmpty() {
+		t.Errorf("expected no resources for a kind that is not allowed but got: %+v\n", sum)
+	}
+}
+
+func TestParseOwnerKinds(t *testing.T) {
+	if _, err := ParseOwnerKinds("CloneSet"); err == nil {
+		t.Errorf("expected an error for a kind without version and group\n")
+	}
+	if kinds, err := ParseOwnerKinds(""); err != nil || len(kinds) != 0 {
+		t.Errorf("expected no kinds but got: %v %v\n", kinds, err)
+	}
+}
+
+func TestRestartableInitContainers(t *testing.T) {
+	replicaSet := newTestOwner("apps/v1", "ReplicaSet", "app")
+	_ = unstructured.SetNestedSlice(replicaSet.Object, []interface{}{
+		map[string]interface{}{"name": "migrate"},
+		map[string]interface{}{"name": "istio-proxy", "restartPolicy": "Always"},
+	}, "spec", "template", "spec", "initContainers")
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v15.SchemeGroupVersion.WithKind("ReplicaSet"), meta.RESTScopeNamespace)
+	owners := NewOwnerResolver(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), replicaSet), nil, nil)
+	owners.Mapper = mapper
+
+	sidecars := owners.RestartableInitContainers(v12.ObjectReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app", Namespace: "example-dev"})
+	if len(sidecars) != 1 || !sidecars["istio-proxy"] {
+		t.Errorf("expected sidecar istio-proxy but got: %v\n", sidecars)
+	}
+
+	// Unknown owners have no sidecars
+	if sidecars := owners.RestartableInitContainers(v12.ObjectReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "other", Namespace: "example-dev"}); len(sidecars) != 0 {
+		t.Errorf("expected no sidecars but got: %v\n", sidecars)
+	}
+	if sidecars := (*OwnerResolver)(nil).RestartableInitContainers(v12.ObjectReference{}); sidecars != nil {
+		t.Errorf("expected no sidecars without resolver but got: %v\n", sidecars)
+	}
+}
@@ -0,0 +1,243 @@
+package internal
+
+// This file contains the admission webhook of Pods, which grows the quota before a Pod is created instead of after it
+// was rejected. Without it a controller first fails to create the Pod (FailedCreate), the scaler raises the quota
+// after the debounce and the controller retries after its backoff, which adds minutes to rollouts. When a Pod does not
+// fit in the ResourceQuota of a QuotaAutoscaler, the leader grows the quota to the used resources plus the Pod, limited
+// like a scale up of its calculation: by the maximum step, the rate limits and the maximums. The growth is requested
+// through the resize queue of the event handler, so it counts towards the rate limits and is serialised with the
+// resizes of the calculations. Followers do not grow quotas, the Service of the webhook only selects the leader, see
+// LeaderLabel. The webhook never rejects a Pod: when the growth is not allowed, fails or takes longer than the
+// podAdmissionBudget of the cluster config, the Pod is admitted and the quota admission rejects it like before.
+//
+// Example usage:
+//  webhook := NewPodAdmissionWebhook(watcher)
+//  mux.HandleFunc("/pods", webhook.ServePods)
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/ing-bank/quota-scaler/pkg/utils"
+	admissionv1 "k8s.io/api/admission/v1"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Results of the pod admission webhook for the quota_scaler_pod_admission_total metric
+const (
+	podAdmissionFits    = "fits"
+	podAdmissionResized = "resized"
+	podAdmissionSkipped = "skipped"
+	podAdmissionFailed  = "failed"
+)
+
+// PodAdmissionWebhook serves the admission webhook of Pods. Every replica serves it, only the leader grows quotas,
+// see QuotaWatcher.GrowQuota.
+type PodAdmissionWebhook struct {
+	Watcher *QuotaWatcher
+}
+
+func NewPodAdmissionWebhook(watcher *QuotaWatcher) *PodAdmissionWebhook {
+	return &PodAdmissionWebhook{Watcher: watcher}
+}
+
+// podSidecars is the part of a Pod that the typed API of this client does not know, see RestartableInitContainers
+type podSidecars struct {
+	Spec struct {
+		InitContainers []struct {
+			Name          string `json:"name"`
+			RestartPolicy string `json:"restartPolicy"`
+		} `json:"initContainers"`
+	} `json:"spec"`
+}
+
+// ServePods admits every Pod. Pods that are created, but not in a dry run, grow the quota first when they do not fit.
+// The reply is sent when the podAdmissionBudget is spent, also when the resize is still running.
+func (webhook *PodAdmissionWebhook) ServePods(w http.ResponseWriter, r *http.Request) {
+	review := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, "expected an AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	request := review.Request
+	if request.Operation == admissionv1.Create && (request.DryRun == nil || !*request.DryRun) {
+		ctx, cancel := context.WithTimeout(r.Context(), CurrentClusterConfig().PodAdmissionBudget.Duration)
+		done := make(chan string, 1)
+		go func() {
+			done <- webhook.admitPod(ctx, request)
+		}()
+
+		var result string
+		select {
+		case result = <-done:
+		case <-ctx.Done():
+			logging.LogWarning("[%s] Admitting Pod %s without growing the quota, the budget of %s is spent", request.Namespace, request.Name, CurrentClusterConfig().PodAdmissionBudget.Duration)
+			result = podAdmissionFailed
+		}
+		cancel()
+		podAdmissionCounter.WithLabelValues(result).Inc()
+	}
+
+	writeAdmissionReview(w, review, &admissionv1.AdmissionResponse{Allowed: true})
+}
+
+// admitPod grows the quota when the Pod does not fit, and returns the result for the metrics.
+func (webhook *PodAdmissionWebhook) admitPod(ctx context.Context, request *admissionv1.AdmissionRequest) string {
+	pod, sidecarsSpec := &v12.Pod{}, podSidecars{}
+	if err := json.Unmarshal(request.Object.Raw, pod); err != nil {
+		logging.LogError("[%s] Cannot decode Pod %s: %v", request.Namespace, request.Name, err)
+		return podAdmissionFailed
+	}
+	_ = json.Unmarshal(request.Object.Raw, &sidecarsSpec)
+	sidecars := map[string]bool{}
+	for _, container := range sidecarsSpec.Spec.InitContainers {
+		if container.RestartPolicy == "Always" {
+			sidecars[container.Name] = true
+		}
+	}
+
+	err := webhook.Watcher.GrowQuota(ctx, request.Namespace, CalculatePodResources(v12.PodTemplateSpec{Spec: pod.Spec}, sidecars, 1))
+	if errors.Is(err, errPodFits) {
+		return podAdmissionFits
+	} else if errors.Is(err, errPodSkipped) {
+		return podAdmissionSkipped
+	} else if err != nil {
+		logging.LogError("[%s] Cannot grow the quota for Pod %s: %v", request.Namespace, pod.GenerateName+pod.Name, err)
+		return podAdmissionFailed
+	}
+	return podAdmissionResized
+}
+
+var (
+	errPodFits    = errors.New("the Pod fits in the quota")
+	errPodSkipped = errors.New("the quota cannot grow for the Pod")
+)
+
+// GrowQuota resizes the ResourceQuota of the QuotaAutoscaler of the namespace to the used resources plus the needed
+// resources of a Pod, when they do not fit. The growth is limited like a scale up of the calculation and counts
+// towards the rate limits, it waits until the resize API is done or ctx is done. It returns errPodFits when the Pod
+// fits or the namespace has no QuotaAutoscaler, and errPodSkipped when the watcher is not running, i.e. on followers,
+// or the QuotaAutoscaler does not allow the growth. The QuotaAutoscaler is read from the informer cache, only the
+// namespaces that have one read their quota from the API server.
+func (watcher *QuotaWatcher) GrowQuota(ctx context.Context, namespace string, needed resources.Resources) error {
+	if atomic.LoadInt32(&watcher.running) == 0 {
+		logging.LogDebug("[%s] Not growing the quota for a Pod, only the leader resizes", namespace)
+		return errPodSkipped
+	}
+	cached, err := watcher.GetScaler(namespace)
+	if err != nil {
+		return err
+	}
+	if cached == nil {
+		return errPodFits // Most Pods are created in namespaces without QuotaAutoscaler
+	}
+	scaler := *cached.DeepCopy()
+
+	// Held until the resize is done, the next Pod of the namespace must see the grown quota. This delays the
+	// calculation of the namespace by at most the podAdmissionBudget.
+	unlock := watcher.lockNamespace(namespace)
+	defer unlock()
+	if err := ctx.Err(); err != nil {
+		return err // Spent waiting for the calculation or the growth for another Pod
+	}
+
+	if schedule := ActiveSchedule(namespace, scaler.Spec.Schedules, watcher.now()); schedule != nil {
+		scaler.Spec = ApplySchedule(scaler.Spec, schedule)
+	}
+
+	// The informer cache could miss the resize of the previous Pod, the quota is read from the API server instead
+	quota, err := watcher.Client.CoreV1().ResourceQuotas(namespace).Get(ctx, scaler.Spec.ResourceQuota, v13.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if quota.Status.Used == nil || quota.Status.Hard == nil {
+		return errPodFits // The quota admission has not counted the namespace yet
+	}
+
+	validatedScaler := ValidateQuotaScaler(&scaler)
+	independent := validatedScaler.Independent
+	scaled := validatedScaler.ScaledResources(quota)
+	if !independent {
+		quota.Status.Used[v12.ResourceCPU] = GetNormalizedUsedCpu(quota.Status.Used.Cpu(), ResourceQuotaUsedCpuLimit(quota), validatedScaler.CpuLimitRatio, namespace)
+		needed.NormalizeLimits(validatedScaler.CpuLimitRatio)
+	}
+	needed = needed.Only(scaled...)
+	required := usedResources(quota, scaled, independent).Add(needed)
+
+	current := resources.FromHard(quota, scaled...)
+	var missing []v12.ResourceName
+	for name := range needed {
+		if required.Value(name) > current.Value(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return errPodFits
+	}
+
+	switch {
+	case scaler.Spec.Behavior.ScaleUp.SelectPolicy == v14.DisabledPolicySelect:
+		logging.LogInfo("[%s] Pod does not fit in the quota (%v, requires %v), scale up is disabled", namespace, current, required.Only(missing...))
+		return errPodSkipped
+	case scaler.Spec.DryRun || CurrentClusterConfig().DryRun:
+		logging.LogInfo("[%s] Dry run, not growing the quota for a Pod (%v, requires %v)", namespace, current, required.Only(missing...))
+		return errPodSkipped
+	}
+
+	// Limited like a scale up of the calculation, see CalculateScaleUp, and by the rate limits
+	validatedScaler.ForceLimitToCeilings(namespace)
+	desired := current.Copy()
+	for _, name := range missing {
+		bounds, _ := validatedScaler.Bounds(name)
+		grown := utils.Max(required.Value(name), current.Value(name)+bounds.MinStep)
+		grown = utils.Min(grown, utils.Min(bounds.Max, current.Value(name)+bounds.MaxStep))
+		desired.Set(name, utils.Max(grown, current.Value(name)))
+	}
+	desired = watcher.History.LimitRate(namespace, validatedScaler, current, desired)
+	for _, name := range missing {
+		if desired.Value(name) < required.Value(name) {
+			logging.LogInfo("[%s] Pod does not fit in the quota (%v, requires %v), the growth is limited to %v", namespace, current, required.Only(missing...), desired)
+			return errPodSkipped
+		}
+	}
+
+	result := make(chan error, 1)
+	forget := watcher.History.RecordChange(namespace, current, desired)
+	requested := watcher.requestResizeContext(ctx, NamespaceResizeEvent{
+		Namespace:         namespace,
+		ResourceQuota:     scaler.Spec.ResourceQuota,
+		Old:               current,
+		New:               desired,
+		CpuLimitRatio:     validatedScaler.CpuLimitRatio,
+		IndependentLimits: independent,
+		done: func(err error) {
+			if err != nil {
+				forget() // Only applied resizes count towards the rate limits
+			}
+			result <- err
+		},
+	})
+	if !requested {
+		forget()
+		return ctx.Err() // The event handler is busy, the calculation resizes later
+	}
+
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		return ctx.Err() // The resize continues, like the resizes of the calculation
+	}
+	if err != nil {
+		return err
+	}
+	logging.LogInfo("[%s] Grew the quota for a Pod (%v -> %v)", namespace, current, desired)
+	return nil
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	ichpfake "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned/fake"
+	ichplisters "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/listers/quotaautoscaler/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeResizer records the requested resizes and finishes them with err, or never when slow
+type fakeResizer struct {
+	lock    sync.Mutex
+	slow    bool
+	err     error
+	resizes []NamespaceResizeEvent
+}
+
+func (resizer *fakeResizer) Resize(event NamespaceResizeEvent) {
+	resizer.lock.Lock()
+	resizer.resizes = append(resizer.resizes, event)
+	resizer.lock.Unlock()
+	if !resizer.slow {
+		event.finish(resizer.err)
+	}
+}
+
+func (resizer *fakeResizer) Resizes() []NamespaceResizeEvent {
+	resizer.lock.Lock()
+	defer resizer.lock.Unlock()
+	return append([]NamespaceResizeEvent{}, resizer.resizes...)
+}
+
+// newTestPodAdmissionServer serves the Pod admission webhook of a leading watcher with the scalers, each namespace
+// has a quota of cpu=1000m, memory=1000M of which 900m CPU is used.
+func newTestPodAdmissionServer(resizer *fakeResizer, scalers ...*v14.QuotaAutoscaler) (*httptest.Server, *QuotaWatcher) {
+	var quotas, ichpObjects []runtime.Object
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, scaler := range scalers {
+		quotas = append(quotas, newTestNamespaceQuota(scaler.Namespace, "900m"))
+		ichpObjects = append(ichpObjects, scaler)
+		_ = indexer.Add(scaler)
+	}
+	watcher := &QuotaWatcher{
+		Client:     fake.NewSimpleClientset(quotas...),
+		IchpClient: ichpfake.NewSimpleClientset(ichpObjects...),
+		Scalers:    ichplisters.NewQuotaAutoscalerLister(indexer),
+		History:    NewScalingHistory(),
+		Resize:     resizer.Resize,
+		locks:      NewNamespaceLocks(),
+		running:    1,
+	}
+	return httptest.NewServer(http.HandlerFunc(NewPodAdmissionWebhook(watcher).ServePods)), watcher
+}
+
+func newTestPodAdmissionReview(t *testing.T, url, namespace, cpu string, dryRun bool) *admissionv1.AdmissionResponse {
+	pod := &v12.Pod{
+		ObjectMeta: v13.ObjectMeta{GenerateName: "web-6f7d-", Namespace: namespace},
+		Spec: v12.PodSpec{Containers: []v12.Container{{Name: "app", Resources: v12.ResourceRequirements{
+			Requests: v12.ResourceList{v12.ResourceCPU: resource.MustParse(cpu), v12.ResourceMemory: resource.MustParse("100M")},
+		}}}},
+	}
+	raw, _ := json.Marshal(pod)
+	body, _ := json.Marshal(admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		UID:       "1234",
+		Namespace: namespace,
+		Operation: admissionv1.Create,
+		DryRun:    &dryRun,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+
+	reply, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	defer reply.Body.Close()
+
+	review := admissionv1.AdmissionReview{}
+	_ = json.NewDecoder(reply.Body).Decode(&review)
+	if review.Response == nil || review.Response.UID != "1234" || !review.Response.Allowed {
+		t.Fatalf("expected the Pod to be allowed but got: %+v\n", review)
+	}
+	return review.Response
+}
+
+func TestPodAdmissionWebhook(t *testing.T) {
+	scaler, limited, stepped := newTestScaler("example-dev"), newTestScaler("limited-dev"), newTestScaler("stepped-dev")
+	limited.Spec.MaxCpu = "1"
+	stepped.Spec.MaxCpuStep = "100m"
+	resizer := &fakeResizer{}
+	server, watcher := newTestPodAdmissionServer(resizer, scaler, limited, stepped)
+	defer server.Close()
+
+	// Namespaces without QuotaAutoscaler are looked up in the informer cache only
+	newTestPodAdmissionReview(t, server.URL, "other-dev", "300m", false)
+	if actions := watcher.Client.(*fake.Clientset).Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls for a namespace without QuotaAutoscaler but got: %v\n", actions)
+	}
+
+	// Pods that fit and dry runs do not resize
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "100m", false)
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "300m", true)
+	if resizes := resizer.Resizes(); len(resizes) != 0 {
+		t.Fatalf("expected no resizes but got: %+v\n", resizes)
+	}
+
+	// The quota grows to the used resources plus the Pod, memory fits
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "300m", false)
+	resizes := resizer.Resizes()
+	if len(resizes) != 1 || resizes[0].New.Cpu() != 1200 || resizes[0].New.Memory() != 1000 || resizes[0].ResourceQuota != "example-dev-quota" {
+		t.Fatalf("expected a resize to cpu=1200m, memory=1000M but got: %+v\n", resizes)
+	}
+
+	// Above the maximum or the maximum step the Pod is left to the quota admission
+	newTestPodAdmissionReview(t, server.URL, "limited-dev", "300m", false)
+	newTestPodAdmissionReview(t, server.URL, "stepped-dev", "300m", false)
+	if resizes := resizer.Resizes(); len(resizes) != 1 {
+		t.Errorf("expected no resize above the maximum but got: %+v\n", resizes[1:])
+	}
+}
+
+func TestPodAdmissionWebhookRateLimits(t *testing.T) {
+	scaler := newTestScaler("example-dev")
+	scaler.Spec.Behavior.ScaleUp.Policies = []v14.QuotaScalePolicy{{Method: "cpu", Value: 80, PeriodMinutes: 10, MaxChange: "250m"}}
+	resizer := &fakeResizer{}
+	server, watcher := newTestPodAdmissionServer(resizer, scaler)
+	defer server.Close()
+
+	// The growth counts towards the rate limits, the second Pod would exceed the maxChange
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "200m", false)
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "300m", false)
+	if resizes := resizer.Resizes(); len(resizes) != 1 || resizes[0].New.Cpu() != 1100 {
+		t.Fatalf("expected a single resize to cpu=1100m but got: %+v\n", resizes)
+	}
+	if changes := len(watcher.History.changes["example-dev"]); changes != 1 {
+		t.Errorf("expected the growth in the history but got: %d\n", changes)
+	}
+
+	// A failed growth does not count
+	watcher.History.Forget("example-dev")
+	resizer.err = errors.New("timeout")
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "200m", false)
+	if changes := len(watcher.History.changes["example-dev"]); changes != 0 {
+		t.Errorf("expected no changes in the history but got: %d\n", changes)
+	}
+
+	// Followers do not grow the quota
+	resizer.err = nil
+	atomic.StoreInt32(&watcher.running, 0)
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "200m", false)
+	if resizes := resizer.Resizes(); len(resizes) != 2 {
+		t.Errorf("expected no resize on a follower but got: %+v\n", resizes[2:])
+	}
+}
+
+func TestPodAdmissionWebhookBudget(t *testing.T) {
+	config := DefaultClusterConfig()
+	config.PodAdmissionBudget.Duration = 50 * time.Millisecond
+	UseClusterConfig(config)
+	defer UseClusterConfig(DefaultClusterConfig())
+
+	resizer := &fakeResizer{slow: true}
+	server, _ := newTestPodAdmissionServer(resizer, newTestScaler("example-dev"))
+	defer server.Close()
+
+	// The Pod is admitted when the resize takes longer than the budget
+	start := time.Now()
+	newTestPodAdmissionReview(t, server.URL, "example-dev", "300m", false)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a reply within the budget but got: %s\n", elapsed)
+	}
+	if resizes := resizer.Resizes(); len(resizes) != 1 {
+		t.Errorf("expected a single resize but got: %+v\n", resizes)
+	}
+}
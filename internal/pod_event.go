@@ -7,75 +7,138 @@ import (
 
 	"github.com/ing-bank/quota-scaler/pkg/logging"
 	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v15 "k8s.io/api/apps/v1"
 	v12 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 )
 
-func GetResourcesFromPodEvents(client kubernetes.Interface, events []v12.Event) (*resources.Resources, error) {
-	sum := &resources.Resources{}
+// GetResourcesFromPodEvents sums the requests and limits that the Pods of the Events were missing. The storage of a
+// claim is only known from the FailedCreate Events of a StatefulSet, which state the exceeded quota of its claim. The
+// owners resolve kinds that are not built in and the runtimeClasses the overhead of the templates, both may be nil.
+func GetResourcesFromPodEvents(client kubernetes.Interface, owners *OwnerResolver, runtimeClasses *RuntimeClasses, events []v12.Event) (resources.Resources, error) {
+	sum := resources.Resources{}
 	involvedObjects := map[string]bool{} // Make sure we only handle each InvolvedObject once
 
 	for _, ev := range events {
-		if isDaemonSet(ev) {
-			continue // Skip these for now
-		}
-
+		podEventsCounter.WithLabelValues(ev.Reason, ev.InvolvedObject.Kind).Inc()
 		name := ev.InvolvedObject.Kind + ev.InvolvedObject.Name
 		if _, ok := involvedObjects[name]; !ok {
 			logging.LogInfo("[%s] Processing event %s %s", ev.Namespace, ev.InvolvedObject.Kind, ev.InvolvedObject.Name)
 			involvedObjects[name] = true
 
-			spec, missingReplicas, err := getPodTemplateSpecFromEv(client, ev)
+			spec, missingReplicas, err := getPodTemplateSpecFromEv(client, owners, ev)
+
+			// The admission error states exactly which resources the Pod was missing, the Pod template is an estimate
+			if exceeded, ok := ParseQuotaExceeded(ev.Message); ok {
+				if err != nil {
+					logging.LogWarning("[%s] Cannot get replicas from event: %s %s: %v. Assuming 1 missing Pod", ev.Namespace, ev.InvolvedObject.Kind, ev.InvolvedObject.Name, err)
+					missingReplicas = 1
+				}
+				if missingReplicas > 0 {
+					sum.Add(exceeded.RequestedResources().Multiply(int64(missingReplicas)))
+				}
+				continue
+			}
+
 			if err != nil {
 				logging.LogError("[%s] Cannot get template spec from event: %s %s: %v. Ignoring it", ev.Namespace, ev.InvolvedObject.Kind, ev.InvolvedObject.Name, err)
 				continue // We process those we do know
 			}
 
-			res := CalculatePodResources(spec, int64(missingReplicas))
-			sum.Add(&res)
+			var sidecars map[string]bool
+			if len(spec.Spec.InitContainers) > 0 {
+				sidecars = owners.RestartableInitContainers(ev.InvolvedObject)
+			}
+			sum.Add(CalculatePodResources(runtimeClasses.WithOverhead(spec), sidecars, int64(missingReplicas)))
 		}
 	}
 
 	return sum, nil
 }
 
-// CalculatePodResources sums the container resources of a Pod and multiplies them by the missing replicas.
-// Zero or negative replicas will result in an empty Resource.
-func CalculatePodResources(podTemplate v12.PodTemplateSpec, missingReplicas int64) resources.Resources {
-	neededCpu := resource.NewQuantity(0, resource.DecimalSI)
-	neededMemory := resource.NewQuantity(0, resource.DecimalSI)
+// CalculatePodResources calculates the effective requests and limits of a Pod like the quota admission does, and
+// multiplies them by the missing replicas. Init containers run one by one before the app containers, so only the
+// biggest counts. Restartable init containers (sidecars) keep running next to the containers that start after them.
+// The overhead of the template is added on top, see RuntimeClasses.WithOverhead, and each Pod counts towards the pods
+// and count/pods quotas. Zero or negative replicas will result in an empty Resource.
+func CalculatePodResources(podTemplate v12.PodTemplateSpec, sidecars map[string]bool, missingReplicas int64) resources.Resources {
+	if missingReplicas <= 0 {
+		return resources.Resources{}
+	}
+
+	needed := resources.Resources{}
 	for _, container := range podTemplate.Spec.Containers {
-		if container.Resources.Requests != nil {
-			expectedNeededCpu := *container.Resources.Requests.Cpu()
-			expectedNeededMemory := *container.Resources.Requests.Memory()
-
-			// Take limits into accounts, especially the ratio between CPU requests and limits
-			if container.Resources.Limits != nil {
-				expectedNeededMemory = *container.Resources.Limits.Memory()
-				expectedNeededCpu = GetNormalizedUsedCpu(container.Resources.Requests.Cpu(), container.Resources.Limits.Cpu(), podTemplate.Namespace)
-			}
+		needed.Add(containerResources(container))
+	}
 
-			neededCpu.Add(expectedNeededCpu)
-			neededMemory.Add(expectedNeededMemory)
+	initNeeded := resources.Resources{}
+	sidecarsNeeded := resources.Resources{}
+	for _, container := range podTemplate.Spec.InitContainers {
+		res := containerResources(container)
+		if sidecars[container.Name] {
+			// A sidecar runs next to the app containers and the init containers after it
+			needed.Add(res)
+			sidecarsNeeded.Add(res)
+			res = sidecarsNeeded.Copy()
+		} else {
+			res.Add(sidecarsNeeded)
 		}
+		initNeeded.Max(res)
 	}
+	needed.Max(initNeeded)
 
-	if missingReplicas <= 0 {
-		return resources.Resources{}
-	}
-	return resources.Resources{
-		Cpu:    neededCpu.ScaledValue(resource.Milli) * missingReplicas,
-		Memory: neededMemory.ScaledValue(resource.Mega) * missingReplicas,
-	}
+	overhead := v12.Container{Resources: v12.ResourceRequirements{Requests: podTemplate.Spec.Overhead, Limits: podTemplate.Spec.Overhead}}
+	needed.Add(containerResources(overhead))
+	needed.Set(v12.ResourcePods, 1)
+	needed.Set(v12.ResourceName("count/pods"), 1)
+
+	return needed.Multiply(missingReplicas)
 }
 
-func isDaemonSet(ev v12.Event) bool {
-	return ev.InvolvedObject.Kind == "DaemonSet"
+// containerResources returns the requests and limits of a container by their ResourceQuota name. Like the API server,
+// missing requests default to the limits. Missing limits count as the requests, which is an estimate: a LimitRange
+// may fill in a higher default limit at admission, that is only known from the exceeded quota message. Extended
+// resources, e.g. GPUs, only have requests.
+func containerResources(container v12.Container) resources.Resources {
+	res := resources.Resources{}
+	requests, limits := container.Resources.Requests, container.Resources.Limits
+	add := func(name v12.ResourceName) {
+		request, hasRequest := requests[name]
+		limit, hasLimit := limits[name]
+		if !hasRequest {
+			request = limit
+		}
+		if !hasLimit {
+			limit = request
+		}
+
+		switch name {
+		case v12.ResourceCPU, v12.ResourceMemory:
+			res[name] = request.DeepCopy()
+			res[v12.ResourceName("limits."+name)] = limit.DeepCopy()
+		case v12.ResourceEphemeralStorage:
+			res[v12.ResourceRequestsEphemeralStorage] = request.DeepCopy()
+			res[v12.ResourceLimitsEphemeralStorage] = limit.DeepCopy()
+		default:
+			res[v12.ResourceName("requests."+name)] = request.DeepCopy()
+		}
+	}
+
+	for name := range requests {
+		add(name)
+	}
+	for name := range limits {
+		if _, ok := requests[name]; !ok {
+			add(name)
+		}
+	}
+	return res
 }
 
-func getPodTemplateSpecFromEv(client kubernetes.Interface, ev v12.Event) (v12.PodTemplateSpec, int32, error) {
+func getPodTemplateSpecFromEv(client kubernetes.Interface, owners *OwnerResolver, ev v12.Event) (v12.PodTemplateSpec, int32, error) {
 	var pod v12.PodTemplateSpec
 	var replicas int32 = 1
 
@@ -89,6 +152,16 @@ func getPodTemplateSpecFromEv(client kubernetes.Interface, ev v12.Event) (v12.Po
 		}
 		pod = target.Spec.Template
 		replicas = *target.Spec.Replicas - target.Status.Replicas
+	case "DaemonSet":
+		target, err := client.AppsV1().DaemonSets(namespace).Get(context.TODO(), name, v13.GetOptions{})
+		if err != nil {
+			return pod, replicas, err
+		}
+		pod = target.Spec.Template
+		replicas, err = missingDaemonSetPods(client, target)
+		if err != nil {
+			return pod, replicas, err
+		}
 	case "Job":
 		target, err := client.BatchV1().Jobs(namespace).Get(context.TODO(), name, v13.GetOptions{})
 		if err != nil {
@@ -126,6 +199,9 @@ func getPodTemplateSpecFromEv(client kubernetes.Interface, ev v12.Event) (v12.Po
 		// Just one ephemeral pod needed for a challenge
 		replicas = 1
 	default:
+		if owners.Allows(ev.InvolvedObject) {
+			return owners.Resolve(ev.InvolvedObject)
+		}
 		return v12.PodTemplateSpec{}, 0, errors.New("unsupported event")
 	}
 
@@ -133,15 +209,54 @@ func getPodTemplateSpecFromEv(client kubernetes.Interface, ev v12.Event) (v12.Po
 	return pod, replicas, nil
 }
 
-// GetNormalizedUsedCpu calculates if the CPU limit / 10 is bigger than the CPU requests, if so we should scale
+// missingDaemonSetPods returns the number of nodes that should run a Pod of the DaemonSet but do not. When the
+// DaemonSet controller has not reported a status yet, the schedulable nodes matching the nodeSelector without a Pod of
+// the DaemonSet are counted. Taints and node affinity are not taken into account for those.
+func missingDaemonSetPods(client kubernetes.Interface, ds *v15.DaemonSet) (int32, error) {
+	if ds.Status.DesiredNumberScheduled > 0 {
+		return ds.Status.DesiredNumberScheduled - ds.Status.CurrentNumberScheduled, nil
+	}
+
+	nodes, err := client.CoreV1().Nodes().List(context.TODO(), v13.ListOptions{
+		LabelSelector: labels.SelectorFromSet(ds.Spec.Template.Spec.NodeSelector).String(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	selector, err := v13.LabelSelectorAsSelector(ds.Spec.Selector)
+	if err != nil {
+		return 0, err
+	}
+	pods, err := client.CoreV1().Pods(ds.Namespace).List(context.TODO(), v13.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return 0, err
+	}
+
+	nodesWithPod := map[string]bool{}
+	for _, pod := range pods.Items {
+		nodesWithPod[pod.Spec.NodeName] = true
+	}
+	var missing int32
+	for _, node := range nodes.Items {
+		if !node.Spec.Unschedulable && !nodesWithPod[node.Name] {
+			missing++
+		}
+	}
+	return missing, nil
+}
+
+// GetNormalizedUsedCpu calculates if the CPU limit / ratio is bigger than the CPU requests, if so we should scale
 // based on the CPU limit in order not to breach the namespace quota. We then "fake" the CPU request to be higher so that
-// future calculations only have to worry about CPU requests. If the ratio is not exceeded the requested values are
-// returned. Ns variable only used for logging.
-func GetNormalizedUsedCpu(request, limit *resource.Quantity, ns string) resource.Quantity {
-	normalizedUsedCpuLimit := limit.ScaledValue(resource.Milli) / REQ_LIM_RATIO
+// future calculations only have to worry about CPU requests. If the ratio is not exceeded, or zero, the requested
+// values are returned. Ns variable only used for logging.
+func GetNormalizedUsedCpu(request, limit *resource.Quantity, ratio int64, ns string) resource.Quantity {
+	if ratio <= 0 {
+		return *request
+	}
+	normalizedUsedCpuLimit := limit.ScaledValue(resource.Milli) / ratio
 	if normalizedUsedCpuLimit > request.ScaledValue(resource.Milli) {
 		normalizedRes := *resource.NewScaledQuantity(normalizedUsedCpuLimit, resource.Milli)
-		logging.LogInfo("[%s] Using CPU limit instead of request due to ratio (x%d) %d -> %d\n", ns, REQ_LIM_RATIO, request.ScaledValue(resource.Milli), normalizedRes.ScaledValue(resource.Milli))
+		logging.LogInfo("[%s] Using CPU limit instead of request due to ratio (x%d) %d -> %d\n", ns, ratio, request.ScaledValue(resource.Milli), normalizedRes.ScaledValue(resource.Milli))
 		return normalizedRes
 	}
 	return *request
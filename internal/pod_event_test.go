@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v15 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestDaemonSet(name string, status v15.DaemonSetStatus) *v15.DaemonSet {
+	labels := map[string]string{"app": name}
+	return &v15.DaemonSet{
+		ObjectMeta: v13.ObjectMeta{Name: name, Namespace: "example-dev"},
+		Spec: v15.DaemonSetSpec{
+			Selector: &v13.LabelSelector{MatchLabels: labels},
+			Template: v12.PodTemplateSpec{
+				ObjectMeta: v13.ObjectMeta{Labels: labels},
+				Spec: v12.PodSpec{
+					NodeSelector: map[string]string{"role": "worker"},
+					Containers: []v12.Container{{Resources: v12.ResourceRequirements{Requests: v12.ResourceList{
+						v12.ResourceCPU:    resource.MustParse("100m"),
+						v12.ResourceMemory: resource.MustParse("200M"),
+					}}}},
+				},
+			},
+		},
+		Status: status,
+	}
+}
+
+func newTestDaemonSetEvent(name string) v12.Event {
+	return v12.Event{
+		ObjectMeta:     v13.ObjectMeta{Name: name + "-event", Namespace: "example-dev"},
+		InvolvedObject: v12.ObjectReference{Kind: "DaemonSet", Name: name, Namespace: "example-dev"},
+		Reason:         "FailedCreate",
+	}
+}
+
+func TestGetResourcesFromDaemonSetEvents(t *testing.T) {
+	worker := map[string]string{"role": "worker"}
+	client := fake.NewSimpleClientset(
+		// A partial rollout, 2 of 5 nodes have no Pod
+		newTestDaemonSet("rollout", v15.DaemonSetStatus{DesiredNumberScheduled: 5, CurrentNumberScheduled: 3}),
+		// A new DaemonSet without status, 1 of 3 schedulable worker nodes has a Pod
+		newTestDaemonSet("new", v15.DaemonSetStatus{}),
+		&v12.Node{ObjectMeta: v13.ObjectMeta{Name: "node-1", Labels: worker}},
+		&v12.Node{ObjectMeta: v13.ObjectMeta{Name: "node-2", Labels: worker}},
+		&v12.Node{ObjectMeta: v13.ObjectMeta{Name: "node-3", Labels: worker}},
+		&v12.Node{ObjectMeta: v13.ObjectMeta{Name: "node-4", Labels: worker}, Spec: v12.NodeSpec{Unschedulable: true}},
+		&v12.Node{ObjectMeta: v13.ObjectMeta{Name: "master-1"}},
+		&v12.Pod{
+			ObjectMeta: v13.ObjectMeta{Name: "new-abcde", Namespace: "example-dev", Labels: map[string]string{"app": "new"}},
+			Spec:       v12.PodSpec{NodeName: "node-1"},
+		},
+	)
+
+	sum, _ := GetResourcesFromPodEvents(client, nil, nil, []v12.Event{newTestDaemonSetEvent("rollout")})
+	if sum.Cpu() != 200 || sum.Memory() != 400 {
+		t.Errorf("expected 200m 400M for 2 missing Pods but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+
+	// Repeated Events of a DaemonSet count once towards the resources, but every Event is processed
+	processed := testutil.ToFloat64(podEventsCounter.WithLabelValues("FailedCreate", "DaemonSet"))
+	sum, _ = GetResourcesFromPodEvents(client, nil, nil, []v12.Event{newTestDaemonSetEvent("new"), newTestDaemonSetEvent("new")})
+	if sum.Cpu() != 200 || sum.Memory() != 400 {
+		t.Errorf("expected 200m 400M for 2 nodes without Pod but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+	if increase := testutil.ToFloat64(podEventsCounter.WithLabelValues("FailedCreate", "DaemonSet")) - processed; increase != 2 {
+		t.Errorf("expected 2 processed Events but got: %f\n", increase)
+	}
+
+	// A completed rollout needs nothing
+	_, _ = client.AppsV1().DaemonSets("example-dev").UpdateStatus(context.TODO(), newTestDaemonSet("rollout",
+		v15.DaemonSetStatus{DesiredNumberScheduled: 5, CurrentNumberScheduled: 5}), v13.UpdateOptions{})
+	sum, _ = GetResourcesFromPodEvents(client, nil, nil, []v12.Event{newTestDaemonSetEvent("rollout")})
+	if !sum.IsEmpty() {
+		t.Errorf("expected no resources for a completed rollout but got: %+v\n", sum)
+	}
+}
+
+func newTestContainer(name, cpu, memory string) v12.Container {
+	return v12.Container{Name: name, Resources: v12.ResourceRequirements{Requests: v12.ResourceList{
+		v12.ResourceCPU:    resource.MustParse(cpu),
+		v12.ResourceMemory: resource.MustParse(memory),
+	}}}
+}
+
+func TestCalculatePodResources(t *testing.T) {
+	app := []v12.Container{newTestContainer("app", "200m", "200M"), newTestContainer("logger", "100m", "100M")}
+	tests := []struct {
+		name     string
+		spec     v12.PodSpec
+		sidecars map[string]bool
+		expected string
+	}{
+		{
+			name:     "Containers are summed",
+			spec:     v12.PodSpec{Containers: app},
+			expected: "300m 300M",
+		},
+		{
+			name:     "Biggest init container wins",
+			spec:     v12.PodSpec{Containers: app, InitContainers: []v12.Container{newTestContainer("migrate", "1", "50M"), newTestContainer("wait", "10m", "400M")}},
+			expected: "1000m 400M",
+		},
+		{
+			name:     "Small init containers",
+			spec:     v12.PodSpec{Containers: app, InitContainers: []v12.Container{newTestContainer("migrate", "100m", "100M")}},
+			expected: "300m 300M",
+		},
+		{
+			name:     "Sidecar runs next to the containers",
+			spec:     v12.PodSpec{Containers: app, InitContainers: []v12.Container{newTestContainer("istio-proxy", "100m", "128M")}},
+			sidecars: map[string]bool{"istio-proxy": true},
+			expected: "400m 428M",
+		},
+		{
+			name:     "Sidecar runs next to later init containers",
+			spec:     v12.PodSpec{Containers: app, InitContainers: []v12.Container{newTestContainer("istio-proxy", "100m", "128M"), newTestContainer("migrate", "500m", "500M")}},
+			sidecars: map[string]bool{"istio-proxy": true},
+			expected: "600m 628M",
+		},
+		{
+			name:     "Sidecar does not run next to earlier init containers",
+			spec:     v12.PodSpec{Containers: app, InitContainers: []v12.Container{newTestContainer("migrate", "500m", "500M"), newTestContainer("istio-proxy", "100m", "128M")}},
+			sidecars: map[string]bool{"istio-proxy": true},
+			expected: "500m 500M",
+		},
+		{
+			name: "RuntimeClass overhead is added",
+			spec: v12.PodSpec{Containers: app, InitContainers: []v12.Container{newTestContainer("migrate", "1", "50M")}, Overhead: v12.ResourceList{
+				v12.ResourceCPU:    resource.MustParse("250m"),
+				v12.ResourceMemory: resource.MustParse("120M"),
+			}},
+			expected: "1250m 420M",
+		},
+	}
+
+	for _, test := range tests {
+		res := CalculatePodResources(v12.PodTemplateSpec{Spec: test.spec}, test.sidecars, 2)
+		if got := fmt.Sprintf("%dm %dM", res.Cpu()/2, res.Memory()/2); got != test.expected {
+			t.Errorf("%s: expected %s per Pod but got: %s\n", test.name, test.expected, got)
+		}
+	}
+
+	// Other resources are named like in the ResourceQuota, each Pod counts towards the pods quotas
+	gpu := v12.Container{Resources: v12.ResourceRequirements{Limits: v12.ResourceList{
+		"nvidia.com/gpu":             resource.MustParse("1"),
+		v12.ResourceEphemeralStorage: resource.MustParse("1Gi"),
+	}}}
+	res := CalculatePodResources(v12.PodTemplateSpec{Spec: v12.PodSpec{Containers: []v12.Container{gpu}}}, nil, 2)
+	if expected := "count/pods=2, limits.ephemeral-storage=2Gi, pods=2, requests.ephemeral-storage=2Gi, requests.nvidia.com/gpu=2"; res.String() != expected {
+		t.Errorf("expected %s but got: %s\n", expected, res)
+	}
+
+	if res := CalculatePodResources(v12.PodTemplateSpec{Spec: v12.PodSpec{Containers: app}}, nil, 0); !res.IsEmpty() {
+		t.Errorf("expected no resources for 0 replicas but got: %+v\n", res)
+	}
+}
+
+func TestGetResourcesFromRuntimeClassEvents(t *testing.T) {
+	var replicas int32 = 2
+	runtimeClass := "kata"
+	client := fake.NewSimpleClientset(
+		&v15.ReplicaSet{
+			ObjectMeta: v13.ObjectMeta{Name: "app", Namespace: "example-dev"},
+			Spec: v15.ReplicaSetSpec{Replicas: &replicas, Template: v12.PodTemplateSpec{Spec: v12.PodSpec{
+				RuntimeClassName: &runtimeClass,
+				Containers:       []v12.Container{newTestContainer("app", "500m", "200M")},
+			}}},
+		},
+	)
+	event := v12.Event{
+		InvolvedObject: v12.ObjectReference{Kind: "ReplicaSet", Name: "app", Namespace: "example-dev"},
+		Reason:         "FailedCreate",
+	}
+
+	// The template names the RuntimeClass, its overhead is added to each missing Pod
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newTestRuntimeClass(runtimeClass, "250m", "120M"))
+	sum, _ := GetResourcesFromPodEvents(client, nil, NewRuntimeClasses(client, dynamicClient), []v12.Event{event})
+	if sum.Cpu() != 1500 || sum.Memory() != 640 {
+		t.Errorf("expected 1500m 640M for 2 Pods with overhead but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+
+	// Without RuntimeClasses the overhead is unknown
+	sum, _ = GetResourcesFromPodEvents(client, nil, nil, []v12.Event{event})
+	if sum.Cpu() != 1000 || sum.Memory() != 400 {
+		t.Errorf("expected 1000m 400M for 2 Pods without overhead but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+}
@@ -0,0 +1,198 @@
+package internal
+
+// This file forecasts the CPU and memory usage of namespaces for QuotaAutoscalers with a prediction. The usage
+// history of a namespace, see UsageHistory, is fitted with an additive Holt-Winters model with a daily and/or weekly
+// season (Taylor's multiple seasonal method). The scale up policies use the highest forecast within the horizon as
+// usage, so the quota is raised before the usage peaks. Scaling down only uses the current usage.
+//
+// Example usage:
+//  history.Record(namespace, now, usedResources(quota, names, independent))
+//  predicted := history.Predict(namespace, scaler.Spec.Prediction)
+//  scaleUpQuota := withPredictedUsage(quota, predicted, independent)
+
+import (
+	"math"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	v12 "k8s.io/api/core/v1"
+)
+
+const (
+	DefaultPredictionHorizon           = 30 * time.Minute
+	DefaultPredictionLevelSmoothing    = 50
+	DefaultPredictionTrendSmoothing    = 10
+	DefaultPredictionSeasonalSmoothing = 30
+)
+
+// DefaultPredictionSeasons are used when a prediction sets no seasons.
+var DefaultPredictionSeasons = []v14.PredictionSeason{v14.DailySeason, v14.WeeklySeason}
+
+// seasonLengths are the durations of the seasons a prediction can use.
+var seasonLengths = map[v14.PredictionSeason]time.Duration{
+	v14.DailySeason:  24 * time.Hour,
+	v14.WeeklySeason: 7 * 24 * time.Hour,
+}
+
+// HoltWinters is an additive Holt-Winters model with one or more seasons. The smoothing factors are between 0 and 1.
+type HoltWinters struct {
+	Alpha, Beta, Gamma float64 // Of the level, trend and seasons
+	Periods            []int   // Lengths of the seasons in samples, ordered from short to long
+}
+
+// Forecast fits the model to the samples and returns the forecast of the next steps. It returns false when there are
+// fewer samples than the longest season.
+func (model HoltWinters) Forecast(samples []float64, steps int) ([]float64, bool) {
+	longest := 1
+	for _, period := range model.Periods {
+		if period > longest {
+			longest = period
+		}
+	}
+	if len(samples) < longest {
+		return nil, false
+	}
+
+	// The level starts at the mean of the first longest season, each season at the mean deviation per position of
+	// its period that the shorter seasons do not explain
+	level, trend := mean(samples[:longest]), 0.0
+	seasons := make([][]float64, len(model.Periods))
+	for k, period := range model.Periods {
+		seasons[k] = make([]float64, period)
+		counts := make([]int, period)
+		for t, sample := range samples[:longest] {
+			seasons[k][t%period] += sample - level - model.seasonal(seasons[:k], t)
+			counts[t%period]++
+		}
+		for i := range seasons[k] {
+			seasons[k][i] /= float64(counts[i])
+		}
+	}
+
+	for t := longest; t < len(samples); t++ {
+		seasonal := model.seasonal(seasons, t)
+		previous := level
+		level = model.Alpha*(samples[t]-seasonal) + (1-model.Alpha)*(level+trend)
+		trend = model.Beta*(level-previous) + (1-model.Beta)*trend
+		for k, period := range model.Periods {
+			others := seasonal - seasons[k][t%period]
+			seasons[k][t%period] = model.Gamma*(samples[t]-level-others) + (1-model.Gamma)*seasons[k][t%period]
+		}
+	}
+
+	forecast := make([]float64, steps)
+	last := len(samples) - 1
+	for h := 1; h <= steps; h++ {
+		forecast[h-1] = level + float64(h)*trend + model.seasonal(seasons, last+h)
+	}
+	return forecast, true
+}
+
+// seasonal returns the sum of the seasons at sample t.
+func (model HoltWinters) seasonal(seasons [][]float64, t int) float64 {
+	sum := 0.0
+	for k, season := range seasons {
+		sum += season[t%model.Periods[k]]
+	}
+	return sum
+}
+
+func mean(samples []float64) float64 {
+	sum := 0.0
+	for _, sample := range samples {
+		sum += sample
+	}
+	return sum / float64(len(samples))
+}
+
+// predictionModel returns the model of a prediction for samples of the interval, and the number of steps within its
+// horizon. Missing fields use their defaults.
+func predictionModel(prediction *v14.QuotaScalerPrediction, interval time.Duration) (HoltWinters, int) {
+	model := HoltWinters{
+		Alpha: smoothing(prediction.LevelSmoothing, DefaultPredictionLevelSmoothing),
+		Beta:  smoothing(prediction.TrendSmoothing, DefaultPredictionTrendSmoothing),
+		Gamma: smoothing(prediction.SeasonalSmoothing, DefaultPredictionSeasonalSmoothing),
+	}
+	seasons := prediction.Seasons
+	if len(seasons) == 0 {
+		seasons = DefaultPredictionSeasons
+	}
+	// Ordered from short to long, whatever the order of the spec
+	for _, season := range []v14.PredictionSeason{v14.DailySeason, v14.WeeklySeason} {
+		if period := int(seasonLengths[season] / interval); containsSeason(seasons, season) && period > 1 {
+			model.Periods = append(model.Periods, period)
+		}
+	}
+
+	horizon := prediction.Horizon.Duration
+	if horizon <= 0 {
+		horizon = DefaultPredictionHorizon
+	}
+	return model, int((horizon + interval - 1) / interval)
+}
+
+func smoothing(percentage *int32, def int32) float64 {
+	if percentage == nil || *percentage < 0 || *percentage > 100 {
+		return float64(def) / 100
+	}
+	return float64(*percentage) / 100
+}
+
+func containsSeason(seasons []v14.PredictionSeason, season v14.PredictionSeason) bool {
+	for _, s := range seasons {
+		if s == season {
+			return true
+		}
+	}
+	return false
+}
+
+// Predict returns the highest usage that is forecast within the horizon of the prediction, per resource in the
+// history of the namespace. Resources with too little history are omitted.
+func (history *UsageHistory) Predict(namespace string, prediction *v14.QuotaScalerPrediction) resources.Resources {
+	predicted := resources.Resources{}
+	model, steps := predictionModel(prediction, history.interval())
+	for name, samples := range history.Samples(namespace) {
+		values := make([]float64, len(samples))
+		for i, sample := range samples {
+			values[i] = float64(sample)
+		}
+		forecast, ok := model.Forecast(values, steps)
+		if !ok {
+			logging.LogDebug("[%s] Not enough %s history for a prediction (%d samples)", namespace, name, len(samples))
+			continue
+		}
+
+		peak := 0.0
+		for _, value := range forecast {
+			peak = math.Max(peak, value)
+		}
+		predicted.Set(name, int64(math.Ceil(peak)))
+	}
+	return predicted
+}
+
+// withPredictedUsage returns a copy of the ResourceQuota of which the usage, as the scale up policies see it, is
+// raised to the predicted usage.
+func withPredictedUsage(quota *v12.ResourceQuota, predicted resources.Resources, independent bool) *v12.ResourceQuota {
+	names := make([]v12.ResourceName, 0, len(predicted))
+	for name := range predicted {
+		names = append(names, name)
+	}
+	used := usedResources(quota, names, independent)
+
+	predictedQuota := quota.DeepCopy()
+	for _, name := range names {
+		if predicted.Value(name) <= used.Value(name) {
+			continue
+		}
+		key := name
+		if _, ok := quota.Status.Used[v12.ResourceLimitsMemory]; ok && name == v12.ResourceMemory && !independent {
+			key = v12.ResourceLimitsMemory // The memory policies use the memory limits, see ResourceQuotaUsedMemoryLimit
+		}
+		predictedQuota.Status.Used[key] = *predicted.Quantity(name)
+	}
+	return predictedQuota
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	ichpfake "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned/fake"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHoltWintersForecast(t *testing.T) {
+	// Hourly samples of a daily pattern on top of a slow growth
+	usage := func(hour int) float64 {
+		return 1000 + 2*float64(hour) + 400*math.Sin(2*math.Pi*float64(hour)/24)
+	}
+	samples := make([]float64, 24*14)
+	for hour := range samples {
+		samples[hour] = usage(hour)
+	}
+
+	model := HoltWinters{Alpha: 0.5, Beta: 0.1, Gamma: 0.3, Periods: []int{24}}
+	forecast, ok := model.Forecast(samples, 12)
+	if !ok {
+		t.Fatalf("expected a forecast\n")
+	}
+	for step, value := range forecast {
+		if expected := usage(len(samples) + step); math.Abs(value-expected) > 0.05*expected {
+			t.Errorf("expected a forecast of %.0f at step %d but got: %.0f\n", expected, step+1, value)
+		}
+	}
+
+	if _, ok := model.Forecast(samples[:23], 12); ok {
+		t.Errorf("expected no forecast with less than a season of samples\n")
+	}
+}
+
+func TestUpdateQuotaPredicted(t *testing.T) {
+	scaler := newTestScaler("example-dev")
+	scaler.Spec.Prediction = &v14.QuotaScalerPrediction{Seasons: []v14.PredictionSeason{v14.DailySeason}}
+	scaler.Spec.Behavior.ScaleUp.Policies = []v14.QuotaScalePolicy{{Method: "cpu", Value: 80}}
+	ichpClient := ichpfake.NewSimpleClientset(scaler)
+	now := time.Date(2024, 3, 6, 8, 45, 0, 0, time.UTC)
+	var resizes []NamespaceResizeEvent
+	watcher := &QuotaWatcher{
+		Client:     fake.NewSimpleClientset(),
+		IchpClient: ichpClient,
+		History:    NewScalingHistory(),
+		Usage:      NewUsageHistory(nil, ""),
+		Resize:     func(resize NamespaceResizeEvent) { resizes = append(resizes, resize) },
+		Now:        func() time.Time { return now },
+	}
+
+	// Two days in which the usage peaks between 09:00 and 10:00
+	for at := now.Add(-48 * time.Hour); at.Before(now); at = at.Add(10 * time.Minute) {
+		cpu := int64(500)
+		if at.Hour() == 9 {
+			cpu = 950
+		}
+		watcher.Usage.Record("example-dev", at, resources.New(cpu, 500))
+	}
+
+	// The quota is raised before the peak
+	quota := newTestNamespaceQuota("example-dev", "500m")
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 || resizes[0].New.Cpu() <= 1000 {
+		t.Fatalf("expected a CPU scale up ahead of the peak but got: %+v\n", resizes)
+	}
+	updated, _ := ichpClient.IchpV1().QuotaAutoscalers("example-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+	if cpu := updated.Status.PredictedResources.Cpu().MilliValue(); cpu < 900 || cpu > 1000 {
+		t.Errorf("expected a predicted CPU usage near 950m but got: %dm\n", cpu)
+	}
+
+	// After the peak the prediction does not raise the quota
+	now = now.Add(2 * time.Hour)
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 {
+		t.Errorf("expected no resize after the peak but got: %+v\n", resizes[1:])
+	}
+
+	// Removing the prediction forgets the history
+	scaler.Spec.Prediction = nil
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if watcher.Usage.Knows("example-dev") {
+		t.Errorf("expected the usage history to be forgotten\n")
+	}
+}
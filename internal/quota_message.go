@@ -0,0 +1,89 @@
+package internal
+
+// This file parses the admission error of a Pod or PersistentVolumeClaim that would exceed a ResourceQuota. The error
+// is part of the message of FailedCreate Events of Pod owners and of the PresentError Events of cert-manager
+// Challenges. Only a StatefulSet reports the error of its claims, the API server rejects claims that users create
+// directly without an Event. Only the exceeded resources are listed, e.g.:
+//
+//  Error creating: pods "app-5d4f8b-x2v9k" is forbidden: exceeded quota: compute-resources, requested:
+//  limits.cpu=2,limits.memory=2Gi, used: limits.cpu=9,limits.memory=15Gi, limited: limits.cpu=10,limits.memory=16Gi
+//
+//  create Claim data-db-3 for Pod db-3 in StatefulSet db failed error: persistentvolumeclaims "data-db-3" is
+//  forbidden: exceeded quota: storage, requested: requests.storage=50Gi, used: requests.storage=180Gi, limited:
+//  requests.storage=200Gi
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var quotaExceededRegexp = regexp.MustCompile(`exceeded quota: ([^,\s]+), requested: (\S+), used: (\S+), limited: (\S+)`)
+
+// QuotaExceeded is the parsed admission error of a Pod that would exceed a ResourceQuota.
+type QuotaExceeded struct {
+	Quota     string
+	Requested v12.ResourceList // Requested by the Pod
+	Used      v12.ResourceList // Used in the namespace before the Pod
+	Limited   v12.ResourceList // Hard limit of the ResourceQuota
+}
+
+// ParseQuotaExceeded parses the exceeded quota error from an Event message, false when the message has none.
+func ParseQuotaExceeded(message string) (*QuotaExceeded, bool) {
+	match := quotaExceededRegexp.FindStringSubmatch(message)
+	if match == nil {
+		return nil, false
+	}
+
+	exceeded := &QuotaExceeded{Quota: match[1]}
+	var ok bool
+	if exceeded.Requested, ok = parseResourceList(match[2]); !ok {
+		return nil, false
+	}
+	if exceeded.Used, ok = parseResourceList(match[3]); !ok {
+		return nil, false
+	}
+	if exceeded.Limited, ok = parseResourceList(match[4]); !ok {
+		return nil, false
+	}
+	return exceeded, true
+}
+
+// parseResourceList parses a list like `limits.cpu=2,limits.memory=2Gi`. Trailing punctuation of the message, e.g.
+// a closing quote, is ignored.
+func parseResourceList(list string) (v12.ResourceList, bool) {
+	list = strings.TrimRight(list, `".;)'`)
+	result := v12.ResourceList{}
+	for _, item := range strings.Split(list, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, false
+		}
+		quantity, err := resource.ParseQuantity(parts[1])
+		if err != nil {
+			return nil, false
+		}
+		result[v12.ResourceName(parts[0])] = quantity
+	}
+	return result, true
+}
+
+// RequestedResources converts the exceeded resources requested by the Pod to Resources. The CPU and memory requests
+// are named cpu and memory, other resources keep their name. The requests and limits are kept apart, the ResourceQuota
+// usage is normalized when the limits follow the requests.
+func (exceeded *QuotaExceeded) RequestedResources() resources.Resources {
+	res := resources.Resources{}
+	for name, quantity := range exceeded.Requested {
+		switch name {
+		case v12.ResourceRequestsCPU:
+			name = v12.ResourceCPU
+		case v12.ResourceRequestsMemory:
+			name = v12.ResourceMemory
+		}
+		res.Max(resources.Resources{name: quantity})
+	}
+	return res
+}
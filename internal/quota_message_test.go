@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"testing"
+
+	v15 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseQuotaExceeded(t *testing.T) {
+	tests := []struct {
+		name      string
+		message   string
+		ok        bool
+		quota     string
+		requested string
+	}{
+		{
+			name:      "ReplicaSet limits (1.18)",
+			message:   `Error creating: pods "app-7d9c6b7f4-x2v9k" is forbidden: exceeded quota: compute-resources, requested: limits.cpu=2,limits.memory=2Gi, used: limits.cpu=9,limits.memory=15Gi, limited: limits.cpu=10,limits.memory=16Gi`,
+			ok:        true,
+			quota:     "compute-resources",
+			requested: "limits.cpu=2, limits.memory=2Gi",
+		},
+		{
+			name:      "ReplicaSet requests (1.9)",
+			message:   `Error creating: pods "app-1234-abcd" is forbidden: exceeded quota: quota, requested: requests.cpu=500m, used: requests.cpu=1800m, limited: requests.cpu=2`,
+			ok:        true,
+			quota:     "quota",
+			requested: "cpu=500m",
+		},
+		{
+			name:      "StatefulSet",
+			message:   `create Pod db-0 in StatefulSet db failed error: pods "db-0" is forbidden: exceeded quota: compute, requested: requests.memory=4Gi, used: requests.memory=6Gi, limited: requests.memory=8Gi`,
+			ok:        true,
+			quota:     "compute",
+			requested: "memory=4Gi",
+		},
+		{
+			name:      "Job with plain resource names (1.24)",
+			message:   `Error creating: pods "backup-27853-7xk2p" is forbidden: exceeded quota: compute-resources, requested: cpu=1,memory=1G, used: cpu=3500m,memory=7G, limited: cpu=4,memory=8G`,
+			ok:        true,
+			quota:     "compute-resources",
+			requested: "cpu=1, memory=1G",
+		},
+		{
+			name:      "cert-manager PresentError",
+			message:   `Error presenting challenge: pods "cm-acme-http-solver-6xz2b" is forbidden: exceeded quota: example-dev-quota, requested: limits.cpu=100m,limits.memory=64Mi, used: limits.cpu=20,limits.memory=8000M, limited: limits.cpu=20,limits.memory=8000M`,
+			ok:        true,
+			quota:     "example-dev-quota",
+			requested: "limits.cpu=100m, limits.memory=64Mi",
+		},
+		{
+			name:    "Missing limits",
+			message: `Error creating: pods "app-x" is forbidden: failed quota: compute-resources: must specify limits.cpu,limits.memory`,
+		},
+		{
+			name:    "LimitRange",
+			message: `Error creating: pods "app-x" is forbidden: maximum cpu usage per Container is 2, but limit is 4`,
+		},
+	}
+
+	for _, test := range tests {
+		exceeded, ok := ParseQuotaExceeded(test.message)
+		if ok != test.ok {
+			t.Errorf("%s: expected parsed %t but got: %t\n", test.name, test.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if exceeded.Quota != test.quota {
+			t.Errorf("%s: expected quota %s but got: %s\n", test.name, test.quota, exceeded.Quota)
+		}
+		if requested := exceeded.RequestedResources().String(); requested != test.requested {
+			t.Errorf("%s: expected requested %s but got: %s\n", test.name, test.requested, requested)
+		}
+	}
+}
+
+func TestGetResourcesFromQuotaExceededEvents(t *testing.T) {
+	var replicas int32 = 4
+	client := fake.NewSimpleClientset(&v15.ReplicaSet{
+		ObjectMeta: v13.ObjectMeta{Name: "app", Namespace: "example-dev"},
+		Spec:       v15.ReplicaSetSpec{Replicas: &replicas},
+		Status:     v15.ReplicaSetStatus{Replicas: 1},
+	})
+	message := `Error creating: pods "app-x2v9k" is forbidden: exceeded quota: quota, requested: requests.cpu=500m,requests.memory=1G, used: requests.cpu=1800m,requests.memory=1G, limited: requests.cpu=2,requests.memory=1500M`
+
+	// The requested resources of the message are multiplied by the missing replicas of the owner
+	sum, _ := GetResourcesFromPodEvents(client, nil, nil, []v12.Event{{
+		InvolvedObject: v12.ObjectReference{Kind: "ReplicaSet", Name: "app", Namespace: "example-dev"},
+		Message:        message,
+	}})
+	if sum.Cpu() != 1500 || sum.Memory() != 3000 {
+		t.Errorf("expected 1500m 3000M for 3 missing replicas but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+
+	// Owners that cannot be resolved miss a single Pod
+	sum, _ = GetResourcesFromPodEvents(client, nil, nil, []v12.Event{{
+		InvolvedObject: v12.ObjectReference{Kind: "CronJob", Name: "backup", Namespace: "example-dev"},
+		Message:        message,
+	}})
+	if sum.Cpu() != 500 || sum.Memory() != 1000 {
+		t.Errorf("expected 500m 1000M for an unknown owner but got: %dm %dM\n", sum.Cpu(), sum.Memory())
+	}
+
+	// A StatefulSet misses the storage of the claim of its message
+	client = fake.NewSimpleClientset(&v15.StatefulSet{
+		ObjectMeta: v13.ObjectMeta{Name: "db", Namespace: "example-dev"},
+		Spec:       v15.StatefulSetSpec{Replicas: &replicas},
+		Status:     v15.StatefulSetStatus{Replicas: 3},
+	})
+	sum, _ = GetResourcesFromPodEvents(client, nil, nil, []v12.Event{{
+		InvolvedObject: v12.ObjectReference{Kind: "StatefulSet", Name: "db", Namespace: "example-dev"},
+		Reason:         "FailedCreate",
+		Message:        `create Claim data-db-3 for Pod db-3 in StatefulSet db failed error: persistentvolumeclaims "data-db-3" is forbidden: exceeded quota: storage, requested: requests.storage=50Gi, used: requests.storage=180Gi, limited: requests.storage=200Gi`,
+	}})
+	if storage := sum[v12.ResourceRequestsStorage]; storage.String() != "50Gi" || len(sum) != 1 {
+		t.Errorf("expected 50Gi storage for a claim of a StatefulSet but got: %s\n", sum)
+	}
+}
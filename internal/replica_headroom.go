@@ -0,0 +1,168 @@
+package internal
+
+// This file keeps room in the quota for the workloads of HorizontalPodAutoscalers and KEDA ScaledObjects. Without it
+// every scale out of an autoscaler first fails with FailedCreate. With the replicaHeadroom of a QuotaAutoscaler the
+// quota has room for each target to reach its desired replicas or its maximum: the missing replicas times the
+// resources of a Pod of its template. KEDA manages an HPA for every ScaledObject, a target is only counted once.
+//
+// Example usage:
+//  autoscalers := &internal.HorizontalAutoscalers{Client: client, Dynamic: dynamicClient, Owners: owners}
+//  headroom, err := autoscalers.Headroom("example-dev", v14.MaxReplicaHeadroom)
+//  // e.g. Deployment web runs 2 of maxReplicas 10 Pods of cpu=500m, memory=1G: cpu=4, memory=8G
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ScaledObjectResource is the resource of the KEDA ScaledObjects.
+var ScaledObjectResource = schema.GroupVersionResource{Group: "keda.sh", Version: "v1alpha1", Resource: "scaledobjects"}
+
+// kedaDefaultMaxReplicas is the maxReplicaCount of a ScaledObject that does not set it
+const kedaDefaultMaxReplicas = 100
+
+// HorizontalAutoscalers reads the HorizontalPodAutoscalers and KEDA ScaledObjects of a namespace.
+type HorizontalAutoscalers struct {
+	Client         kubernetes.Interface
+	Dynamic        dynamic.Interface // Reads the ScaledObjects, may be nil
+	Owners         *OwnerResolver    // Resolves targets that are not built in, may be nil
+	RuntimeClasses *RuntimeClasses   // Resolves the overhead of the templates, may be nil
+}
+
+// scaleTarget is a workload of an autoscaler and the replicas it can scale to
+type scaleTarget struct {
+	ref      v12.ObjectReference
+	replicas int32
+}
+
+// Headroom returns the resources that the targets of the autoscalers need to reach their desired or max replicas,
+// on top of their current replicas. Targets that cannot be resolved are skipped. This is a slow call.
+func (autoscalers *HorizontalAutoscalers) Headroom(namespace string, mode v14.ReplicaHeadroom) (resources.Resources, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	targets := map[string]*scaleTarget{}
+	add := func(ref v12.ObjectReference, replicas int32) {
+		ref.Namespace = namespace
+		key := ref.Kind + "/" + ref.Name
+		if target, ok := targets[key]; !ok || target.replicas < replicas {
+			targets[key] = &scaleTarget{ref: ref, replicas: replicas}
+		}
+	}
+
+	hpas, err := autoscalers.Client.AutoscalingV1().HorizontalPodAutoscalers(namespace).List(ctx, v13.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, hpa := range hpas.Items {
+		replicas := hpa.Spec.MaxReplicas
+		if mode == v14.DesiredReplicaHeadroom {
+			replicas = hpa.Status.DesiredReplicas
+		}
+		target := hpa.Spec.ScaleTargetRef
+		add(v12.ObjectReference{APIVersion: target.APIVersion, Kind: target.Kind, Name: target.Name}, replicas)
+	}
+
+	// The desired replicas of a ScaledObject are those of its HPA
+	if autoscalers.Dynamic != nil && mode == v14.MaxReplicaHeadroom {
+		scaledObjects, err := autoscalers.Dynamic.Resource(ScaledObjectResource).Namespace(namespace).List(ctx, v13.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			scaledObjects = &unstructured.UnstructuredList{} // KEDA is not installed
+		} else if err != nil {
+			return nil, err
+		}
+		for _, scaledObject := range scaledObjects.Items {
+			ref, replicas := scaledObjectTarget(&scaledObject)
+			add(ref, replicas)
+		}
+	}
+
+	headroom := resources.Resources{}
+	for _, target := range targets {
+		pod, current, err := autoscalers.resolve(ctx, target.ref)
+		if err != nil {
+			logging.LogWarning("[%s] Cannot resolve the autoscaled %s %s: %v", namespace, target.ref.Kind, target.ref.Name, err)
+			continue
+		}
+		var sidecars map[string]bool
+		if len(pod.Spec.InitContainers) > 0 {
+			sidecars = autoscalers.Owners.RestartableInitContainers(target.ref)
+		}
+		headroom.Add(CalculatePodResources(autoscalers.RuntimeClasses.WithOverhead(pod), sidecars, int64(target.replicas-current)))
+	}
+	return headroom, nil
+}
+
+// scaledObjectTarget returns the target of a ScaledObject and its maxReplicaCount, with the defaults of KEDA.
+func scaledObjectTarget(scaledObject *unstructured.Unstructured) (v12.ObjectReference, int32) {
+	ref := v12.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment"}
+	ref.Name, _, _ = unstructured.NestedString(scaledObject.Object, "spec", "scaleTargetRef", "name")
+	if apiVersion, _, _ := unstructured.NestedString(scaledObject.Object, "spec", "scaleTargetRef", "apiVersion"); apiVersion != "" {
+		ref.APIVersion = apiVersion
+	}
+	if kind, _, _ := unstructured.NestedString(scaledObject.Object, "spec", "scaleTargetRef", "kind"); kind != "" {
+		ref.Kind = kind
+	}
+
+	replicas, found, _ := unstructured.NestedInt64(scaledObject.Object, "spec", "maxReplicaCount")
+	if !found {
+		replicas = kedaDefaultMaxReplicas
+	}
+	return ref, int32(replicas)
+}
+
+// resolve returns the Pod template and the current replicas of an autoscaled workload.
+func (autoscalers *HorizontalAutoscalers) resolve(ctx context.Context, ref v12.ObjectReference) (v12.PodTemplateSpec, int32, error) {
+	apps := schema.FromAPIVersionAndKind(ref.APIVersion, ref.Kind).Group == "apps"
+	switch {
+	case apps && ref.Kind == "Deployment":
+		target, err := autoscalers.Client.AppsV1().Deployments(ref.Namespace).Get(ctx, ref.Name, v13.GetOptions{})
+		if err != nil {
+			return v12.PodTemplateSpec{}, 0, err
+		}
+		return target.Spec.Template, target.Status.Replicas, nil
+	case apps && ref.Kind == "StatefulSet":
+		target, err := autoscalers.Client.AppsV1().StatefulSets(ref.Namespace).Get(ctx, ref.Name, v13.GetOptions{})
+		if err != nil {
+			return v12.PodTemplateSpec{}, 0, err
+		}
+		return target.Spec.Template, target.Status.Replicas, nil
+	case apps && ref.Kind == "ReplicaSet":
+		target, err := autoscalers.Client.AppsV1().ReplicaSets(ref.Namespace).Get(ctx, ref.Name, v13.GetOptions{})
+		if err != nil {
+			return v12.PodTemplateSpec{}, 0, err
+		}
+		return target.Spec.Template, target.Status.Replicas, nil
+	case autoscalers.Owners.Allows(ref):
+		pod, _, current, err := autoscalers.Owners.ResolveReplicas(ref)
+		return pod, current, err
+	}
+	return v12.PodTemplateSpec{}, 0, fmt.Errorf("unsupported target kind %s", ref.Kind)
+}
+
+// replicaHeadroom returns the headroom of the QuotaAutoscaler of the namespace, empty when it has no replicaHeadroom
+// or it cannot be read.
+func (watcher *QuotaWatcher) replicaHeadroom(namespace string, scaler v14.QuotaAutoscaler) resources.Resources {
+	mode := scaler.Spec.ReplicaHeadroom
+	if watcher.Autoscalers == nil || mode == "" || mode == v14.NoReplicaHeadroom {
+		return resources.Resources{}
+	}
+	headroom, err := watcher.Autoscalers.Headroom(namespace, mode)
+	if err != nil {
+		logging.LogWarning("[%s] Cannot read the horizontal autoscalers: %s", namespace, err.Error())
+		return resources.Resources{}
+	}
+	return headroom
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	ichpfake "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned/fake"
+	v15 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestDeployment(namespace, name, cpu, memory string, replicas int32) *v15.Deployment {
+	return &v15.Deployment{
+		ObjectMeta: v13.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v15.DeploymentSpec{Replicas: &replicas, Template: v12.PodTemplateSpec{Spec: v12.PodSpec{Containers: []v12.Container{{
+			Name: "app",
+			Resources: v12.ResourceRequirements{
+				Requests: v12.ResourceList{v12.ResourceCPU: resource.MustParse(cpu), v12.ResourceMemory: resource.MustParse(memory)},
+			},
+		}}}}},
+		Status: v15.DeploymentStatus{Replicas: replicas},
+	}
+}
+
+func newTestHPA(namespace, target string, desired, max int32) *autoscalingv1.HorizontalPodAutoscaler {
+	return &autoscalingv1.HorizontalPodAutoscaler{
+		ObjectMeta: v13.ObjectMeta{Name: target, Namespace: namespace},
+		Spec: autoscalingv1.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv1.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: target},
+			MaxReplicas:    max,
+		},
+		Status: autoscalingv1.HorizontalPodAutoscalerStatus{DesiredReplicas: desired},
+	}
+}
+
+// newTestAutoscalers returns the autoscalers of Deployment web, which runs 2 Pods of an HPA with 4 desired and 10 max
+// replicas and a ScaledObject with 6 max replicas, and of Deployment worker, which runs 1 Pod of a ScaledObject with 3
+// max replicas.
+func newTestAutoscalers(t *testing.T, namespace string) *HorizontalAutoscalers {
+	client := fake.NewSimpleClientset(
+		newTestDeployment(namespace, "web", "500m", "1G", 2),
+		newTestDeployment(namespace, "worker", "250m", "500M", 1),
+		newTestHPA(namespace, "web", 4, 10),
+	)
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	for name, spec := range map[string]map[string]interface{}{
+		"web":    {"scaleTargetRef": map[string]interface{}{"name": "web"}, "maxReplicaCount": int64(6)},
+		"worker": {"scaleTargetRef": map[string]interface{}{"name": "worker", "kind": "Deployment"}, "maxReplicaCount": int64(3)},
+	} {
+		scaledObject := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "keda.sh/v1alpha1",
+			"kind":       "ScaledObject",
+			"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+			"spec":       spec,
+		}}
+		if _, err := dynamicClient.Resource(ScaledObjectResource).Namespace(namespace).Create(context.TODO(), scaledObject, v13.CreateOptions{}); err != nil {
+			t.Fatalf("expected no error but got: %v\n", err)
+		}
+	}
+	return &HorizontalAutoscalers{Client: client, Dynamic: dynamicClient}
+}
+
+func TestHorizontalAutoscalersHeadroom(t *testing.T) {
+	autoscalers := newTestAutoscalers(t, "example-dev")
+
+	// web misses 8 Pods to reach the maxReplicas of the HPA, which is above the ScaledObject, worker misses 2
+	headroom, err := autoscalers.Headroom("example-dev", v14.MaxReplicaHeadroom)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if headroom.Cpu() != 4500 || headroom.Memory() != 9000 || headroom.Value(v12.ResourcePods) != 10 {
+		t.Errorf("expected a headroom of cpu=4500m, memory=9000M, pods=10 but got: %v\n", headroom)
+	}
+
+	// Only the HPA knows the desired replicas
+	headroom, err = autoscalers.Headroom("example-dev", v14.DesiredReplicaHeadroom)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if headroom.Cpu() != 1000 || headroom.Memory() != 2000 {
+		t.Errorf("expected a headroom of cpu=1000m, memory=2000M but got: %v\n", headroom)
+	}
+
+	// Without KEDA only the HPAs count
+	autoscalers.Dynamic = nil
+	if headroom, _ := autoscalers.Headroom("example-dev", v14.MaxReplicaHeadroom); headroom.Cpu() != 4000 {
+		t.Errorf("expected a headroom of cpu=4000m but got: %v\n", headroom)
+	}
+}
+
+func TestUpdateQuotaReplicaHeadroom(t *testing.T) {
+	scaler := newTestScaler("example-dev")
+	scaler.Spec.ReplicaHeadroom = v14.MaxReplicaHeadroom
+	scaler.Spec.MaxCpu = "3"
+	ichpClient := ichpfake.NewSimpleClientset(scaler)
+	var resizes []NamespaceResizeEvent
+	watcher := &QuotaWatcher{
+		Client:      fake.NewSimpleClientset(),
+		IchpClient:  ichpClient,
+		History:     NewScalingHistory(),
+		Autoscalers: newTestAutoscalers(t, "example-dev"),
+		Resize:      func(resize NamespaceResizeEvent) { resizes = append(resizes, resize) },
+	}
+
+	// The used resources plus the headroom, the CPU is capped by maxCpu
+	quota := newTestNamespaceQuota("example-dev", "900m")
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 || resizes[0].New.Cpu() != 3000 || resizes[0].New.Memory() != 9500 {
+		t.Fatalf("expected a resize to cpu=3, memory=9500M but got: %+v\n", resizes)
+	}
+	updated, _ := ichpClient.IchpV1().QuotaAutoscalers("example-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+	if headroom := resources.Resources(updated.Status.HeadroomResources); headroom.Cpu() != 4500 || headroom.Memory() != 9000 {
+		t.Errorf("expected a headroom of cpu=4500m, memory=9000M but got: %v\n", headroom)
+	}
+
+	// Without replicaHeadroom the autoscalers are ignored
+	scaler.Spec.ReplicaHeadroom = v14.NoReplicaHeadroom
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 {
+		t.Errorf("expected no resize without headroom but got: %+v\n", resizes[1:])
+	}
+}
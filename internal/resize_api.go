@@ -1,31 +1,49 @@
 package internal
 
-// This file contains the InvokeResizeApi function which calls the ICHP API namespace
-// PATCH operation. The ICHP API is discovered via environment variable ICHP_API_ENDPOINT.
-// The authentication is done via a bearer token stored in environment variable TOKEN.
+// This file contains the RunEventHandler which calls ResizeApiFunc for every namespace resize, serialised per
+// namespace. ResizeApiFunc is set to a resize.Backend by UseResizeBackend, see pkg/resize.
 
 import (
 	"context"
+	"errors"
 	"github.com/ing-bank/quota-scaler/pkg/kubeconfig"
 	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resize"
 	"github.com/ing-bank/quota-scaler/pkg/resources"
-	"github.com/ing-bank/quota-scaler/pkg/utils"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io/ioutil"
-	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
-	"net/http"
-	"os"
 	"time"
 )
 
 type NamespaceResizeEvent struct {
-	Namespace     string
-	ResourceQuota string
-	Old           resources.Resources
-	New           resources.Resources
+	Namespace         string
+	ResourceQuota     string
+	Old               resources.Resources
+	New               resources.Resources
+	CpuLimitRatio     int64
+	IndependentLimits bool
+
+	done func(err error) // Called with the result of the resize API or errResizeSuperseded, may be nil
+}
+
+// errResizeSuperseded is the result of a pending resize that was replaced by a newer resize of its namespace
+var errResizeSuperseded = errors.New("superseded by a newer resize")
+
+// finish reports the result of the resize to the requester.
+func (event NamespaceResizeEvent) finish(err error) {
+	if event.done != nil {
+		event.done(err)
+	}
+}
+
+// Request converts the event to a request for a resize.Backend.
+func (event NamespaceResizeEvent) Request() resize.Request {
+	return resize.Request{
+		Namespace:         event.Namespace,
+		ResourceQuota:     event.ResourceQuota,
+		Old:               event.Old,
+		New:               event.New,
+		CpuLimitRatio:     event.CpuLimitRatio,
+		IndependentLimits: event.IndependentLimits,
+	}
 }
 
 type ResizeResult struct {
@@ -35,193 +53,161 @@ type ResizeResult struct {
 
 var ResizeNsChan = make(chan NamespaceResizeEvent)
 var ResizeResultChan = make(chan ResizeResult, 1024)
-var eventDoneChan = make(chan NamespaceResizeEvent)
-
-type IchpApiResponse struct {
-	Clusters []struct {
-		Message string `json:"message"`
-	} `json:"clusters"`
-	Status    string `json:"status"`
-	RequestId string `json:"requestID"`
-}
-
-// NamespacePatch is the expected schema for an ICHP-API namespace patch operation
-type NamespacePatch struct {
-	Name     string             `json:"name"`
-	Workload string             `json:"workload,omitempty"`
-	Spec     NamespacePatchSpec `json:"spec"`
-}
-
-type NamespacePatchSpec struct {
-	Quota NamespacePatchSpecQuota `json:"quota"`
-}
+var eventDoneChan = make(chan ResizeResult)
 
-type NamespacePatchSpecQuota struct {
-	Cpu     int64 `json:"cpu"`
-	Memory  int64 `json:"memory"`
-	Storage int64 `json:"storage"`
-}
+var ResizeApiFunc = InvokeResizeApiStub // Replaced by UseResizeBackend
 
-type ResizeCache struct {
-	Timestamp time.Time
-	Event     NamespaceResizeEvent
+// UseResizeBackend makes the event handler resize namespaces with the backend. It must be called before
+// RunEventHandler is started.
+func UseResizeBackend(backend resize.Backend) {
+	ResizeApiFunc = func(ns NamespaceResizeEvent) error {
+		return backend.Resize(context.Background(), ns.Request())
+	}
 }
 
-var ResizeApiFunc = InvokeResizeApiStub // TODO: replace this with your own stack resize!
-
 func publishResizeResult(ns NamespaceResizeEvent, err error) {
 	select {
 	case ResizeResultChan <- ResizeResult{NamespaceResizeEvent: ns, Err: err}:
 	default: //NoBlock
+		resizeResultsDroppedCounter.Inc()
 	}
 }
 
 func resizeAsync(event NamespaceResizeEvent) {
+	var err error
 	defer func() {
-		eventDoneChan <- event
+		eventDoneChan <- ResizeResult{NamespaceResizeEvent: event, Err: err}
 	}()
 
-	if err := ResizeApiFunc(event); err != nil {
-		logging.LogError("[%s] Failed to resize ns (%+v): %v\n", event.Namespace, event, err)
+	start := time.Now()
+	err = ResizeApiFunc(event)
+	observeResize(start, err)
+	event.finish(err)
+	if err != nil {
+		logging.LogError("[%s] Failed to resize ns (%+v): %v\n", event.Namespace, event.Request(), err)
 		publishResizeResult(event, err)
 		return
 	}
 
-	logging.LogInfo("[%s] Namespace resized: %+v\n", event.Namespace, event)
+	logging.LogInfo("[%s] Namespace resized: %+v\n", event.Namespace, event.Request())
 	publishResizeResult(event, nil)
 }
 
-// RunEventHandler listens to Async Resize API requests. Replies are published on ResizeResultChan and must be
-// read.
-func RunEventHandler() { // Blocks, forever
-	inProgress := map[string]bool{}              // Namespace resizes that the resize API is currently executing
-	pending := map[string]NamespaceResizeEvent{} // Resize that is waiting for previous resize API to finish
-	cache := map[string]ResizeCache{}
-
-	resize := func(event NamespaceResizeEvent) bool {
-		if previous, ok := cache[event.Namespace]; ok {
-			if (event.New.Cpu < previous.Event.New.Cpu || event.New.Memory < previous.Event.New.Memory) && previous.Timestamp.Add(time.Minute).After(time.Now()) {
-				// Scale down is allowed max once per hour, so ignore this request
-				logging.LogInfo("[%s] We updated this object recently (%v) and this is a scaleDown (%v) which will fail. Ignoring this resize event.", event.Namespace, previous, event)
-				return false
-			}
-		}
-		go resizeAsync(event)
-		return true
-	}
+// ResizeQueue serialises resizes per namespace: a namespace has at most one resize in progress and one pending. A
+// newer resize replaces the pending resize of its namespace, only the latest desired quota matters. The pending resize
+// was calculated from the quota before the resize in progress, it is rebased on that resize when it was applied. It is
+// not safe for concurrent use.
+type ResizeQueue struct {
+	inProgress map[string]bool                 // Namespace resizes that the resize API is currently executing
+	pending    map[string]NamespaceResizeEvent // Resize that is waiting for previous resize API to finish
+}
 
-	for {
-		select {
-		case event := <-ResizeNsChan:
-			if inProgress[event.Namespace] {
-				// Resize API is already handling this namespace, keep event (newest) to execute in the future
-				pending[event.Namespace] = event
-			} else {
-				// Resize API was not handling this namespace
-				if resize(event) {
-					inProgress[event.Namespace] = true
-				}
-			}
+func NewResizeQueue() *ResizeQueue {
+	return &ResizeQueue{inProgress: map[string]bool{}, pending: map[string]NamespaceResizeEvent{}}
+}
 
-		case ns := <-eventDoneChan:
-			cache[ns.Namespace] = ResizeCache{Timestamp: time.Now(), Event: ns}
-
-			// inProgress is still set, see if there are any Pending
-			if event, ok := pending[ns.Namespace]; ok {
-				delete(pending, ns.Namespace) // Consume latest event
-				if !resize(event) {
-					inProgress[ns.Namespace] = false // All events done
-				}
-			} else {
-				inProgress[ns.Namespace] = false // All events done
-			}
+// Add returns whether the resize can start, otherwise it is kept until the resize in progress is done. A pending resize
+// that is replaced finishes with errResizeSuperseded.
+func (queue *ResizeQueue) Add(event NamespaceResizeEvent) bool {
+	if queue.inProgress[event.Namespace] {
+		// Resize API is already handling this namespace, keep event (newest) to execute in the future
+		if previous, ok := queue.pending[event.Namespace]; ok {
+			previous.finish(errResizeSuperseded)
 		}
+		queue.pending[event.Namespace] = event
+		return false
 	}
+	queue.inProgress[event.Namespace] = true
+	return true
 }
 
-func InvokeResizeApiAsync(namespace, resourcequota string, old, new resources.Resources) {
-	// Storage scaling is not yet supported, old and new are always the same
-	ResizeNsChan <- NamespaceResizeEvent{namespace, resourcequota, old, new}
-}
-
-// TODO: this is left as an example as a resize endpoint, this code is not used
-// InvokeResizeApi issues a namespace patch operation to the ICHP-API. The provided `cpu` must in
-// Milli Cores and the `memory` must be in Mega Bytes. The ICHP-API is discovered via environment
-// variable `ICHP_API_ENDPOINT`, with bearer token auth using environment variable `TOKEN`.
-func InvokeResizeApi(ns NamespaceResizeEvent) error {
-	body, err := json.Marshal(&NamespacePatch{
-		Name:     ns.Namespace,
-		Workload: os.Getenv("WORKLOAD"),
-		Spec: NamespacePatchSpec{
-			Quota: NamespacePatchSpecQuota{
-				Cpu:     ns.New.Cpu,
-				Memory:  ns.New.Memory,
-				Storage: ns.New.Storage,
-			},
-		},
-	})
-	if err != nil {
-		return err
+// Done marks the resize of the namespace as done, and returns the pending resize that starts next if there is one. A
+// pending resize that is left without changes after the rebase finishes without calling the resize API.
+func (queue *ResizeQueue) Done(result ResizeResult) (NamespaceResizeEvent, bool) {
+	// inProgress is still set, see if there are any Pending
+	event, ok := queue.pending[result.Namespace]
+	delete(queue.pending, result.Namespace) // Consume latest event
+	if ok && result.Err == nil {
+		var changed bool
+		if event, changed = event.rebase(result.NamespaceResizeEvent); !changed {
+			event.finish(nil) // The applied resize already has the quota of the pending resize
+			ok = false
+		}
 	}
-
-	token, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
-	if err != nil {
-		return errors.New("cannot read serviceaccount token: " + err.Error())
+	if !ok {
+		delete(queue.inProgress, result.Namespace) // All events done
 	}
+	return event, ok
+}
 
-	endpoint := os.Getenv("ICHP_API_ENDPOINT")
-	logging.LogInfo("[%s] Calling %s with CPU: %d Memory: %d Storage %d\n", ns.Namespace, endpoint, ns.New.Cpu, ns.New.Memory, ns.New.Storage)
-	endpoint += "/api/v1/namespace"
-	response, err := utils.HttpPatch(
-		endpoint,
-		map[string]string{
-			"Content-Type":  "application/json",
-			"Authorization": "Bearer " + string(token),
-		},
-		body,
-	)
-	if err != nil {
-		return err
+// rebase returns the resize on top of an applied resize, which was requested before it. Resources that the resize
+// does not change keep the applied quota, and it does not undo the scale up of the applied resize, e.g. the growth for
+// a Pod. Returns false when the rebased resize changes nothing.
+func (event NamespaceResizeEvent) rebase(applied NamespaceResizeEvent) (NamespaceResizeEvent, bool) {
+	rebased := event
+	rebased.Old, rebased.New = event.Old.Copy(), event.New.Copy()
+	for name := range event.New {
+		appliedNew, ok := applied.New[name]
+		if !ok {
+			continue
+		}
+		unchanged := event.New.Value(name) == event.Old.Value(name)
+		undoesScaleUp := applied.New.Value(name) > applied.Old.Value(name) && event.New.Value(name) < applied.New.Value(name)
+		if unchanged || undoesScaleUp {
+			rebased.New[name] = appliedNew.DeepCopy()
+		}
+		rebased.Old[name] = appliedNew.DeepCopy()
 	}
 
-	defer response.Body.Close()
-	respBody, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return err
+	for name := range rebased.New {
+		if rebased.New.Value(name) != rebased.Old.Value(name) {
+			return rebased, true
+		}
 	}
+	return rebased, false
+}
+
+// Len returns the number of resizes in progress and pending.
+func (queue *ResizeQueue) Len() (int, int) {
+	return len(queue.inProgress), len(queue.pending)
+}
+
+// RunEventHandler listens to Async Resize API requests. Replies are published on ResizeResultChan and must be
+// read.
+func RunEventHandler() { // Blocks, forever
+	// Scale down damping is done by the stabilization windows of the QuotaAutoscaler behaviors, see stabilization.go
+	queue := NewResizeQueue()
 
-	// TODO: We should wrap this via https://haisum.github.io/2021/08/14/2021-golang-http-errors/
-	parsedResp := &IchpApiResponse{}
-	if err := json.Unmarshal(respBody, parsedResp); err == nil {
-		if response.StatusCode == http.StatusOK {
-			logging.LogInfo("[%s] Resize API (%dm, %dM) reply: [%s] %s", ns.Namespace, ns.New.Cpu, ns.New.Memory, parsedResp.RequestId, parsedResp.Status)
-		} else {
-			errorMsg := []string{}
-			for _, cluster := range parsedResp.Clusters {
-				errorMsg = append(errorMsg, cluster.Message)
+	for {
+		select {
+		case event := <-ResizeNsChan:
+			if queue.Add(event) {
+				go resizeAsync(event)
+			}
+
+		case result := <-eventDoneChan:
+			if event, ok := queue.Done(result); ok {
+				go resizeAsync(event)
 			}
-			logging.LogError("[%s] Resize API (%dm, %dM) reply: [%s] %s: %v", ns.Namespace, ns.New.Cpu, ns.New.Memory, parsedResp.RequestId, parsedResp.Status, errorMsg)
 		}
-	}
 
-	if response.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("resize API status NOK: %s\n", response.Status))
+		inProgress, pending := queue.Len()
+		resizesInProgressGauge.Set(float64(inProgress))
+		resizesPendingGauge.Set(float64(pending))
 	}
-	return nil
 }
 
+// InvokeResizeApiAsync queues the resize of a namespace for the event handler, see RunEventHandler.
+func InvokeResizeApiAsync(event NamespaceResizeEvent) {
+	ResizeNsChan <- event
+}
+
+// InvokeResizeApiStub patches the ResourceQuota directly, see resize.StubBackend.
 func InvokeResizeApiStub(ns NamespaceResizeEvent) error {
 	client, err := kubeconfig.GetKubernetesClient()
 	if err != nil {
 		return err
 	}
 
-	// Example of resize, e.g. Patch ResourceQuota. But, you should replace this with your own stack!
-	fastMergeExample := []byte(fmt.Sprintf("{\"spec\": {\"hard\": {\"cpu\": \"%dm\", \"limits.cpu\": \"%dm\", \"memory\": \"%dM\", \"limits.memory\": \"%dm\"}}}",
-		ns.New.Cpu, ns.New.Cpu*REQ_LIM_RATIO, // CPU, CPU LIMIT
-		ns.New.Memory, ns.New.Memory, // MEM, MEM LIMIT
-	))
-	_, err = client.CoreV1().ResourceQuotas(ns.Namespace).Patch(context.TODO(), ns.ResourceQuota, types.MergePatchType, fastMergeExample, v1.PatchOptions{})
-	// TODO: Do charging events
-	return err
+	return (&resize.StubBackend{Client: client}).Resize(context.TODO(), ns.Request())
 }
@@ -1,56 +1,74 @@
 package internal
 
 import (
+	"errors"
 	"github.com/ing-bank/quota-scaler/pkg/resources"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// fakeResizeLock guards the counters below, FakeResizeApiCall is called concurrently
+var fakeResizeLock sync.Mutex
 var resizeApiCalledExampleDev = 0
 var exampleDevCpu int64 = 0
 
 var resizeApiCalledFooDev = 0
 var fooDevCpu int64 = 0
 
+var startEventHandlerOnce sync.Once
+
+// startEventHandler starts the (global) RunEventHandler with FakeResizeApiCall once for all tests
+func startEventHandler() {
+	startEventHandlerOnce.Do(func() {
+		ResizeApiFunc = FakeResizeApiCall
+		go RunEventHandler()
+	})
+}
+
 func FakeResizeApiCall(ns NamespaceResizeEvent) error {
 	<-time.After(100 * time.Millisecond)
+	fakeResizeLock.Lock()
+	defer fakeResizeLock.Unlock()
 	if ns.Namespace == "example-dev" {
 		resizeApiCalledExampleDev++
-		exampleDevCpu = ns.New.Cpu
+		exampleDevCpu = ns.New.Cpu()
 	} else if ns.Namespace == "foo-dev" {
 		resizeApiCalledFooDev++
-		fooDevCpu = ns.New.Cpu
+		fooDevCpu = ns.New.Cpu()
 	}
 
 	return nil
 }
 
 func TestRunEventHandler(t *testing.T) {
-	ResizeApiFunc = FakeResizeApiCall
+	startEventHandler()
 
-	resizeResultsReceived := 0
-	go RunEventHandler()
+	var resizeResultsReceived int32 = 0
 	go func() {
 		<-ResizeResultChan
-		resizeResultsReceived++
+		atomic.AddInt32(&resizeResultsReceived, 1)
 		<-ResizeResultChan
-		resizeResultsReceived++
+		atomic.AddInt32(&resizeResultsReceived, 1)
 	}()
 
 	for i := 1; i <= 4000; i++ {
-		InvokeResizeApiAsync(
-			"example-dev",
-			resources.Resources{Cpu: int64(399 + i), Memory: int64(999 + i)},
-			resources.Resources{Cpu: int64(400 + i), Memory: int64(1000 + i)},
-		)
-		InvokeResizeApiAsync(
-			"foo-dev",
-			resources.Resources{Cpu: int64(399 + i), Memory: int64(999 + i)},
-			resources.Resources{Cpu: int64(400 + i), Memory: int64(1000 + i)},
-		)
+		InvokeResizeApiAsync(NamespaceResizeEvent{
+			Namespace: "example-dev", ResourceQuota: "example-dev-quota",
+			Old: resources.New(int64(399+i), int64(999+i)),
+			New: resources.New(int64(400+i), int64(1000+i)),
+		})
+		InvokeResizeApiAsync(NamespaceResizeEvent{
+			Namespace: "foo-dev", ResourceQuota: "foo-dev-quota",
+			Old: resources.New(int64(399+i), int64(999+i)),
+			New: resources.New(int64(400+i), int64(1000+i)),
+		})
 	}
 
 	time.Sleep(250 * time.Millisecond)
+	fakeResizeLock.Lock()
+	defer fakeResizeLock.Unlock()
 	if resizeApiCalledExampleDev != 2 {
 		t.Errorf("expected resize API to be called 2 times for example-dev but got: %d\n", resizeApiCalledExampleDev)
 	}
@@ -65,7 +83,58 @@ func TestRunEventHandler(t *testing.T) {
 		t.Errorf("expected foo-dev Cpu CPU to be 1400 but got: %d\n", fooDevCpu)
 	}
 
-	if resizeResultsReceived != 2 {
-		t.Errorf("expected resizeResultsReceived to be 2 but got: %d\n", resizeResultsReceived)
+	if received := atomic.LoadInt32(&resizeResultsReceived); received != 2 {
+		t.Errorf("expected resizeResultsReceived to be 2 but got: %d\n", received)
+	}
+}
+
+func TestResizeQueueSupersedes(t *testing.T) {
+	queue := NewResizeQueue()
+	var results []error
+	done := func(err error) { results = append(results, err) }
+
+	if !queue.Add(NamespaceResizeEvent{Namespace: "example-dev", done: done}) {
+		t.Fatalf("expected the first resize to start\n")
+	}
+	queue.Add(NamespaceResizeEvent{Namespace: "example-dev", done: done})
+	queue.Add(NamespaceResizeEvent{Namespace: "example-dev", New: resources.New(2000, 1000), done: done})
+	if len(results) != 1 || results[0] != errResizeSuperseded {
+		t.Errorf("expected the first pending resize to be superseded but got: %v\n", results)
+	}
+
+	next, ok := queue.Done(ResizeResult{NamespaceResizeEvent: NamespaceResizeEvent{Namespace: "example-dev"}})
+	if !ok || next.New.Cpu() != 2000 {
+		t.Errorf("expected the newest resize to start next but got: %+v\n", next)
+	}
+}
+
+func TestResizeQueueRebase(t *testing.T) {
+	queue := NewResizeQueue()
+	grown := NamespaceResizeEvent{Namespace: "example-dev", Old: resources.New(1000, 1000), New: resources.New(1300, 1000)}
+	queue.Add(grown)
+
+	// A resize calculated before the growth keeps the growth, and its own change of the memory
+	queue.Add(NamespaceResizeEvent{Namespace: "example-dev", Old: resources.New(1000, 1000), New: resources.New(1100, 1500)})
+	next, ok := queue.Done(ResizeResult{NamespaceResizeEvent: grown})
+	if !ok || next.Old.Cpu() != 1300 || next.New.Cpu() != 1300 || next.New.Memory() != 1500 {
+		t.Errorf("expected the pending resize to be rebased to cpu=1300m, memory=1500M but got: %+v\n", next)
+	}
+
+	// A scale down that would undo the growth is left without changes, it finishes without resizing
+	var results []error
+	queue.Add(NamespaceResizeEvent{Namespace: "example-dev", Old: resources.New(1000, 1000), New: resources.New(800, 1000),
+		done: func(err error) { results = append(results, err) }})
+	if _, ok := queue.Done(ResizeResult{NamespaceResizeEvent: grown}); ok || len(results) != 1 || results[0] != nil {
+		t.Errorf("expected the pending resize to finish without resizing but got: %v\n", results)
+	}
+	if inProgress, pending := queue.Len(); inProgress != 0 || pending != 0 {
+		t.Errorf("expected no resizes but got: %d in progress, %d pending\n", inProgress, pending)
+	}
+
+	// The quota did not change when the resize failed
+	queue.Add(grown)
+	queue.Add(NamespaceResizeEvent{Namespace: "example-dev", Old: resources.New(1000, 1000), New: resources.New(800, 1000)})
+	if next, ok := queue.Done(ResizeResult{NamespaceResizeEvent: grown, Err: errors.New("timeout")}); !ok || next.New.Cpu() != 800 {
+		t.Errorf("expected the pending resize to start as is but got: %+v\n", next)
 	}
 }
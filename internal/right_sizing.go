@@ -0,0 +1,223 @@
+package internal
+
+// This file turns the consumption of the Pods, see consumption.go, into right-sizing recommendations and into the
+// targets of the cpuConsumption and memoryConsumption scale down policies. A container is over-requested when it
+// consumes less than half of its CPU or memory request in every Pod of its workload. The recommended request is the
+// highest consumption plus 25% headroom.
+//
+// Example usage:
+//  consumed, recommendations := RightSize(pods, consumption)
+//  // e.g. Deployment web, container app: requested cpu=2, memory=4G, consumed cpu=150m, memory=800M,
+//  //      recommended cpu=188m, memory=1000M
+//
+//  down := consumptionScaleDown(validatedScaler, scaler.Spec.Behavior.ScaleDown, &quota, consumed, independent)
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/ing-bank/quota-scaler/pkg/utils"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	OverRequestedReason = "OverRequested"
+
+	// overRequestedPercentage is the consumption in percent of the request below which a container is over-requested
+	overRequestedPercentage = 50
+	// recommendationHeadroom is the headroom in percent on top of the highest consumption of a recommended request
+	recommendationHeadroom = 25
+	// maxRecommendations limits the size of the status
+	maxRecommendations = 10
+)
+
+// consumptionPolicies maps the methods of the consumption policies to the resource that they scale
+var consumptionPolicies = map[string]v12.ResourceName{
+	"cpuconsumption":    v12.ResourceCPU,
+	"memoryconsumption": v12.ResourceMemory,
+}
+
+func isConsumptionPolicy(policy v14.QuotaScalePolicy) bool {
+	_, ok := consumptionPolicies[strings.ToLower(policy.Method)]
+	return ok
+}
+
+// workloadKey identifies a container of a workload
+type workloadKey struct {
+	kind, name, container string
+}
+
+// RightSize returns the total consumption of the running Pods and the recommendations for their over-requested
+// containers, the most over-requested first. Pods without consumption are skipped.
+func RightSize(pods []v12.Pod, consumption map[string]PodConsumption) (resources.Resources, []v14.WorkloadRecommendation) {
+	consumed := resources.New(0, 0)
+	workloads := map[workloadKey]*v14.WorkloadRecommendation{}
+	for _, pod := range pods {
+		podConsumption, ok := consumption[pod.Name]
+		if !ok || pod.Status.Phase != v12.PodRunning {
+			continue
+		}
+		kind, name := workloadOf(&pod)
+		for _, container := range pod.Spec.Containers {
+			used, ok := podConsumption[container.Name]
+			if !ok {
+				continue
+			}
+			consumed.Add(used.Only(v12.ResourceCPU, v12.ResourceMemory))
+
+			key := workloadKey{kind, name, container.Name}
+			workload, ok := workloads[key]
+			if !ok {
+				workload = &v14.WorkloadRecommendation{Kind: kind, Name: name, Container: container.Name, Consumed: resources.New(0, 0).ToResourceList()}
+				workloads[key] = workload
+			}
+			workload.Pods++
+			workload.Requested = resources.Resources(container.Resources.Requests).Only(v12.ResourceCPU, v12.ResourceMemory).ToResourceList()
+			workload.Consumed = resources.Resources(workload.Consumed).Max(used.Only(v12.ResourceCPU, v12.ResourceMemory)).ToResourceList()
+		}
+	}
+
+	var recommendations []v14.WorkloadRecommendation
+	for _, workload := range workloads {
+		if recommended, ok := recommend(workload.Requested, workload.Consumed); ok {
+			workload.Recommended = recommended
+			recommendations = append(recommendations, *workload)
+		}
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		a, b := recommendations[i], recommendations[j]
+		if wasteA, wasteB := overRequested(a), overRequested(b); wasteA != wasteB {
+			return wasteA > wasteB
+		}
+		return fmt.Sprint(a.Kind, a.Name, a.Container) < fmt.Sprint(b.Kind, b.Name, b.Container)
+	})
+	if len(recommendations) > maxRecommendations {
+		recommendations = recommendations[:maxRecommendations]
+	}
+	return consumed, recommendations
+}
+
+// recommend returns the recommended requests of a container, when it is over-requested. Requests that are not
+// over-requested are kept.
+func recommend(requested, consumed v12.ResourceList) (v12.ResourceList, bool) {
+	recommended := resources.Resources(requested).Copy()
+	over := false
+	for name := range requested {
+		request, used := resources.Resources(requested).Value(name), resources.Resources(consumed).Value(name)
+		if request == 0 || used*100 >= request*overRequestedPercentage {
+			continue
+		}
+		recommended.Set(name, utils.Max((used*(100+recommendationHeadroom)+99)/100, 1))
+		over = true
+	}
+	return recommended.ToResourceList(), over
+}
+
+// overRequested returns the CPU in milli cores and memory in Mega bytes that all Pods of the workload request above
+// the recommendation.
+func overRequested(recommendation v14.WorkloadRecommendation) int64 {
+	requested, recommended := resources.Resources(recommendation.Requested), resources.Resources(recommendation.Recommended)
+	return int64(recommendation.Pods) * (requested.Cpu() - recommended.Cpu() + requested.Memory() - recommended.Memory())
+}
+
+// workloadOf returns the kind and name of the workload of a Pod: the Deployment of a ReplicaSet, the controller or the
+// Pod itself.
+func workloadOf(pod *v12.Pod) (string, string) {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller == nil || !*owner.Controller {
+			continue
+		}
+		if hash, ok := pod.Labels["pod-template-hash"]; ok && owner.Kind == "ReplicaSet" && strings.HasSuffix(owner.Name, "-"+hash) {
+			return "Deployment", strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		return owner.Kind, owner.Name
+	}
+	return "Pod", pod.Name
+}
+
+// recommendationMessage describes a recommendation for an OverRequested Event
+func recommendationMessage(recommendation v14.WorkloadRecommendation) string {
+	return fmt.Sprintf("%s %s container %s requests %s but consumes at most %s, recommended requests: %s",
+		recommendation.Kind, recommendation.Name, recommendation.Container, resources.Resources(recommendation.Requested),
+		resources.Resources(recommendation.Consumed), resources.Resources(recommendation.Recommended))
+}
+
+// namespaceConsumption is the consumption of the Pods of a namespace and their right-sizing recommendations
+type namespaceConsumption struct {
+	Consumed        resources.Resources
+	Recommendations []v14.WorkloadRecommendation
+}
+
+// readConsumption returns the consumption of the Pods of the namespace when the scaler uses the Metrics usageSource,
+// nil otherwise or when it cannot be read. This is a slow call.
+func (watcher *QuotaWatcher) readConsumption(namespace string, scaler v14.QuotaAutoscaler) *namespaceConsumption {
+	if scaler.Spec.UsageSource != v14.MetricsUsageSource || watcher.Consumption == nil {
+		return nil
+	}
+	consumption, err := watcher.Consumption.PodConsumption(namespace)
+	if err != nil {
+		logging.LogWarning("[%s] Cannot read the consumption of the Pods: %s", namespace, err.Error())
+		return nil
+	}
+	pods, err := watcher.Client.CoreV1().Pods(namespace).List(context.TODO(), v13.ListOptions{})
+	if err != nil {
+		logging.LogWarning("[%s] Cannot list the Pods: %s", namespace, err.Error())
+		return nil
+	}
+
+	consumed, recommendations := RightSize(pods.Items, consumption)
+	logging.LogDebug("[%s] Pods consume %v, %d over-requested containers", namespace, consumed, len(recommendations))
+	return &namespaceConsumption{Consumed: consumed, Recommendations: recommendations}
+}
+
+// publishRecommendations publishes an OverRequested Event for each recommendation that the status does not report yet.
+func (watcher *QuotaWatcher) publishRecommendations(scaler v14.QuotaAutoscaler, recommendations []v14.WorkloadRecommendation) {
+	reported := map[string]bool{}
+	for _, recommendation := range scaler.Status.Recommendations {
+		reported[recommendationMessage(recommendation)] = true
+	}
+
+	ref := scalerReference(&scaler)
+	for _, recommendation := range recommendations {
+		if msg := recommendationMessage(recommendation); !reported[msg] {
+			go func() {
+				if err := publishEvent(watcher.Client, ref, OverRequestedReason, "Normal", msg); err != nil {
+					logging.LogError("[%s] Cannot publish namespace event: %s", scaler.Namespace, err.Error())
+				}
+			}()
+		}
+	}
+}
+
+// consumptionScaleDown returns the targets of the consumption policies of a scale down behavior. They treat the
+// consumption as usage, but never go below the used requests: the quota that Pods hold cannot be released.
+func consumptionScaleDown(scaler *ValidatedQuotaScaler, behavior v14.QuotaScaleBehavior, quota *v12.ResourceQuota, consumed resources.Resources, independent bool) resources.Resources {
+	consumption := v14.QuotaScaleBehavior{SelectPolicy: behavior.SelectPolicy}
+	for _, policy := range behavior.Policies {
+		if name, ok := consumptionPolicies[strings.ToLower(policy.Method)]; ok {
+			policy.Method = string(name)
+			consumption.Policies = append(consumption.Policies, policy)
+		}
+	}
+	if len(consumption.Policies) == 0 {
+		return resources.Resources{}
+	}
+
+	consumedQuota := quota.DeepCopy()
+	consumedQuota.Status.Used[v12.ResourceCPU] = *consumed.Quantity(v12.ResourceCPU)
+	consumedQuota.Status.Used[v12.ResourceMemory] = *consumed.Quantity(v12.ResourceMemory)
+	delete(consumedQuota.Status.Used, v12.ResourceLimitsMemory) // The memory policies would use the memory limits
+
+	targets := scaler.ActivateScalerBehavior(consumption, consumedQuota, false).Only(v12.ResourceCPU, v12.ResourceMemory)
+	used := usedResources(quota, []v12.ResourceName{v12.ResourceCPU, v12.ResourceMemory}, independent)
+	for name := range targets {
+		targets.Set(name, utils.Max(targets.Value(name), used.Value(name)))
+	}
+	return targets
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	ichpfake "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned/fake"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeConsumption is a ConsumptionSource with fixed consumption, or an error when it is nil
+type fakeConsumption map[string]PodConsumption
+
+func (consumption fakeConsumption) PodConsumption(string) (map[string]PodConsumption, error) {
+	if consumption == nil {
+		return nil, errors.New("the server could not find the requested resource")
+	}
+	return consumption, nil
+}
+
+func newTestWorkloadPod(namespace, name, replicaSet, cpu, memory string) *v12.Pod {
+	controller := true
+	return &v12.Pod{
+		ObjectMeta: v13.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			Labels:          map[string]string{"pod-template-hash": "6f7d"},
+			OwnerReferences: []v13.OwnerReference{{Kind: "ReplicaSet", Name: replicaSet, Controller: &controller}},
+		},
+		Spec: v12.PodSpec{Containers: []v12.Container{{Name: "app", Resources: v12.ResourceRequirements{
+			Requests: v12.ResourceList{v12.ResourceCPU: resource.MustParse(cpu), v12.ResourceMemory: resource.MustParse(memory)},
+		}}}},
+		Status: v12.PodStatus{Phase: v12.PodRunning},
+	}
+}
+
+func TestRightSize(t *testing.T) {
+	pods := []v12.Pod{
+		*newTestWorkloadPod("example-dev", "web-6f7d-a", "web-6f7d", "400m", "250M"),
+		*newTestWorkloadPod("example-dev", "web-6f7d-b", "web-6f7d", "400m", "250M"),
+		*newTestWorkloadPod("example-dev", "api-6f7d-a", "api-6f7d", "200m", "100M"),
+		*newTestWorkloadPod("example-dev", "worker", "", "1", "1G"),
+	}
+	pods[3].OwnerReferences = nil
+	consumption := fakeConsumption{
+		"web-6f7d-a": {"app": resources.New(50, 100)},
+		"web-6f7d-b": {"app": resources.New(80, 120)},
+		"api-6f7d-a": {"app": resources.New(150, 90)},
+		"worker":     {"app": resources.New(300, 200)},
+	}
+
+	consumed, recommendations := RightSize(pods, consumption)
+	if consumed.Cpu() != 580 || consumed.Memory() != 510 {
+		t.Errorf("expected a consumption of cpu=580m, memory=510M but got: %v\n", consumed)
+	}
+
+	// The worker wastes more than web, api consumes most of its requests
+	if len(recommendations) != 2 {
+		t.Fatalf("expected 2 recommendations but got: %+v\n", recommendations)
+	}
+	if worker := recommendations[0]; worker.Kind != "Pod" || worker.Name != "worker" {
+		t.Errorf("expected the worker Pod first but got: %+v\n", worker)
+	}
+	web := recommendations[1]
+	if web.Kind != "Deployment" || web.Name != "web" || web.Container != "app" || web.Pods != 2 {
+		t.Errorf("expected the app container of Deployment web with 2 Pods but got: %+v\n", web)
+	}
+	if recommended := resources.Resources(web.Recommended); recommended.Cpu() != 100 || recommended.Memory() != 150 {
+		t.Errorf("expected recommended requests cpu=100m, memory=150M but got: %v\n", recommended)
+	}
+	if consumed := resources.Resources(web.Consumed); consumed.Cpu() != 80 || consumed.Memory() != 120 {
+		t.Errorf("expected the highest consumption cpu=80m, memory=120M but got: %v\n", consumed)
+	}
+}
+
+func TestUpdateQuotaConsumption(t *testing.T) {
+	scaler := newTestScaler("lean-dev")
+	scaler.Spec.UsageSource = v14.MetricsUsageSource
+	scaler.Spec.Behavior.ScaleDown.Policies = []v14.QuotaScalePolicy{{Method: "cpuConsumption", Value: 50}}
+	ichpClient := ichpfake.NewSimpleClientset(scaler)
+	client := fake.NewSimpleClientset([]runtime.Object{
+		newTestWorkloadPod("lean-dev", "web-6f7d-a", "web-6f7d", "400m", "250M"),
+		newTestWorkloadPod("lean-dev", "web-6f7d-b", "web-6f7d", "400m", "250M"),
+	}...)
+	var resizes []NamespaceResizeEvent
+	watcher := &QuotaWatcher{
+		Client:      client,
+		IchpClient:  ichpClient,
+		History:     NewScalingHistory(),
+		Consumption: fakeConsumption{"web-6f7d-a": {"app": resources.New(50, 100)}, "web-6f7d-b": {"app": resources.New(80, 120)}},
+		Resize:      func(resize NamespaceResizeEvent) { resizes = append(resizes, resize) },
+	}
+
+	// The Pods consume 13% of the quota, but the requests of 800m cannot be released
+	quota := newTestNamespaceQuota("lean-dev", "800m")
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 || resizes[0].New.Cpu() != 800 {
+		t.Fatalf("expected a scale down to the 800m CPU requests but got: %+v\n", resizes)
+	}
+
+	updated, _ := ichpClient.IchpV1().QuotaAutoscalers("lean-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+	if consumed := resources.Resources(updated.Status.ConsumedResources); consumed.Cpu() != 130 || consumed.Memory() != 220 {
+		t.Errorf("expected a consumption of cpu=130m, memory=220M but got: %v\n", consumed)
+	}
+	if len(updated.Status.Recommendations) != 1 || updated.Status.Recommendations[0].Name != "web" {
+		t.Errorf("expected a recommendation for Deployment web but got: %+v\n", updated.Status.Recommendations)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		events, _ := client.CoreV1().Events("lean-dev").List(context.TODO(), v13.ListOptions{})
+		if len(events.Items) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	events, _ := client.CoreV1().Events("lean-dev").List(context.TODO(), v13.ListOptions{})
+	if len(events.Items) != 1 || events.Items[0].Reason != OverRequestedReason {
+		t.Fatalf("expected an OverRequested Event but got: %+v\n", events.Items)
+	}
+
+	// When the metrics are unavailable the recommendations are kept and the consumption policies are skipped
+	watcher.Consumption = fakeConsumption(nil)
+	if err := watcher.UpdateQuotaIfRequired(*quota, *updated, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 {
+		t.Errorf("expected no resize without consumption but got: %+v\n", resizes[1:])
+	}
+	updated, _ = ichpClient.IchpV1().QuotaAutoscalers("lean-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+	if len(updated.Status.Recommendations) != 1 {
+		t.Errorf("expected the recommendation to be kept but got: %+v\n", updated.Status.Recommendations)
+	}
+}
@@ -0,0 +1,126 @@
+package internal
+
+// This file resolves the overhead of RuntimeClasses. The RuntimeClass admission copies the overhead of the RuntimeClass
+// of a Pod to its spec.overhead, but the templates of Pod owners only name the RuntimeClass. Without the overhead the
+// resources of Pods with e.g. a gVisor or Kata RuntimeClass are underestimated. The typed API of this client only knows
+// node.k8s.io/v1beta1, which is not served since Kubernetes 1.25, so node.k8s.io/v1 is read with the dynamic client.
+//
+// Example usage:
+//  runtimeClasses := internal.NewRuntimeClasses(client, dynamicClient)
+//  template = runtimeClasses.WithOverhead(template)
+//  needed := internal.CalculatePodResources(template, nil, 1)
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RuntimeClassResource is the resource of the node.k8s.io/v1 RuntimeClasses, served since Kubernetes 1.20.
+var RuntimeClassResource = schema.GroupVersionResource{Group: "node.k8s.io", Version: "v1", Resource: "runtimeclasses"}
+
+// RuntimeClassCacheTTL is how long the RuntimeClasses are cached, they rarely change
+const RuntimeClassCacheTTL = 10 * time.Minute
+
+// RuntimeClasses caches the overhead of the node.k8s.io RuntimeClasses. It is safe for concurrent use.
+type RuntimeClasses struct {
+	Client  kubernetes.Interface // Reads the node.k8s.io/v1beta1 RuntimeClasses when v1 is not served
+	Dynamic dynamic.Interface    // Reads the node.k8s.io/v1 RuntimeClasses, may be nil
+
+	lock     sync.Mutex
+	overhead map[string]v12.ResourceList // Overhead by RuntimeClass, nil when they were never read
+	listed   time.Time
+}
+
+func NewRuntimeClasses(client kubernetes.Interface, dynamicClient dynamic.Interface) *RuntimeClasses {
+	return &RuntimeClasses{Client: client, Dynamic: dynamicClient}
+}
+
+// Overhead returns the Pod overhead of the RuntimeClass, nil when it has none or the RuntimeClasses cannot be read.
+// The RuntimeClasses are read again when the cache is older than the RuntimeClassCacheTTL.
+func (classes *RuntimeClasses) Overhead(name string) v12.ResourceList {
+	classes.lock.Lock()
+	defer classes.lock.Unlock()
+
+	if classes.overhead == nil || time.Since(classes.listed) > RuntimeClassCacheTTL {
+		// A failure keeps the previous cache until the next TTL, the API server is not asked for every Pod
+		classes.listed = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		overhead, err := classes.list(ctx)
+		if err != nil {
+			logging.LogWarning("Cannot read the RuntimeClasses, Pod overhead is ignored: %v", err)
+			if classes.overhead == nil {
+				classes.overhead = map[string]v12.ResourceList{}
+			}
+		} else {
+			classes.overhead = overhead
+		}
+	}
+	return classes.overhead[name]
+}
+
+// list returns the overhead of the node.k8s.io/v1 RuntimeClasses, or of v1beta1 when v1 is not served.
+func (classes *RuntimeClasses) list(ctx context.Context) (map[string]v12.ResourceList, error) {
+	overhead := map[string]v12.ResourceList{}
+	if classes.Dynamic != nil {
+		list, err := classes.Dynamic.Resource(RuntimeClassResource).List(ctx, v13.ListOptions{})
+		if err == nil {
+			for _, class := range list.Items {
+				if podFixed := runtimeClassOverhead(&class); podFixed != nil {
+					overhead[class.GetName()] = podFixed
+				}
+			}
+			return overhead, nil
+		} else if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	list, err := classes.Client.NodeV1beta1().RuntimeClasses().List(ctx, v13.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, class := range list.Items {
+		if class.Overhead != nil {
+			overhead[class.Name] = class.Overhead.PodFixed
+		}
+	}
+	return overhead, nil
+}
+
+// runtimeClassOverhead returns the overhead.podFixed of a RuntimeClass, nil when it has none. Quantities that do not
+// parse are skipped, the API server validates them.
+func runtimeClassOverhead(class *unstructured.Unstructured) v12.ResourceList {
+	podFixed, found, _ := unstructured.NestedStringMap(class.Object, "overhead", "podFixed")
+	if !found {
+		return nil
+	}
+	overhead := v12.ResourceList{}
+	for name, value := range podFixed {
+		if quantity, err := resource.ParseQuantity(value); err == nil {
+			overhead[v12.ResourceName(name)] = quantity
+		}
+	}
+	return overhead
+}
+
+// WithOverhead returns the template with the overhead of its RuntimeClass, like the RuntimeClass admission sets it on a
+// Pod. Templates without RuntimeClass or with an overhead are returned as is, as are all templates when classes is nil.
+func (classes *RuntimeClasses) WithOverhead(template v12.PodTemplateSpec) v12.PodTemplateSpec {
+	if classes == nil || template.Spec.RuntimeClassName == nil || template.Spec.Overhead != nil {
+		return template
+	}
+	template.Spec.Overhead = classes.Overhead(*template.Spec.RuntimeClassName)
+	return template
+}
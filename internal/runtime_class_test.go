@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"testing"
+
+	v12 "k8s.io/api/core/v1"
+	nodev1beta1 "k8s.io/api/node/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestRuntimeClass returns a node.k8s.io/v1 RuntimeClass with a Pod overhead of cpu and memory
+func newTestRuntimeClass(name, cpu, memory string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "node.k8s.io/v1",
+		"kind":       "RuntimeClass",
+		"metadata":   map[string]interface{}{"name": name},
+		"handler":    name,
+		"overhead":   map[string]interface{}{"podFixed": map[string]interface{}{"cpu": cpu, "memory": memory}},
+	}}
+}
+
+func TestRuntimeClassesOverhead(t *testing.T) {
+	runtimeClass := "kata"
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newTestRuntimeClass(runtimeClass, "250m", "120M"),
+		&unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "node.k8s.io/v1",
+			"kind":       "RuntimeClass",
+			"metadata":   map[string]interface{}{"name": "runc"},
+			"handler":    "runc",
+		}},
+	)
+	classes := NewRuntimeClasses(fake.NewSimpleClientset(), dynamicClient)
+
+	// The overhead is read from node.k8s.io/v1
+	overhead := classes.Overhead(runtimeClass)
+	if overhead.Cpu().MilliValue() != 250 || overhead.Memory().ScaledValue(resource.Mega) != 120 {
+		t.Errorf("expected an overhead of cpu=250m, memory=120M but got: %v\n", overhead)
+	}
+	if overhead := classes.Overhead("runc"); overhead != nil {
+		t.Errorf("expected no overhead but got: %v\n", overhead)
+	}
+
+	// The template of a Pod owner gets the overhead of its RuntimeClass
+	template := classes.WithOverhead(v12.PodTemplateSpec{Spec: v12.PodSpec{RuntimeClassName: &runtimeClass}})
+	if template.Spec.Overhead.Cpu().MilliValue() != 250 {
+		t.Errorf("expected an overhead of cpu=250m but got: %v\n", template.Spec.Overhead)
+	}
+}
+
+func TestRuntimeClassesOverheadBeta(t *testing.T) {
+	client := fake.NewSimpleClientset(&nodev1beta1.RuntimeClass{
+		ObjectMeta: v13.ObjectMeta{Name: "kata"},
+		Handler:    "kata",
+		Overhead:   &nodev1beta1.Overhead{PodFixed: v12.ResourceList{v12.ResourceCPU: resource.MustParse("100m")}},
+	})
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dynamicClient.PrependReactor("list", "runtimeclasses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(RuntimeClassResource.GroupResource(), "")
+	})
+
+	// Clusters before Kubernetes 1.20 only serve node.k8s.io/v1beta1
+	if overhead := NewRuntimeClasses(client, dynamicClient).Overhead("kata"); overhead.Cpu().MilliValue() != 100 {
+		t.Errorf("expected an overhead of cpu=100m but got: %v\n", overhead)
+	}
+}
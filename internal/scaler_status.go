@@ -0,0 +1,154 @@
+package internal
+
+// This file maintains the status subresource of QuotaAutoscalers. The status is written after every calculation
+// in UpdateQuotaIfRequired and after every ResizeResult, so tenants can see what the scaler did after the
+// QuotaResize Events have expired.
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// UpdateScalerStatus fetches the latest version of a QuotaAutoscaler, applies mutate to its status and writes it
+// back via the status subresource. Nothing is written when mutate does not change the status. Conflicts are retried.
+func UpdateScalerStatus(client versioned.Interface, namespace, name string, mutate func(status *v14.QuotaAutoscalerStatus)) error {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(10*time.Second))
+	defer cancel()
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scaler, err := client.IchpV1().QuotaAutoscalers(namespace).Get(ctx, name, v13.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		status := scaler.Status.DeepCopy()
+		mutate(status)
+		if equality.Semantic.DeepEqual(*status, scaler.Status) {
+			return nil
+		}
+
+		scaler.Status = *status
+		_, err = client.IchpV1().QuotaAutoscalers(namespace).UpdateStatus(ctx, scaler, v13.UpdateOptions{})
+		return err
+	})
+}
+
+// SetScalerCondition adds or updates the condition of the given type. LastTransitionTime is only changed when the
+// condition status changes.
+func SetScalerCondition(status *v14.QuotaAutoscalerStatus, condType v14.QuotaAutoscalerConditionType, condStatus v12.ConditionStatus, reason, message string) {
+	for i := range status.Conditions {
+		cond := &status.Conditions[i]
+		if cond.Type != condType {
+			continue
+		}
+		if cond.Status != condStatus {
+			cond.LastTransitionTime = v13.Now()
+		}
+		cond.Status = condStatus
+		cond.Reason = reason
+		cond.Message = message
+		return
+	}
+
+	status.Conditions = append(status.Conditions, v14.QuotaAutoscalerCondition{
+		Type:               condType,
+		Status:             condStatus,
+		LastTransitionTime: v13.Now(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// GetScalerCondition returns the condition of the given type, or nil when it is not set.
+func GetScalerCondition(status *v14.QuotaAutoscalerStatus, condType v14.QuotaAutoscalerConditionType) *v14.QuotaAutoscalerCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// CalculationStatus returns a status mutation that records the outcome of UpdateQuotaIfRequired.
+func CalculationStatus(generation, cpuPercentage, memoryPercentage int64, desired resources.Resources, resizing bool) func(status *v14.QuotaAutoscalerStatus) {
+	return func(status *v14.QuotaAutoscalerStatus) {
+		status.ObservedGeneration = generation
+		status.CpuUsagePercentage = cpuPercentage
+		status.MemoryUsagePercentage = memoryPercentage
+		status.LastDesiredResources = desired.ToResourceList()
+
+		SetScalerCondition(status, v14.ConditionQuotaNotFound, v12.ConditionFalse, "QuotaFound", "")
+		SetScalerCondition(status, v14.ConditionReady, v12.ConditionTrue, "Calculated", "")
+		if resizing {
+			SetScalerCondition(status, v14.ConditionScalingActive, v12.ConditionTrue, "ResizeRequested",
+				fmt.Sprintf("Requested resize to %s", desired))
+		} else {
+			SetScalerCondition(status, v14.ConditionScalingActive, v12.ConditionFalse, "DesiredQuotaReached", "")
+		}
+	}
+}
+
+// DryRunCalculationStatus returns a status mutation that records the outcome of UpdateQuotaIfRequired in dry run. The
+// desired resources are recorded, but no resize is requested.
+func DryRunCalculationStatus(generation, cpuPercentage, memoryPercentage int64, desired resources.Resources, wouldResize bool) func(status *v14.QuotaAutoscalerStatus) {
+	calculated := CalculationStatus(generation, cpuPercentage, memoryPercentage, desired, false)
+	return func(status *v14.QuotaAutoscalerStatus) {
+		calculated(status)
+		if wouldResize {
+			SetScalerCondition(status, v14.ConditionScalingActive, v12.ConditionFalse, WouldResizeReason, wouldResizeMessage(desired))
+		}
+	}
+}
+
+// WouldResizeReason is the reason of the ScalingActive condition and the Event of a resize that was not requested
+// because of the dry run.
+const WouldResizeReason = "WouldResize"
+
+func wouldResizeMessage(desired resources.Resources) string {
+	return fmt.Sprintf("Dry run, would resize to %s", desired)
+}
+
+// CalculationFailedStatus returns a status mutation that records a failed run of UpdateQuotaIfRequired.
+func CalculationFailedStatus(generation int64, err error) func(status *v14.QuotaAutoscalerStatus) {
+	return func(status *v14.QuotaAutoscalerStatus) {
+		status.ObservedGeneration = generation
+		SetScalerCondition(status, v14.ConditionReady, v12.ConditionFalse, "CalculationFailed", err.Error())
+	}
+}
+
+// QuotaNotFoundStatus returns a status mutation that records that the referenced ResourceQuota is missing.
+func QuotaNotFoundStatus(generation int64, quotaName string) func(status *v14.QuotaAutoscalerStatus) {
+	return func(status *v14.QuotaAutoscalerStatus) {
+		msg := fmt.Sprintf("ResourceQuota %s not found", quotaName)
+		status.ObservedGeneration = generation
+		SetScalerCondition(status, v14.ConditionQuotaNotFound, v12.ConditionTrue, "QuotaNotFound", msg)
+		SetScalerCondition(status, v14.ConditionReady, v12.ConditionFalse, "QuotaNotFound", msg)
+	}
+}
+
+// ResizeResultStatus returns a status mutation that records the outcome of a resize API call.
+func ResizeResultStatus(ev ResizeResult) func(status *v14.QuotaAutoscalerStatus) {
+	return func(status *v14.QuotaAutoscalerStatus) {
+		now := v13.Now()
+		status.LastResizeTime = &now
+
+		if ev.Err != nil {
+			status.LastResizeError = ev.Err.Error()
+			SetScalerCondition(status, v14.ConditionResizeFailing, v12.ConditionTrue, "ResizeFailed", ev.Err.Error())
+			return
+		}
+
+		status.LastResizeError = ""
+		status.LastAppliedResources = ev.New.ToResourceList()
+		SetScalerCondition(status, v14.ConditionResizeFailing, v12.ConditionFalse, "ResizeSucceeded", "")
+	}
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned/fake"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateScalerStatus(t *testing.T) {
+	client := fake.NewSimpleClientset(&v14.QuotaAutoscaler{
+		ObjectMeta: v13.ObjectMeta{Name: "example-dev-scaler", Namespace: "example-dev", Generation: 2},
+		Spec:       v14.QuotaAutoscalerSpec{ResourceQuota: "example-dev-quota"},
+	})
+
+	desired := resources.New(2500, 4000)
+	if err := UpdateScalerStatus(client, "example-dev", "example-dev-scaler", CalculationStatus(2, 64, 71, desired, true)); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	result := ResizeResult{NamespaceResizeEvent: NamespaceResizeEvent{Namespace: "example-dev", New: desired}, Err: errors.New("backend down")}
+	if err := UpdateScalerStatus(client, "example-dev", "example-dev-scaler", ResizeResultStatus(result)); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	scaler, _ := client.IchpV1().QuotaAutoscalers("example-dev").Get(context.TODO(), "example-dev-scaler", v13.GetOptions{})
+	status := scaler.Status
+	if status.ObservedGeneration != 2 {
+		t.Errorf("expected observedGeneration to be 2 but got: %d\n", status.ObservedGeneration)
+	}
+	if status.CpuUsagePercentage != 64 || status.MemoryUsagePercentage != 71 {
+		t.Errorf("expected usage to be 64/71 but got: %d/%d\n", status.CpuUsagePercentage, status.MemoryUsagePercentage)
+	}
+	if cpu := status.LastDesiredResources[v12.ResourceCPU]; cpu.String() != "2500m" {
+		t.Errorf("expected desired CPU to be 2500m but got: %s\n", cpu.String())
+	}
+	if status.LastAppliedResources != nil {
+		t.Errorf("expected no applied resources after a failed resize but got: %v\n", status.LastAppliedResources)
+	}
+	if status.LastResizeError != "backend down" || status.LastResizeTime == nil {
+		t.Errorf("expected resize error and time to be set but got: %q %v\n", status.LastResizeError, status.LastResizeTime)
+	}
+
+	expected := map[v14.QuotaAutoscalerConditionType]v12.ConditionStatus{
+		v14.ConditionReady:         v12.ConditionTrue,
+		v14.ConditionScalingActive: v12.ConditionTrue,
+		v14.ConditionResizeFailing: v12.ConditionTrue,
+		v14.ConditionQuotaNotFound: v12.ConditionFalse,
+	}
+	for condType, condStatus := range expected {
+		if cond := GetScalerCondition(&status, condType); cond == nil || cond.Status != condStatus {
+			t.Errorf("expected condition %s to be %s but got: %+v\n", condType, condStatus, cond)
+		}
+	}
+}
+
+func TestSetScalerConditionKeepsTransitionTime(t *testing.T) {
+	status := &v14.QuotaAutoscalerStatus{}
+	SetScalerCondition(status, v14.ConditionReady, v12.ConditionTrue, "Calculated", "")
+	transition := v13.Unix(0, 0)
+	status.Conditions[0].LastTransitionTime = transition
+
+	SetScalerCondition(status, v14.ConditionReady, v12.ConditionTrue, "Calculated", "again")
+	if len(status.Conditions) != 1 {
+		t.Fatalf("expected 1 condition but got: %d\n", len(status.Conditions))
+	}
+	if !status.Conditions[0].LastTransitionTime.Equal(&transition) {
+		t.Errorf("expected transition time to be unchanged but got: %v\n", status.Conditions[0].LastTransitionTime)
+	}
+
+	SetScalerCondition(status, v14.ConditionReady, v12.ConditionFalse, "QuotaNotFound", "")
+	if status.Conditions[0].LastTransitionTime.Equal(&transition) {
+		t.Errorf("expected transition time to be updated on status change\n")
+	}
+}
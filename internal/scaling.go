@@ -16,6 +16,9 @@ package internal
 //    active, desired := validatedScaler.ActivatePolicy(isScalingUp, policy, quota)
 //    if desired != -1 { writeYourScaleDownFunction(active) }
 //  }
+//
+//  // Or combine all policies of a behavior following its selectPolicy
+//  desired := validatedScaler.ActivateScalerBehavior(scaler.Spec.Behavior.ScaleDown, quota, false)
 
 import (
 	"github.com/ing-bank/quota-scaler/pkg/logging"
@@ -25,6 +28,7 @@ import (
 	v12 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	"strings"
+	"time"
 )
 
 type ValidatedQuotaScaler struct {
@@ -37,10 +41,48 @@ type ValidatedQuotaScaler struct {
 	MaxMemory     int64 `json:"maxMemory,omitempty"`
 	MinMemoryStep int64 `json:"minMemoryStep,omitempty"`
 	MaxMemoryStep int64 `json:"maxMemoryStep,omitempty"`
+
+	// CpuLimitRatio is the ratio between CPU limits and CPU requests, Independent scales the limits on their own
+	// within the limit bounds instead
+	CpuLimitRatio  int64 `json:"cpuLimitRatio"`
+	Independent    bool  `json:"independent,omitempty"`
+	MinCpuLimit    int64 `json:"minCpuLimit,omitempty"`
+	MaxCpuLimit    int64 `json:"maxCpuLimit,omitempty"`
+	MinMemoryLimit int64 `json:"minMemoryLimit,omitempty"`
+	MaxMemoryLimit int64 `json:"maxMemoryLimit,omitempty"`
+
+	// Resources are the bounds of the other ResourceQuota resources, in the scale of the resource
+	Resources map[v12.ResourceName]ResourceBounds `json:"resources,omitempty"`
+
+	ScaleUp   ValidatedBehavior `json:"scaleUp,omitempty"`
+	ScaleDown ValidatedBehavior `json:"scaleDown,omitempty"`
+}
+
+// ResourceBounds are the bounds of a ResourceQuota resource in its scale, see resources.ScaleOf.
+type ResourceBounds struct {
+	Min     int64 `json:"min"`
+	Max     int64 `json:"max"`
+	MinStep int64 `json:"minStep"`
+	MaxStep int64 `json:"maxStep"`
+}
+
+// ValidatedBehavior contains the time based settings of a QuotaScaleBehavior.
+type ValidatedBehavior struct {
+	SelectPolicy        v1.ScalingPolicySelect `json:"selectPolicy,omitempty"`
+	StabilizationWindow time.Duration          `json:"stabilizationWindow,omitempty"`
+	RateLimits          []RateLimit            `json:"rateLimits,omitempty"`
+}
+
+// RateLimit limits the total change of a resource, in its scale, within a period. It is configured via periodMinutes
+// and maxChange on a policy.
+type RateLimit struct {
+	Resource  v12.ResourceName `json:"resource"`
+	Period    time.Duration    `json:"period"`
+	MaxChange int64            `json:"maxChange"`
 }
 
 type ActivePolicy struct {
-	IsCpu                  bool
+	Resource               v12.ResourceName
 	CurrentMaximum         int64
 	CurrentUsagePercentage int64
 	PolicyThreshold        int64
@@ -51,21 +93,113 @@ type ActivePolicy struct {
 }
 
 // ValidateQuotaScaler validates all fields of the given QuotaAutoscaler and converts them to Milli Cores for
-// CPU and Mega Bytes for Memory. When no values are provided defaults are filled in.
+// CPU, Mega Bytes for Memory and whole units for other resources. When no values are provided defaults are filled in.
 func ValidateQuotaScaler(scaler *v1.QuotaAutoscaler) *ValidatedQuotaScaler {
 	spec := scaler.Spec
-	return &ValidatedQuotaScaler{
-		MinCpu:        ParseQuantityWithDefault(spec.MinCpu, resource.Milli, 400),
-		MaxCpu:        ParseQuantityWithDefault(spec.MaxCpu, resource.Milli, 35000),
-		MinCpuStep:    ParseQuantityWithDefault(spec.MinCpuStep, resource.Milli, 10),
-		MaxCpuStep:    ParseQuantityWithDefault(spec.MinCpuStep, resource.Milli, 35000),
-		MinMemory:     ParseQuantityWithDefault(spec.MinMemory, resource.Mega, 1000),
-		MaxMemory:     ParseQuantityWithDefault(spec.MaxMemory, resource.Mega, 150000),
-		MinMemoryStep: ParseQuantityWithDefault(spec.MinMemoryStep, resource.Mega, 10),
-		MaxMemoryStep: ParseQuantityWithDefault(spec.MaxMemoryStep, resource.Mega, 150000),
+	defaults := CurrentClusterConfig().Defaults
+	validated := &ValidatedQuotaScaler{
+		MinCpu:        ParseQuantityWithDefault(spec.MinCpu, resource.Milli, defaults.MinCpu.ScaledValue(resource.Milli)),
+		MaxCpu:        ParseQuantityWithDefault(spec.MaxCpu, resource.Milli, defaults.MaxCpu.ScaledValue(resource.Milli)),
+		MinCpuStep:    ParseQuantityWithDefault(spec.MinCpuStep, resource.Milli, defaults.MinCpuStep.ScaledValue(resource.Milli)),
+		MaxCpuStep:    ParseQuantityWithDefault(spec.MaxCpuStep, resource.Milli, defaults.MaxCpuStep.ScaledValue(resource.Milli)),
+		MinMemory:     ParseQuantityWithDefault(spec.MinMemory, resource.Mega, defaults.MinMemory.ScaledValue(resource.Mega)),
+		MaxMemory:     ParseQuantityWithDefault(spec.MaxMemory, resource.Mega, defaults.MaxMemory.ScaledValue(resource.Mega)),
+		MinMemoryStep: ParseQuantityWithDefault(spec.MinMemoryStep, resource.Mega, defaults.MinMemoryStep.ScaledValue(resource.Mega)),
+		MaxMemoryStep: ParseQuantityWithDefault(spec.MaxMemoryStep, resource.Mega, defaults.MaxMemoryStep.ScaledValue(resource.Mega)),
+		CpuLimitRatio: DefaultCpuLimitRatio,
+		Resources:     map[v12.ResourceName]ResourceBounds{},
+	}
+	if spec.CpuLimitRatio != nil && *spec.CpuLimitRatio >= 0 {
+		validated.CpuLimitRatio = *spec.CpuLimitRatio
+	}
+	if spec.Mode == v1.IndependentQuotaMode {
+		validated.Independent = true
+		validated.MinCpuLimit = ParseQuantityWithDefault(spec.MinCpuLimit, resource.Milli, validated.MinCpu)
+		validated.MaxCpuLimit = ParseQuantityWithDefault(spec.MaxCpuLimit, resource.Milli, validated.MaxCpu)
+		validated.MinMemoryLimit = ParseQuantityWithDefault(spec.MinMemoryLimit, resource.Mega, validated.MinMemory)
+		validated.MaxMemoryLimit = ParseQuantityWithDefault(spec.MaxMemoryLimit, resource.Mega, validated.MaxMemory)
+	}
+	for _, bounds := range spec.Resources {
+		name := v12.ResourceName(strings.ToLower(string(bounds.Name)))
+		if isComputeResource(name) {
+			logging.LogWarning("[%s] Bounds of %s are ignored, they have their own fields", scaler.Namespace, name)
+			continue
+		}
+		scale := resources.ScaleOf(name)
+		max := ParseQuantityWithDefault(bounds.Max, scale, -1)
+		if max < 0 {
+			logging.LogWarning("[%s] Bounds of %s are ignored, they have no max", scaler.Namespace, name)
+			continue
+		}
+		validated.Resources[name] = ResourceBounds{
+			Min:     ParseQuantityWithDefault(bounds.Min, scale, 0),
+			Max:     max,
+			MinStep: ParseQuantityWithDefault(bounds.MinStep, scale, 1),
+			MaxStep: ParseQuantityWithDefault(bounds.MaxStep, scale, max),
+		}
+	}
+
+	validated.ScaleUp = validated.validateBehavior(spec.Behavior.ScaleUp, 0) // Scaling up is not stabilized by default
+	validated.ScaleDown = validated.validateBehavior(spec.Behavior.ScaleDown, defaults.ScaleDownStabilizationWindow.Duration)
+	return validated
+}
+
+// isComputeResource returns whether the resource is a CPU or memory request or limit, these are bounded by the
+// dedicated fields of the QuotaAutoscaler.
+func isComputeResource(name v12.ResourceName) bool {
+	switch name {
+	case v12.ResourceCPU, v12.ResourceRequestsCPU, v12.ResourceLimitsCPU,
+		v12.ResourceMemory, v12.ResourceRequestsMemory, v12.ResourceLimitsMemory:
+		return true
+	default:
+		return false
 	}
 }
 
+// validateBehavior converts the stabilization window and the policies with a periodMinutes of a behavior. The
+// maxChange of a policy defaults to the maximum step of its resource.
+func (scaler *ValidatedQuotaScaler) validateBehavior(behavior v1.QuotaScaleBehavior, defaultWindow time.Duration) ValidatedBehavior {
+	validated := ValidatedBehavior{
+		SelectPolicy:        behavior.SelectPolicy,
+		StabilizationWindow: defaultWindow,
+	}
+	if behavior.StabilizationWindowSeconds != nil && *behavior.StabilizationWindowSeconds >= 0 {
+		validated.StabilizationWindow = time.Duration(*behavior.StabilizationWindowSeconds) * time.Second
+	}
+	for _, policy := range behavior.Policies {
+		if policy.PeriodMinutes <= 0 {
+			continue
+		}
+
+		for _, name := range scaler.PolicyResources(policy) {
+			bounds, _ := scaler.Bounds(name)
+			validated.RateLimits = append(validated.RateLimits, RateLimit{
+				Resource:  name,
+				Period:    time.Duration(policy.PeriodMinutes) * time.Minute,
+				MaxChange: ParseQuantityWithDefault(policy.MaxChange, resources.ScaleOf(name), bounds.MaxStep),
+			})
+		}
+	}
+
+	return validated
+}
+
+// HistoryRetention returns how long scaling history is relevant for this scaler.
+func (scaler *ValidatedQuotaScaler) HistoryRetention() time.Duration {
+	retention := time.Duration(0)
+	for _, behavior := range []ValidatedBehavior{scaler.ScaleUp, scaler.ScaleDown} {
+		if behavior.StabilizationWindow > retention {
+			retention = behavior.StabilizationWindow
+		}
+		for _, limit := range behavior.RateLimits {
+			if limit.Period > retention {
+				retention = limit.Period
+			}
+		}
+	}
+	return retention
+}
+
 // ParseQuantityWithDefault attempts to parse the given value as the provided scale. Default is used when
 // parsing fails.
 func ParseQuantityWithDefault(value string, scale resource.Scale, def int64) int64 {
@@ -82,49 +216,141 @@ func ParseQuantityWithDefault(value string, scale resource.Scale, def int64) int
 	return parsedValue.ScaledValue(scale)
 }
 
-func (scaler *ValidatedQuotaScaler) ForceLimitToDefaultMax() {
-	// Get the default maximum values, these are the max allowed
-	defaultScaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{})
+// ForceLimitToCeilings limits the maximums to the ceilings of the cluster. The admission webhook rejects maximums
+// above the ceilings, this only happens for QuotaAutoscalers admitted before the ceilings were lowered or without
+// webhook.
+func (scaler *ValidatedQuotaScaler) ForceLimitToCeilings(namespace string) {
+	for _, ceiling := range scaler.ceilings() {
+		if *ceiling.value > ceiling.max {
+			logging.LogWarning("[%s] %s %s exceeds the maximum %s of the cluster, using the maximum", namespace,
+				ceiling.name, formatQuantity(*ceiling.value, ceiling.scale), formatQuantity(ceiling.max, ceiling.scale))
+			*ceiling.value = ceiling.max
+		}
+	}
+}
+
+type ceiling struct {
+	name  string
+	value *int64
+	max   int64
+	scale resource.Scale
+}
 
-	if scaler.MaxMemory > defaultScaler.MaxMemory {
-		scaler.MaxMemory = defaultScaler.MaxMemory
+// ceilings returns the maximums of the scaler with their ceiling from the cluster config.
+func (scaler *ValidatedQuotaScaler) ceilings() []ceiling {
+	ceilings := CurrentClusterConfig().Ceilings
+	result := []ceiling{
+		{"maxCpu", &scaler.MaxCpu, ceilings.MaxCpu.ScaledValue(resource.Milli), resource.Milli},
+		{"maxMemory", &scaler.MaxMemory, ceilings.MaxMemory.ScaledValue(resource.Mega), resource.Mega},
 	}
-	if scaler.MaxCpu > defaultScaler.MaxCpu {
-		scaler.MaxCpu = defaultScaler.MaxCpu
+	if scaler.Independent {
+		result = append(result,
+			ceiling{"maxCpuLimit", &scaler.MaxCpuLimit, ceilings.MaxCpuLimit.ScaledValue(resource.Milli), resource.Milli},
+			ceiling{"maxMemoryLimit", &scaler.MaxMemoryLimit, ceilings.MaxMemoryLimit.ScaledValue(resource.Mega), resource.Mega},
+		)
 	}
+	return result
 }
 
-// ToActivePolicy converts a QuotaScalePolicy to an ActivePolicy given the scaleUp type and ResourceQuota values.
-func (scaler *ValidatedQuotaScaler) ToActivePolicy(scaleUp bool, policy v1.QuotaScalePolicy, quota *v12.ResourceQuota) *ActivePolicy {
-	active := &ActivePolicy{
-		PolicyThreshold: int64(policy.Value),
+// formatQuantity formats a value in the scale as quantity, e.g. 35000 millicores as 35.
+func formatQuantity(value int64, scale resource.Scale) string {
+	return resource.NewScaledQuantity(value, scale).String()
+}
+
+// Bounds returns the bounds of a resource and whether the scaler has them. The CPU and memory requests always have
+// bounds, their limits only in the Independent mode and other resources when the spec lists them.
+func (scaler *ValidatedQuotaScaler) Bounds(name v12.ResourceName) (ResourceBounds, bool) {
+	switch name {
+	case v12.ResourceCPU:
+		return ResourceBounds{Min: scaler.MinCpu, Max: scaler.MaxCpu, MinStep: scaler.MinCpuStep, MaxStep: scaler.MaxCpuStep}, true
+	case v12.ResourceMemory:
+		return ResourceBounds{Min: scaler.MinMemory, Max: scaler.MaxMemory, MinStep: scaler.MinMemoryStep, MaxStep: scaler.MaxMemoryStep}, true
+	case v12.ResourceLimitsCPU:
+		return ResourceBounds{Min: scaler.MinCpuLimit, Max: scaler.MaxCpuLimit, MinStep: scaler.MinCpuStep, MaxStep: scaler.MaxCpuStep}, scaler.Independent
+	case v12.ResourceLimitsMemory:
+		return ResourceBounds{Min: scaler.MinMemoryLimit, Max: scaler.MaxMemoryLimit, MinStep: scaler.MinMemoryStep, MaxStep: scaler.MaxMemoryStep}, scaler.Independent
 	}
+	bounds, ok := scaler.Resources[name]
+	return bounds, ok
+}
 
-	if strings.ToLower(policy.Method) == "memory" {
-		active.IsCpu = false
-		active.MinimalStep = scaler.MinMemoryStep
-		active.MaximumStep = scaler.MaxMemoryStep
-		active.CurrentMaximum = quota.Spec.Hard.Memory().ScaledValue(resource.Mega)
-		active.Used = ResourceQuotaUsedMemoryLimit(quota).ScaledValue(resource.Mega)
+// ScaledResources returns the resources of the ResourceQuota that the scaler scales. These are the CPU and memory
+// requests, and the other resources with bounds that the ResourceQuota has.
+func (scaler *ValidatedQuotaScaler) ScaledResources(quota *v12.ResourceQuota) []v12.ResourceName {
+	names := []v12.ResourceName{v12.ResourceCPU, v12.ResourceMemory}
+	for _, name := range []v12.ResourceName{v12.ResourceLimitsCPU, v12.ResourceLimitsMemory} {
+		if _, ok := scaler.Bounds(name); ok && hasHard(quota, name) {
+			names = append(names, name)
+		}
+	}
+	for name := range scaler.Resources {
+		if hasHard(quota, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
 
-		if scaleUp {
-			active.QuotaLimit = scaler.MaxMemory
-		} else {
-			active.QuotaLimit = scaler.MinMemory
+// MinMax returns the minimum and maximum of the given resources.
+func (scaler *ValidatedQuotaScaler) MinMax(names ...v12.ResourceName) (resources.Resources, resources.Resources) {
+	minimum, maximum := resources.Resources{}, resources.Resources{}
+	for _, name := range names {
+		if bounds, ok := scaler.Bounds(name); ok {
+			minimum.Set(name, bounds.Min)
+			maximum.Set(name, bounds.Max)
 		}
-	} else if strings.ToLower(policy.Method) == "cpu" {
-		active.IsCpu = true
-		active.MinimalStep = scaler.MinCpuStep
-		active.MaximumStep = scaler.MaxCpuStep
-		active.CurrentMaximum = quota.Spec.Hard.Cpu().ScaledValue(resource.Milli)
-		active.Used = quota.Status.Used.Cpu().ScaledValue(resource.Milli)
+	}
+	return minimum, maximum
+}
 
-		if scaleUp {
-			active.QuotaLimit = scaler.MaxCpu
-		} else {
-			active.QuotaLimit = scaler.MinCpu
+// PolicyResources returns the resources a policy targets. The cpu and memory policies target the requests, and in
+// the Independent mode also the limits. Other policies target the resource named by their method, when it has bounds.
+func (scaler *ValidatedQuotaScaler) PolicyResources(policy v1.QuotaScalePolicy) []v12.ResourceName {
+	var names []v12.ResourceName
+	switch name := v12.ResourceName(strings.ToLower(policy.Method)); name {
+	case v12.ResourceCPU:
+		names = []v12.ResourceName{v12.ResourceCPU, v12.ResourceLimitsCPU}
+	case v12.ResourceMemory:
+		names = []v12.ResourceName{v12.ResourceMemory, v12.ResourceLimitsMemory}
+	default:
+		names = []v12.ResourceName{name}
+	}
+
+	var bounded []v12.ResourceName
+	for _, name := range names {
+		if _, ok := scaler.Bounds(name); ok {
+			bounded = append(bounded, name)
 		}
 	}
+	return bounded
+}
+
+// ToActivePolicy converts a QuotaScalePolicy to an ActivePolicy given the scaleUp type and ResourceQuota values. The
+// policy is applied to the resource named by its method.
+func (scaler *ValidatedQuotaScaler) ToActivePolicy(scaleUp bool, policy v1.QuotaScalePolicy, quota *v12.ResourceQuota) *ActivePolicy {
+	return scaler.ToActiveResourcePolicy(scaleUp, v12.ResourceName(strings.ToLower(policy.Method)), policy, quota)
+}
+
+// ToActiveResourcePolicy converts a QuotaScalePolicy to an ActivePolicy for the given resource, see ToActivePolicy.
+func (scaler *ValidatedQuotaScaler) ToActiveResourcePolicy(scaleUp bool, name v12.ResourceName, policy v1.QuotaScalePolicy, quota *v12.ResourceQuota) *ActivePolicy {
+	bounds, _ := scaler.Bounds(name)
+	scale := resources.ScaleOf(name)
+	hard, used := quota.Spec.Hard[name], quota.Status.Used[name]
+	active := &ActivePolicy{
+		Resource:        name,
+		PolicyThreshold: int64(policy.Value),
+		CurrentMaximum:  hard.ScaledValue(scale),
+		Used:            used.ScaledValue(scale),
+		MinimalStep:     bounds.MinStep,
+		MaximumStep:     bounds.MaxStep,
+		QuotaLimit:      bounds.Min,
+	}
+	if scaleUp {
+		active.QuotaLimit = bounds.Max
+	}
+	if name == v12.ResourceMemory && !scaler.Independent {
+		active.Used = ResourceQuotaUsedMemoryLimit(quota).ScaledValue(scale)
+	}
 
 	if active.CurrentMaximum != 0 {
 		active.CurrentUsagePercentage = int64(float64(active.Used) / float64(active.CurrentMaximum) * 100)
@@ -133,10 +359,15 @@ func (scaler *ValidatedQuotaScaler) ToActivePolicy(scaleUp bool, policy v1.Quota
 }
 
 // ActivatePolicy first converts a QuotaScalePolicy to an ActivePolicy given the scaleUp type and ResourceQuota values.
-// It then uses the active policy to calculate the desired scaling value (Milli Cores for CPU and Mega Bytes for
-// Memory). When a policy is not in effect (no scaling should occur) it returns the converted policy and 0.
+// It then uses the active policy to calculate the desired scaling value (Milli Cores for CPU, Mega Bytes for Memory and
+// whole units for other resources). When a policy is not in effect (no scaling should occur) it returns the converted
+// policy and 0.
 func (scaler *ValidatedQuotaScaler) ActivatePolicy(scaleUp bool, policy v1.QuotaScalePolicy, quota *v12.ResourceQuota) (*ActivePolicy, int64) {
-	active := scaler.ToActivePolicy(scaleUp, policy, quota)
+	return activate(scaler.ToActivePolicy(scaleUp, policy, quota), scaleUp)
+}
+
+// activate calculates the desired scaling value of an active policy, 0 when the policy is not in effect.
+func activate(active *ActivePolicy, scaleUp bool) (*ActivePolicy, int64) {
 	if active.PolicyThreshold == 100 {
 		// When PolicyThreshold is 100 we will never scale up based on used ResourceQuota, because Used quota will always
 		// be lower or equal to 100 percent. Instead, events need to bump up the quota.
@@ -144,9 +375,9 @@ func (scaler *ValidatedQuotaScaler) ActivatePolicy(scaleUp bool, policy v1.Quota
 			return active, utils.Max(active.Used, active.QuotaLimit)
 		}
 	} else {
-		if scaleUp && active.CurrentUsagePercentage > int64(policy.Value) {
+		if scaleUp && active.CurrentUsagePercentage > active.PolicyThreshold {
 			return active, CalculateScaleUp(active)
-		} else if !scaleUp && active.CurrentUsagePercentage < int64(policy.Value) {
+		} else if !scaleUp && active.CurrentUsagePercentage < active.PolicyThreshold {
 			return active, CalculateScaleDown(active)
 		}
 	}
@@ -154,21 +385,61 @@ func (scaler *ValidatedQuotaScaler) ActivatePolicy(scaleUp bool, policy v1.Quota
 	return active, 0 // Nothing to do
 }
 
-func (scaler *ValidatedQuotaScaler) ActivateScalerPolicy(policy v1.QuotaScalePolicy, quota *v12.ResourceQuota, scaleUp bool) *resources.Resources {
-	desired := &resources.Resources{}
+// ActivateScalerPolicy activates a policy for each resource it targets and returns the targets. The CPU and memory
+// requests are always targeted, other resources only when the ResourceQuota has them.
+func (scaler *ValidatedQuotaScaler) ActivateScalerPolicy(policy v1.QuotaScalePolicy, quota *v12.ResourceQuota, scaleUp bool) resources.Resources {
+	desired := resources.Resources{}
+	for _, name := range scaler.PolicyResources(policy) {
+		if name != v12.ResourceCPU && name != v12.ResourceMemory && !hasHard(quota, name) {
+			continue
+		}
+		if _, target := activate(scaler.ToActiveResourcePolicy(scaleUp, name, policy, quota), scaleUp); target != 0 {
+			desired.Set(name, target)
+		}
+	}
+	return desired
+}
+
+func hasHard(quota *v12.ResourceQuota, name v12.ResourceName) bool {
+	_, ok := quota.Spec.Hard[name]
+	return ok
+}
+
+// ActivateScalerBehavior activates all policies of a behavior and combines the targets per resource following the
+// selectPolicy of the behavior. Max (default) selects the policy with the biggest change, Min the policy with the
+// smallest change and Disabled turns the behavior off. Resources without a target are omitted.
+func (scaler *ValidatedQuotaScaler) ActivateScalerBehavior(behavior v1.QuotaScaleBehavior, quota *v12.ResourceQuota, scaleUp bool) resources.Resources {
+	desired := resources.Resources{}
+	if behavior.SelectPolicy == v1.DisabledPolicySelect {
+		return desired
+	}
 
-	active, target := scaler.ActivatePolicy(scaleUp, policy, quota)
-	if target != 0 {
-		if active.IsCpu {
-			desired.Cpu = target
-		} else {
-			desired.Memory = target
+	// The biggest change is the highest target when scaling up, and the lowest target when scaling down
+	preferHigher := (behavior.SelectPolicy != v1.MinPolicySelect) == scaleUp
+	for _, policy := range behavior.Policies {
+		target := scaler.ActivateScalerPolicy(policy, quota, scaleUp)
+		for name := range target {
+			desired.Set(name, selectTarget(desired.Value(name), target.Value(name), preferHigher))
 		}
 	}
 
 	return desired
 }
 
+// selectTarget returns the higher or lower of two targets, where zero means there is no target.
+func selectTarget(current, candidate int64, preferHigher bool) int64 {
+	if current == 0 {
+		return candidate
+	}
+	if candidate == 0 {
+		return current
+	}
+	if preferHigher {
+		return utils.Max(current, candidate)
+	}
+	return utils.Min(current, candidate)
+}
+
 // CalculateScaleUp calculates the desired value a quota should have given the scaleUp policy.
 func CalculateScaleUp(policy *ActivePolicy) int64 {
 	// Desired quota based on desired percentage
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"testing"
+
+	v1 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func newTestQuota(hardCpu, usedCpu, hardMemory, usedMemory string) *v12.ResourceQuota {
+	return &v12.ResourceQuota{
+		Spec: v12.ResourceQuotaSpec{Hard: v12.ResourceList{
+			v12.ResourceCPU:    resource.MustParse(hardCpu),
+			v12.ResourceMemory: resource.MustParse(hardMemory),
+		}},
+		Status: v12.ResourceQuotaStatus{
+			Hard: v12.ResourceList{
+				v12.ResourceCPU:    resource.MustParse(hardCpu),
+				v12.ResourceMemory: resource.MustParse(hardMemory),
+			},
+			Used: v12.ResourceList{
+				v12.ResourceCPU:    resource.MustParse(usedCpu),
+				v12.ResourceMemory: resource.MustParse(usedMemory),
+			},
+		},
+	}
+}
+
+func TestActivateScalerBehaviorSelectPolicy(t *testing.T) {
+	scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{})
+	upQuota := newTestQuota("1000m", "900m", "1000M", "900M")    // 90% used
+	downQuota := newTestQuota("1000m", "300m", "4000M", "1200M") // 30% used
+
+	// Targets of the individual policies, the behavior must select one of these
+	upPolicies := []v1.QuotaScalePolicy{{Method: "cpu", Value: 70}, {Method: "cpu", Value: 80}, {Method: "memory", Value: 80}}
+	downPolicies := []v1.QuotaScalePolicy{{Method: "cpu", Value: 50}, {Method: "cpu", Value: 60}, {Method: "memory", Value: 60}}
+	for i, expected := range []int64{1285, 1125} {
+		if target := scaler.ActivateScalerPolicy(upPolicies[i], upQuota, true); target.Cpu() != expected {
+			t.Errorf("expected scaleUp policy %d to target %dm but got: %dm\n", i, expected, target.Cpu())
+		}
+	}
+	for i, expected := range []int64{600, 500} {
+		if target := scaler.ActivateScalerPolicy(downPolicies[i], downQuota, false); target.Cpu() != expected {
+			t.Errorf("expected scaleDown policy %d to target %dm but got: %dm\n", i, expected, target.Cpu())
+		}
+	}
+
+	tests := []struct {
+		name           string
+		selectPolicy   v1.ScalingPolicySelect
+		scaleUp        bool
+		expectedCpu    int64
+		expectedMemory int64
+	}{
+		{"scaleUp default", "", true, 1285, 1125},
+		{"scaleUp Max", v1.MaxPolicySelect, true, 1285, 1125},
+		{"scaleUp Min", v1.MinPolicySelect, true, 1125, 1125},
+		{"scaleUp Disabled", v1.DisabledPolicySelect, true, 0, 0},
+		{"scaleDown default", "", false, 500, 2000},
+		{"scaleDown Max", v1.MaxPolicySelect, false, 500, 2000},
+		{"scaleDown Min", v1.MinPolicySelect, false, 600, 2000},
+		{"scaleDown Disabled", v1.DisabledPolicySelect, false, 0, 0},
+	}
+
+	for _, test := range tests {
+		behavior := v1.QuotaScaleBehavior{SelectPolicy: test.selectPolicy, Policies: downPolicies}
+		quota := downQuota
+		if test.scaleUp {
+			behavior.Policies = upPolicies
+			quota = upQuota
+		}
+
+		desired := scaler.ActivateScalerBehavior(behavior, quota, test.scaleUp)
+		if desired.Cpu() != test.expectedCpu || desired.Memory() != test.expectedMemory {
+			t.Errorf("%s: expected %dm %dM but got: %dm %dM\n", test.name, test.expectedCpu, test.expectedMemory, desired.Cpu(), desired.Memory())
+		}
+	}
+}
+
+func TestValidateQuotaScalerSteps(t *testing.T) {
+	// Each step is parsed from its own field, maxCpuStep used to be parsed from minCpuStep
+	scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{
+		MinCpuStep: "100m", MaxCpuStep: "2", MinMemoryStep: "50M", MaxMemoryStep: "4G",
+	}})
+	if scaler.MinCpuStep != 100 || scaler.MaxCpuStep != 2000 || scaler.MinMemoryStep != 50 || scaler.MaxMemoryStep != 4000 {
+		t.Errorf("expected steps 100m-2000m and 50M-4000M but got: %dm-%dm and %dM-%dM\n",
+			scaler.MinCpuStep, scaler.MaxCpuStep, scaler.MinMemoryStep, scaler.MaxMemoryStep)
+	}
+
+	// A minCpuStep alone leaves maxCpuStep at its default
+	defaults := CurrentClusterConfig().Defaults
+	scaler = ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{MinCpuStep: "100m"}})
+	if expected := defaults.MaxCpuStep.ScaledValue(resource.Milli); scaler.MaxCpuStep != expected {
+		t.Errorf("expected the default maxCpuStep %dm but got: %dm\n", expected, scaler.MaxCpuStep)
+	}
+}
+
+func TestValidateQuotaScalerCpuLimitRatio(t *testing.T) {
+	zero, four := int64(0), int64(4)
+	for _, test := range []struct {
+		ratio    *int64
+		expected int64
+	}{{nil, DefaultCpuLimitRatio}, {&zero, 0}, {&four, 4}} {
+		scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{CpuLimitRatio: test.ratio}})
+		if scaler.CpuLimitRatio != test.expected {
+			t.Errorf("expected CPU limit ratio %d but got: %d\n", test.expected, scaler.CpuLimitRatio)
+		}
+	}
+
+	// Limit bounds default to the request bounds in the Independent mode only
+	scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{Mode: v1.IndependentQuotaMode, MaxCpu: "10", MaxMemoryLimit: "20G"}})
+	if scaler.MaxCpuLimit != 10000 || scaler.MaxMemoryLimit != 20000 || scaler.MinMemoryLimit != scaler.MinMemory {
+		t.Errorf("expected limit bounds 10000m 20000M but got: %+v\n", scaler)
+	}
+	if scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{}); scaler.MaxCpuLimit != 0 || scaler.Independent {
+		t.Errorf("expected no limit bounds in the Ratio mode but got: %+v\n", scaler)
+	}
+
+	// The limit ceilings do not depend on the CPU limit ratio
+	config := DefaultClusterConfig()
+	config.Ceilings.MaxCpuLimit = resource.MustParse("50")
+	UseClusterConfig(config)
+	defer UseClusterConfig(DefaultClusterConfig())
+	scaler = ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{Mode: v1.IndependentQuotaMode, MaxCpuLimit: "100", MaxMemoryLimit: "200G"}})
+	scaler.ForceLimitToCeilings("example-dev")
+	if scaler.MaxCpuLimit != 50000 || scaler.MaxMemoryLimit != 150000 {
+		t.Errorf("expected limit bounds 50000m 150000M but got: %+v\n", scaler)
+	}
+}
+
+func TestValidateQuotaScalerResources(t *testing.T) {
+	scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{Resources: []v1.QuotaResourceBounds{
+		{Name: "requests.storage", Min: "10Gi", Max: "1Ti", MaxStep: "100Gi"},
+		{Name: "count/pods", Min: "10"},  // Without max
+		{Name: "limits.cpu", Max: "100"}, // Has its own fields
+	}}})
+	bounds, ok := scaler.Bounds("requests.storage")
+	if !ok || bounds.Min != 10<<30 || bounds.Max != 1<<40 || bounds.MinStep != 1 || bounds.MaxStep != 100<<30 {
+		t.Errorf("expected requests.storage bounds in bytes but got: %+v\n", bounds)
+	}
+	if _, ok := scaler.Bounds("count/pods"); ok {
+		t.Errorf("expected count/pods without max to be ignored\n")
+	}
+	if _, ok := scaler.Bounds("limits.cpu"); ok {
+		t.Errorf("expected limits.cpu bounds to be ignored in the Ratio mode\n")
+	}
+
+	policy := v1.QuotaScalePolicy{Method: "requests.storage", Value: 80, PeriodMinutes: 60}
+	if names := scaler.PolicyResources(policy); len(names) != 1 || names[0] != "requests.storage" {
+		t.Errorf("expected the policy to target requests.storage but got: %v\n", names)
+	}
+	if names := scaler.PolicyResources(v1.QuotaScalePolicy{Method: "count/pods"}); len(names) != 0 {
+		t.Errorf("expected a policy without bounds to target nothing but got: %v\n", names)
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+// This file evaluates the schedules of QuotaAutoscalers. A schedule opens a window at every activation of its cron
+// expression in its time zone, which stays open for its duration. While the window is open the schedule overrides the
+// bounds or behavior of the spec, e.g. a minCpu of 4 on weekdays from 07:00 to 19:00. When several windows are open
+// the first schedule of the spec applies. The QuotaWatcher calculates a namespace again when a window opens or closes.
+//
+// Example usage:
+//  if schedule := ActiveSchedule(namespace, scaler.Spec.Schedules, now); schedule != nil {
+//    scaler.Spec = ApplySchedule(scaler.Spec, schedule)
+//  }
+//  next, ok := NextScheduleTransition(namespace, scaler.Spec.Schedules, now) // Calculate again at next
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/robfig/cron/v3"
+)
+
+// ParseSchedule parses the cron expression of the schedule in its time zone.
+func ParseSchedule(schedule v14.QuotaScalerSchedule) (*cron.SpecSchedule, error) {
+	location, err := scheduleLocation(schedule.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseCron(schedule.Cron)
+	if err != nil {
+		return nil, err
+	}
+	spec.Location = location
+	return spec, nil
+}
+
+// scheduleLocation loads the time zone of a schedule, UTC when it is empty.
+func scheduleLocation(timeZone string) (*time.Location, error) {
+	if timeZone == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(timeZone)
+}
+
+// parseCron parses a standard cron expression with 5 fields or a descriptor like @daily. The time zone is set by the
+// timeZone of the schedule, not in the expression.
+func parseCron(expression string) (*cron.SpecSchedule, error) {
+	if strings.HasPrefix(expression, "TZ=") || strings.HasPrefix(expression, "CRON_TZ=") {
+		return nil, errors.New("the time zone must be set in timeZone")
+	}
+	schedule, err := cron.ParseStandard(expression)
+	if err != nil {
+		return nil, err
+	}
+	spec, ok := schedule.(*cron.SpecSchedule)
+	if !ok {
+		return nil, errors.New("must be a cron expression, @every is not supported")
+	}
+	return spec, nil
+}
+
+// scheduleWindow returns whether the window of the schedule is open at now, and when it closes or else opens next.
+func scheduleWindow(spec *cron.SpecSchedule, duration time.Duration, now time.Time) (bool, time.Time) {
+	// The window is open when the schedule was activated within the duration before now, overlapping windows are
+	// open until the last one closes
+	var lastActivation time.Time
+	for activation := spec.Next(now.Add(-duration)); !activation.IsZero() && !activation.After(now); activation = spec.Next(activation) {
+		lastActivation = activation
+	}
+	if lastActivation.IsZero() {
+		return false, spec.Next(now)
+	}
+	return true, lastActivation.Add(duration)
+}
+
+// ActiveSchedule returns the first schedule with an open window, nil when no window is open. Schedules that do not
+// parse are logged and ignored, the admission webhook rejects them.
+func ActiveSchedule(namespace string, schedules []v14.QuotaScalerSchedule, now time.Time) *v14.QuotaScalerSchedule {
+	for i := range schedules {
+		spec, ok := parseScheduleOrWarn(namespace, schedules[i])
+		if !ok {
+			continue
+		}
+		if open, _ := scheduleWindow(spec, schedules[i].Duration.Duration, now); open {
+			return &schedules[i]
+		}
+	}
+	return nil
+}
+
+// NextScheduleTransition returns the first time after now at which a window opens or closes, false when there is
+// none.
+func NextScheduleTransition(namespace string, schedules []v14.QuotaScalerSchedule, now time.Time) (time.Time, bool) {
+	var next time.Time
+	for _, schedule := range schedules {
+		spec, ok := parseScheduleOrWarn(namespace, schedule)
+		if !ok {
+			continue
+		}
+		if _, transition := scheduleWindow(spec, schedule.Duration.Duration, now); !transition.IsZero() && (next.IsZero() || transition.Before(next)) {
+			next = transition
+		}
+	}
+	return next, !next.IsZero()
+}
+
+func parseScheduleOrWarn(namespace string, schedule v14.QuotaScalerSchedule) (*cron.SpecSchedule, bool) {
+	if schedule.Duration.Duration <= 0 {
+		logging.LogWarning("[%s] Schedule %s is ignored, its duration must be positive", namespace, schedule.Name)
+		return nil, false
+	}
+	spec, err := ParseSchedule(schedule)
+	if err != nil {
+		logging.LogWarning("[%s] Schedule %s is ignored: %v", namespace, schedule.Name, err)
+		return nil, false
+	}
+	return spec, true
+}
+
+// ApplySchedule returns the spec with the bounds and behavior that the schedule sets.
+func ApplySchedule(spec v14.QuotaAutoscalerSpec, schedule *v14.QuotaScalerSchedule) v14.QuotaAutoscalerSpec {
+	for _, override := range []struct {
+		field *string
+		value string
+	}{
+		{&spec.MinCpu, schedule.MinCpu},
+		{&spec.MaxCpu, schedule.MaxCpu},
+		{&spec.MinMemory, schedule.MinMemory},
+		{&spec.MaxMemory, schedule.MaxMemory},
+	} {
+		if override.value != "" {
+			*override.field = override.value
+		}
+	}
+	if schedule.Behavior != nil {
+		spec.Behavior = *schedule.Behavior.DeepCopy()
+	}
+	return spec
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	ichpfake "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned/fake"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestSchedules() []v14.QuotaScalerSchedule {
+	return []v14.QuotaScalerSchedule{
+		{Name: "office-hours", Cron: "0 7 * * 1-5", TimeZone: "Europe/Amsterdam", Duration: v13.Duration{Duration: 12 * time.Hour}, MinCpu: "4"},
+		{Name: "nightly-batch", Cron: "0 1 * * *", Duration: v13.Duration{Duration: 2 * time.Hour}, MaxCpu: "2"},
+		{Name: "invalid", Cron: "0 7 * *", Duration: v13.Duration{Duration: time.Hour}},
+	}
+}
+
+func TestScheduleWindows(t *testing.T) {
+	tests := []struct {
+		name   string
+		now    string
+		active string
+		next   string
+	}{
+		{"Before office hours", "2024-03-04T05:30:00Z", "", "2024-03-04T06:00:00Z"},
+		{"Office hours (CET)", "2024-03-04T06:30:00Z", "office-hours", "2024-03-04T18:00:00Z"},
+		{"Office hours (CEST)", "2024-04-02T05:00:00Z", "office-hours", "2024-04-02T17:00:00Z"},
+		{"Weekend night", "2024-03-09T02:00:00Z", "nightly-batch", "2024-03-09T03:00:00Z"},
+		{"Weekend", "2024-03-09T10:00:00Z", "", "2024-03-10T01:00:00Z"},
+		{"Window closes", "2024-03-09T03:00:00Z", "", "2024-03-10T01:00:00Z"},
+	}
+
+	for _, test := range tests {
+		now, _ := time.Parse(time.RFC3339, test.now)
+		active := ""
+		if schedule := ActiveSchedule("example-dev", newTestSchedules(), now); schedule != nil {
+			active = schedule.Name
+		}
+		if active != test.active {
+			t.Errorf("%s: expected active schedule %q but got: %q\n", test.name, test.active, active)
+		}
+		next, ok := NextScheduleTransition("example-dev", newTestSchedules(), now)
+		if !ok || next.UTC().Format(time.RFC3339) != test.next {
+			t.Errorf("%s: expected next transition at %s but got: %s\n", test.name, test.next, next.UTC().Format(time.RFC3339))
+		}
+	}
+
+	if _, ok := NextScheduleTransition("example-dev", nil, time.Now()); ok {
+		t.Errorf("expected no transition without schedules\n")
+	}
+}
+
+func TestApplySchedule(t *testing.T) {
+	spec := newTestScaler("example-dev").Spec
+	spec.MinCpu, spec.MaxCpu = "1", "10"
+	schedule := &v14.QuotaScalerSchedule{MinCpu: "4", Behavior: &v14.QuotaAutoscalerSpecBehavior{
+		ScaleDown: v14.QuotaScaleBehavior{SelectPolicy: v14.DisabledPolicySelect},
+	}}
+
+	scheduled := ApplySchedule(spec, schedule)
+	if scheduled.MinCpu != "4" || scheduled.MaxCpu != "10" || scheduled.Behavior.ScaleDown.SelectPolicy != v14.DisabledPolicySelect {
+		t.Errorf("expected minCpu 4, maxCpu 10 and a disabled scaleDown but got: %+v\n", scheduled)
+	}
+	if spec.MinCpu != "1" || spec.Behavior.ScaleDown.SelectPolicy != "" {
+		t.Errorf("expected the spec to be unchanged but got: %+v\n", spec)
+	}
+}
+
+func TestUpdateQuotaScheduled(t *testing.T) {
+	scaler := newTestScaler("office-dev")
+	scaler.Spec.Schedules = newTestSchedules()
+	ichpClient := ichpfake.NewSimpleClientset(scaler)
+	now, _ := time.Parse(time.RFC3339, "2024-03-04T06:30:00Z")
+	var resizes []NamespaceResizeEvent
+	watcher := &QuotaWatcher{
+		Client:     fake.NewSimpleClientset(),
+		IchpClient: ichpClient,
+		History:    NewScalingHistory(),
+		Resize:     func(resize NamespaceResizeEvent) { resizes = append(resizes, resize) },
+		Now:        func() time.Time { return now },
+	}
+	quota := newTestNamespaceQuota("office-dev", "500m")
+
+	// The minCpu of the open window raises the quota
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 || resizes[0].New.Cpu() != 4000 {
+		t.Fatalf("expected a resize to 4000m CPU but got: %+v\n", resizes)
+	}
+	updated, _ := ichpClient.IchpV1().QuotaAutoscalers("office-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+	if updated.Status.ActiveSchedule != "office-hours" {
+		t.Errorf("expected active schedule office-hours but got: %q\n", updated.Status.ActiveSchedule)
+	}
+
+	// After the window closes the default minCpu applies again
+	now = now.Add(12 * time.Hour)
+	if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(resizes) != 1 {
+		t.Errorf("expected no resize outside the window but got: %+v\n", resizes[1:])
+	}
+	updated, _ = ichpClient.IchpV1().QuotaAutoscalers("office-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+	if updated.Status.ActiveSchedule != "" {
+		t.Errorf("expected no active schedule but got: %q\n", updated.Status.ActiveSchedule)
+	}
+}
+
+func TestQuotaWatcherQueuesScheduleTransitions(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	scaler := newTestScaler("example-dev")
+	scaler.Spec.Schedules = []v14.QuotaScalerSchedule{{Name: "every-minute", Cron: "* * * * *", Duration: v13.Duration{Duration: 30 * time.Second}}}
+	watcher, _, _ := newTestWatcher(t, stopCh, []*v14.QuotaAutoscaler{scaler}, []*v12.ResourceQuota{newTestNamespaceQuota("example-dev", "500m")})
+	watcher.Resize = func(NamespaceResizeEvent) {}
+	watcher.Now = func() time.Time { return time.Date(2024, 3, 4, 10, 0, 59, 900000000, time.UTC) }
+	waitForQueue(watcher, 1, time.Second)
+	drainQueue(watcher)
+
+	// The window opens 100ms after the calculation
+	if err := watcher.UpdateNs("example-dev"); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if length := waitForQueue(watcher, 1, time.Second); length != 1 {
+		t.Errorf("expected the namespace to be queued when the window opens but got: %d\n", length)
+	}
+}
+
+func TestSimulationScheduleTransitions(t *testing.T) {
+	timeline, err := ParseTimeline([]byte(`
+end: "2024-03-05T00:00:00Z"
+records:
+- time: "2024-03-04T00:00:30Z"
+  quotaAutoscaler:
+    metadata: {name: example-scaler, namespace: example-dev}
+    spec:
+      resourceQuota: example-quota
+      schedules: [{name: office-hours, cron: "0 7 * * 1-5", timeZone: Europe/Amsterdam, duration: 12h, minCpu: "4"}]
+      behavior:
+        scaleDown:
+          policies: [{method: cpu, value: 50}]
+- time: "2024-03-04T00:00:30Z"
+  resourceQuota:
+    metadata: {name: example-quota, namespace: example-dev}
+    spec: {hard: {cpu: "1", memory: 1G}}
+    status: {used: {cpu: 500m, memory: 500M}}
+`))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	result, err := NewSimulation(timeline, 10*time.Second).Run()
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	// Without any quota changes the quota is raised when the window opens and lowered when it closes, the records are
+	// 30s out of step with the resyncs so that only the transitions calculate at 06:00 and 18:00
+	expected := []struct {
+		requested string
+		cpu       int64
+	}{{"2024-03-04T06:00:00Z", 4000}, {"2024-03-04T18:00:00Z", 960}}
+	if len(result.Resizes) != len(expected) {
+		t.Fatalf("expected %d resizes but got: %+v\n", len(expected), result.Resizes)
+	}
+	for i, resize := range result.Resizes {
+		if resize.Requested.UTC().Format(time.RFC3339) != expected[i].requested || resize.New.Cpu() != expected[i].cpu {
+			t.Errorf("expected a resize to %dm CPU at %s but got: %+v\n", expected[i].cpu, expected[i].requested, resize)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+package internal
+
+// This file contains the Simulation, which replays a recorded Timeline of QuotaAutoscalers, ResourceQuota statuses and
+// Pod Events through the calculation of the QuotaWatcher, without a cluster. Time is virtual: like in the cluster,
+// changes are debounced, namespaces are resynced, resizes are serialised per namespace by a ResizeQueue and take the
+// resize latency, but the simulation runs as fast as it can. Resizes are applied to a fake clientset by the stub
+// backend, so the hard quota of a ResourceQuota is only read from its first record. Later records update its usage.
+//
+// Example usage:
+//  timeline, err := internal.LoadTimeline("timeline.yaml")
+//  if err != nil { panic(err) }
+//
+//  result, err := internal.NewSimulation(timeline, 10*time.Second).Run()
+//  if err != nil { panic(err) }
+//  for _, resize := range result.Resizes { fmt.Println(resize.Namespace, resize.Old, resize.New) }
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resize"
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// Timeline is a recording of the objects that the quota-scaler watches.
+type Timeline struct {
+	Records []TimelineRecord `json:"records"`
+	// End of the simulation, defaults to the time of the last record
+	End *v13.Time `json:"end,omitempty"`
+}
+
+// TimelineRecord is a change of a single object at a point in time.
+type TimelineRecord struct {
+	Time v13.Time `json:"time"`
+
+	QuotaAutoscaler *v14.QuotaAutoscaler `json:"quotaAutoscaler,omitempty"`
+	// ResourceQuota updates the used resources, the hard resources are only taken from the first record of a quota
+	ResourceQuota *v12.ResourceQuota `json:"resourceQuota,omitempty"`
+	// Event is a Pod creation failure, e.g. FailedCreate
+	Event *v12.Event `json:"event,omitempty"`
+	// Object is a Pod owner that Events refer to, e.g. a ReplicaSet with its desired and current replicas
+	Object *runtime.RawExtension `json:"object,omitempty"`
+}
+
+// LoadTimeline reads and validates a YAML or JSON timeline file.
+func LoadTimeline(path string) (*Timeline, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTimeline(content)
+}
+
+// ParseTimeline parses and validates a YAML or JSON timeline, see LoadTimeline. The records are sorted by time.
+func ParseTimeline(content []byte) (*Timeline, error) {
+	timeline := &Timeline{}
+	if err := yaml.Unmarshal(content, timeline); err != nil {
+		return nil, fmt.Errorf("invalid timeline: %v", err)
+	}
+	if len(timeline.Records) == 0 {
+		return nil, errors.New("invalid timeline: no records")
+	}
+
+	for i := range timeline.Records {
+		if err := timeline.Records[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid timeline: records[%d]: %v", i, err)
+		}
+	}
+	sort.SliceStable(timeline.Records, func(i, j int) bool {
+		return timeline.Records[i].Time.Before(&timeline.Records[j].Time)
+	})
+
+	last := timeline.Records[len(timeline.Records)-1].Time
+	if timeline.End != nil && timeline.End.Before(&last) {
+		return nil, errors.New("invalid timeline: end must not be before the last record")
+	}
+	return timeline, nil
+}
+
+// validate requires a time and exactly one object with a namespace, and decodes the Object.
+func (record *TimelineRecord) validate() error {
+	if record.Time.IsZero() {
+		return errors.New("time must be set")
+	}
+
+	var namespaces []string
+	if record.QuotaAutoscaler != nil {
+		namespaces = append(namespaces, record.QuotaAutoscaler.Namespace)
+	}
+	if record.ResourceQuota != nil {
+		namespaces = append(namespaces, record.ResourceQuota.Namespace)
+	}
+	if record.Event != nil {
+		namespaces = append(namespaces, eventNamespace(record.Event))
+	}
+	if record.Object != nil {
+		obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(record.Object.Raw, nil, nil)
+		if err != nil {
+			return fmt.Errorf("object: %v", err)
+		}
+		object, err := meta.Accessor(obj)
+		if err != nil {
+			return fmt.Errorf("object: %v", err)
+		}
+		record.Object.Object = obj
+		namespaces = append(namespaces, object.GetNamespace())
+	}
+
+	if len(namespaces) != 1 {
+		return errors.New("exactly one of quotaAutoscaler, resourceQuota, event and object must be set")
+	}
+	if namespaces[0] == "" {
+		return errors.New("namespace must be set")
+	}
+	return nil
+}
+
+// eventNamespace returns the namespace of the object of the Event, like the QuotaWatcher.
+func eventNamespace(ev *v12.Event) string {
+	if ev.InvolvedObject.Namespace != "" {
+		return ev.InvolvedObject.Namespace
+	}
+	return ev.Namespace
+}
+
+// SimulationResult is the outcome of a Simulation.
+type SimulationResult struct {
+	Start      time.Time                    `json:"start"`
+	End        time.Time                    `json:"end"`
+	Resizes    []SimulatedResize            `json:"resizes"`
+	Namespaces map[string]*NamespaceSummary `json:"namespaces"`
+}
+
+// SimulatedResize is a resize requested by a calculation.
+type SimulatedResize struct {
+	Namespace string              `json:"namespace"`
+	Requested time.Time           `json:"requested"`
+	Applied   *time.Time          `json:"applied,omitempty"` // Nil when it was superseded or still in progress at the end
+	Old       resources.Resources `json:"old"`
+	New       resources.Resources `json:"new"`
+	// Superseded resizes were replaced by a newer resize while waiting for the previous resize to finish
+	Superseded bool `json:"superseded,omitempty"`
+}
+
+// NamespaceSummary contains the statistics of a namespace.
+type NamespaceSummary struct {
+	Calculations     int `json:"calculations"`
+	ResizesRequested int `json:"resizesRequested"`
+	ResizesApplied   int `json:"resizesApplied"`
+	Events           int `json:"events"`
+	// Stalls counts the Pod creations that the simulated quota would have rejected: Events whose missing resources
+	// do not fit in it, and records whose used resources start to exceed it
+	Stalls int `json:"stalls"`
+	// AverageHeadroom is the time weighted average percentage of the hard quota that was not used, per resource
+	AverageHeadroom map[v12.ResourceName]float64 `json:"averageHeadroom"`
+}
+
+// Simulation replays a Timeline, see NewSimulation. It is not safe for concurrent use.
+type Simulation struct {
+	timeline      *Timeline
+	resizeLatency time.Duration
+
+	now        time.Time
+	client     *fake.Clientset
+	watcher    *QuotaWatcher
+	resizes    *ResizeQueue
+	pending    map[string]int   // Index of the pending resize per namespace
+	steps      []simulationStep // Ordered by time
+	namespaces map[string]*simulatedNamespace
+	result     *SimulationResult
+}
+
+// simulationStep is a scheduled resync, calculation of a namespace or end of a resize.
+type simulationStep struct {
+	time      time.Time
+	namespace string // Empty for a resync
+	resize    *NamespaceResizeEvent
+	index     int // Of the resize in the result
+}
+
+type simulatedNamespace struct {
+	scaler      *v14.QuotaAutoscaler
+	events      []v12.Event
+	calculateAt time.Time // Zero when no calculation is scheduled
+	stalled     bool
+
+	summary      *NamespaceSummary
+	last         time.Time
+	headroom     map[v12.ResourceName]float64 // Headroom percentage multiplied by seconds
+	headroomTime map[v12.ResourceName]float64
+}
+
+// NewSimulation creates a Simulation of the timeline, in which the resize API takes resizeLatency. The defaults and
+// timings are taken from the cluster config in use.
+func NewSimulation(timeline *Timeline, resizeLatency time.Duration) *Simulation {
+	sim := &Simulation{
+		timeline:      timeline,
+		resizeLatency: resizeLatency,
+		client:        fake.NewSimpleClientset(),
+		resizes:       NewResizeQueue(),
+		pending:       map[string]int{},
+		namespaces:    map[string]*simulatedNamespace{},
+		result:        &SimulationResult{Namespaces: map[string]*NamespaceSummary{}},
+	}
+	now := func() time.Time { return sim.now }
+	history, dryRunHistory := NewScalingHistory(), NewScalingHistory()
+	history.Now, dryRunHistory.Now = now, now
+	sim.watcher = &QuotaWatcher{Client: sim.client, History: history, DryRunHistory: dryRunHistory, Usage: NewUsageHistory(nil, ""),
+		Resize: sim.requestResize, Now: now}
+	return sim
+}
+
+// Run replays the timeline until its end. Steps that are scheduled after the end are not simulated.
+func (sim *Simulation) Run() (*SimulationResult, error) {
+	records := sim.timeline.Records
+	start, end := records[0].Time.Time, records[len(records)-1].Time.Time
+	if sim.timeline.End != nil {
+		end = sim.timeline.End.Time
+	}
+	sim.result.Start, sim.result.End = start, end
+	sim.schedule(simulationStep{time: start.Add(CurrentClusterConfig().ResyncPeriod.Duration)})
+
+	for next := 0; ; {
+		stepDue := len(sim.steps) > 0 && !sim.steps[0].time.After(end)
+		if next < len(records) && (!stepDue || !records[next].Time.After(sim.steps[0].time)) {
+			sim.now = records[next].Time.Time
+			if err := sim.replay(records[next]); err != nil {
+				return nil, fmt.Errorf("records at %s: %v", sim.now.Format(time.RFC3339), err)
+			}
+			next++
+		} else if stepDue {
+			step := sim.steps[0]
+			sim.steps = sim.steps[1:]
+			sim.now = step.time
+			sim.run(step)
+		} else {
+			break
+		}
+	}
+
+	sim.now = end
+	for namespace, ns := range sim.namespaces {
+		sim.accumulate(namespace)
+		ns.summary.AverageHeadroom = map[v12.ResourceName]float64{}
+		for name, seconds := range ns.headroomTime {
+			if seconds > 0 {
+				ns.summary.AverageHeadroom[name] = ns.headroom[name] / seconds
+			}
+		}
+	}
+	return sim.result, nil
+}
+
+// schedule inserts the step after the steps at the same time.
+func (sim *Simulation) schedule(step simulationStep) {
+	i := sort.Search(len(sim.steps), func(i int) bool { return sim.steps[i].time.After(step.time) })
+	sim.steps = append(sim.steps, simulationStep{})
+	copy(sim.steps[i+1:], sim.steps[i:])
+	sim.steps[i] = step
+}
+
+// enqueue schedules a calculation of the namespace after the delay, like the workqueue an earlier calculation that is
+// already scheduled is kept.
+func (sim *Simulation) enqueue(namespace string, delay time.Duration) {
+	ns := sim.namespace(namespace)
+	at := sim.now.Add(delay)
+	if !ns.calculateAt.IsZero() && !ns.calculateAt.After(at) {
+		return
+	}
+	ns.calculateAt = at
+	sim.schedule(simulationStep{time: at, namespace: namespace})
+}
+
+func (sim *Simulation) namespace(namespace string) *simulatedNamespace {
+	ns, ok := sim.namespaces[namespace]
+	if !ok {
+		ns = &simulatedNamespace{
+			summary:      &NamespaceSummary{},
+			headroom:     map[v12.ResourceName]float64{},
+			headroomTime: map[v12.ResourceName]float64{},
+		}
+		sim.namespaces[namespace] = ns
+		sim.result.Namespaces[namespace] = ns.summary
+	}
+	return ns
+}
+
+// quota returns the simulated ResourceQuota of the QuotaAutoscaler of the namespace, nil when there is none.
+func (sim *Simulation) quota(namespace string) *v12.ResourceQuota {
+	ns := sim.namespace(namespace)
+	if ns.scaler == nil {
+		return nil
+	}
+	quota, err := sim.client.CoreV1().ResourceQuotas(namespace).Get(context.TODO(), ns.scaler.Spec.ResourceQuota, v13.GetOptions{})
+	if err != nil {
+		return nil
+	}
+	return quota
+}
+
+func (sim *Simulation) replay(record TimelineRecord) error {
+	switch {
+	case record.QuotaAutoscaler != nil:
+		namespace := record.QuotaAutoscaler.Namespace
+		sim.accumulate(namespace)
+		sim.namespace(namespace).scaler = record.QuotaAutoscaler.DeepCopy()
+		sim.enqueue(namespace, 0)
+	case record.ResourceQuota != nil:
+		return sim.replayQuota(record.ResourceQuota.DeepCopy())
+	case record.Event != nil:
+		sim.replayEvent(*record.Event.DeepCopy())
+	case record.Object != nil:
+		return sim.replayObject(record.Object.Object)
+	}
+	return nil
+}
+
+// replayQuota creates the ResourceQuota, or updates the used resources of the simulated ResourceQuota.
+func (sim *Simulation) replayQuota(quota *v12.ResourceQuota) error {
+	sim.accumulate(quota.Namespace)
+	quotas := sim.client.CoreV1().ResourceQuotas(quota.Namespace)
+	existing, err := quotas.Get(context.TODO(), quota.Name, v13.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		quota.Status.Hard = quota.Spec.Hard
+		_, err = quotas.Create(context.TODO(), quota, v13.CreateOptions{})
+	} else if err == nil {
+		existing.Status.Used = quota.Status.Used
+		_, err = quotas.Update(context.TODO(), existing, v13.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	sim.updateStalled(quota.Namespace)
+	if scaler := sim.namespace(quota.Namespace).scaler; scaler != nil && scaler.Spec.ResourceQuota == quota.Name {
+		sim.enqueue(quota.Namespace, sim.watcher.debounce())
+	}
+	return nil
+}
+
+// replayEvent stores the Event for the next calculation, and counts a stall when the simulated quota has no room for
+// the missing resources either.
+func (sim *Simulation) replayEvent(ev v12.Event) {
+	if eventTime(&ev).IsZero() {
+		ev.LastTimestamp = v13.NewTime(sim.now)
+	}
+	namespace := eventNamespace(&ev)
+	ns := sim.namespace(namespace)
+	ns.summary.Events++
+
+	if quota := sim.quota(namespace); quota != nil {
+		missing, _ := GetResourcesFromPodEvents(sim.client, nil, nil, []v12.Event{ev})
+		if !fits(quota, missing) {
+			ns.summary.Stalls++
+		}
+	}
+	ns.events = append(ns.events, ev)
+	sim.enqueue(namespace, sim.watcher.debounce())
+}
+
+// fits returns whether the missing resources fit in the ResourceQuota next to its used resources.
+func fits(quota *v12.ResourceQuota, missing resources.Resources) bool {
+	hard, used := resources.Resources(quota.Spec.Hard), resources.Resources(quota.Status.Used)
+	for name := range hard {
+		if used.Value(name)+missing.Value(name) > hard.Value(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// replayObject creates or replaces a Pod owner in the fake clientset.
+func (sim *Simulation) replayObject(obj runtime.Object) error {
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	gvr, _ := meta.UnsafeGuessKindToResource(obj.GetObjectKind().GroupVersionKind())
+	err = sim.client.Tracker().Create(gvr, obj.DeepCopyObject(), object.GetNamespace())
+	if apierrors.IsAlreadyExists(err) {
+		err = sim.client.Tracker().Update(gvr, obj.DeepCopyObject(), object.GetNamespace())
+	}
+	return err
+}
+
+func (sim *Simulation) run(step simulationStep) {
+	switch {
+	case step.resize != nil:
+		sim.resizeDone(step)
+	case step.namespace != "":
+		if sim.namespace(step.namespace).calculateAt.Equal(step.time) {
+			sim.calculate(step.namespace)
+		}
+	default:
+		// Like the informer resync of the QuotaAutoscalers
+		for namespace, ns := range sim.namespaces {
+			if ns.scaler != nil {
+				sim.enqueue(namespace, 0)
+			}
+		}
+		sim.schedule(simulationStep{time: sim.now.Add(CurrentClusterConfig().ResyncPeriod.Duration)})
+	}
+}
+
+// calculate calculates the namespace like QuotaWatcher.UpdateNs. QuotaAutoscalers in dry run are simulated as if they
+// were not.
+func (sim *Simulation) calculate(namespace string) {
+	ns := sim.namespace(namespace)
+	ns.calculateAt = time.Time{}
+	quota := sim.quota(namespace)
+	if quota == nil {
+		return
+	}
+
+	var events []v12.Event
+	staleEventAge := CurrentClusterConfig().StaleEventAge.Duration
+	for _, ev := range ns.events {
+		if eventTime(&ev).Add(staleEventAge).After(sim.now) {
+			events = append(events, ev)
+		}
+	}
+	ns.events = nil
+
+	scaler := ns.scaler.DeepCopy()
+	scaler.Spec.DryRun = false
+	ns.summary.Calculations++
+	if err := sim.watcher.UpdateQuotaIfRequired(*quota, *scaler, events); err != nil {
+		logging.LogWarning("[%s] Calculation failed at %s: %v", namespace, sim.now.Format(time.RFC3339), err)
+		ns.events = append(events, ns.events...)
+		return
+	}
+	if next, ok := NextScheduleTransition(namespace, scaler.Spec.Schedules, sim.now); ok {
+		sim.enqueue(namespace, next.Sub(sim.now))
+	}
+}
+
+// requestResize starts the resize, or keeps it pending until the resize in progress of the namespace is done.
+func (sim *Simulation) requestResize(event NamespaceResizeEvent) {
+	index := len(sim.result.Resizes)
+	sim.result.Resizes = append(sim.result.Resizes, SimulatedResize{
+		Namespace: event.Namespace,
+		Requested: sim.now,
+		Old:       event.Old.Copy(),
+		New:       event.New.Copy(),
+	})
+	sim.namespace(event.Namespace).summary.ResizesRequested++
+
+	if sim.resizes.Add(event) {
+		sim.schedule(simulationStep{time: sim.now.Add(sim.resizeLatency), namespace: event.Namespace, resize: &event, index: index})
+		return
+	}
+	if previous, ok := sim.pending[event.Namespace]; ok {
+		sim.result.Resizes[previous].Superseded = true
+	}
+	sim.pending[event.Namespace] = index
+}
+
+// resizeDone applies the resize with the stub backend and starts the pending resize of the namespace.
+func (sim *Simulation) resizeDone(step simulationStep) {
+	namespace := step.namespace
+	sim.accumulate(namespace)
+	err := (&resize.StubBackend{Client: sim.client}).Resize(context.TODO(), step.resize.Request())
+	step.resize.finish(err)
+	if err != nil {
+		logging.LogWarning("[%s] Resize failed at %s: %v", namespace, sim.now.Format(time.RFC3339), err)
+	} else {
+		applied := sim.now
+		sim.result.Resizes[step.index].Applied = &applied
+		sim.namespace(namespace).summary.ResizesApplied++
+		sim.syncHard(namespace, step.resize.ResourceQuota)
+		sim.updateStalled(namespace)
+		sim.enqueue(namespace, sim.watcher.debounce()) // Like the update of the ResourceQuota
+	}
+
+	if next, ok := sim.resizes.Done(ResizeResult{NamespaceResizeEvent: *step.resize, Err: err}); ok {
+		index := sim.pending[namespace]
+		delete(sim.pending, namespace)
+		sim.schedule(simulationStep{time: sim.now.Add(sim.resizeLatency), namespace: namespace, resize: &next, index: index})
+	}
+}
+
+// syncHard copies the hard resources of the spec to the status, like the ResourceQuota controller.
+func (sim *Simulation) syncHard(namespace, name string) {
+	quotas := sim.client.CoreV1().ResourceQuotas(namespace)
+	quota, err := quotas.Get(context.TODO(), name, v13.GetOptions{})
+	if err != nil {
+		return
+	}
+	quota.Status.Hard = quota.Spec.Hard
+	_, _ = quotas.Update(context.TODO(), quota, v13.UpdateOptions{})
+}
+
+// updateStalled counts a stall when the used resources start to exceed the simulated quota.
+func (sim *Simulation) updateStalled(namespace string) {
+	quota := sim.quota(namespace)
+	if quota == nil {
+		return
+	}
+
+	ns := sim.namespace(namespace)
+	stalled := !fits(quota, nil)
+	if stalled && !ns.stalled {
+		ns.summary.Stalls++
+	}
+	ns.stalled = stalled
+}
+
+// accumulate adds the headroom of the quota of the namespace since the previous change.
+func (sim *Simulation) accumulate(namespace string) {
+	ns := sim.namespace(namespace)
+	if quota := sim.quota(namespace); quota != nil && !ns.last.IsZero() {
+		seconds := sim.now.Sub(ns.last).Seconds()
+		for name, hard := range quota.Spec.Hard {
+			used, ok := quota.Status.Used[name]
+			if !ok || hard.IsZero() {
+				continue
+			}
+			ns.headroom[name] += seconds * float64(hard.MilliValue()-used.MilliValue()) / float64(hard.MilliValue()) * 100
+			ns.headroomTime[name] += seconds
+		}
+	}
+	ns.last = sim.now
+}
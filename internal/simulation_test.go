@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTimeline = `
+end: "2024-03-01T10:03:00Z"
+records:
+- time: "2024-03-01T10:00:00Z"
+  quotaAutoscaler:
+    metadata: {name: example-scaler, namespace: example-dev}
+    spec:
+      resourceQuota: example-quota
+      behavior:
+        scaleUp:
+          policies: [{method: cpu, value: 70}]
+- time: "2024-03-01T10:00:00Z"
+  resourceQuota:
+    metadata: {name: example-quota, namespace: example-dev}
+    spec: {hard: {cpu: "1", memory: 1G}}
+    status: {used: {cpu: 500m, memory: 500M}}
+- time: "2024-03-01T10:01:00Z"
+  resourceQuota:
+    metadata: {name: example-quota, namespace: example-dev}
+    spec: {hard: {cpu: "5", memory: 1G}}
+    status: {used: {cpu: 900m, memory: 500M}}
+- time: "2024-03-01T10:01:30Z"
+  object:
+    apiVersion: apps/v1
+    kind: ReplicaSet
+    metadata: {name: app, namespace: example-dev}
+    spec: {replicas: 3, selector: {matchLabels: {app: app}}, template: {metadata: {labels: {app: app}}}}
+    status: {replicas: 1}
+- time: "2024-03-01T10:02:00Z"
+  event:
+    metadata: {name: app.1, namespace: example-dev}
+    involvedObject: {kind: ReplicaSet, name: app, namespace: example-dev}
+    reason: FailedCreate
+    message: 'Error creating: pods "app-x2v9k" is forbidden: exceeded quota: example-quota, requested: requests.cpu=500m, used: requests.cpu=900m, limited: requests.cpu=1285m'
+`
+
+func TestParseTimeline(t *testing.T) {
+	timeline, err := ParseTimeline([]byte(testTimeline))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if len(timeline.Records) != 5 || timeline.Records[3].Object.Object == nil {
+		t.Errorf("expected 5 records with a decoded object but got: %+v\n", timeline.Records)
+	}
+
+	for content, expected := range map[string]string{
+		"records: []": "no records",
+		"records: [{quotaAutoscaler: {metadata: {namespace: a}}}]":                                                  "time must be set",
+		"records: [{time: '2024-03-01T10:00:00Z'}]":                                                                 "exactly one of",
+		"records: [{time: '2024-03-01T10:00:00Z', resourceQuota: {metadata: {name: quota}}}]":                       "namespace must be set",
+		"records: [{time: '2024-03-01T10:00:00Z', object: {apiVersion: v1, kind: Unknown}}]":                        "object:",
+		"end: '2024-03-01T09:00:00Z'\nrecords: [{time: '2024-03-01T10:00:00Z', event: {metadata: {namespace: a}}}]": "end must not be before",
+	} {
+		if _, err := ParseTimeline([]byte(content)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error %s but got: %v\n", expected, err)
+		}
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	timeline, _ := ParseTimeline([]byte(testTimeline))
+	result, err := NewSimulation(timeline, 10*time.Second).Run()
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	// The usage scales up after the debounce, the Event adds the 2 missing replicas of the ReplicaSet
+	start := timeline.Records[0].Time.Time
+	expected := []struct {
+		requested, applied time.Duration
+		cpu                int64
+	}{{65 * time.Second, 75 * time.Second, 1285}, {125 * time.Second, 135 * time.Second, 1900}}
+	if len(result.Resizes) != len(expected) {
+		t.Fatalf("expected %d resizes but got: %+v\n", len(expected), result.Resizes)
+	}
+	for i, resize := range result.Resizes {
+		if !resize.Requested.Equal(start.Add(expected[i].requested)) || resize.Applied == nil || !resize.Applied.Equal(start.Add(expected[i].applied)) {
+			t.Errorf("expected resize %d to be requested at %s and applied at %s but got: %+v\n", i, expected[i].requested, expected[i].applied, resize)
+		}
+		if resize.New.Cpu() != expected[i].cpu {
+			t.Errorf("expected resize %d to %dm CPU but got: %dm\n", i, expected[i].cpu, resize.New.Cpu())
+		}
+	}
+
+	summary := result.Namespaces["example-dev"]
+	if summary.ResizesApplied != 2 || summary.Events != 1 || summary.Stalls != 1 {
+		t.Errorf("expected 2 resizes, 1 event and 1 stall but got: %+v\n", summary)
+	}
+	// 50% for 60s, 10% for 15s, 30% for 60s and 53% for 45s
+	if headroom := summary.AverageHeadroom["cpu"]; headroom < 40 || headroom > 41 {
+		t.Errorf("expected an average CPU headroom of 40.6%% but got: %.1f%%\n", headroom)
+	}
+}
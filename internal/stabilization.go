@@ -0,0 +1,210 @@
+package internal
+
+// This file implements the time based parts of QuotaAutoscaler behaviors: stabilization windows and periodMinutes
+// rate limits. Like the HPA, a stabilization window uses the lowest recommendation within the window when scaling
+// up and the highest recommendation within the window when scaling down, which prevents the quota from flapping
+// when Pods are restarted. A policy with a periodMinutes limits the total change of a resource within that period.
+//
+// Usage:
+//  history := NewScalingHistory()
+//
+//  desired = history.Stabilize(namespace, validatedScaler, current, desired)
+//  desired = history.LimitRate(namespace, validatedScaler, current, desired)
+//  if desired != current {
+//    forget := history.RecordChange(namespace, current, desired)
+//    // When the resize fails or a newer resize supersedes it
+//    forget()
+//  }
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v1 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/ing-bank/quota-scaler/pkg/utils"
+	v12 "k8s.io/api/core/v1"
+)
+
+type timedResources struct {
+	Timestamp time.Time
+	resources.Resources
+
+	id uint64 // Identifies a change, see RecordChange
+}
+
+// ScalingHistory keeps the recent recommendations and requested resizes per namespace. It is safe for concurrent use.
+type ScalingHistory struct {
+	lock            sync.Mutex
+	recommendations map[string][]timedResources
+	changes         map[string][]timedResources // Signed difference between the new and old quota of a resize
+	lastChange      uint64
+
+	Now func() time.Time
+}
+
+func NewScalingHistory() *ScalingHistory {
+	return &ScalingHistory{
+		recommendations: map[string][]timedResources{},
+		changes:         map[string][]timedResources{},
+		Now:             time.Now,
+	}
+}
+
+// Stabilize records desired as a recommendation for the namespace, and returns the stabilized resources given the
+// stabilization windows of the scaler.
+func (history *ScalingHistory) Stabilize(namespace string, scaler *ValidatedQuotaScaler, current, desired resources.Resources) resources.Resources {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	now := history.Now()
+	recommendations := prune(history.recommendations[namespace], now.Add(-scaler.HistoryRetention()))
+	recommendations = append(recommendations, timedResources{Timestamp: now, Resources: desired.Copy()})
+	history.recommendations[namespace] = recommendations
+
+	// The lowest recommendation is the upper bound for scaling up, the highest the lower bound for scaling down. Past
+	// recommendations without the resource are skipped.
+	stabilized := desired.Copy()
+	for name := range desired {
+		up, down := desired.Value(name), desired.Value(name)
+		for _, rec := range recommendations {
+			if _, ok := rec.Resources[name]; !ok {
+				continue
+			}
+			if !rec.Timestamp.Before(now.Add(-scaler.ScaleUp.StabilizationWindow)) {
+				up = utils.Min(up, rec.Value(name))
+			}
+			if !rec.Timestamp.Before(now.Add(-scaler.ScaleDown.StabilizationWindow)) {
+				down = utils.Max(down, rec.Value(name))
+			}
+		}
+		if value := stabilize(current.Value(name), up, down); value != desired.Value(name) {
+			stabilized.Set(name, value)
+		}
+	}
+	return stabilized
+}
+
+func stabilize(current, upRecommendation, downRecommendation int64) int64 {
+	if current < upRecommendation {
+		return upRecommendation
+	}
+	if current > downRecommendation {
+		return downRecommendation
+	}
+	return current
+}
+
+// LimitRate limits the change from current to desired to what the rate limits of the scaler still allow, given the
+// resizes recorded for the namespace.
+func (history *ScalingHistory) LimitRate(namespace string, scaler *ValidatedQuotaScaler, current, desired resources.Resources) resources.Resources {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	now := history.Now()
+	changes := prune(history.changes[namespace], now.Add(-scaler.HistoryRetention()))
+	history.changes[namespace] = changes
+
+	limited := desired.Copy()
+	for name := range desired {
+		if value := limitRate(current.Value(name), desired.Value(name), changes, scaler, name, now); value != desired.Value(name) {
+			limited.Set(name, value)
+		}
+	}
+	return limited
+}
+
+func limitRate(current, desired int64, changes []timedResources, scaler *ValidatedQuotaScaler, name v12.ResourceName, now time.Time) int64 {
+	scaleUp := desired > current
+	behavior := scaler.ScaleDown
+	if scaleUp {
+		behavior = scaler.ScaleUp
+	}
+
+	allowed, found := int64(0), false
+	for _, limit := range behavior.RateLimits {
+		if limit.Resource != name {
+			continue
+		}
+
+		used := int64(0)
+		for _, change := range changes {
+			if change.Timestamp.Before(now.Add(-limit.Period)) {
+				continue
+			}
+			delta := change.Value(name)
+			if scaleUp && delta > 0 {
+				used += delta
+			} else if !scaleUp && delta < 0 {
+				used -= delta
+			}
+		}
+
+		limitAllowed := utils.Max(limit.MaxChange-used, 0)
+		if !found {
+			allowed, found = limitAllowed, true
+		} else if behavior.SelectPolicy == v1.MinPolicySelect {
+			allowed = utils.Min(allowed, limitAllowed)
+		} else {
+			allowed = utils.Max(allowed, limitAllowed)
+		}
+	}
+
+	if !found {
+		return desired
+	}
+	if scaleUp {
+		return utils.Min(desired, current+allowed)
+	}
+	return utils.Max(desired, current-allowed)
+}
+
+// RecordChange records a requested resize of the namespace, it counts towards the rate limits. The returned function
+// removes the change again, for a resize that failed or was superseded before it was applied.
+func (history *ScalingHistory) RecordChange(namespace string, old, new resources.Resources) func() {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	change := resources.Resources{}
+	for name := range new {
+		change.Set(name, new.Value(name)-old.Value(name))
+	}
+	history.lastChange++
+	id := history.lastChange
+	history.changes[namespace] = append(history.changes[namespace], timedResources{Timestamp: history.Now(), Resources: change, id: id})
+
+	return func() { history.forgetChange(namespace, id) }
+}
+
+// forgetChange removes a recorded change, when it is still kept.
+func (history *ScalingHistory) forgetChange(namespace string, id uint64) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	changes := history.changes[namespace]
+	for i := range changes {
+		if changes[i].id == id {
+			history.changes[namespace] = append(changes[:i:i], changes[i+1:]...)
+			return
+		}
+	}
+}
+
+// Forget removes all history of the namespace.
+func (history *ScalingHistory) Forget(namespace string) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	delete(history.recommendations, namespace)
+	delete(history.changes, namespace)
+}
+
+// prune removes entries from before the given time, entries are sorted by time.
+func prune(entries []timedResources, before time.Time) []timedResources {
+	for i, entry := range entries {
+		if !entry.Timestamp.Before(before) {
+			return entries[i:]
+		}
+	}
+	return nil
+}
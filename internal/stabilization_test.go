@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v1 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.now = clock.now.Add(d)
+}
+
+func TestStabilizeScaleDown(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	history := NewScalingHistory()
+	history.Now = clock.Now
+
+	var window int32 = 300
+	scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{Behavior: v1.QuotaAutoscalerSpecBehavior{
+		ScaleDown: v1.QuotaScaleBehavior{StabilizationWindowSeconds: &window},
+	}}})
+	current := resources.New(2000, 2000)
+
+	// A high recommendation keeps the quota up for the duration of the window
+	history.Stabilize("example-dev", scaler, current, resources.New(2000, 2000))
+	clock.Advance(4 * time.Minute)
+	stabilized := history.Stabilize("example-dev", scaler, current, resources.New(1000, 1500))
+	if stabilized.Cpu() != 2000 || stabilized.Memory() != 2000 {
+		t.Errorf("expected scale down to be held at 2000m 2000M but got: %dm %dM\n", stabilized.Cpu(), stabilized.Memory())
+	}
+
+	// The highest recommendation within the window is used once older ones expire
+	clock.Advance(2 * time.Minute)
+	stabilized = history.Stabilize("example-dev", scaler, current, resources.New(800, 1000))
+	if stabilized.Cpu() != 1000 || stabilized.Memory() != 1500 {
+		t.Errorf("expected scale down to 1000m 1500M but got: %dm %dM\n", stabilized.Cpu(), stabilized.Memory())
+	}
+
+	// Scaling up is not stabilized by default
+	clock.Advance(time.Second)
+	stabilized = history.Stabilize("example-dev", scaler, current, resources.New(3000, 2000))
+	if stabilized.Cpu() != 3000 {
+		t.Errorf("expected scale up to 3000m but got: %dm\n", stabilized.Cpu())
+	}
+}
+
+func TestLimitRateScaleUp(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	history := NewScalingHistory()
+	history.Now = clock.Now
+
+	// At most 2 cores added per 5 minutes
+	scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{Behavior: v1.QuotaAutoscalerSpecBehavior{
+		ScaleUp: v1.QuotaScaleBehavior{Policies: []v1.QuotaScalePolicy{{Method: "cpu", Value: 70, PeriodMinutes: 5, MaxChange: "2"}}},
+	}}})
+
+	current := resources.New(1000, 1000)
+	limited := history.LimitRate("example-dev", scaler, current, resources.New(4000, 5000))
+	if limited.Cpu() != 3000 || limited.Memory() != 5000 {
+		t.Errorf("expected 3000m 5000M but got: %dm %dM\n", limited.Cpu(), limited.Memory())
+	}
+	history.RecordChange("example-dev", current, limited)
+
+	clock.Advance(time.Minute)
+	current = limited
+	limited = history.LimitRate("example-dev", scaler, current, resources.New(4000, 5000))
+	if limited.Cpu() != 3000 {
+		t.Errorf("expected the budget to be used up at 3000m but got: %dm\n", limited.Cpu())
+	}
+
+	// Scaling down is not limited by a scaleUp policy
+	limited = history.LimitRate("example-dev", scaler, current, resources.New(500, 5000))
+	if limited.Cpu() != 500 {
+		t.Errorf("expected scale down to 500m but got: %dm\n", limited.Cpu())
+	}
+
+	clock.Advance(5 * time.Minute)
+	limited = history.LimitRate("example-dev", scaler, current, resources.New(4000, 5000))
+	if limited.Cpu() != 4000 {
+		t.Errorf("expected a new budget after the period, 4000m but got: %dm\n", limited.Cpu())
+	}
+}
+
+func TestRecordChangeForget(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	history := NewScalingHistory()
+	history.Now = clock.Now
+
+	scaler := ValidateQuotaScaler(&v1.QuotaAutoscaler{Spec: v1.QuotaAutoscalerSpec{Behavior: v1.QuotaAutoscalerSpecBehavior{
+		ScaleUp: v1.QuotaScaleBehavior{Policies: []v1.QuotaScalePolicy{{Method: "cpu", Value: 70, PeriodMinutes: 5, MaxChange: "2"}}},
+	}}})
+
+	// A superseded resize no longer counts, the applied one still does
+	current := resources.New(1000, 1000)
+	forget := history.RecordChange("example-dev", current, resources.New(2000, 1000))
+	history.RecordChange("example-dev", current, resources.New(2500, 1000))
+	forget()
+	forget()
+
+	limited := history.LimitRate("example-dev", scaler, current, resources.New(4000, 1000))
+	if limited.Cpu() != 1500 {
+		t.Errorf("expected 500m of the budget to be left, 1500m but got: %dm\n", limited.Cpu())
+	}
+}
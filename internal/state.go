@@ -0,0 +1,105 @@
+package internal
+
+// This file contains the mutable state of the QuotaWatcher that is not kept by the informers. QuotaAutoscalers and
+// ResourceQuotas are read from the informer caches and deep copied before use, so every calculation works on an
+// immutable snapshot. Pod Events are kept in an EventStore until a calculation consumes them or they become stale.
+// Calculations are serialised per namespace by the workqueue, NamespaceLocks serialises work outside of it. All types in
+// this file are safe for concurrent use.
+
+import (
+	"sync"
+	"time"
+
+	v12 "k8s.io/api/core/v1"
+)
+
+// EventStore keeps Pod Events per namespace until the next calculation of that namespace consumes them.
+type EventStore struct {
+	lock   sync.Mutex
+	events map[string][]v12.Event
+}
+
+func NewEventStore() *EventStore {
+	return &EventStore{events: map[string][]v12.Event{}}
+}
+
+// Add stores an Event for the namespace and drops its stale Events. Events are not consumed on followers, see
+// leader_election.go, so only recent Events are kept.
+func (store *EventStore) Add(namespace string, ev v12.Event) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.events[namespace] = append(withoutStaleEvents(store.events[namespace]), ev)
+}
+
+// Take returns and removes the recent stored Events of the namespace, nil when there are none.
+func (store *EventStore) Take(namespace string) []v12.Event {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	events := withoutStaleEvents(store.events[namespace])
+	delete(store.events, namespace)
+	return events
+}
+
+func withoutStaleEvents(events []v12.Event) []v12.Event {
+	staleEventAge := CurrentClusterConfig().StaleEventAge.Duration
+	var recent []v12.Event
+	for i := range events {
+		if eventTime(&events[i]).Add(staleEventAge).After(time.Now()) {
+			recent = append(recent, events[i])
+		}
+	}
+	return recent
+}
+
+// Restore puts Events back in front of the Events that were stored since they were taken, e.g. when their
+// calculation failed.
+func (store *EventStore) Restore(namespace string, events []v12.Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.events[namespace] = append(events, store.events[namespace]...)
+}
+
+// NamespaceLocks provides a mutex per namespace. A mutex is removed when no goroutine holds or waits for it.
+type NamespaceLocks struct {
+	lock  sync.Mutex
+	locks map[string]*namespaceLock
+}
+
+type namespaceLock struct {
+	sync.Mutex
+	users int // Goroutines that hold or wait for the mutex
+}
+
+func NewNamespaceLocks() *NamespaceLocks {
+	return &NamespaceLocks{locks: map[string]*namespaceLock{}}
+}
+
+// Lock locks the namespace and returns the function that unlocks it.
+func (locks *NamespaceLocks) Lock(namespace string) func() {
+	locks.lock.Lock()
+	nsLock, ok := locks.locks[namespace]
+	if !ok {
+		nsLock = &namespaceLock{}
+		locks.locks[namespace] = nsLock
+	}
+	nsLock.users++
+	locks.lock.Unlock()
+
+	nsLock.Lock()
+	return func() {
+		nsLock.Unlock()
+
+		locks.lock.Lock()
+		defer locks.lock.Unlock()
+		if nsLock.users--; nsLock.users == 0 {
+			delete(locks.locks, namespace)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNamespaceLocks(t *testing.T) {
+	locks := NewNamespaceLocks()
+
+	// The namespace is held by one goroutine at a time
+	var wg sync.WaitGroup
+	holders, maxHolders := 0, 0
+	var counter sync.Mutex
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.Lock("example-dev")
+			defer unlock()
+
+			counter.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			counter.Unlock()
+
+			counter.Lock()
+			holders--
+			counter.Unlock()
+		}()
+	}
+	wg.Wait()
+	if maxHolders != 1 {
+		t.Errorf("expected a single holder at a time but got: %d\n", maxHolders)
+	}
+
+	// Unused locks are removed
+	locks.Lock("other-dev")()
+	if len(locks.locks) != 0 {
+		t.Errorf("expected no locks to be kept but got: %d\n", len(locks.locks))
+	}
+}
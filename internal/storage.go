@@ -0,0 +1,70 @@
+package internal
+
+// This file protects the storage quota of a namespace. Storage is scaled like any other resource with bounds, e.g.
+// `requests.storage` or `<class>.storageclass.storage.k8s.io/requests.storage`, but a scale down never goes below what
+// the bound PersistentVolumeClaims hold: their volumes exist, releasing the quota would only block new claims.
+//
+// Example usage:
+//  watcher.WatchClaims(factory.Core().V1().PersistentVolumeClaims())
+//  bound, err := BoundClaimResources(watcher.Claims, namespace) // e.g. requests.storage=120Gi, persistentvolumeclaims=3
+
+import (
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// storageClassAnnotation is the deprecated way to set the StorageClass of a claim, still honoured by the quota
+const storageClassAnnotation = "volume.beta.kubernetes.io/storage-class"
+
+// WatchClaims makes the watcher keep storage quotas above the bound PersistentVolumeClaims of the informer. The
+// informer must be started by the caller.
+func (watcher *QuotaWatcher) WatchClaims(claims coreinformers.PersistentVolumeClaimInformer) {
+	watcher.Claims = claims.Lister()
+	watcher.synced = append(watcher.synced, claims.Informer().HasSynced)
+}
+
+// BoundClaimResources returns the storage and number of the bound PersistentVolumeClaims of the namespace, in total
+// and per StorageClass, named like the ResourceQuota resources. A claim holds the biggest of its request and the
+// capacity of its volume.
+func BoundClaimResources(claims corelisters.PersistentVolumeClaimLister, namespace string) (resources.Resources, error) {
+	bound := resources.Resources{}
+	list, err := claims.PersistentVolumeClaims(namespace).List(labels.Everything())
+	if err != nil {
+		return bound, err
+	}
+
+	for _, claim := range list {
+		if claim.Status.Phase != v12.ClaimBound {
+			continue
+		}
+		storage := claim.Spec.Resources.Requests[v12.ResourceStorage]
+		if capacity, ok := claim.Status.Capacity[v12.ResourceStorage]; ok && capacity.Cmp(storage) > 0 {
+			storage = capacity
+		}
+		count := *resource.NewQuantity(1, resource.DecimalSI)
+
+		bound.Add(resources.Resources{v12.ResourceRequestsStorage: storage, v12.ResourcePersistentVolumeClaims: count})
+		if class := storageClassOf(claim); class != "" {
+			prefix := class + ".storageclass.storage.k8s.io/"
+			bound.Add(resources.Resources{
+				v12.ResourceName(prefix + string(v12.ResourceRequestsStorage)):        storage,
+				v12.ResourceName(prefix + string(v12.ResourcePersistentVolumeClaims)): count,
+			})
+		}
+	}
+	return bound, nil
+}
+
+func storageClassOf(claim *v12.PersistentVolumeClaim) string {
+	if class, ok := claim.Annotations[storageClassAnnotation]; ok {
+		return class
+	}
+	if claim.Spec.StorageClassName != nil {
+		return *claim.Spec.StorageClassName
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"testing"
+
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestClaim(name, class, request, capacity string, phase v12.PersistentVolumeClaimPhase) *v12.PersistentVolumeClaim {
+	claim := &v12.PersistentVolumeClaim{
+		ObjectMeta: v13.ObjectMeta{Name: name, Namespace: "example-dev"},
+		Spec: v12.PersistentVolumeClaimSpec{Resources: v12.ResourceRequirements{Requests: v12.ResourceList{
+			v12.ResourceStorage: resource.MustParse(request),
+		}}},
+		Status: v12.PersistentVolumeClaimStatus{Phase: phase},
+	}
+	if class != "" {
+		claim.Spec.StorageClassName = &class
+	}
+	if capacity != "" {
+		claim.Status.Capacity = v12.ResourceList{v12.ResourceStorage: resource.MustParse(capacity)}
+	}
+	return claim
+}
+
+func newTestClaimLister(claims ...*v12.PersistentVolumeClaim) corelisters.PersistentVolumeClaimLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, claim := range claims {
+		_ = indexer.Add(claim)
+	}
+	return corelisters.NewPersistentVolumeClaimLister(indexer)
+}
+
+func TestBoundClaimResources(t *testing.T) {
+	claims := newTestClaimLister(
+		newTestClaim("data-db-0", "fast", "10Gi", "10Gi", v12.ClaimBound),
+		newTestClaim("data-db-1", "fast", "10Gi", "", v12.ClaimPending), // Not bound
+		newTestClaim("backup", "", "1Gi", "5Gi", v12.ClaimBound),        // The volume is bigger than requested
+	)
+
+	bound, err := BoundClaimResources(claims, "example-dev")
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	expected := "fast.storageclass.storage.k8s.io/persistentvolumeclaims=1, fast.storageclass.storage.k8s.io/requests.storage=10Gi, persistentvolumeclaims=2, requests.storage=15Gi"
+	if bound.String() != expected {
+		t.Errorf("expected %s but got: %s\n", expected, bound)
+	}
+
+	if bound, _ := BoundClaimResources(claims, "foo-dev"); !bound.IsEmpty() {
+		t.Errorf("expected no bound claims in another namespace but got: %s\n", bound)
+	}
+}
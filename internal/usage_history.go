@@ -0,0 +1,270 @@
+package internal
+
+// This file records the CPU and memory usage of namespaces for predictions, see prediction.go. The usage is kept
+// per interval of the cluster config (usageSampleInterval), the highest usage within an interval counts, for two weeks.
+// Intervals without calculations repeat the previous usage. The history is kept in memory and saved periodically to a
+// ConfigMap per namespace in the namespace of the quota-scaler, so a new leader continues where the previous one
+// stopped.
+//
+// Example usage:
+//  history := NewUsageHistory(client, "quota-scaler")
+//  go history.Run(UsageHistorySaveInterval, stopCh)
+//
+//  history.Record(namespace, time.Now(), used)
+//  samples := history.Samples(namespace) // e.g. cpu=[400 450 ...], memory=[1200 1250 ...]
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// UsageHistoryRetention is how long the usage is kept, the weekly season needs a week of history before it predicts.
+	UsageHistoryRetention = 14 * 24 * time.Hour
+	// UsageHistorySaveInterval is how often the usage history is saved to its ConfigMaps.
+	UsageHistorySaveInterval = time.Minute
+
+	usageConfigMapPrefix = "quota-scaler-usage-"
+	usageConfigMapKey    = "history.json"
+)
+
+// usageSeries are the samples of a resource, one per interval from Start, in the scale of the resource.
+type usageSeries struct {
+	Start   time.Time `json:"start"`
+	Samples []int64   `json:"samples"`
+}
+
+type namespaceUsage struct {
+	Interval v13.Duration                      `json:"interval"`
+	Series   map[v12.ResourceName]*usageSeries `json:"series"`
+
+	dirty bool
+}
+
+// UsageHistory keeps the usage history of namespaces. It is safe for concurrent use.
+type UsageHistory struct {
+	Client    kubernetes.Interface // Saves the history in ConfigMaps, nil keeps it in memory only
+	Namespace string               // Of the ConfigMaps
+
+	lock       sync.Mutex
+	namespaces map[string]*namespaceUsage
+}
+
+func NewUsageHistory(client kubernetes.Interface, namespace string) *UsageHistory {
+	return &UsageHistory{
+		Client:     client,
+		Namespace:  namespace,
+		namespaces: map[string]*namespaceUsage{},
+	}
+}
+
+func (history *UsageHistory) interval() time.Duration {
+	return CurrentClusterConfig().UsageSampleInterval.Duration
+}
+
+// Record adds the used resources of the namespace at the given time to its history.
+func (history *UsageHistory) Record(namespace string, now time.Time, used resources.Resources) {
+	if !history.load(namespace) {
+		return
+	}
+
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	interval := history.interval()
+	usage := history.namespaces[namespace]
+	if usage.Interval.Duration != interval {
+		if len(usage.Series) > 0 {
+			logging.LogInfo("[%s] Usage sample interval changed to %s, discarding the usage history", namespace, interval)
+		}
+		usage.Interval, usage.Series = v13.Duration{Duration: interval}, map[v12.ResourceName]*usageSeries{}
+	}
+
+	at := now.Truncate(interval)
+	for name := range used {
+		usage.Series[name] = record(usage.Series[name], at, interval, used.Value(name))
+	}
+	usage.dirty = true
+}
+
+func record(series *usageSeries, at time.Time, interval time.Duration, value int64) *usageSeries {
+	if series == nil || len(series.Samples) == 0 || at.Sub(series.last(interval)) > UsageHistoryRetention {
+		return &usageSeries{Start: at, Samples: []int64{value}}
+	}
+
+	last := series.last(interval)
+	if at.Before(last) {
+		return series // Clock skew, the interval has been recorded already
+	}
+	if at.Equal(last) {
+		if value > series.Samples[len(series.Samples)-1] {
+			series.Samples[len(series.Samples)-1] = value
+		}
+		return series
+	}
+
+	// Intervals without calculations had the previous usage
+	previous := series.Samples[len(series.Samples)-1]
+	for t := last.Add(interval); t.Before(at); t = t.Add(interval) {
+		series.Samples = append(series.Samples, previous)
+	}
+	series.Samples = append(series.Samples, value)
+
+	if excess := len(series.Samples) - int(UsageHistoryRetention/interval); excess > 0 {
+		series.Samples = append([]int64(nil), series.Samples[excess:]...)
+		series.Start = series.Start.Add(time.Duration(excess) * interval)
+	}
+	return series
+}
+
+func (series *usageSeries) last(interval time.Duration) time.Time {
+	return series.Start.Add(time.Duration(len(series.Samples)-1) * interval)
+}
+
+// Samples returns a copy of the usage history of the namespace per resource, oldest first.
+func (history *UsageHistory) Samples(namespace string) map[v12.ResourceName][]int64 {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	samples := map[v12.ResourceName][]int64{}
+	if usage, ok := history.namespaces[namespace]; ok {
+		for name, series := range usage.Series {
+			samples[name] = append([]int64(nil), series.Samples...)
+		}
+	}
+	return samples
+}
+
+// Knows returns whether the history of the namespace is loaded.
+func (history *UsageHistory) Knows(namespace string) bool {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	_, ok := history.namespaces[namespace]
+	return ok
+}
+
+// load reads the history of the namespace from its ConfigMap, unless it is loaded already. It returns false when the
+// ConfigMap cannot be read, the next calculation tries again.
+func (history *UsageHistory) load(namespace string) bool {
+	if history.Knows(namespace) {
+		return true
+	}
+
+	usage := &namespaceUsage{Series: map[v12.ResourceName]*usageSeries{}}
+	if history.Client != nil {
+		configMap, err := history.Client.CoreV1().ConfigMaps(history.Namespace).Get(context.TODO(), usageConfigMapName(namespace), v13.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			logging.LogWarning("[%s] Cannot load the usage history: %s", namespace, err.Error())
+			return false
+		}
+		if err == nil {
+			if err := json.Unmarshal([]byte(configMap.Data[usageConfigMapKey]), usage); err != nil {
+				logging.LogWarning("[%s] Discarding invalid usage history: %s", namespace, err.Error())
+				usage = &namespaceUsage{Series: map[v12.ResourceName]*usageSeries{}}
+			}
+		}
+	}
+
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	if _, ok := history.namespaces[namespace]; !ok {
+		history.namespaces[namespace] = usage
+	}
+	return true
+}
+
+// Forget removes the history of the namespace, including its ConfigMap when the history is loaded.
+func (history *UsageHistory) Forget(namespace string) {
+	history.lock.Lock()
+	_, ok := history.namespaces[namespace]
+	delete(history.namespaces, namespace)
+	history.lock.Unlock()
+
+	if !ok || history.Client == nil {
+		return
+	}
+	err := history.Client.CoreV1().ConfigMaps(history.Namespace).Delete(context.TODO(), usageConfigMapName(namespace), v13.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logging.LogWarning("[%s] Cannot delete the usage history: %s", namespace, err.Error())
+	}
+}
+
+// Save writes the histories that changed since the last save to their ConfigMaps.
+func (history *UsageHistory) Save() {
+	if history.Client == nil {
+		return
+	}
+
+	history.lock.Lock()
+	changed := map[string][]byte{}
+	for namespace, usage := range history.namespaces {
+		if !usage.dirty {
+			continue
+		}
+		data, err := json.Marshal(usage)
+		if err != nil {
+			logging.LogError("[%s] Cannot encode the usage history: %s", namespace, err.Error())
+			continue
+		}
+		changed[namespace] = data
+		usage.dirty = false
+	}
+	history.lock.Unlock()
+
+	for namespace, data := range changed {
+		if err := history.save(namespace, data); err != nil {
+			logging.LogWarning("[%s] Cannot save the usage history: %s", namespace, err.Error())
+			history.lock.Lock()
+			if usage, ok := history.namespaces[namespace]; ok {
+				usage.dirty = true // Retried with the next save
+			}
+			history.lock.Unlock()
+		}
+	}
+}
+
+func (history *UsageHistory) save(namespace string, data []byte) error {
+	configMap := &v12.ConfigMap{
+		ObjectMeta: v13.ObjectMeta{
+			Name:      usageConfigMapName(namespace),
+			Namespace: history.Namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "quota-scaler", "quota-scaler/namespace": namespace},
+		},
+		Data: map[string]string{usageConfigMapKey: string(data)},
+	}
+	configMaps := history.Client.CoreV1().ConfigMaps(history.Namespace)
+	_, err := configMaps.Update(context.TODO(), configMap, v13.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(context.TODO(), configMap, v13.CreateOptions{})
+	}
+	return err
+}
+
+// Run saves the histories every period and when stopCh is closed. This is a blocking call until stopCh is closed.
+func (history *UsageHistory) Run(period time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			history.Save()
+		case <-stopCh:
+			history.Save()
+			return
+		}
+	}
+}
+
+func usageConfigMapName(namespace string) string {
+	return usageConfigMapPrefix + namespace
+}
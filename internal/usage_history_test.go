@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v12 "k8s.io/api/core/v1"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func equalSamples(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUsageHistoryRecord(t *testing.T) {
+	history := NewUsageHistory(nil, "")
+	start := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	// The highest usage within an interval is kept, missing intervals repeat the previous usage
+	history.Record("example-dev", start.Add(time.Minute), resources.New(400, 1000))
+	history.Record("example-dev", start.Add(5*time.Minute), resources.New(600, 900))
+	history.Record("example-dev", start.Add(35*time.Minute), resources.New(300, 800))
+	history.Record("example-dev", start.Add(2*time.Minute), resources.New(900, 900)) // Recorded already
+
+	samples := history.Samples("example-dev")
+	if !equalSamples(samples[v12.ResourceCPU], []int64{600, 600, 600, 300}) {
+		t.Errorf("expected cpu samples [600 600 600 300] but got: %v\n", samples[v12.ResourceCPU])
+	}
+	if !equalSamples(samples[v12.ResourceMemory], []int64{1000, 1000, 1000, 800}) {
+		t.Errorf("expected memory samples [1000 1000 1000 800] but got: %v\n", samples[v12.ResourceMemory])
+	}
+
+	// The history is limited to the retention
+	history.Record("example-dev", start.Add(UsageHistoryRetention), resources.New(500, 700))
+	if samples = history.Samples("example-dev"); len(samples[v12.ResourceCPU]) != int(UsageHistoryRetention/(10*time.Minute)) || samples[v12.ResourceCPU][0] != 600 {
+		t.Errorf("expected the oldest samples to be removed but got %d samples\n", len(samples[v12.ResourceCPU]))
+	}
+
+	// A gap longer than the retention starts over
+	history.Record("example-dev", start.Add(3*UsageHistoryRetention), resources.New(500, 700))
+	if samples = history.Samples("example-dev"); !equalSamples(samples[v12.ResourceCPU], []int64{500}) {
+		t.Errorf("expected the history to start over but got: %v\n", samples[v12.ResourceCPU])
+	}
+
+	// Changing the interval discards the history
+	config := DefaultClusterConfig()
+	config.UsageSampleInterval.Duration = time.Minute
+	UseClusterConfig(config)
+	defer UseClusterConfig(DefaultClusterConfig())
+	history.Record("example-dev", start.Add(3*UsageHistoryRetention+time.Minute), resources.New(400, 700))
+	if samples = history.Samples("example-dev"); !equalSamples(samples[v12.ResourceCPU], []int64{400}) {
+		t.Errorf("expected the history to be discarded but got: %v\n", samples[v12.ResourceCPU])
+	}
+}
+
+func TestUsageHistoryPersistence(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	start := time.Date(2024, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	history := NewUsageHistory(client, "quota-scaler")
+	history.Record("example-dev", start, resources.New(400, 1000))
+	history.Record("example-dev", start.Add(10*time.Minute), resources.New(500, 1100))
+	history.Save()
+	history.Record("example-dev", start.Add(20*time.Minute), resources.New(600, 1200))
+	history.Save()
+
+	configMap, err := client.CoreV1().ConfigMaps("quota-scaler").Get(context.TODO(), "quota-scaler-usage-example-dev", v13.GetOptions{})
+	if err != nil || configMap.Data["history.json"] == "" {
+		t.Fatalf("expected the history to be saved but got: %v\n", err)
+	}
+
+	// A new leader continues with the saved history
+	restored := NewUsageHistory(client, "quota-scaler")
+	restored.Record("example-dev", start.Add(30*time.Minute), resources.New(700, 1300))
+	if samples := restored.Samples("example-dev"); !equalSamples(samples[v12.ResourceCPU], []int64{400, 500, 600, 700}) {
+		t.Errorf("expected cpu samples [400 500 600 700] but got: %v\n", samples[v12.ResourceCPU])
+	}
+
+	restored.Forget("example-dev")
+	if _, err := client.CoreV1().ConfigMaps("quota-scaler").Get(context.TODO(), "quota-scaler-usage-example-dev", v13.GetOptions{}); err == nil {
+		t.Errorf("expected the ConfigMap to be deleted\n")
+	}
+	if samples := restored.Samples("example-dev"); len(samples) != 0 {
+		t.Errorf("expected no samples but got: %v\n", samples)
+	}
+}
@@ -1,235 +1,359 @@
 package internal
 
-// This file contains functions that take namespaced ResourceQuota and QuotaAutoscaler events and turn
-// them into behaviour which can invoke the resize API. Event watching is the responsibility of the
-// calling function, this also includes stream resets.
+// This file contains the QuotaWatcher, which takes namespaced ResourceQuota, QuotaAutoscaler and Pod Event changes
+// from shared informers and turns them into behaviour which can invoke the resize API. Informer handlers only
+// enqueue namespaces on a rate limited workqueue, workers then calculate the desired quota per namespace.
 //
 // Example usage:
-//  quotas, _ := core.ResourceQuotas("").Watch(context.TODO(), v1.ListOptions{})
-//  scalers, _ := ichp.QuotaAutoscalers("").Watch(context.TODO(), v1.ListOptions{})
-//  events, _ := client.CoreV1().Events("").Watch(context.TODO(), v1.ListOptions{})
+//  factory := informers.NewSharedInformerFactory(client, 0)
+//  ichpFactory := externalversions.NewSharedInformerFactory(ichpClient, internal.CurrentClusterConfig().ResyncPeriod.Duration)
+//  watcher := internal.NewQuotaWatcher(client, ichpClient, ichpFactory.Ichp().V1().QuotaAutoscalers(),
+//    factory.Core().V1().ResourceQuotas(), eventFactory.Core().V1().Events())
 //
-//  // This is a blocking call, until either watcher channel terminates
-//  internal.WatchQuotas(client, quotas.ResultChan(), scalers.ResultChan(), events.ResultChan())
+//  factory.Start(stopCh)
+//  ichpFactory.Start(stopCh)
+//  eventFactory.Start(stopCh)
 //
-//	quotas.Stop()
-//  scalers.Stop()
-//  events.Stop()
+//  // This is a blocking call, until stopCh is closed
+//  watcher.Run(4, stopCh)
 
 import (
 	"context"
-	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
 	"errors"
 	_ "net/http/pprof"
+	"reflect"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/ing-bank/quota-scaler/pkg/logging"
 	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	"github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned"
+	ichpinformers "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/informers/externalversions/quotaautoscaler/v1"
+	ichplisters "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/listers/quotaautoscaler/v1"
 	v12 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
-	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
-// REQ_LIM_RATIO is the ratio between namespace ResourceQuota CPU requests and CPU limits.
-// E.g. with ratio=10 when a consumer requests 400m CPU, they will have a 4 core CPU limit.
-const REQ_LIM_RATIO = 10
+// DefaultCpuLimitRatio is the ratio between namespace ResourceQuota CPU requests and CPU limits, for QuotaAutoscalers
+// without a cpuLimitRatio. E.g. with ratio=10 when a consumer requests 400m CPU, they will have a 4 core CPU limit.
+var DefaultCpuLimitRatio int64 = 10
 
-// QuotaWatcher internally manages a list of QuotaAutoscalers and ResourceQuotas.
+// QuotaWatcher calculates the desired ResourceQuota for namespaces with a QuotaAutoscaler. It is safe for
+// concurrent use, see state.go.
 type QuotaWatcher struct {
-	Scalers map[string]v14.QuotaAutoscaler
-	Quotas  map[string]v12.ResourceQuota
-	Events  map[string][]v12.Event
-
-	Client *kubernetes.Clientset
+	Scalers ichplisters.QuotaAutoscalerLister
+	Quotas  corelisters.ResourceQuotaLister
+	Claims  corelisters.PersistentVolumeClaimLister // Keeps storage quotas above the bound claims, may be nil
+	Events  *EventStore
+
+	Client         kubernetes.Interface
+	IchpClient     versioned.Interface
+	Owners         *OwnerResolver  // Resolves Pod owners that are not built in, may be nil
+	RuntimeClasses *RuntimeClasses // Resolves the overhead of Pod templates, may be nil
+	History        *ScalingHistory
+	DryRunHistory  *ScalingHistory            // Rate limits the would-be resizes of dry runs, nil does not limit them
+	Usage          *UsageHistory              // Records the usage for predictions, nil disables predictions
+	Consumption    ConsumptionSource          // Reads the consumption of Pods for the Metrics usageSource, may be nil
+	Autoscalers    *HorizontalAutoscalers     // Reads the autoscalers for the replicaHeadroom, may be nil
+	Debounce       time.Duration              // Zero uses the debounce of the cluster config
+	Resize         func(NamespaceResizeEvent) // Requests a resize, nil uses InvokeResizeApiAsync
+	Now            func() time.Time           // Evaluates the schedules, nil uses time.Now
+
+	queue   workqueue.RateLimitingInterface
+	synced  []cache.InformerSynced
+	locks   *NamespaceLocks // Serialises the calculations with GrowQuota, nil does not serialise them
+	running int32           // Whether the workers run, only the leader grows quotas. Accessed atomically
 }
 
-// WatchQuotas listens to namespaced ResourceQuotas and QuotaAutoscalers. When both are known for a namespace
-// the required behaviour is calculated. If scaling is required, following the behavior, the resize API is
-// invoked. This is a blocking call until either channel terminates.
-func WatchQuotas(client *kubernetes.Clientset, startScalers []v14.QuotaAutoscaler, quotas, scalers, events <-chan watch.Event, cmEvents <-chan watch.Event) {
+// NewQuotaWatcher creates a QuotaWatcher and registers its handlers on the given informers. The informers must be
+// started by the caller.
+func NewQuotaWatcher(client kubernetes.Interface, ichpClient versioned.Interface, scalers ichpinformers.QuotaAutoscalerInformer,
+	quotas coreinformers.ResourceQuotaInformer, events ...coreinformers.EventInformer) *QuotaWatcher {
 	watcher := &QuotaWatcher{
-		Scalers: map[string]v14.QuotaAutoscaler{},
-		Quotas:  map[string]v12.ResourceQuota{},
-		Events:  map[string][]v12.Event{},
-		Client:  client,
-	}
-
-	// Init scaler state so that we know which ResourceQuotas to couple. The Scaler has a field with the
-	// resource name of the ResourceQuota object, so we cannot store ResourceQuota objects until we know
-	// the scaler spec. After registering the Scalers we will get the ResourceQuotas in the event stream.
-	for _, nsScaler := range startScalers {
-		watcher.Scalers[nsScaler.Namespace] = nsScaler
-	}
-	startQuotas, _ := client.CoreV1().ResourceQuotas("").List(context.TODO(), v13.ListOptions{})
-	for _, startQuota := range startQuotas.Items {
-		scaler, ok := watcher.Scalers[startQuota.Namespace]
-		if ok && scaler.Spec.ResourceQuota == startQuota.Name {
-			watcher.Quotas[startQuota.Namespace] = startQuota
-		}
+		Scalers: scalers.Lister(),
+		Quotas:  quotas.Lister(),
+		Events:  NewEventStore(),
+
+		Client:        client,
+		IchpClient:    ichpClient,
+		History:       NewScalingHistory(),
+		DryRunHistory: NewScalingHistory(),
+
+		queue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "quota-scaler"),
+		synced: []cache.InformerSynced{scalers.Informer().HasSynced, quotas.Informer().HasSynced},
+		locks:  NewNamespaceLocks(),
 	}
 
-	// Ticker aggregates Namespace and ResourceQuota events
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case event, ok := <-quotas:
-			// Quota Changes are very frequent, every Pod "modifies" the Quota status twice.
-			// To be a bit more friendly during a scale down we let ticker aggregate Quota
-			// events. For most cases this will suffice. The ideal implementation would be to
-			// aggregate a few seconds after the first ResourceQuota event per unique namespace.
-			if !ok {
-				return
-			}
-			ns := watcher.RegisterQuotaEvent(event)
-			if ns != "" {
-				logging.LogDebug("[%s] QuotaEvent", ns)
-				if _, ok := watcher.Events[ns]; !ok {
-					watcher.Events[ns] = []v12.Event{}
-					// We let the ticker aggregate events
-				}
-			}
-		case event, ok := <-scalers:
-			if !ok {
-				return
-			}
-			ns := watcher.RegisterScalerEvent(event)
-			if ns != "" {
-				logging.LogDebug("[%s] ScalerEvent", ns)
-				watcher.UpdateNs(ns, false)
+	scalers.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: watcher.enqueueScaler,
+		UpdateFunc: func(old, new interface{}) {
+			oldScaler, newScaler := old.(*v14.QuotaAutoscaler), new.(*v14.QuotaAutoscaler)
+			// Status changes are written by ourselves, only recalculate on spec changes and periodic resyncs. A resync
+			// delivers the cached object itself.
+			if oldScaler == newScaler || !reflect.DeepEqual(oldScaler.Spec, newScaler.Spec) {
+				watcher.enqueueScaler(new)
 			}
+		},
+		DeleteFunc: watcher.enqueueScaler,
+	})
+	quotas.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    watcher.enqueueQuota,
+		UpdateFunc: func(_, new interface{}) { watcher.enqueueQuota(new) },
+		DeleteFunc: watcher.enqueueQuota,
+	})
+	for _, informer := range events {
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    watcher.registerEvent,
+			UpdateFunc: func(_, new interface{}) { watcher.registerEvent(new) }, // Repeated failures update the Event
+		})
+		watcher.synced = append(watcher.synced, informer.Informer().HasSynced)
+	}
 
-		case event, ok := <-events:
-			if !ok {
-				return
-			}
-			ns := watcher.RegisterNamespacedEvent(event)
-			if ns != "" {
-				logging.LogDebug("[%s] PodEvent", ns)
-			}
-			// We let the ticker aggregate events
+	return watcher
+}
 
-		// cert-manager events will also be handled by the function RegisterNamespacedEvent
-		case cmEvent, ok := <-cmEvents:
-			if !ok {
-				return
-			}
-			ns := watcher.RegisterNamespacedEvent(cmEvent)
-			if ns != "" {
-				logging.LogDebug("[%s] CertManagerEvent", ns)
-			}
-			// We let the ticker aggregate events
+// Run waits for the informer caches to sync and then starts the workers. This is a blocking call until stopCh
+// is closed.
+func (watcher *QuotaWatcher) Run(workers int, stopCh <-chan struct{}) {
+	defer watcher.queue.ShutDown()
 
-		case <-ticker.C:
-			for ns, _ := range watcher.Events {
-				logging.LogDebug("[%s] Ticker", ns)
-				watcher.UpdateNs(ns, true) // New expensive, as reading events will read ReplicaSets, etc
-				delete(watcher.Events, ns)
-			}
+	logging.LogInfo("Waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(stopCh, watcher.synced...) {
+		logging.LogError("Failed to sync informer caches")
+		return
+	}
+
+	go watcher.handleResizeResults(stopCh)
+	for i := 0; i < workers; i++ {
+		go wait.Until(watcher.runWorker, time.Second, stopCh)
+	}
+
+	logging.LogInfo("Started %d workers", workers)
+	atomic.StoreInt32(&watcher.running, 1)
+	defer atomic.StoreInt32(&watcher.running, 0)
+	<-stopCh
+}
+
+func (watcher *QuotaWatcher) runWorker() {
+	for watcher.processNextItem() {
+	}
+}
+
+// processNextItem calculates the next namespace from the queue. The workqueue guarantees that a namespace is
+// never processed by two workers at the same time.
+func (watcher *QuotaWatcher) processNextItem() bool {
+	key, quit := watcher.queue.Get()
+	if quit {
+		return false
+	}
+	defer watcher.queue.Done(key)
+
+	namespace := key.(string)
+	if err := watcher.UpdateNs(namespace); err != nil {
+		logging.LogError("[%s] Failed to update quota for: %s", namespace, err.Error())
+		watcher.queue.AddRateLimited(key)
+		return true
+	}
+
+	watcher.queue.Forget(key)
+	return true
+}
+
+// handleResizeResults publishes the results of the resize API as namespace Events and QuotaAutoscaler status.
+func (watcher *QuotaWatcher) handleResizeResults(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
 		case event := <-ResizeResultChan: // This channel is managed by resize_api.go, should never close
-			scalerObj := watcher.Scalers[event.Namespace]
-			ref := v12.ObjectReference{
-				Kind:            "quotaautoscaler",
-				Namespace:       scalerObj.Namespace,
-				Name:            scalerObj.Name,
-				UID:             scalerObj.UID,
-				APIVersion:      scalerObj.APIVersion,
-				ResourceVersion: scalerObj.ResourceVersion,
+			scalerObj, err := watcher.GetScaler(event.Namespace)
+			if err != nil || scalerObj == nil {
+				continue
 			}
+			ref := scalerReference(scalerObj)
 			go func() {
-				if err := PublishNamespaceEvent(client, ref, event); err != nil {
+				if err := PublishNamespaceEvent(watcher.Client, ref, event); err != nil {
 					logging.LogError("[%s] Cannot publish namespace event: %s", event.Namespace, err.Error())
 				}
 			}()
+			go watcher.updateStatus(*scalerObj, ResizeResultStatus(event))
 		}
 	}
 }
 
-func (watcher *QuotaWatcher) UpdateNs(namespace string, readEvents bool) {
-	scaler, scalerOk := watcher.Scalers[namespace]
-	quota, quotaOk := watcher.Quotas[namespace]
-	var events []v12.Event
-	if readEvents {
-		events = watcher.Events[namespace]
+func scalerReference(scaler *v14.QuotaAutoscaler) v12.ObjectReference {
+	return v12.ObjectReference{
+		Kind:            "quotaautoscaler",
+		Namespace:       scaler.Namespace,
+		Name:            scaler.Name,
+		UID:             scaler.UID,
+		APIVersion:      scaler.APIVersion,
+		ResourceVersion: scaler.ResourceVersion,
 	}
-	logging.LogDebug("[%s] Checking Quota Updates (Found Scaler: %t Quota: %t Events %d (%t) ", namespace, scalerOk, quotaOk, len(events), readEvents)
+}
 
-	if scalerOk && quotaOk {
-		go func() {
-			err := watcher.UpdateQuotaIfRequired(quota, scaler, events)
-			if err != nil {
-				logging.LogError("[%s] Failed to update quota for: %s", namespace, err.Error())
-			}
-		}()
+// UpdateNs calculates the desired quota of a namespace, consuming its stored Pod Events. It must not be called for a
+// namespace that is being calculated, the workqueue guarantees this for the workers. It waits while GrowQuota grows
+// the quota of the namespace.
+func (watcher *QuotaWatcher) UpdateNs(namespace string) error {
+	unlock := watcher.lockNamespace(namespace)
+	defer unlock()
+
+	scaler, err := watcher.GetScaler(namespace)
+	if err != nil {
+		return err
+	}
+	if scaler == nil {
+		watcher.History.Forget(namespace)
+		if watcher.DryRunHistory != nil {
+			watcher.DryRunHistory.Forget(namespace)
+		}
+		if watcher.Usage != nil {
+			watcher.Usage.Forget(namespace)
+		}
+		forgetNamespaceMetrics(namespace)
+		watcher.Events.Take(namespace)
+		return nil
 	}
-}
 
-// RegisterScalerEvent stores a QuotaAutoscaler in watcher, or deletes it.
-func (watcher *QuotaWatcher) RegisterScalerEvent(event watch.Event) string {
-	scaler := event.Object.(*v14.QuotaAutoscaler)
+	quota, err := watcher.Quotas.ResourceQuotas(namespace).Get(scaler.Spec.ResourceQuota)
+	if apierrors.IsNotFound(err) {
+		logging.LogError("[%s] ResourceQuota %s not found", namespace, scaler.Spec.ResourceQuota)
+		watcher.updateStatus(*scaler, QuotaNotFoundStatus(scaler.Generation, scaler.Spec.ResourceQuota))
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-	if event.Type == watch.Deleted {
-		delete(watcher.Scalers, scaler.Namespace)
-		return ""
+	events := watcher.Events.Take(namespace)
+	logging.LogDebug("[%s] Checking Quota Updates (Events %d)", namespace, len(events))
+
+	// Objects from the informer cache are shared and must not be modified
+	if err := watcher.UpdateQuotaIfRequired(*quota.DeepCopy(), *scaler.DeepCopy(), events); err != nil {
+		watcher.Events.Restore(namespace, events) // Retried with the next calculation
+		return err
 	}
 
-	watcher.Scalers[scaler.Namespace] = *scaler
-	if _, ok := watcher.Quotas[scaler.Namespace]; !ok {
-		_ = watcher.RegisterMissingResourceQuota(scaler.Namespace, scaler.Spec.ResourceQuota) // A bit slow, but needed
+	// Calculate again when a window opens or closes, also without changes of the quota
+	now := watcher.now()
+	if next, ok := NextScheduleTransition(namespace, scaler.Spec.Schedules, now); ok {
+		logging.LogDebug("[%s] Next schedule transition at %s", namespace, next.Format(time.RFC3339))
+		watcher.queue.AddAfter(namespace, next.Sub(now))
 	}
-	return scaler.Namespace
+	return nil
 }
 
-// RegisterQuotaEvent stores a ResourceQuota in watcher, or deletes it.
-func (watcher *QuotaWatcher) RegisterQuotaEvent(event watch.Event) string {
-	quota := event.Object.(*v12.ResourceQuota)
+func (watcher *QuotaWatcher) now() time.Time {
+	if watcher.Now != nil {
+		return watcher.Now()
+	}
+	return time.Now()
+}
 
-	// Get QuotaAutoscaler to see event Quota is a target
-	scaler, ok := watcher.Scalers[quota.Namespace]
-	if ok && scaler.Spec.ResourceQuota == quota.Name {
+// GetScaler returns the QuotaAutoscaler of the namespace, or nil when the namespace has none. When a namespace has
+// several QuotaAutoscalers the first by name is used.
+func (watcher *QuotaWatcher) GetScaler(namespace string) (*v14.QuotaAutoscaler, error) {
+	scalers, err := watcher.Scalers.QuotaAutoscalers(namespace).List(labels.Everything())
+	if err != nil || len(scalers) == 0 {
+		return nil, err
+	}
+	if len(scalers) > 1 {
+		sort.Slice(scalers, func(i, j int) bool { return scalers[i].Name < scalers[j].Name })
+		logging.LogWarning("[%s] Found %d QuotaAutoscalers, only %s is used", namespace, len(scalers), scalers[0].Name)
+	}
+	return scalers[0], nil
+}
 
-		if event.Type == watch.Deleted {
-			delete(watcher.Quotas, quota.Namespace)
-			return ""
-		}
+// updateStatus writes the status mutation to the given QuotaAutoscaler. Failures are only logged, the status is
+// informational and will be written again on the next calculation.
+func (watcher *QuotaWatcher) updateStatus(scaler v14.QuotaAutoscaler, mutate func(status *v14.QuotaAutoscalerStatus)) {
+	if watcher.IchpClient == nil || scaler.Name == "" {
+		return
+	}
+	if err := UpdateScalerStatus(watcher.IchpClient, scaler.Namespace, scaler.Name, mutate); err != nil {
+		logging.LogError("[%s] Cannot update QuotaAutoscaler status: %s", scaler.Namespace, err.Error())
+	}
+}
 
-		watcher.Quotas[quota.Namespace] = *quota
-		return quota.Namespace
+// enqueueScaler immediately queues the namespace of a QuotaAutoscaler.
+func (watcher *QuotaWatcher) enqueueScaler(obj interface{}) {
+	if namespace := namespaceOf(obj); namespace != "" {
+		logging.LogDebug("[%s] ScalerEvent", namespace)
+		watcher.queue.Add(namespace)
 	}
+}
 
-	return ""
+// debounce returns how long changes of a namespace are aggregated.
+func (watcher *QuotaWatcher) debounce() time.Duration {
+	if watcher.Debounce != 0 {
+		return watcher.Debounce
+	}
+	return CurrentClusterConfig().Debounce.Duration
 }
 
-// RegisterMissingResourceQuota fetches the given quota and stores it in the watcher. Does not consume Lock, so
-// it must be called when holding the (Mutex) Lock.
-func (watcher *QuotaWatcher) RegisterMissingResourceQuota(namespace, quotaName string) error {
-	logging.LogInfo("[%s] Registering missing ResourceQuota: %s", namespace, quotaName)
-	quota, err := watcher.Client.CoreV1().ResourceQuotas(namespace).Get(context.TODO(), quotaName, v13.GetOptions{})
-	if err == nil {
-		watcher.Quotas[namespace] = *quota // Register
-	} else {
-		logging.LogError("[%s] Failed to register ResourceQuota %s: %v", namespace, quotaName, err)
+// enqueueQuota queues the namespace of a ResourceQuota after the debounce period, when the ResourceQuota is the
+// target of a QuotaAutoscaler. Further changes within the debounce period are aggregated by the queue.
+func (watcher *QuotaWatcher) enqueueQuota(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	quota, ok := obj.(*v12.ResourceQuota)
+	if !ok {
+		return
 	}
 
-	return err
+	scaler, err := watcher.GetScaler(quota.Namespace)
+	if err == nil && scaler != nil && scaler.Spec.ResourceQuota == quota.Name {
+		logging.LogDebug("[%s] QuotaEvent", quota.Namespace)
+		watcher.queue.AddAfter(quota.Namespace, watcher.debounce())
+	}
 }
 
-// RegisterNamespacedEvent stores namespaced Events in watcher. Should be cleaned up by aggregate loop
-// every iteration (events should be consumed once). This function does not delete any stored events.
-func (watcher *QuotaWatcher) RegisterNamespacedEvent(event watch.Event) string {
-	ev := event.Object.(*v12.Event)
-	target := ev.InvolvedObject
+// registerEvent stores a Pod Event for the next calculation of its namespace, which is queued after the debounce
+// period.
+func (watcher *QuotaWatcher) registerEvent(obj interface{}) {
+	ev, ok := obj.(*v12.Event)
+	if !ok || eventTime(ev).Add(CurrentClusterConfig().StaleEventAge.Duration).Before(time.Now()) {
+		return
+	}
 
-	if _, ok := watcher.Events[target.Namespace]; !ok {
-		watcher.Events[target.Namespace] = []v12.Event{*ev}
-	} else {
-		watcher.Events[target.Namespace] = append(watcher.Events[target.Namespace], *ev)
+	namespace := ev.InvolvedObject.Namespace
+	watcher.Events.Add(namespace, *ev)
+
+	logging.LogDebug("[%s] PodEvent %s", namespace, ev.Reason)
+	watcher.queue.AddAfter(namespace, watcher.debounce())
+}
+
+func eventTime(ev *v12.Event) time.Time {
+	if !ev.LastTimestamp.IsZero() {
+		return ev.LastTimestamp.Time
+	}
+	if !ev.EventTime.IsZero() {
+		return ev.EventTime.Time
 	}
+	return ev.CreationTimestamp.Time
+}
 
-	return ev.Namespace
+func namespaceOf(obj interface{}) string {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return object.GetNamespace()
 }
 
 func ResourceQuotaUsedMemoryLimit(quota *v12.ResourceQuota) *resource.Quantity {
@@ -249,58 +373,247 @@ func ResourceQuotaUsedCpuLimit(quota *v12.ResourceQuota) *resource.Quantity {
 }
 
 func (watcher *QuotaWatcher) UpdateQuotaIfRequired(quota v12.ResourceQuota, scaler v14.QuotaAutoscaler, events []v12.Event) error {
-	validatedScaler := ValidateQuotaScaler(&scaler)
-	desired := &resources.Resources{
-		Cpu:    quota.Spec.Hard.Cpu().ScaledValue(resource.Milli),
-		Memory: quota.Spec.Hard.Memory().ScaledValue(resource.Mega),
+	var activeSchedule string
+	if schedule := ActiveSchedule(scaler.Namespace, scaler.Spec.Schedules, watcher.now()); schedule != nil {
+		logging.LogDebug("[%s] Using schedule %s", scaler.Namespace, schedule.Name)
+		scaler.Spec = ApplySchedule(scaler.Spec, schedule)
+		activeSchedule = schedule.Name
 	}
 
+	validatedScaler := ValidateQuotaScaler(&scaler)
+	independent := validatedScaler.Independent
+	scaled := validatedScaler.ScaledResources(&quota)
+	desired := resources.FromHard(&quota, scaled...)
+
 	if quota.Status.Used == nil || quota.Status.Hard == nil {
-		return errors.New("quota status is nil")
+		err := errors.New("quota status is nil")
+		watcher.updateStatus(scaler, CalculationFailedStatus(scaler.Generation, err))
+		return err
 	}
+	recordQuotaMetrics(&quota, scaled)
 
 	// Take limits into accounts, especially the ratio between CPU requests and limits. Fake Req CPU if limits are high
-	quota.Status.Used[v12.ResourceCPU] = GetNormalizedUsedCpu(quota.Status.Used.Cpu(), ResourceQuotaUsedCpuLimit(&quota), scaler.Namespace)
+	if !independent {
+		quota.Status.Used[v12.ResourceCPU] = GetNormalizedUsedCpu(quota.Status.Used.Cpu(), ResourceQuotaUsedCpuLimit(&quota), validatedScaler.CpuLimitRatio, scaler.Namespace)
+	}
 
-	for _, policy := range scaler.Spec.Behavior.ScaleDown.Policies {
-		desired.Replace(validatedScaler.ActivateScalerPolicy(policy, &quota, false))
+	scaleUpDisabled := scaler.Spec.Behavior.ScaleUp.SelectPolicy == v14.DisabledPolicySelect
+	scaleDownDisabled := scaler.Spec.Behavior.ScaleDown.SelectPolicy == v14.DisabledPolicySelect
+
+	consumption := watcher.readConsumption(quota.Namespace, scaler)
+	down := validatedScaler.ActivateScalerBehavior(scaler.Spec.Behavior.ScaleDown, &quota, false)
+	if consumption != nil {
+		preferHigher := scaler.Spec.Behavior.ScaleDown.SelectPolicy == v14.MinPolicySelect
+		targets := consumptionScaleDown(validatedScaler, scaler.Spec.Behavior.ScaleDown, &quota, consumption.Consumed, independent)
+		for name := range targets {
+			down.Set(name, selectTarget(down.Value(name), targets.Value(name), preferHigher))
+		}
 	}
-	logging.LogDebug("[%s] Desired resources after ScaleDown: %+v\n", scaler.Namespace, desired)
-	for _, policy := range scaler.Spec.Behavior.ScaleUp.Policies {
-		desired.Replace(validatedScaler.ActivateScalerPolicy(policy, &quota, true))
+	desired.Replace(down)
+	logging.LogDebug("[%s] Desired resources after ScaleDown: %v\n", scaler.Namespace, desired)
+	// Only scaling up is ahead of the predicted usage, scaling down follows the current usage
+	predicted := watcher.predictUsage(&quota, scaler, scaled, independent)
+	scaleUpQuota := &quota
+	if !predicted.IsEmpty() {
+		logging.LogDebug("[%s] Predicted usage: %v\n", scaler.Namespace, predicted)
+		scaleUpQuota = withPredictedUsage(&quota, predicted, independent)
 	}
-	logging.LogDebug("[%s] Desired resources after ScaleUp: %+v\n", scaler.Namespace, desired)
+	desired.Replace(validatedScaler.ActivateScalerBehavior(scaler.Spec.Behavior.ScaleUp, scaleUpQuota, true))
+	logging.LogDebug("[%s] Desired resources after ScaleUp: %v\n", scaler.Namespace, desired)
 
-	if events != nil {
-		if sum, _ := GetResourcesFromPodEvents(watcher.Client, events); sum != nil && !sum.IsEmpty() { // This is a slow call!
-			logging.LogInfo("[%s] Namespace events require an extra %+v resources\n", scaler.Namespace, sum)
-			desired = (&resources.Resources{
-				Cpu:    quota.Status.Used.Cpu().ScaledValue(resource.Milli),
-				Memory: ResourceQuotaUsedMemoryLimit(&quota).ScaledValue(resource.Mega),
-			}).Add(sum).Max(desired)
-		}
+	// The autoscaled workloads can scale out without FailedCreate, within the bounds
+	headroom := resources.Resources{}
+	if !scaleUpDisabled {
+		headroom = watcher.replicaHeadroom(quota.Namespace, scaler) // This is a slow call!
+	}
+	if !independent {
+		headroom.NormalizeLimits(validatedScaler.CpuLimitRatio)
+	}
+	if headroom = headroom.Only(scaled...); !headroom.IsEmpty() {
+		logging.LogDebug("[%s] Headroom of the autoscaled workloads: %v\n", scaler.Namespace, headroom)
+		desired.Max(usedResources(&quota, scaled, independent).Add(headroom).Only(scaled...))
 	}
 
-	// We don't do anything with Storage
-	storage := quota.Spec.Hard["requests.storage"]
+	if events != nil && !scaleUpDisabled {
+		if sum, _ := GetResourcesFromPodEvents(watcher.Client, watcher.Owners, watcher.RuntimeClasses, events); !sum.IsEmpty() { // This is a slow call!
+			if !independent {
+				sum.NormalizeLimits(validatedScaler.CpuLimitRatio)
+			}
+			if sum = sum.Only(scaled...); !sum.IsEmpty() {
+				logging.LogInfo("[%s] Namespace events require an extra %v resources\n", scaler.Namespace, sum)
+				desired = usedResources(&quota, scaled, independent).Add(sum).Max(desired)
+			}
+		}
+	}
 
 	// Make sure desired quota is within bounds
-	validatedScaler.ForceLimitToDefaultMax()
-	desired.Max(&resources.Resources{Cpu: validatedScaler.MinCpu, Memory: validatedScaler.MinMemory})
-	desired.Limit(&resources.Resources{Cpu: validatedScaler.MaxCpu, Memory: validatedScaler.MaxMemory})
-	desired.Storage = storage.ScaledValue(resource.Giga)
-
-	current := resources.Resources{
-		Cpu:     quota.Spec.Hard.Cpu().ScaledValue(resource.Milli),
-		Memory:  quota.Spec.Hard.Memory().ScaledValue(resource.Mega),
-		Storage: storage.ScaledValue(resource.Giga),
+	validatedScaler.ForceLimitToCeilings(scaler.Namespace)
+	minimum, maximum := validatedScaler.MinMax(scaled...)
+	desired.Max(minimum)
+	desired.Limit(maximum)
+
+	current := resources.FromHard(&quota, scaled...)
+	if watcher.Claims != nil {
+		bound, err := BoundClaimResources(watcher.Claims, quota.Namespace)
+		if err != nil {
+			return err
+		}
+		// Never go below the bound claims, not even to respect the max, but they do not cause a scale up
+		desired.Max(bound.Only(scaled...).Limit(current))
+	}
+	if scaleDownDisabled {
+		desired.Max(current) // Never go below the current quota, not even to respect maxCpu/maxMemory
 	}
-	logging.LogInfo("[%s] Calculated desired resources (%+v -> %+v) for namespace %s\n", quota.Namespace, current, desired, scaler.Namespace)
+	if scaleUpDisabled {
+		desired.Limit(current) // Never go above the current quota, not even to respect minCpu/minMemory
+	}
+	dryRun := scaler.Spec.DryRun || CurrentClusterConfig().DryRun
+	desired = watcher.History.Stabilize(quota.Namespace, validatedScaler, current, desired)
+	if !dryRun {
+		desired = watcher.History.LimitRate(quota.Namespace, validatedScaler, current, desired)
+	} else if watcher.DryRunHistory != nil {
+		desired = watcher.DryRunHistory.LimitRate(quota.Namespace, validatedScaler, current, desired)
+	}
+	logging.LogInfo("[%s] Calculated desired resources (%v -> %v) for namespace %s\n", quota.Namespace, current, desired, scaler.Namespace)
 	desired.ForceNoScaleDownWhenScaleUp(&quota)
-	if desired.DiffersFrom(&quota) {
+	resizing := desired.DiffersFrom(&quota)
+	resize := NamespaceResizeEvent{
+		Namespace:         quota.Namespace,
+		ResourceQuota:     scaler.Spec.ResourceQuota,
+		Old:               current,
+		New:               desired.Copy(),
+		CpuLimitRatio:     validatedScaler.CpuLimitRatio,
+		IndependentLimits: independent,
+	}
+	if resizing && dryRun {
+		// The quota does not change, the would-be resize only counts towards the rate limits of the dry run. Those
+		// are kept apart, so the rate limits behave the same when dry run is turned off.
+		logging.LogInfo("[%s] Dry run, not resizing (%v -> %v)", quota.Namespace, current, desired)
+		if watcher.DryRunHistory != nil {
+			watcher.DryRunHistory.RecordChange(quota.Namespace, current, desired)
+		}
+		watcher.publishWouldResize(scaler, resize)
+	} else if resizing {
 		logging.LogDebug("[%s] InvokeResizeApiAsync", quota.Namespace)
-		InvokeResizeApiAsync(quota.Namespace, scaler.Spec.ResourceQuota, current, *desired)
+		forget := watcher.History.RecordChange(quota.Namespace, current, desired)
+		// Only applied resizes count towards the rate limits
+		resize.done = func(err error) {
+			if err != nil {
+				forget()
+			}
+		}
+		watcher.requestResize(resize)
 	}
 
+	cpuUsage := validatedScaler.ToActivePolicy(false, v14.QuotaScalePolicy{Method: "cpu"}, &quota).CurrentUsagePercentage
+	memoryUsage := validatedScaler.ToActivePolicy(false, v14.QuotaScalePolicy{Method: "memory"}, &quota).CurrentUsagePercentage
+	recordDesiredMetrics(quota.Namespace, desired, cpuUsage, memoryUsage)
+	recordDryRunMetrics(quota.Namespace, dryRun, resizing)
+	recordPredictionMetrics(quota.Namespace, predicted)
+	recordComputeMetrics(replicaHeadroomGauge, quota.Namespace, headroom)
+	if consumption != nil {
+		recordConsumptionMetrics(quota.Namespace, consumption.Consumed)
+		watcher.publishRecommendations(scaler, consumption.Recommendations)
+	} else if scaler.Spec.UsageSource != v14.MetricsUsageSource {
+		recordConsumptionMetrics(quota.Namespace, nil)
+	}
+	status := CalculationStatus(scaler.Generation, cpuUsage, memoryUsage, desired, resizing)
+	if dryRun {
+		status = DryRunCalculationStatus(scaler.Generation, cpuUsage, memoryUsage, desired, resizing)
+	}
+	watcher.updateStatus(scaler, func(s *v14.QuotaAutoscalerStatus) {
+		status(s)
+		s.ActiveSchedule = activeSchedule
+		s.PredictedResources, s.HeadroomResources = nil, nil
+		if !predicted.IsEmpty() {
+			s.PredictedResources = predicted.ToResourceList()
+		}
+		if !headroom.IsEmpty() {
+			s.HeadroomResources = headroom.ToResourceList()
+		}
+		// Without consumption, e.g. when the metrics API is unavailable, the last recommendations are kept
+		if consumption != nil {
+			s.ConsumedResources, s.Recommendations = consumption.Consumed.ToResourceList(), consumption.Recommendations
+		} else if scaler.Spec.UsageSource != v14.MetricsUsageSource {
+			s.ConsumedResources, s.Recommendations = nil, nil
+		}
+	})
+
 	return nil
 }
+
+// predictUsage records the current CPU and memory usage of the namespace and returns its predicted usage, when the
+// scaler has a prediction. The history of namespaces without a prediction is removed.
+func (watcher *QuotaWatcher) predictUsage(quota *v12.ResourceQuota, scaler v14.QuotaAutoscaler, scaled []v12.ResourceName, independent bool) resources.Resources {
+	if watcher.Usage == nil {
+		return resources.Resources{}
+	}
+	if scaler.Spec.Prediction == nil {
+		watcher.Usage.Forget(quota.Namespace)
+		return resources.Resources{}
+	}
+
+	used := usedResources(quota, scaled, independent).Only(scaled...).Only(v12.ResourceCPU, v12.ResourceMemory)
+	watcher.Usage.Record(quota.Namespace, watcher.now(), used)
+	return watcher.Usage.Predict(quota.Namespace, scaler.Spec.Prediction).Only(scaled...)
+}
+
+// lockNamespace locks the namespace for a calculation or GrowQuota, and returns the function that unlocks it.
+func (watcher *QuotaWatcher) lockNamespace(namespace string) func() {
+	if watcher.locks == nil {
+		return func() {}
+	}
+	return watcher.locks.Lock(namespace)
+}
+
+func (watcher *QuotaWatcher) requestResize(resize NamespaceResizeEvent) {
+	if watcher.Resize != nil {
+		watcher.Resize(resize)
+		return
+	}
+	InvokeResizeApiAsync(resize)
+}
+
+// requestResizeContext requests a resize like requestResize, but gives up when ctx is done before the event handler
+// accepts it. It returns whether the resize was requested.
+func (watcher *QuotaWatcher) requestResizeContext(ctx context.Context, resize NamespaceResizeEvent) bool {
+	if watcher.Resize != nil {
+		watcher.Resize(resize)
+		return true
+	}
+	select {
+	case ResizeNsChan <- resize:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// publishWouldResize publishes a WouldResize Event for a resize that was not requested because of the dry run. The
+// Event is skipped when the status already reports the same resize, a namespace is calculated after every change.
+func (watcher *QuotaWatcher) publishWouldResize(scaler v14.QuotaAutoscaler, resize NamespaceResizeEvent) {
+	cond := GetScalerCondition(&scaler.Status, v14.ConditionScalingActive)
+	if cond != nil && cond.Reason == WouldResizeReason && cond.Message == wouldResizeMessage(resize.New) {
+		return
+	}
+
+	ref := scalerReference(&scaler)
+	go func() {
+		if err := PublishWouldResizeEvent(watcher.Client, ref, resize); err != nil {
+			logging.LogError("[%s] Cannot publish namespace event: %s", resize.Namespace, err.Error())
+		}
+	}()
+}
+
+// usedResources returns the given used resources of the ResourceQuota. Unless the limits are independent, the memory
+// limits count as memory requests and the CPU requests must have been normalized already.
+func usedResources(quota *v12.ResourceQuota, names []v12.ResourceName, independent bool) resources.Resources {
+	used := resources.Resources{}
+	for _, name := range names {
+		used[name] = quota.Status.Used[name].DeepCopy()
+	}
+	if !independent {
+		used[v12.ResourceMemory] = ResourceQuotaUsedMemoryLimit(quota).DeepCopy()
+	}
+	return used
+}
@@ -0,0 +1,436 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	v14 "github.com/ing-bank/quota-scaler/pkg/scalerclient/apis/quotaautoscaler/v1"
+	ichpfake "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/clientset/versioned/fake"
+	ichpinformers "github.com/ing-bank/quota-scaler/pkg/scalerclient/client/informers/externalversions"
+	v15 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestWatcher(t *testing.T, stopCh chan struct{}, scalers []*v14.QuotaAutoscaler, quotas []*v12.ResourceQuota) (*QuotaWatcher, *fake.Clientset, *ichpfake.Clientset) {
+	client := fake.NewSimpleClientset()
+	ichpClient := ichpfake.NewSimpleClientset()
+	for _, scaler := range scalers {
+		_, _ = ichpClient.IchpV1().QuotaAutoscalers(scaler.Namespace).Create(context.TODO(), scaler, v13.CreateOptions{})
+	}
+	for _, quota := range quotas {
+		_, _ = client.CoreV1().ResourceQuotas(quota.Namespace).Create(context.TODO(), quota, v13.CreateOptions{})
+	}
+
+	factory := informers.NewSharedInformerFactory(client, 0)
+	ichpFactory := ichpinformers.NewSharedInformerFactory(ichpClient, 0)
+	watcher := NewQuotaWatcher(client, ichpClient, ichpFactory.Ichp().V1().QuotaAutoscalers(),
+		factory.Core().V1().ResourceQuotas(), factory.Core().V1().Events())
+	watcher.Debounce = 100 * time.Millisecond
+
+	factory.Start(stopCh)
+	ichpFactory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, watcher.synced...) {
+		t.Fatalf("expected informer caches to sync\n")
+	}
+	return watcher, client, ichpClient
+}
+
+func newTestScaler(namespace string) *v14.QuotaAutoscaler {
+	return &v14.QuotaAutoscaler{
+		ObjectMeta: v13.ObjectMeta{Name: namespace + "-scaler", Namespace: namespace},
+		Spec:       v14.QuotaAutoscalerSpec{ResourceQuota: namespace + "-quota"},
+	}
+}
+
+func newTestNamespaceQuota(namespace, usedCpu string) *v12.ResourceQuota {
+	quota := newTestQuota("1000m", usedCpu, "1000M", "500M")
+	quota.Name = namespace + "-quota"
+	quota.Namespace = namespace
+	return quota
+}
+
+// waitForQueue waits until the queue has the expected length, or returns the last length after the timeout.
+func waitForQueue(watcher *QuotaWatcher, expected int, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) && watcher.queue.Len() != expected {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return watcher.queue.Len()
+}
+
+func drainQueue(watcher *QuotaWatcher) {
+	for watcher.queue.Len() > 0 {
+		key, _ := watcher.queue.Get()
+		watcher.queue.Done(key)
+		watcher.queue.Forget(key)
+	}
+}
+
+func TestQuotaWatcherDebouncesQuotaChanges(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	watcher, client, ichpClient := newTestWatcher(t, stopCh,
+		[]*v14.QuotaAutoscaler{newTestScaler("example-dev")},
+		[]*v12.ResourceQuota{newTestNamespaceQuota("example-dev", "100m")},
+	)
+
+	// Every QuotaAutoscaler is queued at start
+	if length := waitForQueue(watcher, 1, time.Second); length != 1 {
+		t.Fatalf("expected 1 queued namespace at start but got: %d\n", length)
+	}
+	time.Sleep(2 * watcher.Debounce) // The initial ResourceQuota may be queued as well
+	drainQueue(watcher)
+
+	// Many ResourceQuota changes result in a single calculation after the debounce period
+	for _, used := range []string{"200m", "300m", "400m", "500m"} {
+		_, _ = client.CoreV1().ResourceQuotas("example-dev").UpdateStatus(context.TODO(), newTestNamespaceQuota("example-dev", used), v13.UpdateOptions{})
+	}
+	time.Sleep(50 * time.Millisecond)
+	if length := watcher.queue.Len(); length != 0 {
+		t.Errorf("expected no queued namespace within the debounce period but got: %d\n", length)
+	}
+	if length := waitForQueue(watcher, 1, time.Second); length != 1 {
+		t.Errorf("expected 1 queued namespace after the debounce period but got: %d\n", length)
+	}
+	drainQueue(watcher)
+
+	// A status update of the QuotaAutoscaler (written by ourselves) is not queued
+	if err := UpdateScalerStatus(ichpClient, "example-dev", "example-dev-scaler", QuotaNotFoundStatus(1, "example-dev-quota")); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if length := waitForQueue(watcher, 1, 300*time.Millisecond); length != 0 {
+		t.Errorf("expected status changes not to be queued but got: %d\n", length)
+	}
+
+	// ResourceQuotas without a QuotaAutoscaler are ignored
+	_, _ = client.CoreV1().ResourceQuotas("foo-dev").Create(context.TODO(), newTestNamespaceQuota("foo-dev", "100m"), v13.CreateOptions{})
+	if length := waitForQueue(watcher, 1, 300*time.Millisecond); length != 0 {
+		t.Errorf("expected quotas without scaler not to be queued but got: %d\n", length)
+	}
+}
+
+func TestQuotaWatcherConsumesEvents(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	watcher, client, _ := newTestWatcher(t, stopCh, nil, nil)
+
+	stale := &v12.Event{
+		ObjectMeta:     v13.ObjectMeta{Name: "stale", Namespace: "example-dev"},
+		InvolvedObject: v12.ObjectReference{Kind: "ReplicaSet", Name: "app", Namespace: "example-dev"},
+		Reason:         "FailedCreate",
+		LastTimestamp:  v13.NewTime(time.Now().Add(-time.Hour)),
+	}
+	recent := stale.DeepCopy()
+	recent.Name = "recent"
+	recent.LastTimestamp = v13.Now()
+	for _, ev := range []*v12.Event{stale, recent} {
+		_, _ = client.CoreV1().Events("example-dev").Create(context.TODO(), ev, v13.CreateOptions{})
+	}
+
+	if length := waitForQueue(watcher, 1, time.Second); length != 1 {
+		t.Fatalf("expected 1 queued namespace but got: %d\n", length)
+	}
+	events := watcher.Events.Take("example-dev")
+	if len(events) != 1 || events[0].Name != "recent" {
+		t.Errorf("expected only the recent event but got: %+v\n", events)
+	}
+	if events := watcher.Events.Take("example-dev"); events != nil {
+		t.Errorf("expected events to be consumed but got: %+v\n", events)
+	}
+}
+
+func TestQuotaWatcherQuotaNotFound(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	watcher, _, ichpClient := newTestWatcher(t, stopCh, []*v14.QuotaAutoscaler{newTestScaler("example-dev")}, nil)
+	if err := watcher.UpdateNs("example-dev"); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	scaler, _ := ichpClient.IchpV1().QuotaAutoscalers("example-dev").Get(context.TODO(), "example-dev-scaler", v13.GetOptions{})
+	if cond := GetScalerCondition(&scaler.Status, v14.ConditionQuotaNotFound); cond == nil || cond.Status != v12.ConditionTrue {
+		t.Errorf("expected QuotaNotFound condition to be True but got: %+v\n", cond)
+	}
+}
+
+// TestQuotaWatcherConcurrentUpdates feeds the informers of many namespaces in parallel while the workers are
+// running. Run with -race to detect unsynchronised state.
+func TestQuotaWatcherConcurrentUpdates(t *testing.T) {
+	startEventHandler()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	var namespaces []string
+	var scalers []*v14.QuotaAutoscaler
+	var quotas []*v12.ResourceQuota
+	// The fake clientsets buffer at most 100 watch events, keep the number of changes per resource below that
+	for i := 0; i < 6; i++ {
+		namespace := fmt.Sprintf("race-%d", i)
+		namespaces = append(namespaces, namespace)
+		scalers = append(scalers, newTestScaler(namespace))
+		quotas = append(quotas, newTestNamespaceQuota(namespace, "100m"))
+	}
+
+	watcher, client, ichpClient := newTestWatcher(t, stopCh, scalers, quotas)
+	go watcher.Run(4, stopCh)
+
+	var replicas int32 = 3
+	var wg sync.WaitGroup
+	for _, namespace := range namespaces {
+		_, _ = client.AppsV1().ReplicaSets(namespace).Create(context.TODO(), &v15.ReplicaSet{
+			ObjectMeta: v13.ObjectMeta{Name: "app", Namespace: namespace},
+			Spec: v15.ReplicaSetSpec{Replicas: &replicas, Template: v12.PodTemplateSpec{Spec: v12.PodSpec{Containers: []v12.Container{{
+				Resources: v12.ResourceRequirements{Requests: v12.ResourceList{
+					v12.ResourceCPU:    resource.MustParse("100m"),
+					v12.ResourceMemory: resource.MustParse("100M"),
+				}},
+			}}}}},
+		}, v13.CreateOptions{})
+
+		wg.Add(3)
+		go func(namespace string) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				quota := newTestNamespaceQuota(namespace, fmt.Sprintf("%dm", 100+i*80))
+				_, _ = client.CoreV1().ResourceQuotas(namespace).UpdateStatus(context.TODO(), quota, v13.UpdateOptions{})
+			}
+		}(namespace)
+		go func(namespace string) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				_, _ = client.CoreV1().Events(namespace).Create(context.TODO(), &v12.Event{
+					ObjectMeta:     v13.ObjectMeta{Name: fmt.Sprintf("app-%d", i), Namespace: namespace},
+					InvolvedObject: v12.ObjectReference{Kind: "ReplicaSet", Name: "app", Namespace: namespace},
+					Reason:         "FailedCreate",
+					LastTimestamp:  v13.Now(),
+				}, v13.CreateOptions{})
+			}
+		}(namespace)
+		go func(namespace string) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				scaler := newTestScaler(namespace)
+				scaler.Spec.MinCpu = fmt.Sprintf("%dm", 400+i*10)
+				_, _ = ichpClient.IchpV1().QuotaAutoscalers(namespace).Update(context.TODO(), scaler, v13.UpdateOptions{})
+			}
+		}(namespace)
+	}
+	wg.Wait()
+
+	// Every namespace is eventually calculated
+	deadline := time.Now().Add(5 * time.Second)
+	for _, namespace := range namespaces {
+		for {
+			scaler, _ := ichpClient.IchpV1().QuotaAutoscalers(namespace).Get(context.TODO(), namespace+"-scaler", v13.GetOptions{})
+			cond := GetScalerCondition(&scaler.Status, v14.ConditionReady)
+			if cond != nil && cond.Status == v12.ConditionTrue {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected namespace %s to be calculated but got: %+v\n", namespace, scaler.Status)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func TestUpdateQuotaLimits(t *testing.T) {
+	startEventHandler() // Consumes the resizes
+	ratio := int64(4)
+	tests := []struct {
+		name     string
+		spec     v14.QuotaAutoscalerSpec
+		hard     v12.ResourceList
+		used     v12.ResourceList
+		events   []v12.Event
+		claims   []*v12.PersistentVolumeClaim
+		expected v12.ResourceList
+	}{
+		{
+			name: "Ratio",
+			spec: v14.QuotaAutoscalerSpec{CpuLimitRatio: &ratio},
+			hard: v12.ResourceList{"cpu": resource.MustParse("1"), "limits.cpu": resource.MustParse("4"), "memory": resource.MustParse("1G"), "limits.memory": resource.MustParse("1G")},
+			used: v12.ResourceList{"cpu": resource.MustParse("200m"), "limits.cpu": resource.MustParse("3200m"), "memory": resource.MustParse("500M"), "limits.memory": resource.MustParse("500M")},
+			events: []v12.Event{{
+				InvolvedObject: v12.ObjectReference{Kind: "ReplicaSet", Name: "app", Namespace: "example-dev"},
+				Message:        `pods "app-x" is forbidden: exceeded quota: quota, requested: limits.cpu=2, used: limits.cpu=3200m, limited: limits.cpu=4`,
+			}},
+			// The used CPU limit (800m) and requested CPU limit (500m) are divided by the ratio
+			expected: v12.ResourceList{"cpu": resource.MustParse("1300m"), "memory": resource.MustParse("1G")},
+		},
+		{
+			name: "Independent",
+			spec: v14.QuotaAutoscalerSpec{Mode: v14.IndependentQuotaMode, Behavior: v14.QuotaAutoscalerSpecBehavior{
+				ScaleUp: v14.QuotaScaleBehavior{Policies: []v14.QuotaScalePolicy{{Method: "cpu", Value: 80}}},
+			}},
+			hard: v12.ResourceList{"cpu": resource.MustParse("1"), "limits.cpu": resource.MustParse("4"), "memory": resource.MustParse("1G"), "limits.memory": resource.MustParse("2G")},
+			used: v12.ResourceList{"cpu": resource.MustParse("500m"), "limits.cpu": resource.MustParse("3800m"), "memory": resource.MustParse("500M"), "limits.memory": resource.MustParse("1G")},
+			// Only the CPU limit is used above 80%
+			expected: v12.ResourceList{"cpu": resource.MustParse("1"), "limits.cpu": resource.MustParse("4750m"), "memory": resource.MustParse("1G"), "limits.memory": resource.MustParse("2G")},
+		},
+		{
+			name: "Other resources",
+			spec: v14.QuotaAutoscalerSpec{
+				Resources: []v14.QuotaResourceBounds{{Name: "requests.storage", Max: "1Ti"}, {Name: "count/pods", Min: "10", Max: "50"}},
+				Behavior: v14.QuotaAutoscalerSpecBehavior{ScaleUp: v14.QuotaScaleBehavior{Policies: []v14.QuotaScalePolicy{
+					{Method: "requests.storage", Value: 80},
+					{Method: "count/pods", Value: 80},
+				}}},
+			},
+			hard: v12.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1G"), "requests.storage": resource.MustParse("100Gi"), "count/pods": resource.MustParse("20"), "services.loadbalancers": resource.MustParse("2")},
+			used: v12.ResourceList{"cpu": resource.MustParse("500m"), "memory": resource.MustParse("500M"), "requests.storage": resource.MustParse("90Gi"), "count/pods": resource.MustParse("19"), "services.loadbalancers": resource.MustParse("2")},
+			// Resources without bounds are left alone
+			expected: v12.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1G"), "requests.storage": resource.MustParse("112.5Gi"), "count/pods": resource.MustParse("23")},
+		},
+		{
+			name: "Other resources of events",
+			spec: v14.QuotaAutoscalerSpec{Resources: []v14.QuotaResourceBounds{{Name: "count/pods", Max: "50"}}},
+			hard: v12.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1G"), "count/pods": resource.MustParse("20")},
+			used: v12.ResourceList{"cpu": resource.MustParse("500m"), "memory": resource.MustParse("500M"), "count/pods": resource.MustParse("20")},
+			events: []v12.Event{{
+				InvolvedObject: v12.ObjectReference{Kind: "ReplicaSet", Name: "app", Namespace: "example-dev"},
+				Message:        `pods "app-x" is forbidden: exceeded quota: quota, requested: count/pods=1, used: count/pods=20, limited: count/pods=20`,
+			}},
+			expected: v12.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1G"), "count/pods": resource.MustParse("21")},
+		},
+		{
+			name: "Storage above bound claims",
+			spec: v14.QuotaAutoscalerSpec{
+				Resources: []v14.QuotaResourceBounds{{Name: "requests.storage", Max: "1Ti"}},
+				Behavior: v14.QuotaAutoscalerSpecBehavior{ScaleDown: v14.QuotaScaleBehavior{Policies: []v14.QuotaScalePolicy{
+					{Method: "requests.storage", Value: 50},
+				}}},
+			},
+			hard:   v12.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1G"), "requests.storage": resource.MustParse("100Gi")},
+			used:   v12.ResourceList{"cpu": resource.MustParse("500m"), "memory": resource.MustParse("500M"), "requests.storage": resource.MustParse("30Gi")},
+			claims: []*v12.PersistentVolumeClaim{newTestClaim("data", "", "20Gi", "80Gi", v12.ClaimBound)},
+			// The policy would scale down to 60Gi
+			expected: v12.ResourceList{"cpu": resource.MustParse("1"), "memory": resource.MustParse("1G"), "requests.storage": resource.MustParse("80Gi")},
+		},
+	}
+
+	for _, test := range tests {
+		scaler := newTestScaler("example-dev")
+		scaler.Spec.Mode, scaler.Spec.CpuLimitRatio, scaler.Spec.Behavior = test.spec.Mode, test.spec.CpuLimitRatio, test.spec.Behavior
+		scaler.Spec.Resources = test.spec.Resources
+		ichpClient := ichpfake.NewSimpleClientset(scaler)
+		watcher := &QuotaWatcher{Client: fake.NewSimpleClientset(), IchpClient: ichpClient, History: NewScalingHistory()}
+		if test.claims != nil {
+			watcher.Claims = newTestClaimLister(test.claims...)
+		}
+
+		quota := v12.ResourceQuota{
+			ObjectMeta: v13.ObjectMeta{Name: "example-dev-quota", Namespace: "example-dev"},
+			Spec:       v12.ResourceQuotaSpec{Hard: test.hard},
+			Status:     v12.ResourceQuotaStatus{Hard: test.hard, Used: test.used},
+		}
+		if err := watcher.UpdateQuotaIfRequired(quota, *scaler, test.events); err != nil {
+			t.Fatalf("%s: expected no error but got: %v\n", test.name, err)
+		}
+
+		updated, _ := ichpClient.IchpV1().QuotaAutoscalers("example-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+		desired := updated.Status.LastDesiredResources
+		if len(desired) != len(test.expected) {
+			t.Errorf("%s: expected desired %v but got: %v\n", test.name, test.expected, desired)
+		}
+		for name, expected := range test.expected {
+			if got := desired[name]; got.Cmp(expected) != 0 {
+				t.Errorf("%s: expected desired %s %s but got: %s\n", test.name, name, expected.String(), got.String())
+			}
+		}
+	}
+}
+
+func TestUpdateQuotaDryRun(t *testing.T) {
+	scaler := newTestScaler("shadow-dev")
+	scaler.Spec.DryRun = true
+	scaler.Spec.Behavior.ScaleUp.Policies = []v14.QuotaScalePolicy{{Method: "cpu", Value: 70}}
+	client, ichpClient := fake.NewSimpleClientset(), ichpfake.NewSimpleClientset(scaler)
+	watcher := &QuotaWatcher{Client: client, IchpClient: ichpClient, History: NewScalingHistory()}
+	quota := newTestNamespaceQuota("shadow-dev", "900m") // 90% used
+
+	// A resize would block on ResizeNsChan when the event handler is not running
+	done := make(chan error)
+	go func() { done <- watcher.UpdateQuotaIfRequired(*quota, *scaler, nil) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected no error but got: %v\n", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected no resize in dry run\n")
+	}
+	if changes := len(watcher.History.changes["shadow-dev"]); changes != 0 {
+		t.Errorf("expected no resizes in the history but got: %d\n", changes)
+	}
+
+	updated, _ := ichpClient.IchpV1().QuotaAutoscalers("shadow-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+	cond := GetScalerCondition(&updated.Status, v14.ConditionScalingActive)
+	if cond == nil || cond.Status != v12.ConditionFalse || cond.Reason != WouldResizeReason {
+		t.Errorf("expected condition ScalingActive False WouldResize but got: %+v\n", cond)
+	}
+	if cpu := updated.Status.LastDesiredResources[v12.ResourceCPU]; cpu.String() != "1285m" {
+		t.Errorf("expected desired CPU 1285m but got: %s\n", cpu.String())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		events, _ := client.CoreV1().Events("shadow-dev").List(context.TODO(), v13.ListOptions{})
+		if len(events.Items) == 1 && events.Items[0].Reason == WouldResizeReason {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	events, _ := client.CoreV1().Events("shadow-dev").List(context.TODO(), v13.ListOptions{})
+	if len(events.Items) != 1 {
+		t.Fatalf("expected a WouldResize Event but got: %+v\n", events.Items)
+	}
+
+	// The same decision is not published twice
+	if err := watcher.UpdateQuotaIfRequired(*quota, *updated, nil); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if events, _ := client.CoreV1().Events("shadow-dev").List(context.TODO(), v13.ListOptions{}); len(events.Items) != 1 {
+		t.Errorf("expected a single WouldResize Event but got: %d\n", len(events.Items))
+	}
+}
+
+func TestUpdateQuotaDryRunRateLimit(t *testing.T) {
+	scaler := newTestScaler("shadow-dev")
+	scaler.Spec.DryRun = true
+	scaler.Spec.Behavior.ScaleUp.Policies = []v14.QuotaScalePolicy{{Method: "cpu", Value: 70, PeriodMinutes: 10, MaxChange: "200m"}}
+	ichpClient := ichpfake.NewSimpleClientset(scaler)
+	watcher := &QuotaWatcher{Client: fake.NewSimpleClientset(), IchpClient: ichpClient, History: NewScalingHistory(), DryRunHistory: NewScalingHistory()}
+	quota := newTestNamespaceQuota("shadow-dev", "900m") // 90% used
+
+	// The would-be resize is limited by the maxChange, and counts towards it
+	for i, cpu := range []int64{1200, 1000} {
+		if err := watcher.UpdateQuotaIfRequired(*quota, *scaler, nil); err != nil {
+			t.Fatalf("expected no error but got: %v\n", err)
+		}
+		updated, _ := ichpClient.IchpV1().QuotaAutoscalers("shadow-dev").Get(context.TODO(), scaler.Name, v13.GetOptions{})
+		if desired := updated.Status.LastDesiredResources[v12.ResourceCPU]; desired.MilliValue() != cpu {
+			t.Errorf("expected desired CPU %dm in calculation %d but got: %s\n", cpu, i+1, desired.String())
+		}
+	}
+
+	// The real rate limits are left alone
+	if changes := len(watcher.History.changes["shadow-dev"]); changes != 0 {
+		t.Errorf("expected no resizes in the history but got: %d\n", changes)
+	}
+	if changes := len(watcher.DryRunHistory.changes["shadow-dev"]); changes != 1 {
+		t.Errorf("expected a would-be resize in the dry run history but got: %d\n", changes)
+	}
+}
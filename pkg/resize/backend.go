@@ -0,0 +1,128 @@
+package resize
+
+// This package contains the resize backends, which apply the desired ResourceQuota of a namespace calculated by the
+// quota-scaler. Backends register a Factory under a name, the backend is selected at runtime by name from a flag or
+// a config file. Custom backends can be registered from an init function and compiled into a custom main package.
+//
+// Example usage:
+//  config, _ := resize.LoadConfig("/etc/quota-scaler/resize-backend.yaml")
+//  backend, _ := resize.New(config.Backend, client, config.Options)
+//  err := backend.Resize(ctx, resize.Request{Namespace: "example-dev", ResourceQuota: "quota", New: desired})
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultBackend is the backend that is used when none is configured
+const DefaultBackend = "stub"
+
+// Request is a resize of the ResourceQuota of a namespace from Old to New. Old and New hold the scaled resources of the
+// ResourceQuota by name, e.g. `{"cpu": "2500m", "memory": "4G", "requests.storage": "100Gi"}`.
+type Request struct {
+	Namespace     string              `json:"namespace"`
+	ResourceQuota string              `json:"resourceQuota"`
+	Old           resources.Resources `json:"old"`
+	New           resources.Resources `json:"new"`
+	CpuLimitRatio int64               `json:"cpuLimitRatio"` // Ratio between the CPU limits and CPU requests of the quota, zero leaves the CPU limits alone
+	// IndependentLimits is true when the limits are scaled independently, they are set in New instead of following
+	// the requests
+	IndependentLimits bool `json:"independentLimits"`
+}
+
+// Backend resizes the ResourceQuota of a namespace, e.g. by calling a charging stack. Resize is called concurrently
+// for different namespaces, but never concurrently for the same namespace: the resizes of the Pod admission webhook
+// also go through the event handler of the leader.
+type Backend interface {
+	Name() string
+	Resize(ctx context.Context, request Request) error
+}
+
+// Factory creates a Backend from its options, which are the raw JSON of the `options` in the Config.
+type Factory func(client kubernetes.Interface, options json.RawMessage) (Backend, error)
+
+var registryLock sync.RWMutex
+var registry = map[string]Factory{}
+
+// Register makes a backend available under the given name. It panics when the name is registered twice.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("resize backend %s is registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// Names returns the sorted names of the registered backends.
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the backend registered under name.
+func New(name string, client kubernetes.Interface, options json.RawMessage) (Backend, error) {
+	registryLock.RLock()
+	factory, ok := registry[name]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown resize backend %q, available: %s", name, strings.Join(Names(), ", "))
+	}
+	return factory(client, options)
+}
+
+// Config selects and configures a backend, e.g.:
+//
+//	backend: webhook
+//	options:
+//	  url: https://charging.example.com/api/v1/resize
+type Config struct {
+	Backend string          `json:"backend"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// LoadConfig reads a YAML or JSON Config file. The backend defaults to DefaultBackend.
+func LoadConfig(path string) (Config, error) {
+	config := Config{Backend: DefaultBackend}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("invalid resize backend config %s: %v", path, err)
+	}
+	if config.Backend == "" {
+		config.Backend = DefaultBackend
+	}
+	return config, nil
+}
+
+// decodeOptions decodes the options of a backend into out, no options keep the defaults of out.
+func decodeOptions(options json.RawMessage, out interface{}) error {
+	if len(options) == 0 || string(options) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(options, out); err != nil {
+		return fmt.Errorf("invalid resize backend options: %v", err)
+	}
+	return nil
+}
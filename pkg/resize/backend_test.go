@@ -0,0 +1,137 @@
+package resize
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v13 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRegistry(t *testing.T) {
+	names := Names()
+	if len(names) != 3 || names[0] != "dry-run" || names[1] != "stub" || names[2] != "webhook" {
+		t.Errorf("expected the built-in backends but got: %v\n", names)
+	}
+
+	if _, err := New("charging", nil, nil); err == nil {
+		t.Errorf("expected an error for an unknown backend\n")
+	}
+	if _, err := New("webhook", nil, json.RawMessage(`{}`)); err == nil {
+		t.Errorf("expected an error for a webhook without url\n")
+	}
+	backend, err := New("dry-run", nil, nil)
+	if err != nil || backend.Name() != "dry-run" {
+		t.Errorf("expected the dry-run backend but got: %v %v\n", backend, err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "resize")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backend.yaml")
+	_ = ioutil.WriteFile(path, []byte("backend: webhook\noptions:\n  url: http://localhost/resize\n  timeout: 10s\n"), 0644)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if config.Backend != "webhook" {
+		t.Errorf("expected the webhook backend but got: %s\n", config.Backend)
+	}
+
+	backend, err := New(config.Backend, nil, config.Options)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if timeout := backend.(*WebhookBackend).Options.Timeout.Seconds(); timeout != 10 {
+		t.Errorf("expected a timeout of 10s but got: %fs\n", timeout)
+	}
+
+	_ = ioutil.WriteFile(path, []byte("{}"), 0644)
+	if config, _ := LoadConfig(path); config.Backend != DefaultBackend {
+		t.Errorf("expected the default backend but got: %s\n", config.Backend)
+	}
+}
+
+func TestStubBackend(t *testing.T) {
+	client := fake.NewSimpleClientset(&v12.ResourceQuota{
+		ObjectMeta: v13.ObjectMeta{Name: "example-quota", Namespace: "example-dev"},
+		Spec:       v12.ResourceQuotaSpec{Hard: v12.ResourceList{v12.ResourceCPU: resource.MustParse("1")}},
+	})
+	backend, _ := New("stub", client, nil)
+
+	err := backend.Resize(context.TODO(), Request{
+		Namespace:     "example-dev",
+		ResourceQuota: "example-quota",
+		New:           resources.New(2000, 3000),
+		CpuLimitRatio: 10,
+	})
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	quota, _ := client.CoreV1().ResourceQuotas("example-dev").Get(context.TODO(), "example-quota", v13.GetOptions{})
+	if cpu := quota.Spec.Hard.Cpu().MilliValue(); cpu != 2000 {
+		t.Errorf("expected 2000m CPU but got: %d\n", cpu)
+	}
+	if limit := quota.Spec.Hard["limits.cpu"]; limit.MilliValue() != 20000 {
+		t.Errorf("expected 20000m CPU limit but got: %d\n", limit.MilliValue())
+	}
+	if limit := quota.Spec.Hard["limits.memory"]; limit.Value() != 3000e6 {
+		t.Errorf("expected 3000M memory limit but got: %d\n", limit.Value())
+	}
+
+	// Independent limits are not derived from the requests
+	err = backend.Resize(context.TODO(), Request{
+		Namespace:         "example-dev",
+		ResourceQuota:     "example-quota",
+		New:               resources.New(1000, 1000).Set(v12.ResourceLimitsCPU, 4000).Set(v12.ResourceLimitsMemory, 2000),
+		CpuLimitRatio:     10,
+		IndependentLimits: true,
+	})
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	quota, _ = client.CoreV1().ResourceQuotas("example-dev").Get(context.TODO(), "example-quota", v13.GetOptions{})
+	if limit := quota.Spec.Hard["limits.cpu"]; limit.MilliValue() != 4000 {
+		t.Errorf("expected 4000m CPU limit but got: %d\n", limit.MilliValue())
+	}
+	if limit := quota.Spec.Hard["limits.memory"]; limit.Value() != 2000e6 {
+		t.Errorf("expected 2000M memory limit but got: %d\n", limit.Value())
+	}
+}
+
+func TestWebhookBackend(t *testing.T) {
+	var received Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		if r.Header.Get("X-Cluster") != "prod-1" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	backend, _ := New("webhook", nil, json.RawMessage(`{"url": "`+server.URL+`", "headers": {"X-Cluster": "prod-1"}}`))
+	if err := backend.Resize(context.TODO(), Request{Namespace: "example-dev", New: resources.New(2000, 0)}); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if received.Namespace != "example-dev" || received.New.Cpu() != 2000 {
+		t.Errorf("expected the request to be sent but got: %+v\n", received)
+	}
+
+	backend, _ = New("webhook", nil, json.RawMessage(`{"url": "`+server.URL+`"}`))
+	if err := backend.Resize(context.TODO(), Request{Namespace: "example-dev"}); err == nil {
+		t.Errorf("expected an error for status 400\n")
+	}
+}
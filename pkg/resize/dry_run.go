@@ -0,0 +1,29 @@
+package resize
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"k8s.io/client-go/kubernetes"
+)
+
+func init() {
+	Register("dry-run", NewDryRunBackend)
+}
+
+// DryRunBackend only logs the resizes, e.g. to evaluate QuotaAutoscalers before they take effect.
+type DryRunBackend struct{}
+
+func NewDryRunBackend(_ kubernetes.Interface, _ json.RawMessage) (Backend, error) {
+	return &DryRunBackend{}, nil
+}
+
+func (backend *DryRunBackend) Name() string {
+	return "dry-run"
+}
+
+func (backend *DryRunBackend) Resize(_ context.Context, request Request) error {
+	logging.LogInfo("[%s] Dry run, not resizing ResourceQuota %s: %+v -> %+v", request.Namespace, request.ResourceQuota, request.Old, request.New)
+	return nil
+}
@@ -0,0 +1,54 @@
+package resize
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	v12 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+func init() {
+	Register("stub", NewStubBackend)
+}
+
+// StubBackend patches the ResourceQuota directly, so that the quota-scaler is functional without a resize API.
+// It does not do any charging.
+type StubBackend struct {
+	Client kubernetes.Interface
+}
+
+func NewStubBackend(client kubernetes.Interface, _ json.RawMessage) (Backend, error) {
+	if client == nil {
+		return nil, errors.New("stub resize backend requires a Kubernetes client")
+	}
+	return &StubBackend{Client: client}, nil
+}
+
+func (backend *StubBackend) Name() string {
+	return "stub"
+}
+
+// Resize patches the resources of New into the hard ResourceQuota, other resources are left alone. Unless the limits
+// are independent, the CPU and memory limits follow the requests.
+func (backend *StubBackend) Resize(ctx context.Context, request Request) error {
+	hard := request.New.Copy()
+	if !request.IndependentLimits {
+		if cpu, ok := request.New[v12.ResourceCPU]; ok && request.CpuLimitRatio > 0 {
+			hard.Set(v12.ResourceLimitsCPU, cpu.MilliValue()*request.CpuLimitRatio)
+		}
+		if memory, ok := request.New[v12.ResourceMemory]; ok {
+			hard[v12.ResourceLimitsMemory] = memory
+		}
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{"spec": map[string]interface{}{"hard": hard}})
+	if err != nil {
+		return err
+	}
+	_, err = backend.Client.CoreV1().ResourceQuotas(request.Namespace).Patch(ctx, request.ResourceQuota, types.MergePatchType, patch, v1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,448 @@
+package resize
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/logging"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+func init() {
+	Register("webhook", NewWebhookBackend)
+}
+
+const (
+	// DefaultWebhookTimeout is the timeout of a single webhook call when none is configured
+	DefaultWebhookTimeout = 30 * time.Second
+
+	DefaultWebhookMaxAttempts    = 4
+	DefaultWebhookInitialBackoff = time.Second
+	DefaultWebhookMaxBackoff     = 30 * time.Second
+)
+
+// DefaultWebhookRetryStatusCodes are the response status codes after which a webhook call is retried
+var DefaultWebhookRetryStatusCodes = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// WebhookOptions configures the WebhookBackend, e.g.:
+//
+//	url: https://charging.example.com/api/v1/namespace
+//	method: PATCH
+//	headers:
+//	  X-Cluster: prod-1
+//	body: '{"name": "{{ .Namespace }}", "spec": {"quota": {"cpu": {{ .New.Cpu }}, "memory": {{ .New.Memory }}}}}'
+//	auth:
+//	  bearerTokenFile: /var/run/secrets/kubernetes.io/serviceaccount/token
+//	caFile: /etc/pki/tls/certs/ca-bundle.crt
+//	timeout: 1m
+//	retry:
+//	  maxAttempts: 5
+//	response:
+//	  requestIdField: requestID
+//	  messageField: status
+type WebhookOptions struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Body is a Go template executed with the Request, the Request is sent as JSON when both Body and JSONPatch are
+	// empty. Besides the standard functions the template can use `json` to encode a value and `env` to read an
+	// environment variable.
+	Body string `json:"body,omitempty"`
+	// JSONPatch sends an RFC 6902 JSON patch, the value of each operation is a template like Body. Values that are
+	// valid JSON after templating are sent as JSON, other values as strings.
+	JSONPatch []WebhookPatchOperation `json:"jsonPatch,omitempty"`
+
+	Auth    WebhookAuth     `json:"auth,omitempty"`
+	CAFile  string          `json:"caFile,omitempty"` // PEM bundle that replaces the system roots
+	Timeout *v1.Duration    `json:"timeout,omitempty"`
+	Retry   WebhookRetry    `json:"retry,omitempty"`
+	Reply   WebhookResponse `json:"response,omitempty"`
+}
+
+type WebhookPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value,omitempty"`
+}
+
+// WebhookAuth configures one of bearer, basic or mutual TLS authentication. Files are read on every call, so
+// rotated credentials are picked up.
+type WebhookAuth struct {
+	BearerToken     string `json:"bearerToken,omitempty"`
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+
+	ClientCertFile string `json:"clientCertFile,omitempty"`
+	ClientKeyFile  string `json:"clientKeyFile,omitempty"`
+}
+
+// WebhookRetry configures the exponential backoff of failed calls. The StatusCodes are retried, and calls that failed
+// before a connection was established. Other connection errors are not retried, the webhook may have received the
+// call and a resize is not idempotent.
+type WebhookRetry struct {
+	MaxAttempts    int          `json:"maxAttempts,omitempty"`
+	InitialBackoff *v1.Duration `json:"initialBackoff,omitempty"`
+	MaxBackoff     *v1.Duration `json:"maxBackoff,omitempty"`
+	StatusCodes    []int        `json:"statusCodes,omitempty"`
+}
+
+// WebhookResponse configures the JSONResponseParser. Fields are dot separated paths in a JSON reply.
+type WebhookResponse struct {
+	RequestIDField  string `json:"requestIdField,omitempty"`
+	RequestIDHeader string `json:"requestIdHeader,omitempty"`
+	MessageField    string `json:"messageField,omitempty"`
+}
+
+// WebhookReply is the parsed response of the webhook, for audit purposes.
+type WebhookReply struct {
+	RequestID string
+	Message   string
+}
+
+// ResponseParser parses the response of a webhook call, e.g. to log the request ID of the resize for audit.
+type ResponseParser interface {
+	Parse(response *http.Response, body []byte) (WebhookReply, error)
+}
+
+// WebhookBackend sends the resize Request to an HTTP endpoint, any status other than 2xx is an error.
+type WebhookBackend struct {
+	Options WebhookOptions
+	Client  *http.Client
+	Parser  ResponseParser
+
+	body      *template.Template
+	patch     []*template.Template
+	tlsConfig *tls.Config
+}
+
+func NewWebhookBackend(_ kubernetes.Interface, options json.RawMessage) (Backend, error) {
+	webhookOptions := WebhookOptions{Method: http.MethodPost, Timeout: &v1.Duration{Duration: DefaultWebhookTimeout}}
+	if err := decodeOptions(options, &webhookOptions); err != nil {
+		return nil, err
+	}
+	backend, err := NewWebhookBackendFromOptions(webhookOptions)
+	if err != nil {
+		return nil, err
+	}
+	return backend, nil
+}
+
+// NewWebhookBackendFromOptions validates the options and creates a WebhookBackend which uses the JSONResponseParser.
+func NewWebhookBackendFromOptions(options WebhookOptions) (*WebhookBackend, error) {
+	if options.URL == "" {
+		return nil, errors.New("webhook resize backend requires a url")
+	}
+	if options.Method == "" {
+		options.Method = http.MethodPost
+	}
+	if options.Timeout == nil {
+		options.Timeout = &v1.Duration{Duration: DefaultWebhookTimeout}
+	}
+	if options.Body != "" && len(options.JSONPatch) > 0 {
+		return nil, errors.New("webhook resize backend accepts either a body or a jsonPatch")
+	}
+	options.Retry = options.Retry.withDefaults()
+
+	backend := &WebhookBackend{Options: options, Parser: &JSONResponseParser{Options: options.Reply}}
+
+	var err error
+	if options.Body != "" {
+		if backend.body, err = newWebhookTemplate("body", options.Body); err != nil {
+			return nil, err
+		}
+	}
+	for i, operation := range options.JSONPatch {
+		tmpl, err := newWebhookTemplate(fmt.Sprintf("jsonPatch[%d]", i), operation.Value)
+		if err != nil {
+			return nil, err
+		}
+		backend.patch = append(backend.patch, tmpl)
+	}
+
+	// The CA bundle is loaded once, client certificates on every TLS handshake
+	backend.tlsConfig = &tls.Config{}
+	if options.CAFile != "" {
+		caCert, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, errors.New("could not read CA file: " + err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", options.CAFile)
+		}
+		backend.tlsConfig.RootCAs = pool
+	}
+	if auth := options.Auth; auth.ClientCertFile != "" || auth.ClientKeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(auth.ClientCertFile, auth.ClientKeyFile); err != nil {
+			return nil, errors.New("could not load client certificate: " + err.Error())
+		}
+		backend.tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(auth.ClientCertFile, auth.ClientKeyFile)
+			return &cert, err
+		}
+	}
+
+	backend.Client = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: backend.tlsConfig,
+	}}
+	return backend, nil
+}
+
+func newWebhookTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"json": func(value interface{}) (string, error) {
+			encoded, err := json.Marshal(value)
+			return string(encoded), err
+		},
+		"env": os.Getenv,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook %s template: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+func (retry WebhookRetry) withDefaults() WebhookRetry {
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = DefaultWebhookMaxAttempts
+	}
+	if retry.InitialBackoff == nil {
+		retry.InitialBackoff = &v1.Duration{Duration: DefaultWebhookInitialBackoff}
+	}
+	if retry.MaxBackoff == nil {
+		retry.MaxBackoff = &v1.Duration{Duration: DefaultWebhookMaxBackoff}
+	}
+	if retry.StatusCodes == nil {
+		retry.StatusCodes = DefaultWebhookRetryStatusCodes
+	}
+	return retry
+}
+
+func (backend *WebhookBackend) Name() string {
+	return "webhook"
+}
+
+// Resize calls the webhook, retrying with exponential backoff until the call succeeds, fails with a status that is
+// not retryable, the attempts are exhausted or ctx is done.
+func (backend *WebhookBackend) Resize(ctx context.Context, request Request) error {
+	body, contentType, err := backend.renderBody(request)
+	if err != nil {
+		return err
+	}
+
+	backoff := backend.Options.Retry.InitialBackoff.Duration
+	for attempt := 1; ; attempt++ {
+		reply, retryable, err := backend.call(ctx, body, contentType)
+		if err == nil {
+			logging.LogInfo("[%s] Resize webhook reply: [%s] %s", request.Namespace, reply.RequestID, reply.Message)
+			return nil
+		}
+		if !retryable || attempt >= backend.Options.Retry.MaxAttempts {
+			return err
+		}
+
+		logging.LogWarning("[%s] Resize webhook attempt %d failed, retrying in %s: %v", request.Namespace, attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > backend.Options.Retry.MaxBackoff.Duration {
+			backoff = backend.Options.Retry.MaxBackoff.Duration
+		}
+	}
+}
+
+func (backend *WebhookBackend) renderBody(request Request) ([]byte, string, error) {
+	if backend.body != nil {
+		var body bytes.Buffer
+		if err := backend.body.Execute(&body, request); err != nil {
+			return nil, "", err
+		}
+		return body.Bytes(), "application/json", nil
+	}
+
+	if backend.patch != nil {
+		var operations []map[string]interface{}
+		for i, operation := range backend.Options.JSONPatch {
+			patch := map[string]interface{}{"op": operation.Op, "path": operation.Path}
+			if operation.Value != "" {
+				var value bytes.Buffer
+				if err := backend.patch[i].Execute(&value, request); err != nil {
+					return nil, "", err
+				}
+				if json.Valid(value.Bytes()) {
+					patch["value"] = json.RawMessage(value.Bytes())
+				} else {
+					patch["value"] = value.String()
+				}
+			}
+			operations = append(operations, patch)
+		}
+		body, err := json.Marshal(operations)
+		return body, "application/json-patch+json", err
+	}
+
+	body, err := json.Marshal(request)
+	return body, "application/json", err
+}
+
+// call does a single webhook call and returns whether a failure may be retried.
+func (backend *WebhookBackend) call(ctx context.Context, body []byte, contentType string) (WebhookReply, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, backend.Options.Timeout.Duration)
+	defer cancel()
+
+	req, err := http.NewRequest(backend.Options.Method, backend.Options.URL, bytes.NewReader(body))
+	if err != nil {
+		return WebhookReply{}, false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	for header, value := range backend.Options.Headers {
+		req.Header.Set(header, value)
+	}
+	if err := backend.authorize(req); err != nil {
+		return WebhookReply{}, false, err
+	}
+
+	// Without a connection the call never left, e.g. when dialing or the TLS handshake failed
+	var connected int32
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { atomic.StoreInt32(&connected, 1) },
+	}))
+	response, err := backend.Client.Do(req)
+	if err != nil {
+		return WebhookReply{}, atomic.LoadInt32(&connected) == 0, err
+	}
+	defer response.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return WebhookReply{}, false, err
+	}
+
+	reply, parseErr := backend.Parser.Parse(response, respBody)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message := reply.Message
+		if message == "" {
+			message = string(bytes.TrimSpace(respBody))
+			if len(message) > 256 {
+				message = message[:256]
+			}
+		}
+		err := fmt.Errorf("resize webhook status NOK: %s: [%s] %s", response.Status, reply.RequestID, message)
+		return reply, backend.retryable(response.StatusCode), err
+	}
+	if parseErr != nil {
+		// The resize was accepted, only the audit information is missing
+		logging.LogWarning("Cannot parse resize webhook reply: %v", parseErr)
+	}
+	return reply, false, nil
+}
+
+func (backend *WebhookBackend) retryable(statusCode int) bool {
+	for _, code := range backend.Options.Retry.StatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (backend *WebhookBackend) authorize(req *http.Request) error {
+	auth := backend.Options.Auth
+	switch {
+	case auth.BearerToken != "" || auth.BearerTokenFile != "":
+		token := auth.BearerToken
+		if auth.BearerTokenFile != "" {
+			content, err := ioutil.ReadFile(auth.BearerTokenFile)
+			if err != nil {
+				return errors.New("cannot read bearer token: " + err.Error())
+			}
+			token = strings.TrimSpace(string(content))
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case auth.Username != "":
+		password := auth.Password
+		if auth.PasswordFile != "" {
+			content, err := ioutil.ReadFile(auth.PasswordFile)
+			if err != nil {
+				return errors.New("cannot read password: " + err.Error())
+			}
+			password = strings.TrimSpace(string(content))
+		}
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth.Username+":"+password)))
+	}
+	return nil
+}
+
+// JSONResponseParser reads the request ID and message from a JSON reply or from a header. Replies that are not JSON
+// are accepted when no fields are configured.
+type JSONResponseParser struct {
+	Options WebhookResponse
+}
+
+func (parser *JSONResponseParser) Parse(response *http.Response, body []byte) (WebhookReply, error) {
+	reply := WebhookReply{}
+	if parser.Options.RequestIDHeader != "" {
+		reply.RequestID = response.Header.Get(parser.Options.RequestIDHeader)
+	}
+	if parser.Options.RequestIDField == "" && parser.Options.MessageField == "" {
+		return reply, nil
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return reply, err
+	}
+	if parser.Options.RequestIDField != "" {
+		reply.RequestID = jsonField(parsed, parser.Options.RequestIDField)
+	}
+	if parser.Options.MessageField != "" {
+		reply.Message = jsonField(parsed, parser.Options.MessageField)
+	}
+	return reply, nil
+}
+
+// jsonField returns the value at the dot separated path, formatted as string. Missing fields return "".
+func jsonField(value interface{}, path string) string {
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typed
+	default:
+		encoded, _ := json.Marshal(typed)
+		return string(encoded)
+	}
+}
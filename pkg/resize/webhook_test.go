@@ -0,0 +1,275 @@
+package resize
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ing-bank/quota-scaler/pkg/resources"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var testRequest = Request{
+	Namespace:     "example-dev",
+	ResourceQuota: "example-quota",
+	Old:           resources.New(1000, 1000),
+	New:           resources.New(2000, 3000).Add(resources.Resources{"requests.storage": resource.MustParse("100Gi")}),
+}
+
+func newTestWebhook(t *testing.T, options WebhookOptions) *WebhookBackend {
+	options.Retry.InitialBackoff = &v1.Duration{Duration: 10 * time.Millisecond}
+	backend, err := NewWebhookBackendFromOptions(options)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	return backend
+}
+
+func TestWebhookTemplateBody(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhook")
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	_ = ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600)
+
+	var body map[string]interface{}
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		_, _ = w.Write([]byte(`{"requestID": "42", "status": "OK"}`))
+	}))
+	defer server.Close()
+
+	backend := newTestWebhook(t, WebhookOptions{
+		URL:    server.URL,
+		Method: http.MethodPatch,
+		Body:   `{"name": {{ json .Namespace }}, "spec": {"quota": {"cpu": {{ .New.Cpu }}, "memory": {{ .New.Memory }}, "storage": {{ json (.New.Quantity "requests.storage") }}}}}`,
+		Auth:   WebhookAuth{BearerTokenFile: tokenFile},
+		Reply:  WebhookResponse{RequestIDField: "requestID", MessageField: "status"},
+	})
+	if err := backend.Resize(context.TODO(), testRequest); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	if authorization != "Bearer secret" {
+		t.Errorf("expected bearer token auth but got: %s\n", authorization)
+	}
+	quota, _ := body["spec"].(map[string]interface{})["quota"].(map[string]interface{})
+	if body["name"] != "example-dev" || quota["cpu"] != 2000.0 || quota["memory"] != 3000.0 || quota["storage"] != "100Gi" {
+		t.Errorf("expected the templated body but got: %+v\n", body)
+	}
+
+	if _, err := NewWebhookBackendFromOptions(WebhookOptions{URL: server.URL, Body: "{{ .Namespace"}); err == nil {
+		t.Errorf("expected an error for an invalid template\n")
+	}
+}
+
+func TestWebhookJSONPatch(t *testing.T) {
+	var patch []map[string]interface{}
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		_ = json.NewDecoder(r.Body).Decode(&patch)
+	}))
+	defer server.Close()
+
+	backend := newTestWebhook(t, WebhookOptions{
+		URL: server.URL,
+		JSONPatch: []WebhookPatchOperation{
+			{Op: "replace", Path: "/spec/hard/cpu", Value: "{{ .New.Cpu }}m"},
+			{Op: "replace", Path: "/spec/quota/memory", Value: "{{ .New.Memory }}"},
+		},
+	})
+	if err := backend.Resize(context.TODO(), testRequest); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+
+	if contentType != "application/json-patch+json" {
+		t.Errorf("expected a JSON patch content type but got: %s\n", contentType)
+	}
+	if len(patch) != 2 || patch[0]["value"] != "2000m" || patch[1]["value"] != 3000.0 {
+		t.Errorf("expected string and number values but got: %+v\n", patch)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1, 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("X-Request-Id", "42")
+		}
+	}))
+	defer server.Close()
+
+	// Retryable status codes are retried with backoff
+	backend := newTestWebhook(t, WebhookOptions{URL: server.URL, Reply: WebhookResponse{RequestIDHeader: "X-Request-Id"}})
+	if err := backend.Resize(context.TODO(), testRequest); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 3 {
+		t.Errorf("expected 3 calls but got: %d\n", calls)
+	}
+
+	// Attempts are limited
+	atomic.StoreInt32(&calls, 0)
+	backend = newTestWebhook(t, WebhookOptions{URL: server.URL, Retry: WebhookRetry{MaxAttempts: 2}})
+	if err := backend.Resize(context.TODO(), testRequest); err == nil {
+		t.Errorf("expected an error after 2 attempts\n")
+	}
+
+	// Other status codes are not retried
+	atomic.StoreInt32(&calls, 0)
+	backend = newTestWebhook(t, WebhookOptions{URL: server.URL, Retry: WebhookRetry{StatusCodes: []int{}}})
+	if err := backend.Resize(context.TODO(), testRequest); err == nil {
+		t.Errorf("expected an error for status 503\n")
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected 1 call but got: %d\n", calls)
+	}
+}
+
+func TestWebhookConnectionErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}))
+	defer server.Close()
+
+	// The webhook received the call before the connection broke, it may have resized
+	backend := newTestWebhook(t, WebhookOptions{URL: server.URL})
+	if err := backend.Resize(context.TODO(), testRequest); err == nil {
+		t.Errorf("expected a connection error\n")
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected 1 call but got: %d\n", calls)
+	}
+
+	// Calls that could not connect are retried
+	var dials int32
+	backend = newTestWebhook(t, WebhookOptions{URL: server.URL, Retry: WebhookRetry{MaxAttempts: 3}})
+	backend.Client = &http.Client{Transport: &http.Transport{DialContext: func(context.Context, string, string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errors.New("connection refused")
+	}}}
+	if err := backend.Resize(context.TODO(), testRequest); err == nil {
+		t.Errorf("expected a dial error\n")
+	}
+	if dials := atomic.LoadInt32(&dials); dials != 3 {
+		t.Errorf("expected 3 dials but got: %d\n", dials)
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	backend := newTestWebhook(t, WebhookOptions{
+		URL:     server.URL,
+		Timeout: &v1.Duration{Duration: 50 * time.Millisecond},
+		Retry:   WebhookRetry{MaxAttempts: 1},
+	})
+	if err := backend.Resize(context.TODO(), testRequest); err == nil {
+		t.Errorf("expected a timeout error\n")
+	}
+}
+
+// writeTestCertificate writes a self-signed client certificate and key to dir.
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "quota-scaler"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	cert, _ := x509.ParseCertificate(der)
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	_ = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, cert
+}
+
+func TestWebhookMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhook")
+	defer os.RemoveAll(dir)
+	certFile, keyFile, clientCert := writeTestCertificate(t, dir)
+
+	var username, password string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, _ = r.BasicAuth()
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	_ = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	backend := newTestWebhook(t, WebhookOptions{
+		URL:    server.URL,
+		CAFile: caFile,
+		Auth:   WebhookAuth{Username: "scaler", Password: "secret", ClientCertFile: certFile, ClientKeyFile: keyFile},
+		Retry:  WebhookRetry{MaxAttempts: 1},
+	})
+	if err := backend.Resize(context.TODO(), testRequest); err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if username != "scaler" || password != "secret" {
+		t.Errorf("expected basic auth but got: %s:%s\n", username, password)
+	}
+
+	// Without the client certificate the server rejects the connection
+	backend = newTestWebhook(t, WebhookOptions{URL: server.URL, CAFile: caFile, Retry: WebhookRetry{MaxAttempts: 1}})
+	if err := backend.Resize(context.TODO(), testRequest); err == nil {
+		t.Errorf("expected an error without client certificate\n")
+	}
+}
+
+func TestJSONResponseParser(t *testing.T) {
+	parser := &JSONResponseParser{Options: WebhookResponse{RequestIDField: "meta.id", MessageField: "clusters"}}
+	reply, err := parser.Parse(&http.Response{}, []byte(`{"meta": {"id": 42}, "clusters": [{"message": "quota exceeded"}]}`))
+	if err != nil {
+		t.Fatalf("expected no error but got: %v\n", err)
+	}
+	if reply.RequestID != "42" || reply.Message != `[{"message":"quota exceeded"}]` {
+		t.Errorf("expected the request ID and message but got: %+v\n", reply)
+	}
+
+	if _, err := parser.Parse(&http.Response{}, []byte("OK")); err == nil {
+		t.Errorf("expected an error for a reply that is not JSON\n")
+	}
+}
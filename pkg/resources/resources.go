@@ -1,106 +1,253 @@
 package resources
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+
 	"github.com/ing-bank/quota-scaler/pkg/logging"
+	"gopkg.in/inf.v0"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-// This package combines Cpu and Memory resources into a single struct, combined with some actions upon them.
-// For ease of use each function updates a struct pointer, as well as returns a reference to that struct. This
-// allows chaining of function calls. For example:
+// This package holds ResourceQuota resources by name, combined with some actions upon them. The quantities are kept
+// exactly, e.g. `requests.storage=100Gi` stays 100Gi. Policies calculate with int64 values in the scale of a resource,
+// see ScaleOf. Resources is a map, so each function updates res in place, as well as returns it. This allows chaining
+// of function calls. For example:
 //
-//  example := &Resources{Cpu: 1}
-//  example.Add(&Resources{Cpu: 1}).Add(&Resources{Cpu: 1}) // example.Cpu = 3
-//  example.Limit(&Resources{Cpu: 2})                       // example.Cpu = 2
+//  example := New(1, 0)
+//  example.Add(New(1, 0)).Add(New(1, 0)) // example.Cpu() = 3
+//  example.Limit(New(2, 0))              // example.Cpu() = 2
+//  example.Set("count/pods", 10)         // example["count/pods"] = 10
 
-// Resources combines Cpu and Memory into a single container
-type Resources struct {
-	Cpu     int64 // In millicores
-	Memory  int64 // In megabytes
-	Storage int64 // Store is included here for logging purposes, but not intended to be scaled (yet)
-}
+// Resources maps ResourceQuota resource names to their quantities. The CPU and memory requests are named `cpu` and
+// `memory`, other resources use their ResourceQuota name, e.g. `limits.cpu`, `requests.storage` or `count/pods`.
+type Resources map[v1.ResourceName]resource.Quantity
 
-// Add adds the new resources to the existing resources. Result is updated and also returned.
-func (res *Resources) Add(new *Resources) *Resources {
-	res.Cpu += new.Cpu
-	res.Memory += new.Memory
-	res.Storage += new.Storage
+// New returns Resources with the CPU requests in millicores and the memory requests in megabytes. Zero values are
+// omitted.
+func New(cpu, memory int64) Resources {
+	res := Resources{}
+	if cpu != 0 {
+		res.Set(v1.ResourceCPU, cpu)
+	}
+	if memory != 0 {
+		res.Set(v1.ResourceMemory, memory)
+	}
 	return res
 }
 
-// Replace replaces fields in `res` if they are non-default in `new`. Result is updated and also returned.
-func (res *Resources) Replace(new *Resources) *Resources {
-	if new == nil {
-		return res
+// ScaleOf returns the scale in which policies calculate with a resource: millicores for CPU, megabytes for memory and
+// whole units, e.g. bytes or objects, for everything else.
+func ScaleOf(name v1.ResourceName) resource.Scale {
+	switch name {
+	case v1.ResourceCPU, v1.ResourceRequestsCPU, v1.ResourceLimitsCPU:
+		return resource.Milli
+	case v1.ResourceMemory, v1.ResourceRequestsMemory, v1.ResourceLimitsMemory:
+		return resource.Mega
+	default:
+		return 0
 	}
+}
 
-	if new.Cpu != 0 {
-		res.Cpu = new.Cpu
+// Value returns the resource in its scale, zero when it is not set.
+func (res Resources) Value(name v1.ResourceName) int64 {
+	quantity, ok := res[name]
+	if !ok {
+		return 0
 	}
-	if new.Memory != 0 {
-		res.Memory = new.Memory
+	return quantity.ScaledValue(ScaleOf(name))
+}
+
+// Set sets the resource to a value in its scale, formatted like the quantity it replaces. Result is updated and also
+// returned.
+func (res Resources) Set(name v1.ResourceName, value int64) Resources {
+	quantity := resource.NewScaledQuantity(value, ScaleOf(name))
+	if previous, ok := res[name]; ok {
+		quantity.Format = previous.Format // e.g. 100Gi set to 200Gi in bytes is 200Gi
 	}
+	res[name] = *quantity
+	return res
+}
+
+// Quantity returns the quantity of the resource, zero when it is not set. Meant for webhook templates, e.g.
+// `{{ .New.Quantity "requests.storage" }}`.
+func (res Resources) Quantity(name v1.ResourceName) *resource.Quantity {
+	quantity := res[name]
+	return &quantity
+}
+
+// Cpu returns the CPU requests in millicores.
+func (res Resources) Cpu() int64 {
+	return res.Value(v1.ResourceCPU)
+}
 
-	if new.Storage != 0 {
-		res.Storage = new.Storage
+// Memory returns the memory requests in megabytes.
+func (res Resources) Memory() int64 {
+	return res.Value(v1.ResourceMemory)
+}
+
+// Copy returns a copy of res.
+func (res Resources) Copy() Resources {
+	copied := make(Resources, len(res))
+	for name, quantity := range res {
+		copied[name] = quantity.DeepCopy()
 	}
+	return copied
+}
+
+// Only returns a copy of res with only the given resources.
+func (res Resources) Only(names ...v1.ResourceName) Resources {
+	only := Resources{}
+	for _, name := range names {
+		if quantity, ok := res[name]; ok {
+			only[name] = quantity.DeepCopy()
+		}
+	}
+	return only
+}
 
+// Add adds the new resources to the existing resources. Result is updated and also returned.
+func (res Resources) Add(new Resources) Resources {
+	for name, quantity := range new {
+		sum := res[name].DeepCopy()
+		sum.Add(quantity)
+		res[name] = sum
+	}
+	return res
+}
+
+// Multiply multiplies all resources with n. Result is updated and also returned.
+func (res Resources) Multiply(n int64) Resources {
+	for name, quantity := range res {
+		product := resource.Quantity{}
+		product.Add(resource.MustParse(new(inf.Dec).Mul(quantity.AsDec(), inf.NewDec(n, 0)).String()))
+		product.Format = quantity.Format // Formatted like the quantity, e.g. 3*64Mi is 192Mi
+		res[name] = product
+	}
 	return res
 }
 
-// Limit limits the resources with a maximum of the specified limit. Result is updated and also returned.
-func (res *Resources) Limit(limit *Resources) *Resources {
-	if res.Cpu > limit.Cpu {
-		res.Cpu = limit.Cpu
+// Replace replaces resources in `res` if they are non-zero in `new`. Result is updated and also returned.
+func (res Resources) Replace(new Resources) Resources {
+	for name, quantity := range new {
+		if !quantity.IsZero() {
+			res[name] = quantity.DeepCopy()
+		}
 	}
-	if res.Memory > limit.Memory {
-		res.Memory = limit.Memory
+	return res
+}
+
+// Limit limits the resources with a maximum of the specified limit. Resources without limit are left alone. Result is
+// updated and also returned.
+func (res Resources) Limit(limit Resources) Resources {
+	for name, quantity := range limit {
+		if _, ok := res[name]; ok && res.Value(name) > limit.Value(name) {
+			res[name] = quantity.DeepCopy()
+		}
 	}
 	return res
 }
 
 // Max updates res with the maximum values of res and new. Result is updated and also returned.
-func (res *Resources) Max(new *Resources) *Resources {
-	if new.Cpu > res.Cpu {
-		res.Cpu = new.Cpu
+func (res Resources) Max(new Resources) Resources {
+	for name, quantity := range new {
+		if _, ok := res[name]; !ok || new.Value(name) > res.Value(name) {
+			res[name] = quantity.DeepCopy()
+		}
+	}
+	return res
+}
+
+// NormalizeLimits folds the limits into the requests for quotas whose limits follow the requests. The CPU limit
+// counts as CPU request divided by the ratio, a zero ratio ignores it. The memory limit counts as memory request.
+// Result is updated and also returned.
+func (res Resources) NormalizeLimits(cpuLimitRatio int64) Resources {
+	if cpuLimitRatio > 0 && res.Value(v1.ResourceLimitsCPU)/cpuLimitRatio > res.Cpu() {
+		res.Set(v1.ResourceCPU, res.Value(v1.ResourceLimitsCPU)/cpuLimitRatio)
 	}
-	if new.Memory > res.Memory {
-		res.Memory = new.Memory
+	if res.Value(v1.ResourceLimitsMemory) > res.Memory() {
+		res[v1.ResourceMemory] = res[v1.ResourceLimitsMemory]
 	}
+	delete(res, v1.ResourceLimitsCPU)
+	delete(res, v1.ResourceLimitsMemory)
 	return res
 }
 
-// IsEmpty returns true when Cpu and Memory are both zero.
-func (res *Resources) IsEmpty() bool {
-	return res.Cpu == 0 && res.Memory == 0
+// IsEmpty returns true when all resources are zero.
+func (res Resources) IsEmpty() bool {
+	for _, quantity := range res {
+		if !quantity.IsZero() {
+			return false
+		}
+	}
+	return true
 }
 
-func (res *Resources) DiffersFrom(quota *v1.ResourceQuota) bool {
-	if res.Cpu != quota.Spec.Hard.Cpu().ScaledValue(resource.Milli) {
-		return true
+// DiffersFrom returns true when any resource of res differs from the hard ResourceQuota in its scale.
+func (res Resources) DiffersFrom(quota *v1.ResourceQuota) bool {
+	hard := Resources(quota.Spec.Hard)
+	for name := range res {
+		if res.Value(name) != hard.Value(name) {
+			return true
+		}
 	}
-	if res.Memory != quota.Spec.Hard.Memory().ScaledValue(resource.Mega) {
-		return true
+	return false
+}
+
+// IsScaleDown returns true when any resource of res is below the hard ResourceQuota in its scale.
+func (res Resources) IsScaleDown(quota *v1.ResourceQuota) bool {
+	hard := Resources(quota.Spec.Hard)
+	for name := range res {
+		if res.Value(name) < hard.Value(name) {
+			return true
+		}
 	}
 	return false
 }
 
-func (res *Resources) IsScaleDown(quota *v1.ResourceQuota) bool {
-	return res.Cpu < quota.Spec.Hard.Cpu().ScaledValue(resource.Milli) || res.Memory < quota.Spec.Hard.Memory().ScaledValue(resource.Mega)
+// FromHard returns a copy of the given hard resources of the ResourceQuota, resources it does not have are omitted.
+func FromHard(quota *v1.ResourceQuota, names ...v1.ResourceName) Resources {
+	return Resources(quota.Spec.Hard).Only(names...)
 }
 
-func (res *Resources) ForceNoScaleDownWhenScaleUp(quota *v1.ResourceQuota) {
-	if res.Cpu > quota.Spec.Hard.Cpu().ScaledValue(resource.Milli) { // We are scaling up CPU
-		if res.Memory < quota.Spec.Hard.Memory().ScaledValue(resource.Mega) { // But Memory is a scale down
-			res.Memory = quota.Spec.Hard.Memory().ScaledValue(resource.Mega) // So keep Memory like quota, no scale down, perhaps it is not allowed (max once per hour)
-			logging.LogInfo("[%s] Raising Memory to %d to make sure we do a scaleUp", quota.Namespace, res.Memory)
-		}
+func (res Resources) ForceNoScaleDownWhenScaleUp(quota *v1.ResourceQuota) {
+	hard := Resources(quota.Spec.Hard)
+	scaleUp := false
+	for name := range res {
+		scaleUp = scaleUp || res.Value(name) > hard.Value(name)
+	}
+	if !scaleUp {
+		return
+	}
 
-	} else if res.Memory > quota.Spec.Hard.Memory().ScaledValue(resource.Mega) { // We are scaling up memory
-		if res.Cpu < quota.Spec.Hard.Cpu().ScaledValue(resource.Milli) { // But CPU is a scale down
-			res.Cpu = quota.Spec.Hard.Cpu().ScaledValue(resource.Milli) // So keep CPU like quota, no scale down, perhaps it is not allowed (max once per hour)
-			logging.LogInfo("[%s] Raising CPU to %d to make sure we do a scaleUp", quota.Namespace, res.Cpu)
+	// Keep resources that would scale down like quota, no scale down, perhaps it is not allowed (max once per hour)
+	for name := range res {
+		if quantity, ok := hard[name]; ok && res.Value(name) < hard.Value(name) {
+			res[name] = quantity.DeepCopy()
+			logging.LogInfo("[%s] Raising %s to %s to make sure we do a scaleUp", quota.Namespace, name, quantity.String())
 		}
 	}
 }
+
+// ToResourceList converts res to a ResourceList.
+func (res Resources) ToResourceList() v1.ResourceList {
+	return v1.ResourceList(res.Copy())
+}
+
+// String formats the resources sorted by name, e.g. `cpu=1300m, memory=2G, requests.storage=100Gi`.
+func (res Resources) String() string {
+	names := make([]string, 0, len(res))
+	for name := range res {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	formatted := make([]string, len(names))
+	for i, name := range names {
+		quantity := res[v1.ResourceName(name)]
+		formatted[i] = fmt.Sprintf("%s=%s", name, quantity.String())
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,54 @@
+package resources
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestResourcesKeepUnits(t *testing.T) {
+	res := Resources{
+		v1.ResourceMemory:          resource.MustParse("64Mi"),
+		v1.ResourceRequestsStorage: resource.MustParse("100Gi"),
+		"count/pods":               resource.MustParse("2"),
+	}
+	res.Multiply(3).Add(Resources{"count/pods": resource.MustParse("1")})
+	if formatted := res.String(); formatted != "count/pods=7, memory=192Mi, requests.storage=300Gi" {
+		t.Errorf("expected the units to be kept but got: %s\n", formatted)
+	}
+	if memory := res.Memory(); memory != 202 {
+		t.Errorf("expected 202M memory but got: %d\n", memory)
+	}
+	if storage := res.Value(v1.ResourceRequestsStorage); storage != 300*1024*1024*1024 {
+		t.Errorf("expected 300Gi storage in bytes but got: %d\n", storage)
+	}
+
+	res.Set(v1.ResourceRequestsStorage, 400*1024*1024*1024).Set(v1.ResourceCPU, 1500)
+	if formatted := res.String(); formatted != "count/pods=7, cpu=1500m, memory=192Mi, requests.storage=400Gi" {
+		t.Errorf("expected the units to be kept by Set but got: %s\n", formatted)
+	}
+}
+
+func TestResourcesBounds(t *testing.T) {
+	res := New(500, 4000).Set("count/pods", 60)
+	res.Max(New(1000, 1000)).Limit(Resources{"count/pods": resource.MustParse("50")})
+	if res.Cpu() != 1000 || res.Memory() != 4000 || res.Value("count/pods") != 50 {
+		t.Errorf("expected 1000m 4000M 50 pods but got: %s\n", res)
+	}
+
+	quota := &v1.ResourceQuota{Spec: v1.ResourceQuotaSpec{Hard: res.ToResourceList()}}
+	if New(1000, 4000).Set("count/pods", 50).DiffersFrom(quota) {
+		t.Errorf("expected no difference from the quota\n")
+	}
+	if !New(1000, 4000).Set("count/pods", 40).IsScaleDown(quota) {
+		t.Errorf("expected a scale down of the pods\n")
+	}
+}
+
+func TestNormalizeLimits(t *testing.T) {
+	res := New(100, 100).Set(v1.ResourceLimitsCPU, 2000).Set(v1.ResourceLimitsMemory, 500).NormalizeLimits(10)
+	if res.Cpu() != 200 || res.Memory() != 500 || len(res) != 2 {
+		t.Errorf("expected 200m 500M without limits but got: %s\n", res)
+	}
+}
@@ -1,15 +1,18 @@
 package v1
 
-import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
 
 // +genclient
-// +genclient:noStatus
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 type QuotaAutoscaler struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec QuotaAutoscalerSpec `json:"spec"`
+	Spec   QuotaAutoscalerSpec   `json:"spec"`
+	Status QuotaAutoscalerStatus `json:"status,omitempty"`
 }
 
 type QuotaAutoscalerSpec struct {
@@ -25,7 +28,129 @@ type QuotaAutoscalerSpec struct {
 	MinMemoryStep string `json:"minMemoryStep,omitempty"`
 	MaxMemoryStep string `json:"maxMemoryStep,omitempty"`
 
+	// Mode decides how the CPU and memory limits of the ResourceQuota are scaled, defaults to Ratio.
+	Mode QuotaMode `json:"mode,omitempty"`
+	// CpuLimitRatio is the ratio between the CPU limits and CPU requests of the ResourceQuota in the Ratio mode. Zero
+	// leaves the CPU limits alone. Defaults to the ratio of the cluster.
+	CpuLimitRatio *int64 `json:"cpuLimitRatio,omitempty"`
+
+	// Bounds of the limits in the Independent mode, they default to the bounds of the requests
+	MinCpuLimit    string `json:"minCpuLimit,omitempty"`
+	MaxCpuLimit    string `json:"maxCpuLimit,omitempty"`
+	MinMemoryLimit string `json:"minMemoryLimit,omitempty"`
+	MaxMemoryLimit string `json:"maxMemoryLimit,omitempty"`
+
+	// Resources are the bounds of other ResourceQuota resources, e.g. requests.storage or count/pods. Only resources
+	// with bounds can be scaled by a policy with the resource name as method.
+	Resources []QuotaResourceBounds `json:"resources,omitempty"`
+
 	Behavior QuotaAutoscalerSpecBehavior `json:"behavior"`
+
+	// DryRun calculates the desired quota and reports it in a WouldResize Event, metrics and the status, without
+	// resizing the ResourceQuota.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// Schedules override the bounds or behavior while their window is open, e.g. a higher minCpu during office hours.
+	// When several windows are open the first schedule applies.
+	Schedules []QuotaScalerSchedule `json:"schedules,omitempty"`
+
+	// Prediction scales up ahead of the usage that a seasonal model forecasts from the usage history, scaling down
+	// stays reactive. Nil disables the prediction.
+	Prediction *QuotaScalerPrediction `json:"prediction,omitempty"`
+
+	// UsageSource is where the actual consumption of the Pods is read from, defaults to Quota which only uses the
+	// ResourceQuota. Metrics enables the right-sizing recommendations and the consumption policies.
+	UsageSource UsageSource `json:"usageSource,omitempty"`
+
+	// ReplicaHeadroom keeps room in the quota for the workloads of the HorizontalPodAutoscalers and KEDA ScaledObjects
+	// of the namespace to scale out, defaults to None. The headroom is a scale up floor within maxCpu/maxMemory.
+	ReplicaHeadroom ReplicaHeadroom `json:"replicaHeadroom,omitempty"`
+}
+
+// UsageSource is where the actual consumption of the Pods is read from.
+type UsageSource string
+
+const (
+	// QuotaUsageSource only uses the requests and limits that the ResourceQuota reports, this is the default.
+	QuotaUsageSource UsageSource = "Quota"
+	// MetricsUsageSource reads the CPU and memory consumption of the Pods from the metrics API, or from Prometheus
+	// when the cluster config sets a URL.
+	MetricsUsageSource UsageSource = "Metrics"
+)
+
+// ReplicaHeadroom is the number of replicas that the quota keeps room for, for each horizontally scaled workload.
+type ReplicaHeadroom string
+
+const (
+	// NoReplicaHeadroom ignores horizontal scaling, this is the default.
+	NoReplicaHeadroom ReplicaHeadroom = "None"
+	// DesiredReplicaHeadroom keeps room for the desired replicas of the HorizontalPodAutoscalers.
+	DesiredReplicaHeadroom ReplicaHeadroom = "DesiredReplicas"
+	// MaxReplicaHeadroom keeps room for the maxReplicas of the HorizontalPodAutoscalers and the maxReplicaCount of
+	// the ScaledObjects.
+	MaxReplicaHeadroom ReplicaHeadroom = "MaxReplicas"
+)
+
+// QuotaScalerSchedule opens a window at every activation of its cron expression, which stays open for the duration.
+type QuotaScalerSchedule struct {
+	Name string `json:"name"`
+	// Cron is a standard cron expression with 5 fields, e.g. "0 7 * * 1-5" for weekdays at 07:00
+	Cron string `json:"cron"`
+	// TimeZone of the cron expression, e.g. Europe/Amsterdam. Defaults to UTC.
+	TimeZone string          `json:"timeZone,omitempty"`
+	Duration metav1.Duration `json:"duration"`
+
+	// Bounds that replace the bounds of the spec while the window is open, when set
+	MinCpu    string `json:"minCpu,omitempty"`
+	MaxCpu    string `json:"maxCpu,omitempty"`
+	MinMemory string `json:"minMemory,omitempty"`
+	MaxMemory string `json:"maxMemory,omitempty"`
+	// Behavior replaces the behavior of the spec while the window is open, when set
+	Behavior *QuotaAutoscalerSpecBehavior `json:"behavior,omitempty"`
+}
+
+// QuotaScalerPrediction configures the Holt-Winters model that forecasts the CPU and memory usage. The scale up
+// policies use the highest forecast within the horizon as usage.
+type QuotaScalerPrediction struct {
+	// Horizon is how far ahead the usage is forecast, defaults to 30m
+	Horizon metav1.Duration `json:"horizon,omitempty"`
+	// Seasons of the model, defaults to Daily and Weekly. The model needs a history of the longest season.
+	Seasons []PredictionSeason `json:"seasons,omitempty"`
+
+	// Smoothing factors of the level, trend and seasons in percent, default to 50, 10 and 30. Higher factors follow
+	// recent usage more closely.
+	LevelSmoothing    *int32 `json:"levelSmoothing,omitempty"`
+	TrendSmoothing    *int32 `json:"trendSmoothing,omitempty"`
+	SeasonalSmoothing *int32 `json:"seasonalSmoothing,omitempty"`
+}
+
+// PredictionSeason is a period in which the usage repeats itself.
+type PredictionSeason string
+
+const (
+	DailySeason  PredictionSeason = "Daily"
+	WeeklySeason PredictionSeason = "Weekly"
+)
+
+// QuotaMode decides how the limits of a ResourceQuota relate to its requests.
+type QuotaMode string
+
+const (
+	// RatioQuotaMode scales the requests, the CPU limits are the CPU requests times the CpuLimitRatio and the memory
+	// limits equal the memory requests. CPU limits count as requests divided by the ratio. This is the default.
+	RatioQuotaMode QuotaMode = "Ratio"
+	// IndependentQuotaMode scales requests.cpu, limits.cpu, requests.memory and limits.memory independently, each
+	// using its own usage. The cpu and memory policies apply to both the requests and the limits.
+	IndependentQuotaMode QuotaMode = "Independent"
+)
+
+// QuotaResourceBounds are the bounds of a ResourceQuota resource. The steps default to 1 and to the maximum.
+type QuotaResourceBounds struct {
+	Name    corev1.ResourceName `json:"name"`
+	Min     string              `json:"min,omitempty"`
+	Max     string              `json:"max"`
+	MinStep string              `json:"minStep,omitempty"`
+	MaxStep string              `json:"maxStep,omitempty"`
 }
 
 type QuotaAutoscalerSpecBehavior struct {
@@ -34,13 +159,101 @@ type QuotaAutoscalerSpecBehavior struct {
 }
 
 type QuotaScaleBehavior struct {
-	Policies []QuotaScalePolicy `json:"policies"`
+	Policies     []QuotaScalePolicy  `json:"policies"`
+	SelectPolicy ScalingPolicySelect `json:"selectPolicy,omitempty"`
+
+	// StabilizationWindowSeconds is the window in which past recommendations are considered. Scaling up uses the
+	// lowest, scaling down the highest recommendation within the window.
+	StabilizationWindowSeconds *int32 `json:"stabilizationWindowSeconds,omitempty"`
 }
 
+// ScalingPolicySelect decides between several policies for the same resource, following HPA semantics.
+type ScalingPolicySelect string
+
+const (
+	// MaxPolicySelect selects the policy with the biggest change, this is the default.
+	MaxPolicySelect ScalingPolicySelect = "Max"
+	// MinPolicySelect selects the policy with the smallest change.
+	MinPolicySelect ScalingPolicySelect = "Min"
+	// DisabledPolicySelect turns off scaling in the direction of the behavior.
+	DisabledPolicySelect ScalingPolicySelect = "Disabled"
+)
+
+// QuotaScalePolicy scales the resource named by its method when its usage crosses the value in percent. The
+// cpuConsumption and memoryConsumption scale down policies use the actual consumption of the Pods instead of their
+// requests, they require the Metrics usageSource and never scale below the requests.
 type QuotaScalePolicy struct {
 	Method        string `json:"method"`
 	Value         int    `json:"value"`
 	PeriodMinutes int    `json:"periodMinutes,omitempty"`
+	// MaxChange is the maximum quantity that is added or removed within PeriodMinutes. Defaults to the max step.
+	MaxChange string `json:"maxChange,omitempty"`
+}
+
+// QuotaAutoscalerStatus is written by the quota-scaler after every calculation and after every call to the
+// resize API, so tenants can see what the scaler did without relying on (expiring) namespace Events.
+type QuotaAutoscalerStatus struct {
+	ObservedGeneration int64                      `json:"observedGeneration,omitempty"`
+	Conditions         []QuotaAutoscalerCondition `json:"conditions,omitempty"`
+
+	CpuUsagePercentage    int64 `json:"cpuUsagePercentage,omitempty"`
+	MemoryUsagePercentage int64 `json:"memoryUsagePercentage,omitempty"`
+
+	LastDesiredResources corev1.ResourceList `json:"lastDesiredResources,omitempty"`
+	LastAppliedResources corev1.ResourceList `json:"lastAppliedResources,omitempty"`
+	LastResizeTime       *metav1.Time        `json:"lastResizeTime,omitempty"`
+	LastResizeError      string              `json:"lastResizeError,omitempty"`
+
+	// ActiveSchedule is the name of the schedule that applied to the last calculation, empty when none did
+	ActiveSchedule string `json:"activeSchedule,omitempty"`
+
+	// PredictedResources is the highest usage that the last calculation forecast within the horizon of the prediction
+	PredictedResources corev1.ResourceList `json:"predictedResources,omitempty"`
+
+	// ConsumedResources is the CPU and memory that the Pods consumed at the last calculation with the Metrics
+	// usageSource
+	ConsumedResources corev1.ResourceList `json:"consumedResources,omitempty"`
+	// Recommendations are the containers that request much more than they consume, most over-requested first
+	Recommendations []WorkloadRecommendation `json:"recommendations,omitempty"`
+
+	// HeadroomResources is the room that the last calculation kept for the horizontally scaled workloads, see
+	// replicaHeadroom
+	HeadroomResources corev1.ResourceList `json:"headroomResources,omitempty"`
+}
+
+// WorkloadRecommendation right-sizes the requests of a container of a workload, per Pod.
+type WorkloadRecommendation struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	Pods      int32  `json:"pods"`
+
+	// Requested are the requests of the container, Consumed the highest consumption of the container in any Pod
+	Requested   corev1.ResourceList `json:"requested"`
+	Consumed    corev1.ResourceList `json:"consumed"`
+	Recommended corev1.ResourceList `json:"recommended"`
+}
+
+type QuotaAutoscalerConditionType string
+
+const (
+	// ConditionReady is True when both the QuotaAutoscaler and its ResourceQuota are known and the last
+	// calculation succeeded.
+	ConditionReady QuotaAutoscalerConditionType = "Ready"
+	// ConditionScalingActive is True when the last calculation requested a resize of the ResourceQuota.
+	ConditionScalingActive QuotaAutoscalerConditionType = "ScalingActive"
+	// ConditionResizeFailing is True when the last call to the resize API returned an error.
+	ConditionResizeFailing QuotaAutoscalerConditionType = "ResizeFailing"
+	// ConditionQuotaNotFound is True when the ResourceQuota referenced by the spec cannot be found.
+	ConditionQuotaNotFound QuotaAutoscalerConditionType = "QuotaNotFound"
+)
+
+type QuotaAutoscalerCondition struct {
+	Type               QuotaAutoscalerConditionType `json:"type"`
+	Status             corev1.ConditionStatus       `json:"status"`
+	LastTransitionTime metav1.Time                  `json:"lastTransitionTime,omitempty"`
+	Reason             string                       `json:"reason,omitempty"`
+	Message            string                       `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -21,6 +21,7 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -30,6 +31,7 @@ func (in *QuotaAutoscaler) DeepCopyInto(out *QuotaAutoscaler) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -51,6 +53,23 @@ func (in *QuotaAutoscaler) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaAutoscalerCondition) DeepCopyInto(out *QuotaAutoscalerCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaAutoscalerCondition.
+func (in *QuotaAutoscalerCondition) DeepCopy() *QuotaAutoscalerCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaAutoscalerCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *QuotaAutoscalerList) DeepCopyInto(out *QuotaAutoscalerList) {
 	*out = *in
@@ -87,7 +106,29 @@ func (in *QuotaAutoscalerList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *QuotaAutoscalerSpec) DeepCopyInto(out *QuotaAutoscalerSpec) {
 	*out = *in
+	if in.CpuLimitRatio != nil {
+		in, out := &in.CpuLimitRatio, &out.CpuLimitRatio
+		*out = new(int64)
+		**out = **in
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = make([]QuotaResourceBounds, len(*in))
+		copy(*out, *in)
+	}
 	in.Behavior.DeepCopyInto(&out.Behavior)
+	if in.Schedules != nil {
+		in, out := &in.Schedules, &out.Schedules
+		*out = make([]QuotaScalerSchedule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Prediction != nil {
+		in, out := &in.Prediction, &out.Prediction
+		*out = new(QuotaScalerPrediction)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -119,6 +160,91 @@ func (in *QuotaAutoscalerSpecBehavior) DeepCopy() *QuotaAutoscalerSpecBehavior {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaAutoscalerStatus) DeepCopyInto(out *QuotaAutoscalerStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]QuotaAutoscalerCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastDesiredResources != nil {
+		in, out := &in.LastDesiredResources, &out.LastDesiredResources
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.LastAppliedResources != nil {
+		in, out := &in.LastAppliedResources, &out.LastAppliedResources
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.LastResizeTime != nil {
+		in, out := &in.LastResizeTime, &out.LastResizeTime
+		*out = (*in).DeepCopy()
+	}
+	if in.PredictedResources != nil {
+		in, out := &in.PredictedResources, &out.PredictedResources
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.ConsumedResources != nil {
+		in, out := &in.ConsumedResources, &out.ConsumedResources
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.Recommendations != nil {
+		in, out := &in.Recommendations, &out.Recommendations
+		*out = make([]WorkloadRecommendation, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.HeadroomResources != nil {
+		in, out := &in.HeadroomResources, &out.HeadroomResources
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaAutoscalerStatus.
+func (in *QuotaAutoscalerStatus) DeepCopy() *QuotaAutoscalerStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaAutoscalerStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaResourceBounds) DeepCopyInto(out *QuotaResourceBounds) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaResourceBounds.
+func (in *QuotaResourceBounds) DeepCopy() *QuotaResourceBounds {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaResourceBounds)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *QuotaScaleBehavior) DeepCopyInto(out *QuotaScaleBehavior) {
 	*out = *in
@@ -127,6 +253,11 @@ func (in *QuotaScaleBehavior) DeepCopyInto(out *QuotaScaleBehavior) {
 		*out = make([]QuotaScalePolicy, len(*in))
 		copy(*out, *in)
 	}
+	if in.StabilizationWindowSeconds != nil {
+		in, out := &in.StabilizationWindowSeconds, &out.StabilizationWindowSeconds
+		*out = new(int32)
+		**out = **in
+	}
 	return
 }
 
@@ -155,3 +286,99 @@ func (in *QuotaScalePolicy) DeepCopy() *QuotaScalePolicy {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaScalerPrediction) DeepCopyInto(out *QuotaScalerPrediction) {
+	*out = *in
+	out.Horizon = in.Horizon
+	if in.Seasons != nil {
+		in, out := &in.Seasons, &out.Seasons
+		*out = make([]PredictionSeason, len(*in))
+		copy(*out, *in)
+	}
+	if in.LevelSmoothing != nil {
+		in, out := &in.LevelSmoothing, &out.LevelSmoothing
+		*out = new(int32)
+		**out = **in
+	}
+	if in.TrendSmoothing != nil {
+		in, out := &in.TrendSmoothing, &out.TrendSmoothing
+		*out = new(int32)
+		**out = **in
+	}
+	if in.SeasonalSmoothing != nil {
+		in, out := &in.SeasonalSmoothing, &out.SeasonalSmoothing
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaScalerPrediction.
+func (in *QuotaScalerPrediction) DeepCopy() *QuotaScalerPrediction {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaScalerPrediction)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaScalerSchedule) DeepCopyInto(out *QuotaScalerSchedule) {
+	*out = *in
+	out.Duration = in.Duration
+	if in.Behavior != nil {
+		in, out := &in.Behavior, &out.Behavior
+		*out = new(QuotaAutoscalerSpecBehavior)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaScalerSchedule.
+func (in *QuotaScalerSchedule) DeepCopy() *QuotaScalerSchedule {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaScalerSchedule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WorkloadRecommendation) DeepCopyInto(out *WorkloadRecommendation) {
+	*out = *in
+	if in.Requested != nil {
+		in, out := &in.Requested, &out.Requested
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.Consumed != nil {
+		in, out := &in.Consumed, &out.Consumed
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.Recommended != nil {
+		in, out := &in.Recommended, &out.Recommended
+		*out = make(corev1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WorkloadRecommendation.
+func (in *WorkloadRecommendation) DeepCopy() *WorkloadRecommendation {
+	if in == nil {
+		return nil
+	}
+	out := new(WorkloadRecommendation)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -102,6 +102,18 @@ func (c *FakeQuotaAutoscalers) Update(ctx context.Context, quotaAutoscaler *quot
 	return obj.(*quotaautoscalerv1.QuotaAutoscaler), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeQuotaAutoscalers) UpdateStatus(ctx context.Context, quotaAutoscaler *quotaautoscalerv1.QuotaAutoscaler, opts v1.UpdateOptions) (*quotaautoscalerv1.QuotaAutoscaler, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(quotaautoscalersResource, "status", c.ns, quotaAutoscaler), &quotaautoscalerv1.QuotaAutoscaler{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*quotaautoscalerv1.QuotaAutoscaler), err
+}
+
 // Delete takes name of the quotaAutoscaler and deletes it. Returns an error if one occurs.
 func (c *FakeQuotaAutoscalers) Delete(ctx context.Context, name string, opts v1.DeleteOptions) error {
 	_, err := c.Fake.
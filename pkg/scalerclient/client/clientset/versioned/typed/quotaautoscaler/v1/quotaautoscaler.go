@@ -39,6 +39,7 @@ type QuotaAutoscalersGetter interface {
 type QuotaAutoscalerInterface interface {
 	Create(ctx context.Context, quotaAutoscaler *v1.QuotaAutoscaler, opts metav1.CreateOptions) (*v1.QuotaAutoscaler, error)
 	Update(ctx context.Context, quotaAutoscaler *v1.QuotaAutoscaler, opts metav1.UpdateOptions) (*v1.QuotaAutoscaler, error)
+	UpdateStatus(ctx context.Context, quotaAutoscaler *v1.QuotaAutoscaler, opts metav1.UpdateOptions) (*v1.QuotaAutoscaler, error)
 	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
 	DeleteCollection(ctx context.Context, opts metav1.DeleteOptions, listOpts metav1.ListOptions) error
 	Get(ctx context.Context, name string, opts metav1.GetOptions) (*v1.QuotaAutoscaler, error)
@@ -134,6 +135,22 @@ func (c *quotaAutoscalers) Update(ctx context.Context, quotaAutoscaler *v1.Quota
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *quotaAutoscalers) UpdateStatus(ctx context.Context, quotaAutoscaler *v1.QuotaAutoscaler, opts metav1.UpdateOptions) (result *v1.QuotaAutoscaler, err error) {
+	result = &v1.QuotaAutoscaler{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("quotaautoscalers").
+		Name(quotaAutoscaler.Name).
+		SubResource("status").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Body(quotaAutoscaler).
+		Do(ctx).
+		Into(result)
+	return
+}
+
 // Delete takes name of the quotaAutoscaler and deletes it. Returns an error if one occurs.
 func (c *quotaAutoscalers) Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error {
 	return c.client.Delete().
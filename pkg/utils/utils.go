@@ -1,17 +1,5 @@
 package utils
 
-import (
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"errors"
-	"io/ioutil"
-	"net/http"
-	"time"
-)
-
-const PathToCA = "/etc/pki/tls/certs/ca-bundle.crt"
-
 func Max(x, y int64) int64 {
 	if x > y {
 		return x
@@ -25,29 +13,3 @@ func Min(x, y int64) int64 {
 	}
 	return y
 }
-
-func HttpPatch(url string, headers map[string]string, content []byte) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewBuffer(content))
-	if err != nil {
-		return nil, err
-	}
-
-	for header, value := range headers {
-		req.Header.Set(header, value)
-	}
-
-	caCert, err := ioutil.ReadFile(PathToCA)
-	if err != nil {
-		return nil, errors.New("could not read CA file: " + err.Error())
-	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs: caCertPool,
-		},
-	}
-	client := &http.Client{Transport: transport, Timeout: 5 * time.Minute}
-	return client.Do(req)
-}